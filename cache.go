@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/geckoboard/oauth2-cli/pkg/oauth2cli"
+	"golang.org/x/oauth2"
+)
+
+// cachedToken returns the token from -cache, under -profile if given, if it's
+// still valid, or refreshes it if it has expired and has a refresh token. The
+// refreshed token is passed to OnToken like that of any other flow.
+func cachedToken(conf config, flow oauth2cli.Flow) (*oauth2.Token, bool) {
+	token, err := readCache(conf)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("warning: ignoring the token cache: %s\n", err)
+		}
+		return nil, false
+	}
+	if token.Valid() {
+		if err := flow.OnToken(token); err != nil {
+			log.Fatalf("error: %s\n", err)
+		}
+		return token, true
+	}
+	if token.RefreshToken == "" {
+		return nil, false
+	}
+
+	flow.Config.Flow = oauth2cli.FlowRefresh
+	flow.Config.RefreshToken = token.RefreshToken
+	flow.Config.PriorIDToken, _ = token.Extra("id_token").(string)
+	token, err = flow.Authorize(context.Background())
+	if err != nil {
+		log.Printf("warning: failed to refresh the cached token, starting a new flow: %s\n", err)
+		return nil, false
+	}
+	return token, true
+}
+
+// cacheEntry is a cached token. The id_token is kept alongside it, as
+// oauth2.Token doesn't marshal its extras.
+type cacheEntry struct {
+	*oauth2.Token
+	IDToken string `json:"id_token,omitempty"`
+}
+
+func newCacheEntry(token *oauth2.Token) cacheEntry {
+	idToken, _ := token.Extra("id_token").(string)
+	return cacheEntry{Token: token, IDToken: idToken}
+}
+
+func (e cacheEntry) token() *oauth2.Token {
+	if e.IDToken == "" {
+		return e.Token
+	}
+	return e.Token.WithExtra(map[string]interface{}{"id_token": e.IDToken})
+}
+
+// readCache reads the token from -cache. With a profile, the file holds a
+// JSON object of tokens by profile name instead of a single token. A
+// keyringCache path keeps each token in its own keyring entry, and with a
+// passphrase the file is encrypted.
+func readCache(conf config) (*oauth2.Token, error) {
+	if account, ok := keyringTokenAccount(conf.Cache, conf.Profile); ok {
+		entry, err := readKeyringCache(account)
+		if err != nil {
+			return nil, err
+		}
+		return entry.token(), nil
+	}
+	data, err := readCacheFile(conf.Cache, conf.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Profile == "" {
+		entry := cacheEntry{Token: &oauth2.Token{}}
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, err
+		}
+		return entry.token(), nil
+	}
+
+	var profiles map[string]cacheEntry
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, err
+	}
+	entry, ok := profiles[conf.Profile]
+	if !ok || entry.Token == nil {
+		return nil, os.ErrNotExist
+	}
+	return entry.token(), nil
+}
+
+// readCacheFile reads path, decrypting it with the passphrase if there is
+// one.
+func readCacheFile(path, passphrase string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil || passphrase == "" {
+		return data, err
+	}
+	return decryptTokenFile(data, passphrase)
+}
+
+// writeCache saves the token to -cache, readable only by the user. With a
+// profile, the tokens of the other profiles in it are kept.
+func writeCache(conf config, token *oauth2.Token) error {
+	entry := newCacheEntry(token)
+	return updateCache(conf, &entry)
+}
+
+// eraseCache removes the token from -cache, keeping those of the other
+// profiles.
+func eraseCache(conf config) error {
+	if account, ok := keyringTokenAccount(conf.Cache, conf.Profile); ok {
+		return writeKeyringCache(account, nil)
+	}
+	if conf.Profile == "" {
+		if err := os.Remove(conf.Cache); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return updateCache(conf, nil)
+}
+
+// updateCache replaces the token of the profile in -cache with entry,
+// removing it if entry is nil.
+func updateCache(conf config, entry *cacheEntry) error {
+	if account, ok := keyringTokenAccount(conf.Cache, conf.Profile); ok {
+		return writeKeyringCache(account, entry)
+	}
+	path := conf.Cache
+	var v interface{} = entry
+	if conf.Profile != "" {
+		profiles := map[string]cacheEntry{}
+		if data, err := readCacheFile(path, conf.Passphrase); err == nil {
+			if err := json.Unmarshal(data, &profiles); err != nil {
+				return err
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if entry != nil {
+			profiles[conf.Profile] = *entry
+		} else {
+			delete(profiles, conf.Profile)
+		}
+		v = profiles
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if conf.Passphrase != "" {
+		if data, err = encryptTokenFile(data, conf.Passphrase); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	// The file may have been created with wider permissions.
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
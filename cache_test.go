@@ -0,0 +1,258 @@
+package main_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+	"github.com/onsi/gomega/ghttp"
+	"golang.org/x/oauth2"
+)
+
+var _ = Describe("Token cache", func() {
+	var (
+		args    []string
+		env     []string
+		dir     string
+		cache   string
+		session *gexec.Session
+		server  *ghttp.Server
+	)
+
+	writeCache := func(token oauth2.Token) {
+		data, err := json.Marshal(token)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ioutil.WriteFile(cache, data, 0600)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "cache")
+		Expect(err).ToNot(HaveOccurred())
+		cache = filepath.Join(dir, "token.json")
+
+		server = ghttp.NewServer()
+		env = nil
+		args = []string{
+			"-flow", "client_credentials",
+			"-token", server.URL() + "/oauth/token",
+			"-id", "123",
+			"-secret", "abc",
+			"-cache", cache,
+		}
+	})
+
+	run := func() *gexec.Session {
+		command := exec.Command(cmdPath, args...)
+		command.Env = append(os.Environ(), env...)
+		session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+		return session
+	}
+
+	JustBeforeEach(func() {
+		session = run()
+	})
+
+	AfterEach(func() {
+		gexec.TerminateAndWait()
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	Context("without a cached token", func() {
+		BeforeEach(func() {
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+				AccessToken: "newtoken",
+				TokenType:   "Bearer",
+			}))
+		})
+
+		It("should run the flow and cache the token", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "newtoken"`))
+
+			info, err := os.Stat(cache)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+			data, err := ioutil.ReadFile(cache)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring(`"access_token":"newtoken"`))
+		})
+	})
+
+	Context("with a valid cached token", func() {
+		BeforeEach(func() {
+			writeCache(oauth2.Token{
+				AccessToken: "cachedtoken",
+				TokenType:   "Bearer",
+				Expiry:      time.Now().Add(time.Hour),
+			})
+		})
+
+		It("should output it without running the flow", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "cachedtoken"`))
+			Expect(server.ReceivedRequests()).To(BeEmpty())
+		})
+
+		Context("with -force", func() {
+			BeforeEach(func() {
+				args = append(args, "-force")
+				server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "newtoken",
+					TokenType:   "Bearer",
+				}))
+			})
+
+			It("should run the flow", func() {
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(session.Err).To(gbytes.Say(`"access_token": "newtoken"`))
+				Expect(server.ReceivedRequests()).To(HaveLen(1))
+			})
+		})
+	})
+
+	Context("with a cached id_token", func() {
+		BeforeEach(func() {
+			args = append(args, "-format", "kubeexec")
+			expiry, err := json.Marshal(time.Now().Add(time.Hour))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ioutil.WriteFile(cache, []byte(`{"access_token":"cachedtoken","token_type":"Bearer","id_token":"cached.id.token","expiry":`+string(expiry)+`}`), 0600)).To(Succeed())
+		})
+
+		It("should output it", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Out).To(gbytes.Say(`"token":"cached.id.token"`))
+			Expect(server.ReceivedRequests()).To(BeEmpty())
+		})
+	})
+
+	Context("with an expired cached token", func() {
+		BeforeEach(func() {
+			writeCache(oauth2.Token{
+				AccessToken:  "cachedtoken",
+				TokenType:    "Bearer",
+				RefreshToken: "cachedrefresh",
+				Expiry:       time.Now().Add(-time.Hour),
+			})
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyFormKV("grant_type", "refresh_token"),
+				ghttp.VerifyFormKV("refresh_token", "cachedrefresh"),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "refreshedtoken",
+					TokenType:   "Bearer",
+				}),
+			))
+		})
+
+		It("should refresh it and rewrite the cache", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "refreshedtoken"`))
+
+			data, err := ioutil.ReadFile(cache)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring(`"access_token":"refreshedtoken"`))
+			// The provider didn't rotate the refresh token, so it's kept.
+			Expect(string(data)).To(ContainSubstring(`"refresh_token":"cachedrefresh"`))
+		})
+	})
+
+	Context("with -profile", func() {
+		BeforeEach(func() {
+			args = append(args, "-profile", "work")
+			data, err := json.Marshal(map[string]oauth2.Token{
+				"personal": {AccessToken: "personaltoken", TokenType: "Bearer"},
+				"work":     {AccessToken: "worktoken", TokenType: "Bearer", Expiry: time.Now().Add(time.Hour)},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ioutil.WriteFile(cache, data, 0600)).To(Succeed())
+		})
+
+		It("should output the token of the profile", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "worktoken"`))
+			Expect(server.ReceivedRequests()).To(BeEmpty())
+		})
+
+		Context("without a token for the profile", func() {
+			BeforeEach(func() {
+				args[len(args)-1] = "new"
+				server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "newtoken",
+					TokenType:   "Bearer",
+				}))
+			})
+
+			It("should add it to the others", func() {
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(session.Err).To(gbytes.Say(`"access_token": "newtoken"`))
+
+				var profiles map[string]oauth2.Token
+				data, err := ioutil.ReadFile(cache)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(json.Unmarshal(data, &profiles)).To(Succeed())
+				Expect(profiles).To(HaveLen(3))
+				Expect(profiles["new"].AccessToken).To(Equal("newtoken"))
+				Expect(profiles["personal"].AccessToken).To(Equal("personaltoken"))
+			})
+		})
+	})
+
+	Context("with -token-file", func() {
+		BeforeEach(func() {
+			args = append(args[:len(args)-2], "-token-file", cache)
+			env = []string{"OAUTH2_CLI_PASSPHRASE=hunter2"}
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+				AccessToken:  "newtoken",
+				TokenType:    "Bearer",
+				RefreshToken: "newrefresh",
+			}))
+		})
+
+		It("should keep the token encrypted, for the next run", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			data, err := ioutil.ReadFile(cache)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring(`"kdf":"pbkdf2-sha256"`))
+			Expect(string(data)).ToNot(ContainSubstring("newrefresh"))
+
+			// Without an expiry, the cached token stays valid.
+			session = run()
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "newtoken"`))
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+		})
+
+		Context("with a plaintext cache", func() {
+			BeforeEach(func() {
+				writeCache(oauth2.Token{AccessToken: "cachedtoken", TokenType: "Bearer"})
+			})
+
+			It("should ignore the cache and run the flow", func() {
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(session.Err).To(gbytes.Say("warning: ignoring the token cache: not an encrypted token file"))
+				Expect(session.Err).To(gbytes.Say(`"access_token": "newtoken"`))
+			})
+		})
+
+		Context("without a passphrase", func() {
+			BeforeEach(func() {
+				env = nil
+			})
+
+			It("should fail", func() {
+				Eventually(session).Should(gexec.Exit(1))
+				Expect(session.Err).To(gbytes.Say("-token-file needs a passphrase"))
+			})
+		})
+	})
+})
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/geckoboard/oauth2-cli/pkg/oauth2cli"
+)
+
+// check compares the configured endpoints with the discovery document of the
+// issuer, for -check, returning the exit code. Mismatches are only warnings
+// unless -strict is set.
+func check(conf config) int {
+	flow := oauth2cli.Flow{Config: conf.Config}
+	discovery, err := flow.Discover(context.Background())
+	if err != nil {
+		log.Printf("error: %s\n", err)
+		return 1
+	}
+
+	log.Printf("authorization_endpoint: %s\n", discovery.AuthorizationEndpoint)
+	log.Printf("token_endpoint: %s\n", discovery.TokenEndpoint)
+	log.Printf("scopes_supported: %s\n", strings.Join(discovery.ScopesSupported, " "))
+	log.Printf("grant_types_supported: %s\n", strings.Join(discovery.GrantTypesSupported, " "))
+
+	mismatches := discovery.Check(conf.Config)
+	for _, err := range mismatches {
+		log.Printf("warning: %s\n", err)
+	}
+	if len(mismatches) > 0 && conf.Strict {
+		return 1
+	}
+	log.Println("check complete")
+	return 0
+}
+
+// printJWKS prints the key ID, algorithm and use of each key that id_tokens
+// are verified with, for -print-jwks, returning the exit code.
+func printJWKS(conf config) int {
+	flow := oauth2cli.Flow{Config: conf.Config}
+	keys, err := flow.Keys(context.Background())
+	if err != nil {
+		log.Printf("error: %s\n", err)
+		return 1
+	}
+	if len(keys) == 0 {
+		log.Println("error: the JWKS has no keys")
+		return 1
+	}
+	for _, key := range keys {
+		fmt.Printf("kid=%s kty=%s alg=%s use=%s\n", key.ID, key.Type, orNone(key.Algorithm), orNone(key.Use))
+	}
+	return 0
+}
+
+// orNone returns s, or "-" for a field the key doesn't have.
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
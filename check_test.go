@@ -0,0 +1,131 @@
+package main_test
+
+import (
+	"fmt"
+	"net/http"
+	"os/exec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Discovery", func() {
+	var (
+		args    []string
+		session *gexec.Session
+		server  *ghttp.Server
+	)
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		server.RouteToHandler("GET", "/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+			ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"issuer":                        server.URL(),
+				"authorization_endpoint":        server.URL() + "/oauth/authorize",
+				"token_endpoint":                server.URL() + "/oauth/token",
+				"device_authorization_endpoint": server.URL() + "/oauth/device",
+				"scopes_supported":              []string{"openid", "email"},
+				"grant_types_supported":         []string{"authorization_code", "refresh_token"},
+			})(w, r)
+		})
+		args = []string{"-issuer", server.URL()}
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		session, err = gexec.Start(exec.Command(cmdPath, args...), GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		gexec.TerminateAndWait()
+		server.Close()
+	})
+
+	Context("with -check", func() {
+		BeforeEach(func() {
+			args = append(args, "-check", "-auth", server.URL()+"/oauth/authorize")
+		})
+
+		It("should print what the provider supports", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say("scopes_supported: openid email"))
+			Expect(session.Err).To(gbytes.Say("grant_types_supported: authorization_code refresh_token"))
+			Expect(session.Err).ToNot(gbytes.Say("warning"))
+		})
+
+		Context("when the token URL doesn't match", func() {
+			BeforeEach(func() {
+				args = append(args, "-token", "https://elsewhere.example/token")
+			})
+
+			It("should warn", func() {
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(session.Err).To(gbytes.Say(`warning: token URL "https://elsewhere.example/token" != discovered token_endpoint`))
+			})
+
+			Context("in strict mode", func() {
+				BeforeEach(func() {
+					args = append(args, "-strict")
+				})
+
+				It("should fail", func() {
+					Eventually(session).Should(gexec.Exit(1))
+				})
+			})
+		})
+	})
+
+	Context("without -auth and -token", func() {
+		BeforeEach(func() {
+			port, err := EphemeralPort()
+			Expect(err).ToNot(HaveOccurred())
+			args = append(args, "-id", "123", "-secret", "abc", "-port", fmt.Sprintf("%d", port))
+		})
+
+		It("should use the discovered endpoints", func() {
+			Eventually(session.Err).Should(gbytes.Say("Visit this URL in your browser:\n" + server.URL() + "/oauth/authorize"))
+		})
+	})
+
+	Context("with -token but without -device-auth", func() {
+		BeforeEach(func() {
+			server.RouteToHandler("POST", "/oauth/device", ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"device_code":      "mydevicecode",
+				"user_code":        "ABCD-EFGH",
+				"verification_uri": "https://provider.example/device",
+				"expires_in":       60,
+			}))
+			args = append(args, "-flow", "device", "-id", "123", "-token", server.URL()+"/oauth/token")
+		})
+
+		It("should discover the device auth URL", func() {
+			Eventually(session.Err).Should(gbytes.Say("enter the code: ABCD-EFGH"))
+		})
+	})
+
+	Context("with -print-jwks", func() {
+		BeforeEach(func() {
+			server.RouteToHandler("GET", "/.well-known/openid-configuration", ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"issuer":   server.URL(),
+				"jwks_uri": server.URL() + "/jwks",
+			}))
+			server.RouteToHandler("GET", "/jwks", ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"keys": []map[string]string{
+					{"kty": "RSA", "kid": "key-1", "alg": "RS256", "use": "sig", "n": "AQAB", "e": "AQAB"},
+					{"kty": "EC", "kid": "key-2", "crv": "P-256", "x": "AQAB", "y": "AQAB"},
+				},
+			}))
+			args = append(args, "-print-jwks")
+		})
+
+		It("should print each key of the discovered JWKS", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Out).To(gbytes.Say("kid=key-1 kty=RSA alg=RS256 use=sig\n"))
+			Expect(session.Out).To(gbytes.Say("kid=key-2 kty=EC alg=- use=-\n"))
+		})
+	})
+})
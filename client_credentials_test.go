@@ -0,0 +1,242 @@
+package main_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+	"github.com/onsi/gomega/ghttp"
+	"golang.org/x/oauth2"
+)
+
+var _ = Describe("Client credentials flow", func() {
+	var (
+		args    []string
+		stdin   string
+		session *gexec.Session
+		server  *ghttp.Server
+	)
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		stdin = ""
+		args = []string{
+			"-flow", "client_credentials",
+			"-token", server.URL() + "/oauth/token",
+			"-id", "123",
+			"-secret", "abc",
+			"-scope", "read write",
+			"-audience", "https://api.example.com",
+		}
+
+		server.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyRequest("POST", "/oauth/token"),
+			ghttp.VerifyBasicAuth("123", "abc"),
+			ghttp.VerifyFormKV("grant_type", "client_credentials"),
+			ghttp.VerifyFormKV("scope", "read write"),
+			ghttp.VerifyFormKV("audience", "https://api.example.com"),
+			ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+				AccessToken: "mytoken",
+				TokenType:   "Bearer",
+			}),
+		))
+	})
+
+	JustBeforeEach(func() {
+		command := exec.Command(cmdPath, args...)
+		command.Stdin = strings.NewReader(stdin)
+
+		var err error
+		session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		gexec.TerminateAndWait()
+		server.Close()
+	})
+
+	It("should fetch a token without a callback", func() {
+		Eventually(session).Should(gexec.Exit(0))
+		Expect(session.Err).ToNot(gbytes.Say("Visit this URL"))
+		Expect(session.Err).To(gbytes.Say(`"access_token": "mytoken"`))
+	})
+
+	Describe("quiet", func() {
+		BeforeEach(func() {
+			args = append(args, "-quiet", "-verbose")
+		})
+
+		It("should only print the token to stdout", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err.Contents()).To(BeEmpty())
+			var token oauth2.Token
+			Expect(json.Unmarshal(session.Out.Contents(), &token)).To(Succeed())
+			Expect(token.AccessToken).To(Equal("mytoken"))
+		})
+	})
+
+	Describe("log level", func() {
+		Context("error", func() {
+			BeforeEach(func() {
+				args = append(args, "-log-level", "error")
+			})
+
+			It("should be quiet", func() {
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(session.Err.Contents()).To(BeEmpty())
+				Expect(session.Out).To(gbytes.Say(`"access_token"`))
+			})
+		})
+
+		Context("debug", func() {
+			BeforeEach(func() {
+				args = append(args, "-log-level", "debug")
+			})
+
+			It("should log the redacted requests", func() {
+				Eventually(session).Should(gexec.Exit(0))
+				logs := string(session.Err.Contents())
+				Expect(logs).To(ContainSubstring("Authorization: [Basic ***]"))
+				Expect(logs).To(ContainSubstring(`"access_token":"***"`))
+			})
+		})
+
+		Context("debug with -log-unsafe", func() {
+			BeforeEach(func() {
+				args = append(args, "-log-level", "debug", "-log-unsafe")
+			})
+
+			It("should log the raw requests", func() {
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(string(session.Err.Contents())).To(ContainSubstring(`"access_token":"mytoken"`))
+			})
+		})
+	})
+
+	Describe("reading the secret from stdin", func() {
+		BeforeEach(func() {
+			// Replace -secret abc.
+			args = append(args[:6], args[8:]...)
+			args = append(args, "-secret-file", "-")
+			stdin = "abc\n"
+		})
+
+		It("should use the secret without its newline", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "mytoken"`))
+		})
+
+		Context("with -secret -", func() {
+			BeforeEach(func() {
+				args = append(args[:len(args)-2], "-secret", "-")
+			})
+
+			It("should read the secret from stdin too", func() {
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(session.Err).To(gbytes.Say(`"access_token": "mytoken"`))
+			})
+		})
+
+		Context("when -secret is also given", func() {
+			BeforeEach(func() {
+				args = append(args, "-secret", "abc")
+			})
+
+			It("should fail", func() {
+				Eventually(session).Should(gexec.Exit(1))
+				Expect(session.Err).To(gbytes.Say("-secret and -secret-file can't be used together"))
+			})
+		})
+	})
+
+	Describe("a command after --", func() {
+		BeforeEach(func() {
+			args = append(args, "--", "sh", "-c", `echo "token is $OAUTH_ACCESS_TOKEN ($OAUTH_TOKEN_TYPE)"; exit 7`)
+		})
+
+		It("should run it with the token in its environment and exit with its status", func() {
+			Eventually(session).Should(gexec.Exit(7))
+			Expect(session.Out).To(gbytes.Say(`token is mytoken \(Bearer\)`))
+		})
+
+		Context("with -exec", func() {
+			BeforeEach(func() {
+				args = append([]string{"-exec", "true"}, args...)
+			})
+
+			It("should refuse to run both", func() {
+				Eventually(session).Should(gexec.Exit(1))
+				Expect(session.Err).To(gbytes.Say("-exec and a command after -- can't be combined"))
+			})
+		})
+	})
+
+	Describe("an id_token for another client", func() {
+		BeforeEach(func() {
+			args = append(args, "-strict")
+			server.SetHandler(0, ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token": "mytoken",
+				"token_type":   "Bearer",
+				"id_token":     FakeJWT(map[string]interface{}{"aud": "123", "azp": "456"}),
+			}))
+		})
+
+		It("should fail the azp check as the code flow does", func() {
+			Eventually(session).Should(gexec.Exit(9))
+			Expect(session.Err).To(gbytes.Say(`OIDC azp error: "456" != "123"`))
+			Expect(session.Err).ToNot(gbytes.Say("mytoken"))
+		})
+	})
+
+	Describe("required scopes and claims", func() {
+		BeforeEach(func() {
+			server.SetHandler(0, ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token": "mytoken",
+				"token_type":   "Bearer",
+				"scope":        "read",
+				"id_token":     FakeJWT(map[string]interface{}{"aud": "123", "tenant": "a"}),
+			}))
+		})
+
+		Context("when a scope isn't granted", func() {
+			BeforeEach(func() {
+				args = append(args, "-scope-required", "read write")
+			})
+
+			It("should fail", func() {
+				Eventually(session).Should(gexec.Exit(9))
+				Expect(session.Err).To(gbytes.Say("Missing required scopes: write"))
+			})
+		})
+
+		Context("when a claim doesn't match", func() {
+			BeforeEach(func() {
+				args = append(args, "-require-claim", "tenant=b")
+			})
+
+			It("should fail", func() {
+				Eventually(session).Should(gexec.Exit(9))
+				Expect(session.Err).To(gbytes.Say("tenant"))
+				Expect(session.Err).ToNot(gbytes.Say("mytoken"))
+			})
+		})
+	})
+
+	Describe("an invalid -template", func() {
+		BeforeEach(func() {
+			args = append(args, "-format", "template", "-template", "{{.AccessToken")
+		})
+
+		It("should fail before requesting a token", func() {
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say("invalid -template"))
+			Expect(server.ReceivedRequests()).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// Fields of the token that -clipboard copies.
+const (
+	clipAccessToken = "access_token"
+	clipIDToken     = "id_token"
+)
+
+// clipboardFlag is -clipboard, which on its own copies the access token, or
+// with -clipboard=id_token the id_token.
+type clipboardFlag struct {
+	field *string
+}
+
+func (f *clipboardFlag) String() string {
+	if f.field == nil {
+		return ""
+	}
+	return *f.field
+}
+
+func (f *clipboardFlag) Set(s string) error {
+	switch s {
+	case clipAccessToken, clipIDToken:
+		*f.field = s
+		return nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("expected %s, %s or a boolean", clipAccessToken, clipIDToken)
+	}
+	*f.field = ""
+	if b {
+		*f.field = clipAccessToken
+	}
+	return nil
+}
+
+func (f *clipboardFlag) IsBoolFlag() bool { return true }
+
+// copyToken copies the -clipboard field of the token to the clipboard.
+func copyToken(field string, token *oauth2.Token) error {
+	value := token.AccessToken
+	if field == clipIDToken {
+		value, _ = token.Extra("id_token").(string)
+		if value == "" {
+			return errors.New("the token response has no id_token")
+		}
+	}
+	return copyToClipboard(value)
+}
+
+// copyToClipboard writes s to the platform's clipboard command.
+func copyToClipboard(s string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("pbcopy")
+	case "windows":
+		cmd = exec.Command("clip")
+	default:
+		cmd = exec.Command("xclip", "-selection", "clipboard")
+		if os.Getenv("WAYLAND_DISPLAY") != "" {
+			cmd = exec.Command("wl-copy")
+		} else if _, err := exec.LookPath("xclip"); err != nil {
+			cmd = exec.Command("xsel", "--clipboard", "--input")
+		}
+	}
+	cmd.Stdin = strings.NewReader(s)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %s", cmd.Args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+
+	"github.com/geckoboard/oauth2-cli/pkg/oauth2cli"
+)
+
+// Flags shared by the subcommands. Without a subcommand, every flag is
+// accepted, as it always has been.
+var (
+	// clientFlags configure the client and how it talks to the provider.
+	clientFlags = []string{
+		"config", "provider", "issuer", "id", "secret", "id-file", "secret-file",
+		"auth-style", "client-auth", "client-key", "client-key-id", "token",
+		"token-header", "token-response-map", "header-file", "user-agent",
+		"cookies", "allow-token-host", "proxy", "ca-cert", "insecure",
+		"insecure-skip-verify", "pin-cert-sha256", "mtls-cert", "mtls-key",
+		"dpop", "http-timeout", "retries", "retry-backoff", "timeout",
+		"cache", "keyring", "token-file", "profile", "verbose", "no-redact",
+		"log-unsafe", "log-level", "quiet", "log-prefix",
+	}
+	// grantFlags are for the commands that issue a token.
+	grantFlags = []string{
+		"scope", "scope-separator", "audience", "resource", "token-param",
+		"force", "strict", "scope-required", "out", "no-stdout", "format",
+		"template", "summary", "summary-only", "clipboard", "aws-token-field",
+		"exec", "refresh-interval", "probe", "probe-method", "probe-body",
+		"revoke-url", "revoke-after", "introspect", "introspect-url",
+		"userinfo", "userinfo-url", "verify-id-token", "jwks-url",
+		"jwks-file", "decode-id-token", "id-token-decrypt-key",
+		"require-claim", "export-request-spec", "debug-out",
+	}
+	// browserFlags are for the code flow and its callback server.
+	browserFlags = []string{
+		"auth", "auth-param", "prompt", "max-age", "login-hint",
+		"acr-values", "ui-locales", "par", "par-url", "request-object",
+		"interface", "port", "callback", "code", "state-param",
+		"callback-param", "response-type", "prefer-id-token", "offline",
+		"response-mode", "accept-any-path", "strict-callback-params",
+		"pkce", "pkce-method", "oidc-nonce", "id-token-only", "manual",
+		"pending-file", "resume", "loop", "open", "no-open", "qr",
+		"success-template", "error-template", "result-template",
+		"no-browser-token", "tls", "tls-cert", "tls-key", "callback-tls",
+		"callback-cert", "callback-key", "tunnel", "callback-wait",
+		"callback-delay",
+	}
+)
+
+// subcommand is a command given before its flags.
+type subcommand struct {
+	usage string
+	// args is the syntax of the arguments after the flags.
+	args string
+	// flow is the -flow the command runs.
+	flow  string
+	flags [][]string
+}
+
+var subcommands = map[string]subcommand{
+	"auth": {
+		usage: "Authorize in the browser with the code flow",
+		flow:  oauth2cli.FlowCode,
+		flags: [][]string{clientFlags, grantFlags, browserFlags},
+	},
+	"device": {
+		usage: "Authorize on another device with the device flow",
+		flow:  oauth2cli.FlowDevice,
+		flags: [][]string{clientFlags, grantFlags, {
+			"device-auth", "device-poll-jitter", "device-max-interval", "qr",
+		}},
+	},
+	"resume": {
+		args:  "[redirect-url|code]",
+		usage: "Complete the authorization pending in -pending-file with the redirect URL or code given as the argument, or its callback",
+		flow:  oauth2cli.FlowCode,
+		flags: [][]string{clientFlags, grantFlags, browserFlags},
+	},
+	"refresh": {
+		usage: "Exchange -refresh-token for a new token",
+		flow:  oauth2cli.FlowRefresh,
+		flags: [][]string{clientFlags, grantFlags, {"refresh-token", "prior-id-token"}},
+	},
+	"token-exchange": {
+		args:  "[subject-token|-]",
+		usage: "Exchange the subject token given as the argument, - for stdin, or -subject-token for another token",
+		flow:  oauth2cli.FlowTokenExchange,
+		flags: [][]string{clientFlags, grantFlags, {
+			"subject-token", "subject-token-type", "actor-token",
+			"actor-token-type", "requested-token-type",
+		}},
+	},
+	"serve": {
+		usage: "Authorize with the code flow, then serve a valid access token on GET /token, refreshing it, until interrupted",
+		flow:  oauth2cli.FlowCode,
+		flags: [][]string{clientFlags, grantFlags, browserFlags, {"serve-addr", "allow-origin"}},
+	},
+	"proxy": {
+		args:  "[upstream-url]",
+		usage: "Authorize with the code flow, then forward requests on -serve-addr to the upstream URL with the token, refreshing it, until interrupted",
+		flow:  oauth2cli.FlowCode,
+		flags: [][]string{clientFlags, grantFlags, browserFlags, {"serve-addr", "upstream"}},
+	},
+	"doctor": {
+		usage: "Check the config without running -flow: discovery, that the endpoints respond, the redirect URL and its port, and the scopes",
+		flags: [][]string{clientFlags, {
+			"flow", "scope", "scope-separator", "strict", "auth",
+			"device-auth", "pkce", "pkce-method", "interface", "port",
+			"callback", "manual", "tls", "tls-cert", "tls-key",
+		}},
+	},
+	"init": {
+		usage: "Set up a profile in the user config file, or -config, by answering questions, then authorize with it",
+		flags: [][]string{{
+			"config", "profile", "provider", "issuer", "id", "scope", "keyring",
+			"proxy", "ca-cert", "log-prefix",
+		}},
+	},
+	"mock-server": {
+		usage: "Run a mock provider on -serve-addr that approves every authorization and issues signed test tokens, for testing clients against, until interrupted",
+		flags: [][]string{{
+			"config", "serve-addr", "issuer", "id", "secret", "secret-file",
+			"mock-claims", "mock-expires-in", "quiet", "log-prefix",
+		}},
+	},
+	flowRevoke: {
+		args:  "[token|-]",
+		usage: "Revoke the token given as the argument, - for stdin, or the cached tokens",
+		flow:  flowRevoke,
+		flags: [][]string{clientFlags, {"revoke-url", "revoke-token", "revoke-token-type"}},
+	},
+	flowIntrospect: {
+		args:  "[token|-]",
+		usage: "Print the introspection response for the token given as the argument, - for stdin, or the cached access token",
+		flow:  flowIntrospect,
+		flags: [][]string{clientFlags, {"introspect-url", "introspect-token"}},
+	},
+	flowLogout: {
+		args:  "[id_token|-]",
+		usage: "End the provider session of the id_token given as the argument, - for stdin, or the cached one",
+		flow:  flowLogout,
+		flags: [][]string{clientFlags, {
+			"end-session-url", "id-token-hint", "interface", "port", "callback",
+			"open", "no-open", "callback-wait",
+		}},
+	},
+	flowDecode: {
+		args:  "jwt|-",
+		usage: "Print the header and claims of the JWT given as the argument, or - for stdin",
+		flow:  flowDecode,
+		flags: [][]string{clientFlags, {"verify-id-token", "jwks-url", "jwks-file"}},
+	},
+}
+
+// parseArgs parses the command line, which starts with a subcommand that
+// takes just its own flags, or is the flags with an optional command after
+// them. It returns the command, if any, followed by its arguments, and the
+// names of the flags that were set.
+func parseArgs(args []string) ([]string, map[string]bool) {
+	flag.Usage = usage
+	set := map[string]bool{}
+	cmd, ok := subcommand{}, false
+	if len(args) > 0 {
+		cmd, ok = subcommands[args[0]]
+	}
+	if !ok {
+		flag.CommandLine.Parse(args)
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		return flag.Args(), set
+	}
+	name := args[0]
+
+	fs := flag.NewFlagSet("oauth2-cli "+name, flag.ExitOnError)
+	for _, names := range cmd.flags {
+		for _, n := range names {
+			f := flag.Lookup(n)
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: oauth2-cli %s [flags] %s\n\n%s.\n\nFlags:\n", name, cmd.args, cmd.usage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args[1:])
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return append([]string{name}, fs.Args()...), set
+}
+
+// usage lists the subcommands ahead of the flags of the bare invocation.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: oauth2-cli [flags] [credential|revoke|introspect|decode]\n       oauth2-cli <command> [flags]\n\nCommands:\n")
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-12s%s\n", name, subcommands[name].usage)
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
@@ -0,0 +1,186 @@
+package main_test
+
+import (
+	"net/http"
+	"net/url"
+	"os/exec"
+	"regexp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+	"github.com/onsi/gomega/ghttp"
+	"golang.org/x/oauth2"
+)
+
+var _ = Describe("Subcommands", func() {
+	var (
+		args    []string
+		session *gexec.Session
+		server  *ghttp.Server
+	)
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		session, err = gexec.Start(exec.Command(cmdPath, args...), GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		gexec.TerminateAndWait()
+		server.Close()
+	})
+
+	Context("refresh", func() {
+		BeforeEach(func() {
+			args = []string{
+				"refresh",
+				"-id", "123",
+				"-secret", "abc",
+				"-token", server.URL() + "/oauth/token",
+				"-refresh-token", "oldrefresh",
+				"-resource", "https://api.example/",
+			}
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", "/oauth/token"),
+				ghttp.VerifyFormKV("grant_type", "refresh_token"),
+				ghttp.VerifyFormKV("refresh_token", "oldrefresh"),
+				ghttp.VerifyFormKV("resource", "https://api.example/"),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "newtoken",
+					TokenType:   "Bearer",
+				}),
+			))
+		})
+
+		It("should run the refresh flow", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "newtoken"`))
+		})
+	})
+
+	Context("token-exchange", func() {
+		BeforeEach(func() {
+			args = []string{
+				"token-exchange",
+				"-id", "123",
+				"-secret", "abc",
+				"-token", server.URL() + "/oauth/token",
+				"-actor-token", "actortoken",
+				"-requested-token-type", "jwt",
+				"-audience", "api-a",
+				"-audience", "api-b",
+				"-resource", "https://api.example/",
+				"subjecttoken",
+			}
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", "/oauth/token"),
+				ghttp.VerifyBasicAuth("123", "abc"),
+				ghttp.VerifyForm(url.Values{
+					"grant_type":           {"urn:ietf:params:oauth:grant-type:token-exchange"},
+					"subject_token":        {"subjecttoken"},
+					"subject_token_type":   {"urn:ietf:params:oauth:token-type:access_token"},
+					"actor_token":          {"actortoken"},
+					"actor_token_type":     {"urn:ietf:params:oauth:token-type:access_token"},
+					"requested_token_type": {"urn:ietf:params:oauth:token-type:jwt"},
+					"audience":             {"api-a", "api-b"},
+					"resource":             {"https://api.example/"},
+				}),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+					"access_token":      "exchangedtoken",
+					"issued_token_type": "urn:ietf:params:oauth:token-type:jwt",
+					"token_type":        "N_A",
+				}),
+			))
+		})
+
+		It("should exchange the subject token given after its flags", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "exchangedtoken"`))
+		})
+	})
+
+	Context("logout", func() {
+		BeforeEach(func() {
+			args = []string{
+				"logout",
+				"-id", "123",
+				"-end-session-url", server.URL() + "/oauth/logout",
+				"-port", "0",
+				"-no-open",
+				"myidtoken",
+			}
+		})
+
+		It("should send the browser to the end session URL and wait for the redirect", func() {
+			re := regexp.MustCompile(regexp.QuoteMeta(server.URL()+"/oauth/logout") + `\S+`)
+			var logoutURL *url.URL
+			Eventually(func() bool {
+				raw := re.Find(session.Err.Contents())
+				if raw == nil {
+					return false
+				}
+				var err error
+				logoutURL, err = url.Parse(string(raw))
+				Expect(err).ToNot(HaveOccurred())
+				return true
+			}).Should(BeTrue(), "couldn't find the logout URL in STDERR")
+
+			query := logoutURL.Query()
+			Expect(query.Get("id_token_hint")).To(Equal("myidtoken"))
+			Expect(query.Get("client_id")).To(Equal("123"))
+			Consistently(session).ShouldNot(gexec.Exit())
+
+			redirect, err := url.Parse(query.Get("post_logout_redirect_uri"))
+			Expect(err).ToNot(HaveOccurred())
+			redirect.RawQuery = url.Values{"state": {query.Get("state")}}.Encode()
+			resp, err := http.Get(redirect.String())
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`Logged out`))
+		})
+	})
+
+	Context("revoke", func() {
+		BeforeEach(func() {
+			args = []string{
+				"revoke",
+				"-id", "123",
+				"-secret", "abc",
+				"-revoke-url", server.URL() + "/oauth/revoke",
+				"oldtoken",
+			}
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", "/oauth/revoke"),
+				ghttp.VerifyFormKV("token", "oldtoken"),
+				ghttp.RespondWith(http.StatusOK, ""),
+			))
+		})
+
+		It("should revoke the token given after its flags", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say("Revoked access_token"))
+		})
+	})
+
+	Context("with a flag of another command", func() {
+		BeforeEach(func() {
+			args = []string{"device", "-id", "123", "-port", "8081"}
+		})
+
+		It("should fail with the command's usage", func() {
+			Eventually(session).Should(gexec.Exit(2))
+			Expect(session.Err).To(gbytes.Say("flag provided but not defined: -port"))
+			Expect(session.Err).To(gbytes.Say("Usage: oauth2-cli device"))
+			Expect(session.Err).To(gbytes.Say("-device-auth"))
+		})
+	})
+})
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/geckoboard/oauth2-cli/pkg/oauth2cli"
+)
+
+// envPrefix is prepended to the upper cased JSON name of a config field to
+// give the environment variable that overrides it.
+const envPrefix = "OAUTH2_CLI_"
+
+// configPath finds the -config flag in args ahead of flag parsing, so that
+// flags can override the config file.
+func configPath(args []string) (string, bool) {
+	return flagValue(args, "config")
+}
+
+// flagValue finds the value of the named flag in args ahead of flag parsing.
+func flagValue(args []string, name string) (string, bool) {
+	values := flagValues(args, name)
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+// flagValues finds the values of the named flag in args ahead of flag
+// parsing, for flags that can be repeated. As in flag parsing, the value
+// after a flag that isn't boolean is its own, not a flag.
+func flagValues(args []string, name string) []string {
+	flags := knownFlags()
+	var values []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			continue
+		}
+		arg = strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		value, hasValue := "", false
+		if j := strings.Index(arg, "="); j >= 0 {
+			arg, value, hasValue = arg[:j], arg[j+1:], true
+		}
+		if !hasValue && !isBoolFlag(flags.Lookup(arg)) && i+1 < len(args) {
+			i++
+			value, hasValue = args[i], true
+		}
+		if arg == name && hasValue {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// knownFlags returns a flag set with the flags that defineFlags defines,
+// for flagValues to tell which of them take a value.
+func knownFlags() *flag.FlagSet {
+	commandLine := flag.CommandLine
+	defer func() { flag.CommandLine = commandLine }()
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	defineFlags(&config{}, "")
+	return flag.CommandLine
+}
+
+// isBoolFlag reports whether f is a boolean flag, which takes no value
+// unless it's given as -name=value.
+func isBoolFlag(f *flag.Flag) bool {
+	if f == nil {
+		return false
+	}
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// decodeConfig reads a config file into conf, followed by its entry in the
+// file's "profiles" for profile, or for the file's own "profile" if profile
+// is empty. A profile that "extends" another has that one's settings first,
+// and so on. Profiles that aren't in the file only key the token cache.
+func decodeConfig(r io.Reader, conf *config, profile string) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return err
+	}
+	var file struct {
+		Profiles map[string]json.RawMessage `json:"profiles"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("profiles: %w", err)
+	}
+	if profile == "" {
+		profile = conf.Profile
+	}
+	if _, ok := file.Profiles[profile]; !ok {
+		return nil
+	}
+	chain, err := profileChain(file.Profiles, profile)
+	if err != nil {
+		return err
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		if err := json.Unmarshal(file.Profiles[chain[i]], conf); err != nil {
+			return fmt.Errorf("profile %q: %w", chain[i], err)
+		}
+	}
+	conf.Profile = profile
+	return nil
+}
+
+// profileChain returns profile followed by the profiles it extends, in
+// turn, erroring on one that isn't in profiles or on a cycle.
+func profileChain(profiles map[string]json.RawMessage, profile string) ([]string, error) {
+	var chain []string
+	seen := map[string]bool{}
+	for name := profile; name != ""; {
+		if seen[name] {
+			return nil, fmt.Errorf("profile %q: extends cycle %s", profile, strings.Join(append(chain, name), " -> "))
+		}
+		seen[name] = true
+		settings, ok := profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("profile %q extends %q, which isn't in the file", chain[len(chain)-1], name)
+		}
+		var extends struct {
+			Extends string `json:"extends"`
+		}
+		if err := json.Unmarshal(settings, &extends); err != nil {
+			return nil, fmt.Errorf("profile %q: %w", name, err)
+		}
+		chain = append(chain, name)
+		name = extends.Extends
+	}
+	return chain, nil
+}
+
+// defaultConfigPaths are configDefaults and the per-user config file, which
+// are loaded in that order when they exist.
+func defaultConfigPaths() []string {
+	paths := []string{configDefaults}
+	if dir := userConfigDir(); dir != "" {
+		path := filepath.Join(dir, "oauth2-cli", "config.json")
+		// Older versions only read oauth2-cli.json.
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			path = filepath.Join(dir, "oauth2-cli.json")
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// loadConfigFile reads the config file at path into conf, if it exists or
+// is required.
+func loadConfigFile(path string, conf *config, profile string, required bool) error {
+	configFile, err := os.Open(path)
+	if err != nil {
+		if !required && os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to open %q: %w", path, err)
+	}
+	defer configFile.Close()
+	if err := decodeConfig(configFile, conf, profile); err != nil {
+		return fmt.Errorf("failed to parse %q: %w", path, err)
+	}
+	if err := expandEnv(conf); err != nil {
+		return fmt.Errorf("failed to parse %q: %w", path, err)
+	}
+	return nil
+}
+
+// defaultTokenStore is where -profile keeps its tokens when -cache isn't
+// given.
+func defaultTokenStore() string {
+	dir := userConfigDir()
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, "oauth2-cli", "tokens.json")
+}
+
+// userConfigDir is $XDG_CONFIG_HOME, or the platform's user config
+// directory: ~/.config, ~/Library/Application Support on macOS or %AppData%
+// on Windows. It is empty if there's no home directory.
+func userConfigDir() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return dir
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return dir
+}
+
+// loadEnv overrides config fields from OAUTH2_CLI_* environment variables,
+// e.g. client_secret from OAUTH2_CLI_CLIENT_SECRET. Lists are comma
+// separated.
+func loadEnv(conf *config) error {
+	return eachField(reflect.ValueOf(conf).Elem(), func(name string, field reflect.Value) error {
+		env := envPrefix + strings.ToUpper(name)
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			return nil
+		}
+
+		var err error
+		switch f := field.Addr().Interface().(type) {
+		case *oauth2cli.StringList:
+			*f = strings.Split(value, ",")
+		case flag.Value:
+			err = f.Set(value)
+		default:
+			switch field.Kind() {
+			case reflect.String:
+				field.SetString(value)
+			case reflect.Bool:
+				var b bool
+				b, err = strconv.ParseBool(value)
+				field.SetBool(b)
+			case reflect.Int:
+				var n int64
+				n, err = strconv.ParseInt(value, 10, 0)
+				field.SetInt(n)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", env, err)
+		}
+		return nil
+	})
+}
+
+// readSecretFile reads a single value from path, or a line from stdin if
+// path is "-", without its trailing newline.
+func readSecretFile(path string) (string, error) {
+	var data []byte
+	if path == "-" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		data = []byte(line)
+	} else {
+		var err error
+		if data, err = ioutil.ReadFile(path); err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// listFlag is a flag that can be repeated to build up a StringList. The
+// first use replaces any values loaded from the config file.
+type listFlag struct {
+	list *oauth2cli.StringList
+	set  bool
+}
+
+func (f *listFlag) String() string {
+	if f.list == nil {
+		return ""
+	}
+	return strings.Join(*f.list, ", ")
+}
+
+func (f *listFlag) Set(s string) error {
+	if !f.set {
+		*f.list = nil
+		f.set = true
+	}
+	*f.list = append(*f.list, s)
+	return nil
+}
+
+// scopeFlag is a flag that can be repeated to build up a space separated
+// scope string. The first use replaces the scopes from the config file.
+type scopeFlag struct {
+	scope *oauth2cli.SpaceList
+	set   bool
+}
+
+func (f *scopeFlag) String() string {
+	if f.scope == nil {
+		return ""
+	}
+	return string(*f.scope)
+}
+
+func (f *scopeFlag) Set(s string) error {
+	if !f.set {
+		*f.scope = oauth2cli.SpaceList(s)
+		f.set = true
+		return nil
+	}
+	*f.scope += oauth2cli.SpaceList(" " + s)
+	return nil
+}
+
+// splitScopes splits the scopes on sep as well as spaces, for
+// -scope-separator.
+func splitScopes(scope oauth2cli.SpaceList, sep string) oauth2cli.SpaceList {
+	return oauth2cli.SpaceList(strings.Join(strings.Fields(strings.ReplaceAll(string(scope), sep, " ")), " "))
+}
+
+// loopFlag is -loop, which on its own loops until interrupted, or with
+// -loop=N stops after N authorizations.
+type loopFlag struct {
+	loop *int
+}
+
+func (f *loopFlag) String() string {
+	if f.loop == nil {
+		return ""
+	}
+	return strconv.Itoa(*f.loop)
+}
+
+func (f *loopFlag) Set(s string) error {
+	// Checked first as ParseBool takes 0 and 1 too.
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 1 {
+			return fmt.Errorf("expected a count of at least 1")
+		}
+		*f.loop = n
+		return nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("expected a count or a boolean")
+	}
+	*f.loop = 0
+	if b {
+		*f.loop = -1
+	}
+	return nil
+}
+
+func (f *loopFlag) IsBoolFlag() bool { return true }
+
+var envVarRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv substitutes ${VAR} references in the string fields of conf from
+// the environment, erroring on variables that aren't set.
+func expandEnv(conf *config) error {
+	return eachField(reflect.ValueOf(conf).Elem(), func(name string, field reflect.Value) error {
+		if field.Kind() != reflect.String {
+			return nil
+		}
+
+		var missing []string
+		expanded := envVarRef.ReplaceAllStringFunc(field.String(), func(ref string) string {
+			name := envVarRef.FindStringSubmatch(ref)[1]
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				missing = append(missing, name)
+			}
+			return value
+		})
+		if len(missing) > 0 {
+			return fmt.Errorf("%s: undefined environment variable %s", name, strings.Join(missing, ", "))
+		}
+		field.SetString(expanded)
+		return nil
+	})
+}
+
+// eachField calls fn with the JSON name of each field of the struct v,
+// including those of embedded structs.
+func eachField(v reflect.Value, fn func(name string, field reflect.Value) error) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		structField := v.Type().Field(i)
+		if structField.Anonymous && field.Kind() == reflect.Struct {
+			if err := eachField(field, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		name := strings.Split(structField.Tag.Get("json"), ",")[0]
+		if err := fn(name, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
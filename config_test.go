@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/geckoboard/oauth2-cli/pkg/oauth2cli"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("expandEnv", func() {
+	BeforeEach(func() {
+		os.Setenv("TENANT", "acme")
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("TENANT")
+	})
+
+	It("should substitute environment variables", func() {
+		conf := config{Config: oauth2cli.Config{
+			AuthURL:  "https://${TENANT}.example.com/authorize",
+			ClientID: "id-${TENANT}",
+			Port:     8081,
+		}}
+		Expect(expandEnv(&conf)).To(Succeed())
+		Expect(conf.AuthURL).To(Equal("https://acme.example.com/authorize"))
+		Expect(conf.ClientID).To(Equal("id-acme"))
+	})
+
+	It("should leave other dollar signs alone", func() {
+		conf := config{Config: oauth2cli.Config{ClientSecret: "pa$$word$TENANT"}}
+		Expect(expandEnv(&conf)).To(Succeed())
+		Expect(conf.ClientSecret).To(Equal("pa$$word$TENANT"))
+	})
+
+	It("should error on undefined variables", func() {
+		conf := config{Config: oauth2cli.Config{TokenURL: "https://${UNDEFINED_TENANT}.example.com/token"}}
+		Expect(expandEnv(&conf)).To(MatchError("token_url: undefined environment variable UNDEFINED_TENANT"))
+	})
+})
+
+var _ = Describe("duration", func() {
+	It("should unmarshal from a JSON string", func() {
+		var conf config
+		Expect(json.Unmarshal([]byte(`{"callback_wait": "2m"}`), &conf)).To(Succeed())
+		Expect(time.Duration(conf.CallbackWait)).To(Equal(2 * time.Minute))
+	})
+
+	It("should reject numbers", func() {
+		var conf config
+		Expect(json.Unmarshal([]byte(`{"callback_wait": 120}`), &conf)).ToNot(Succeed())
+	})
+})
+
+var _ = Describe("listFlag", func() {
+	It("should replace config values with repeated flags", func() {
+		list := oauth2cli.StringList{"from-file"}
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags.Var(&listFlag{list: &list}, "item", "")
+
+		Expect(flags.Parse([]string{"-item", "a", "-item", "b"})).To(Succeed())
+		Expect(list).To(Equal(oauth2cli.StringList{"a", "b"}))
+	})
+})
+
+var _ = Describe("scopeFlag", func() {
+	It("should replace the config scope with repeated flags", func() {
+		scope := oauth2cli.SpaceList("from-file")
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags.Var(&scopeFlag{scope: &scope}, "scope", "")
+
+		Expect(flags.Parse([]string{"-scope", "a", "-scope", "b c"})).To(Succeed())
+		Expect(scope).To(Equal(oauth2cli.SpaceList("a b c")))
+	})
+
+	It("should split the scopes on -scope-separator too", func() {
+		Expect(splitScopes("read,write openid", ",")).To(Equal(oauth2cli.SpaceList("read write openid")))
+		Expect(splitScopes("read,,write,", ",")).To(Equal(oauth2cli.SpaceList("read write")))
+	})
+
+	It("should accept a JSON array of scopes in the config file", func() {
+		var conf config
+		Expect(json.Unmarshal([]byte(`{"scopes": ["openid", "email"]}`), &conf)).To(Succeed())
+		Expect(conf.Scope).To(Equal(oauth2cli.SpaceList("openid email")))
+	})
+})
+
+var _ = Describe("loopFlag", func() {
+	parse := func(args ...string) (int, error) {
+		loop := 0
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags.Var(&loopFlag{loop: &loop}, "loop", "")
+		err := flags.Parse(args)
+		return loop, err
+	}
+
+	It("should loop until interrupted on its own", func() {
+		Expect(parse("-loop")).To(Equal(-1))
+	})
+
+	It("should take a count", func() {
+		Expect(parse("-loop=3")).To(Equal(3))
+	})
+
+	It("should reject counts below 1", func() {
+		_, err := parse("-loop=0")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("configPath", func() {
+	It("should find -config before flag parsing", func() {
+		path, explicit := configPath([]string{"-id", "123", "-config", "a.json"})
+		Expect(path).To(Equal("a.json"))
+		Expect(explicit).To(BeTrue())
+
+		path, _ = configPath([]string{"--config=b.json"})
+		Expect(path).To(Equal("b.json"))
+	})
+
+	It("should report when -config isn't given", func() {
+		_, explicit := configPath([]string{"-id", "123", "--", "-config", "a.json"})
+		Expect(explicit).To(BeFalse())
+	})
+})
+
+var _ = Describe("flagValues", func() {
+	It("should find each value of a repeated flag", func() {
+		Expect(flagValues([]string{"-profile", "a", "auth", "--profile=b"}, "profile")).To(Equal([]string{"a", "b"}))
+	})
+
+	It("should skip the values of other flags", func() {
+		args := []string{"-scope", "profile", "-config", "x.json"}
+		Expect(flagValues(args, "profile")).To(BeEmpty())
+		Expect(flagValues(args, "config")).To(Equal([]string{"x.json"}))
+
+		args = []string{"-secret", "-config", "-profile", "a"}
+		Expect(flagValues(args, "config")).To(BeEmpty())
+		Expect(flagValues(args, "profile")).To(Equal([]string{"a"}))
+	})
+
+	It("should not take a value for a boolean flag", func() {
+		args := []string{"-pkce", "-profile", "a", "-insecure=true", "-profile", "b"}
+		Expect(flagValues(args, "profile")).To(Equal([]string{"a", "b"}))
+	})
+
+	It("should only match flags", func() {
+		Expect(flagValues([]string{"revoke", "profile", "x"}, "profile")).To(BeEmpty())
+	})
+})
+
+var _ = Describe("decodeConfig", func() {
+	const file = `{
+		"client_id": "shared",
+		"port": 9000,
+		"profile": "google",
+		"profiles": {
+			"google": {"auth_url": "https://accounts.google.com/o/oauth2/v2/auth"},
+			"okta-staging": {"client_id": "staging", "scopes": ["openid", "email"]}
+		}
+	}`
+
+	It("should apply the named profile over the top level settings", func() {
+		var conf config
+		Expect(decodeConfig(strings.NewReader(file), &conf, "okta-staging")).To(Succeed())
+		Expect(conf.ClientID).To(Equal("staging"))
+		Expect(conf.Port).To(Equal(9000))
+		Expect(conf.Scope).To(Equal(oauth2cli.SpaceList("openid email")))
+		Expect(conf.Profile).To(Equal("okta-staging"))
+	})
+
+	It("should default to the file's profile", func() {
+		var conf config
+		Expect(decodeConfig(strings.NewReader(file), &conf, "")).To(Succeed())
+		Expect(conf.ClientID).To(Equal("shared"))
+		Expect(conf.AuthURL).To(Equal("https://accounts.google.com/o/oauth2/v2/auth"))
+	})
+
+	It("should keep the top level settings for a profile that isn't in the file", func() {
+		var conf config
+		Expect(decodeConfig(strings.NewReader(file), &conf, "work")).To(Succeed())
+		Expect(conf.ClientID).To(Equal("shared"))
+		Expect(conf.AuthURL).To(BeEmpty())
+	})
+
+	It("should name the profile that doesn't parse", func() {
+		var conf config
+		err := decodeConfig(strings.NewReader(`{"profiles": {"bad": {"port": "x"}}}`), &conf, "bad")
+		Expect(err).To(MatchError(ContainSubstring(`profile "bad"`)))
+	})
+
+	Describe("profiles that extend another", func() {
+		const file = `{
+			"client_id": "shared",
+			"profiles": {
+				"base": {"issuer": "https://dev.example.com", "scopes": ["openid"], "pkce": true, "port": 9000},
+				"stage": {"extends": "base", "issuer": "https://stage.example.com", "client_id": "stage"},
+				"prod": {"extends": "stage", "issuer": "https://example.com", "scopes": ["openid", "email"]},
+				"loop-a": {"extends": "loop-b"},
+				"loop-b": {"extends": "loop-a"},
+				"orphan": {"extends": "missing"}
+			}
+		}`
+
+		It("should merge the settings of each, nearest first", func() {
+			var conf config
+			Expect(decodeConfig(strings.NewReader(file), &conf, "prod")).To(Succeed())
+			Expect(conf.Issuer).To(Equal("https://example.com"))
+			Expect(conf.ClientID).To(Equal("stage"))
+			Expect(conf.Scope).To(Equal(oauth2cli.SpaceList("openid email")))
+			Expect(conf.PKCE).To(BeTrue())
+			Expect(conf.Port).To(Equal(9000))
+			Expect(conf.Profile).To(Equal("prod"))
+		})
+
+		It("should error on a cycle", func() {
+			var conf config
+			err := decodeConfig(strings.NewReader(file), &conf, "loop-a")
+			Expect(err).To(MatchError(`profile "loop-a": extends cycle loop-a -> loop-b -> loop-a`))
+		})
+
+		It("should error on a profile that isn't in the file", func() {
+			var conf config
+			err := decodeConfig(strings.NewReader(file), &conf, "orphan")
+			Expect(err).To(MatchError(`profile "orphan" extends "missing", which isn't in the file`))
+		})
+	})
+})
+
+var _ = Describe("loadEnv", func() {
+	BeforeEach(func() {
+		os.Setenv("OAUTH2_CLI_CLIENT_SECRET", "from-env")
+		os.Setenv("OAUTH2_CLI_PORT", "9090")
+		os.Setenv("OAUTH2_CLI_PKCE", "true")
+		os.Setenv("OAUTH2_CLI_TIMEOUT", "1m")
+		os.Setenv("OAUTH2_CLI_AUDIENCES", "a,b")
+	})
+
+	AfterEach(func() {
+		for _, name := range []string{"CLIENT_SECRET", "PORT", "PKCE", "TIMEOUT", "AUDIENCES"} {
+			os.Unsetenv("OAUTH2_CLI_" + name)
+		}
+	})
+
+	It("should override config fields", func() {
+		conf := config{Config: oauth2cli.Config{ClientSecret: "from-file", Port: 8081}}
+		Expect(loadEnv(&conf)).To(Succeed())
+		Expect(conf.ClientSecret).To(Equal("from-env"))
+		Expect(conf.Port).To(Equal(9090))
+		Expect(conf.PKCE).To(BeTrue())
+		Expect(time.Duration(conf.Timeout)).To(Equal(time.Minute))
+		Expect(conf.Audiences).To(Equal(oauth2cli.StringList{"a", "b"}))
+	})
+
+	It("should error on invalid values", func() {
+		os.Setenv("OAUTH2_CLI_PORT", "many")
+		var conf config
+		Expect(loadEnv(&conf)).To(MatchError(ContainSubstring("OAUTH2_CLI_PORT: ")))
+	})
+})
+
+var _ = Describe("readSecretFile", func() {
+	It("should trim the trailing newline", func() {
+		f, err := ioutil.TempFile("", "secret")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.Remove(f.Name())
+		_, err = f.WriteString("s3cret\r\n")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+
+		Expect(readSecretFile(f.Name())).To(Equal("s3cret"))
+	})
+})
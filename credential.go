@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/geckoboard/oauth2-cli/pkg/oauth2cli"
+	"golang.org/x/oauth2"
+)
+
+// credentialUsername is sent to git with the token when it doesn't ask for a
+// particular user. GitHub ignores the username of an OAuth token and GitLab
+// expects this one.
+const credentialUsername = "oauth2"
+
+// credential is the git credential helper protocol. git runs the helper with
+// get, store or erase, and the attributes of the credential on stdin. The
+// token is given to git as the password, from -cache while it's valid.
+func credential(conf config, flow oauth2cli.Flow, args []string) int {
+	if len(args) != 1 {
+		log.Println("usage: oauth2-cli [flags] credential get|store|erase")
+		return 1
+	}
+	attrs, err := readCredential(os.Stdin)
+	if err != nil {
+		log.Printf("error: failed to read the credential: %s\n", err)
+		return 1
+	}
+
+	// stdout is git's, so the token only goes to the cache.
+	flow.OnToken = func(token *oauth2.Token) error {
+		if conf.Cache == "" {
+			return nil
+		}
+		if err := writeCache(conf, token); err != nil {
+			return fmt.Errorf("failed to write token cache: %w", err)
+		}
+		return nil
+	}
+
+	switch args[0] {
+	case "get":
+		var token *oauth2.Token
+		if conf.Cache != "" && !conf.Force {
+			token, _ = cachedToken(conf, flow)
+		}
+		if token == nil {
+			if token, err = flow.Authorize(context.Background()); err != nil {
+				return reportError(conf, err)
+			}
+		}
+		username := attrs["username"]
+		if username == "" {
+			username = credentialUsername
+		}
+		fmt.Printf("username=%s\npassword=%s\n", username, token.AccessToken)
+		if !token.Expiry.IsZero() {
+			fmt.Printf("password_expiry_utc=%d\n", token.Expiry.Unix())
+		}
+
+	case "erase":
+		// git erases a credential that was rejected, so the next get runs
+		// the flow again.
+		if conf.Cache != "" {
+			if err := eraseCache(conf); err != nil {
+				log.Printf("error: failed to erase the token cache: %s\n", err)
+				return 1
+			}
+		}
+	}
+	// store, like any other action, needs nothing: the token is cached when
+	// it's issued.
+	return 0
+}
+
+// readCredential reads the key=value lines git sends, up to a blank line or
+// the end of the input.
+func readCredential(r io.Reader) (map[string]string, error) {
+	attrs := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid line %q, expected key=value", line)
+		}
+		attrs[kv[0]] = kv[1]
+	}
+	return attrs, scanner.Err()
+}
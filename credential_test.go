@@ -0,0 +1,138 @@
+package main_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+	"github.com/onsi/gomega/ghttp"
+	"golang.org/x/oauth2"
+)
+
+var _ = Describe("Git credential helper", func() {
+	var (
+		args    []string
+		stdin   string
+		dir     string
+		cache   string
+		session *gexec.Session
+		server  *ghttp.Server
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "credential")
+		Expect(err).ToNot(HaveOccurred())
+		cache = filepath.Join(dir, "token.json")
+
+		server = ghttp.NewServer()
+		stdin = "protocol=https\nhost=git.example.com\n\n"
+		args = []string{
+			"-flow", "client_credentials",
+			"-token", server.URL() + "/oauth/token",
+			"-id", "123",
+			"-secret", "abc",
+			"-cache", cache,
+			"credential",
+		}
+	})
+
+	JustBeforeEach(func() {
+		command := exec.Command(cmdPath, args...)
+		command.Stdin = strings.NewReader(stdin)
+
+		var err error
+		session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		gexec.TerminateAndWait()
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	Context("get", func() {
+		BeforeEach(func() {
+			args = append(args, "get")
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token": "mytoken",
+				"token_type":   "Bearer",
+				"expires_in":   3600,
+			}))
+		})
+
+		It("should answer with the token as the password and cache it", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			lines := strings.Split(strings.TrimSpace(string(session.Out.Contents())), "\n")
+			Expect(lines).To(HaveLen(3))
+			Expect(lines[0]).To(Equal("username=oauth2"))
+			Expect(lines[1]).To(Equal("password=mytoken"))
+			Expect(lines[2]).To(HavePrefix("password_expiry_utc="))
+			Expect(cache).To(BeAnExistingFile())
+		})
+
+		Context("with a username", func() {
+			BeforeEach(func() {
+				stdin = "protocol=https\nhost=git.example.com\nusername=me\n\n"
+			})
+
+			It("should keep it", func() {
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(string(session.Out.Contents())).To(HavePrefix("username=me\npassword=mytoken\n"))
+			})
+		})
+
+		Context("with a valid cached token", func() {
+			BeforeEach(func() {
+				data, err := json.Marshal(oauth2.Token{
+					AccessToken: "cachedtoken",
+					TokenType:   "Bearer",
+					Expiry:      time.Now().Add(time.Hour),
+				})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(ioutil.WriteFile(cache, data, 0600)).To(Succeed())
+			})
+
+			It("should answer with it", func() {
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(string(session.Out.Contents())).To(ContainSubstring("password=cachedtoken\n"))
+				Expect(server.ReceivedRequests()).To(BeEmpty())
+			})
+		})
+	})
+
+	Context("erase", func() {
+		BeforeEach(func() {
+			args = append(args, "erase")
+			Expect(ioutil.WriteFile(cache, []byte(`{"access_token":"rejected"}`), 0600)).To(Succeed())
+		})
+
+		It("should remove the cached token", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(cache).ToNot(BeAnExistingFile())
+			Expect(session.Out.Contents()).To(BeEmpty())
+		})
+	})
+
+	Context("store", func() {
+		BeforeEach(func() {
+			args = append(args, "store")
+			stdin = "protocol=https\nhost=git.example.com\nusername=oauth2\npassword=mytoken\n\n"
+		})
+
+		It("should do nothing", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(server.ReceivedRequests()).To(BeEmpty())
+			Expect(session.Out.Contents()).To(BeEmpty())
+		})
+	})
+})
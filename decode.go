@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/geckoboard/oauth2-cli/pkg/oauth2cli"
+)
+
+// decode prints the header and claims of a JWT, warning if it has expired,
+// and with -verify-id-token checks its signature and claims too.
+func decode(conf config, flow *oauth2cli.Flow, jwt string) int {
+	if jwt == "" {
+		log.Println("usage: oauth2-cli [flags] decode <jwt>|-")
+		return 1
+	}
+	decoded, err := oauth2cli.DecodeJWT(jwt)
+	if err != nil {
+		log.Printf("error: %s\n", err)
+		return 1
+	}
+	pretty, err := json.MarshalIndent(decoded, "", "  ")
+	if err != nil {
+		log.Printf("error: %s\n", err)
+		return 1
+	}
+	fmt.Printf("%s\n", pretty)
+
+	if !decoded.Expiry.IsZero() && time.Now().After(decoded.Expiry) {
+		log.Printf("warning: expired at %s\n", decoded.Expiry.UTC().Format(time.RFC3339))
+	}
+	if conf.VerifyIDToken {
+		if err := flow.VerifyJWT(context.Background(), jwt); err != nil {
+			log.Printf("error: verification failed: %s\n", err)
+			return 1
+		}
+		log.Println("Signature and claims verified")
+	}
+	return 0
+}
@@ -0,0 +1,138 @@
+package main_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Decode command", func() {
+	var (
+		args    []string
+		key     *rsa.PrivateKey
+		jwt     string
+		session *gexec.Session
+		server  *ghttp.Server
+	)
+
+	BeforeEach(func() {
+		var err error
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+
+		server = ghttp.NewServer()
+		server.RouteToHandler("GET", "/jwks", ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "key-1",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		}))
+		jwt = SignedJWT(key, "key-1", map[string]interface{}{
+			"iss": "https://provider.example",
+			"sub": "me",
+			"exp": time.Date(2100, 1, 2, 3, 4, 5, 0, time.UTC).Unix(),
+		})
+		args = nil
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		session, err = gexec.Start(exec.Command(cmdPath, append(args, "decode", jwt)...), GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		gexec.TerminateAndWait()
+		server.Close()
+	})
+
+	It("should print the header and claims without needing a client", func() {
+		Eventually(session).Should(gexec.Exit(0))
+		var decoded struct {
+			Header map[string]interface{}
+			Claims map[string]interface{}
+		}
+		Expect(json.Unmarshal(session.Out.Contents(), &decoded)).To(Succeed())
+		Expect(decoded.Header).To(HaveKeyWithValue("kid", "key-1"))
+		Expect(decoded.Claims).To(HaveKeyWithValue("sub", "me"))
+		Expect(decoded.Claims).To(HaveKeyWithValue("exp", "2100-01-02T03:04:05Z"))
+		Expect(session.Err).ToNot(gbytes.Say("warning"))
+	})
+
+	Context("with an expired JWT", func() {
+		BeforeEach(func() {
+			jwt = SignedJWT(key, "key-1", map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})
+		})
+
+		It("should warn", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say("warning: expired at "))
+		})
+	})
+
+	Context("with -verify-id-token", func() {
+		BeforeEach(func() {
+			args = []string{"-verify-id-token", "-jwks-url", server.URL() + "/jwks"}
+		})
+
+		It("should verify the signature", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say("Signature and claims verified"))
+		})
+
+		Context("when signed by another key", func() {
+			BeforeEach(func() {
+				other, err := rsa.GenerateKey(rand.Reader, 2048)
+				Expect(err).ToNot(HaveOccurred())
+				jwt = SignedJWT(other, "key-1", map[string]interface{}{"exp": time.Now().Add(time.Hour).Unix()})
+			})
+
+			It("should fail", func() {
+				Eventually(session).Should(gexec.Exit(1))
+				Expect(session.Err).To(gbytes.Say("error: verification failed: no key matches the RS256 signature"))
+			})
+		})
+	})
+
+	Context("with -verify-id-token and -jwks-file", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "oauth2-cli-jwks")
+			Expect(err).ToNot(HaveOccurred())
+			data, err := json.Marshal(JWKS(&key.PublicKey, "key-1"))
+			Expect(err).ToNot(HaveOccurred())
+			path := filepath.Join(dir, "jwks.json")
+			Expect(ioutil.WriteFile(path, data, 0600)).To(Succeed())
+			// The file is used over the URL, which isn't served.
+			args = []string{"-verify-id-token", "-jwks-file", path, "-jwks-url", server.URL() + "/missing"}
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should verify the signature with the keys of the file", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say("Signature and claims verified"))
+			Expect(server.ReceivedRequests()).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,150 @@
+package main_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"os/exec"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+	"github.com/onsi/gomega/ghttp"
+	"golang.org/x/oauth2"
+)
+
+var _ = Describe("Device flow", func() {
+	var (
+		args    []string
+		session *gexec.Session
+		server  *ghttp.Server
+	)
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		args = []string{
+			"-flow", "device",
+			"-device-auth", server.URL() + "/oauth/device",
+			"-token", server.URL() + "/oauth/token",
+			"-id", "123",
+			"-scope", "public",
+		}
+
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", "/oauth/device"),
+				ghttp.VerifyFormKV("client_id", "123"),
+				ghttp.VerifyFormKV("scope", "public"),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+					"device_code":               "mydevicecode",
+					"user_code":                 "ABCD-EFGH",
+					"verification_uri":          "https://provider.example/device",
+					"verification_uri_complete": "https://provider.example/device?user_code=ABCD-EFGH",
+					"expires_in":                60,
+					"interval":                  1,
+				}),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", "/oauth/token"),
+				ghttp.VerifyFormKV("grant_type", "urn:ietf:params:oauth:grant-type:device_code"),
+				ghttp.VerifyFormKV("device_code", "mydevicecode"),
+				ghttp.RespondWithJSONEncoded(http.StatusBadRequest, map[string]string{"error": "authorization_pending"}),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", "/oauth/token"),
+				ghttp.VerifyFormKV("device_code", "mydevicecode"),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "mytoken",
+					TokenType:   "Bearer",
+				}),
+			),
+		)
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		session, err = gexec.Start(exec.Command(cmdPath, args...), GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		gexec.TerminateAndWait()
+		server.Close()
+	})
+
+	It("should print the user code and poll for the token", func() {
+		Eventually(session.Err).Should(gbytes.Say("To authorize, visit https://provider.example/device and enter the code: ABCD-EFGH"))
+		Eventually(session.Err).Should(gbytes.Say(`https://provider.example/device\?user_code=ABCD-EFGH`))
+
+		Eventually(session, 5).Should(gexec.Exit(0))
+		Expect(session.Err).To(gbytes.Say(`"access_token": "mytoken"`))
+		Expect(server.ReceivedRequests()).To(HaveLen(3))
+	})
+
+	Context("with form encoded responses answered with a 200, as GitHub's", func() {
+		BeforeEach(func() {
+			form := http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}
+			server.SetHandler(1, ghttp.RespondWith(http.StatusOK, "error=authorization_pending&error_description=pending", form))
+			server.SetHandler(2, ghttp.RespondWith(http.StatusOK, "access_token=gho_mytoken&token_type=bearer&scope=repo", form))
+		})
+
+		It("should keep polling until the token is issued", func() {
+			Eventually(session, 5).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "gho_mytoken"`))
+			Expect(server.ReceivedRequests()).To(HaveLen(3))
+		})
+	})
+
+	Context("with -device-max-interval and a slow_down", func() {
+		BeforeEach(func() {
+			args = append(args, "-device-max-interval", "1s", "-verbose")
+			server.SetHandler(1, ghttp.RespondWithJSONEncoded(http.StatusBadRequest, map[string]string{"error": "slow_down"}))
+		})
+
+		It("should back off no further than the cap", func() {
+			Eventually(session.Err, 3).Should(gbytes.Say("device token: slow_down, polling again in 1s"))
+			Eventually(session, 4).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "mytoken"`))
+		})
+	})
+
+	Context("with -grant", func() {
+		BeforeEach(func() {
+			args[0] = "-grant"
+		})
+
+		It("should run the device flow", func() {
+			Eventually(session.Err).Should(gbytes.Say("enter the code: ABCD-EFGH"))
+			Eventually(session, 5).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "mytoken"`))
+		})
+	})
+
+	Context("with -verify-id-token and an id_token signed by another key", func() {
+		BeforeEach(func() {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+			other, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+
+			args = append(args, "-verify-id-token", "-jwks-url", server.URL()+"/jwks")
+			server.RouteToHandler("GET", "/jwks", ghttp.RespondWithJSONEncoded(http.StatusOK, JWKS(&key.PublicKey, "key-1")))
+			server.SetHandler(2, ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token": "mytoken",
+				"token_type":   "Bearer",
+				"id_token": SignedJWT(other, "key-1", map[string]interface{}{
+					"aud": "123",
+					"exp": time.Now().Add(time.Hour).Unix(),
+				}),
+			}))
+		})
+
+		It("should fail the verification", func() {
+			Eventually(session, 5).Should(gexec.Exit(9))
+			Expect(session.Err).To(gbytes.Say("OIDC id_token verification error: no key matches the RS256 signature"))
+			Expect(session.Err).ToNot(gbytes.Say("mytoken"))
+		})
+	})
+})
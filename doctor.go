@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/geckoboard/oauth2-cli/pkg/oauth2cli"
+)
+
+// doctor logs the findings of checking the config, for the doctor command,
+// returning the exit code: 1 if any is an error, or a warning with -strict.
+func doctor(conf config, flow *oauth2cli.Flow) int {
+	failed, warned := 0, 0
+	for _, finding := range flow.Doctor(context.Background()) {
+		switch finding.Level {
+		case oauth2cli.LevelError:
+			failed++
+		case oauth2cli.LevelWarning:
+			warned++
+		}
+		log.Printf("%s: %s\n", finding.Level, finding.Message)
+		if finding.Fix != "" {
+			log.Printf("  fix: %s\n", finding.Fix)
+		}
+	}
+	log.Printf("%d errors, %d warnings\n", failed, warned)
+	if failed > 0 || (warned > 0 && conf.Strict) {
+		return 1
+	}
+	return 0
+}
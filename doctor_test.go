@@ -0,0 +1,151 @@
+package main_test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Doctor", func() {
+	var (
+		args    []string
+		port    int
+		session *gexec.Session
+		server  *ghttp.Server
+	)
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		server.AllowUnhandledRequests = true
+		server.UnhandledRequestStatusCode = http.StatusNotFound
+		server.RouteToHandler("GET", "/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+			ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"issuer":                 server.URL(),
+				"authorization_endpoint": server.URL() + "/oauth/authorize",
+				"token_endpoint":         server.URL() + "/oauth/token",
+				"scopes_supported":       []string{"openid", "email"},
+			})(w, r)
+		})
+		server.RouteToHandler("GET", "/oauth/authorize", ghttp.RespondWith(http.StatusBadRequest, "missing client_id"))
+		server.RouteToHandler("POST", "/oauth/token", ghttp.RespondWithJSONEncoded(http.StatusBadRequest, map[string]string{"error": "invalid_request"}))
+
+		var err error
+		port, err = EphemeralPort()
+		Expect(err).ToNot(HaveOccurred())
+		args = []string{"doctor", "-issuer", server.URL(), "-id", "123", "-port", fmt.Sprint(port), "-scope", "openid email"}
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		session, err = gexec.Start(exec.Command(cmdPath, args...), GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		gexec.TerminateAndWait()
+		server.Close()
+	})
+
+	It("should pass a working config", func() {
+		Eventually(session).Should(gexec.Exit(0))
+		Expect(session.Err).To(gbytes.Say("ok: discovery document of " + server.URL()))
+		Expect(session.Err).To(gbytes.Say(`ok: -auth \S+/oauth/authorize responds \(400 Bad Request\)`))
+		Expect(session.Err).To(gbytes.Say(`ok: -token \S+/oauth/token responds`))
+		Expect(session.Err).To(gbytes.Say(fmt.Sprintf("ok: can listen on 127.0.0.1:%d", port)))
+		Expect(session.Err).To(gbytes.Say(fmt.Sprintf("ok: redirect URL http://127.0.0.1:%d/oauth/callback", port)))
+		Expect(session.Err).To(gbytes.Say("ok: scopes openid email are supported"))
+		Expect(session.Err).To(gbytes.Say("0 errors, 0 warnings"))
+	})
+
+	Context("with an unsupported scope", func() {
+		BeforeEach(func() {
+			args = append(args, "-scope", "openid profile")
+		})
+
+		It("should warn", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`warning: scope "profile" isn't in the provider's scopes_supported`))
+			Expect(session.Err).To(gbytes.Say("fix: check its spelling"))
+		})
+
+		Context("with -strict", func() {
+			BeforeEach(func() {
+				args = append(args, "-strict")
+			})
+
+			It("should fail", func() {
+				Eventually(session).Should(gexec.Exit(1))
+				Expect(session.Err).To(gbytes.Say("0 errors, 1 warnings"))
+			})
+		})
+	})
+
+	Context("with a token URL that isn't there", func() {
+		BeforeEach(func() {
+			args = append(args, "-token", server.URL()+"/token")
+		})
+
+		It("should report it", func() {
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say(`warning: token URL "\S+/token" != discovered token_endpoint`))
+			Expect(session.Err).To(gbytes.Say(`error: POST \S+/token answered 404 Not Found`))
+			Expect(session.Err).To(gbytes.Say("fix: check the path of -token"))
+		})
+	})
+
+	Context("with the port in use", func() {
+		var listener net.Listener
+
+		BeforeEach(func() {
+			var err error
+			listener, err = net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			listener.Close()
+		})
+
+		It("should report it", func() {
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say(fmt.Sprintf("error: can't listen on 127.0.0.1:%d for the callback", port)))
+			Expect(session.Err).To(gbytes.Say("fix: pick another -port"))
+		})
+	})
+
+	Context("with -auth and -token instead of -issuer", func() {
+		BeforeEach(func() {
+			args = []string{
+				"doctor", "-id", "123", "-port", fmt.Sprint(port), "-pkce",
+				"-auth", server.URL() + "/oauth/authorize", "-token", server.URL() + "/oauth/token",
+			}
+		})
+
+		It("should check them", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`ok: -auth \S+/oauth/authorize responds \(400 Bad Request\)`))
+			Expect(session.Err).To(gbytes.Say(`ok: -token \S+/oauth/token responds`))
+			Expect(session.Err).To(gbytes.Say("0 errors"))
+		})
+	})
+
+	Context("without a client ID or issuer", func() {
+		BeforeEach(func() {
+			args = []string{"doctor", "-port", fmt.Sprint(port)}
+		})
+
+		It("should say what to set", func() {
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say("error: no client ID"))
+			Expect(session.Err).To(gbytes.Say("fix: set -id, -id-file or OAUTH2_CLI_CLIENT_ID"))
+			Expect(session.Err).To(gbytes.Say("error: no -auth URL"))
+		})
+	})
+})
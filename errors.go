@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+
+	"github.com/geckoboard/oauth2-cli/pkg/oauth2cli"
+	"golang.org/x/oauth2"
+)
+
+// The -error-format values.
+const (
+	errorFormatText = "text"
+	errorFormatJSON = "json"
+)
+
+// errInterrupted is the failure of a flow stopped by a signal.
+var errInterrupted = errors.New("interrupted before the flow completed")
+
+// errorJSON is a failed flow as -error-format json logs it, with the error
+// response of the provider when there was one.
+type errorJSON struct {
+	// Error is the class of failure, which the exit code tells apart too.
+	Error            string `json:"error"`
+	ExitCode         int    `json:"exit_code"`
+	Message          string `json:"message"`
+	Profile          string `json:"profile,omitempty"`
+	ErrorCode        string `json:"error_code,omitempty"`
+	ErrorDescription string `json:"error_description,omitempty"`
+	ErrorURI         string `json:"error_uri,omitempty"`
+	// Status is that of the token endpoint's error response.
+	Status int `json:"status,omitempty"`
+}
+
+// classifyError returns the errorJSON of a failed flow.
+func classifyError(err error) errorJSON {
+	e := errorJSON{Error: "error", ExitCode: 1, Message: err.Error()}
+	var (
+		authErr     *oauth2cli.AuthorizationError
+		retrieveErr *oauth2.RetrieveError
+		urlErr      *url.Error
+	)
+	switch {
+	case errors.Is(err, errInterrupted):
+		e.Error = "interrupted"
+	case errors.As(err, &authErr):
+		e.Error, e.ExitCode = "authorization_error", exitAuthorizationError
+		if authErr.InteractionRequired() {
+			e.Error, e.ExitCode = "interaction_required", exitSilentAuth
+		}
+		e.ErrorCode, e.ErrorDescription, e.ErrorURI = authErr.Code, authErr.Description, authErr.URI
+	case errors.Is(err, oauth2cli.ErrTimeout):
+		e.Error, e.ExitCode = "timeout", exitCallbackTimeout
+	case errors.Is(err, oauth2cli.ErrInvalidState):
+		e.Error, e.ExitCode = "invalid_state", exitInvalidState
+	case errors.Is(err, oauth2cli.ErrValidation):
+		e.Error, e.ExitCode = "validation_error", exitValidation
+	case errors.As(err, &retrieveErr):
+		e.Error, e.ExitCode = "token_error", exitTokenError
+		e.Status = retrieveErr.Response.StatusCode
+		var body struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+			URI         string `json:"error_uri"`
+		}
+		// Error responses that aren't JSON just have their status.
+		if json.Unmarshal(retrieveErr.Body, &body) == nil {
+			e.ErrorCode, e.ErrorDescription, e.ErrorURI = body.Error, body.Description, body.URI
+		}
+	case errors.Is(err, oauth2cli.ErrUnreachable), errors.As(err, &urlErr):
+		e.Error, e.ExitCode = "unreachable", exitUnreachable
+	}
+	return e
+}
+
+// reportError logs the failure of a flow as -error-format has it, returning
+// the exit code for it.
+func reportError(conf config, err error) int {
+	e := classifyError(err)
+	if conf.ErrorFormat != errorFormatJSON {
+		log.Printf("error: %s\n", err)
+		return e.ExitCode
+	}
+	e.Profile = conf.Profile
+	// Written as one line without the log prefix, for scripts to parse.
+	if err := json.NewEncoder(os.Stderr).Encode(e); err != nil {
+		log.Printf("error: %s\n", e.Message)
+	}
+	return e.ExitCode
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// runWithToken runs command through the shell with the token fields in its
+// environment, returning the command's exit code.
+func runWithToken(command string, token *oauth2.Token) (int, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", command)
+	}
+	return run(cmd, tokenEnv(token, ""))
+}
+
+// execWithToken runs the command given after -- with the token fields in its
+// environment, as OAUTH_ACCESS_TOKEN and so on, returning its exit code.
+func execWithToken(args []string, token *oauth2.Token) (int, error) {
+	return run(exec.Command(args[0], args[1:]...), tokenEnv(token, "OAUTH_"))
+}
+
+func run(cmd *exec.Cmd, env []string) (int, error) {
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), env...)
+
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), nil
+	}
+	return 0, err
+}
+
+// tokenEnv returns the token fields as NAME=value environment entries, with
+// the names prefixed by prefix.
+func tokenEnv(token *oauth2.Token, prefix string) []string {
+	env := []string{
+		prefix + "ACCESS_TOKEN=" + token.AccessToken,
+		prefix + "TOKEN_TYPE=" + token.Type(),
+	}
+	if token.RefreshToken != "" {
+		env = append(env, prefix+"REFRESH_TOKEN="+token.RefreshToken)
+	}
+	if idToken, ok := token.Extra("id_token").(string); ok {
+		env = append(env, prefix+"ID_TOKEN="+idToken)
+	}
+	if !token.Expiry.IsZero() {
+		env = append(env, prefix+"TOKEN_EXPIRY="+token.Expiry.Format(time.RFC3339))
+	}
+	return env
+}
+
+// splitExecArgs splits the command line at the first --, returning the args
+// before it and the command after it.
+func splitExecArgs(args []string) ([]string, []string) {
+	for i, arg := range args {
+		if arg == "--" {
+			return args[:i], args[i+1:]
+		}
+	}
+	return args, nil
+}
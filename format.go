@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/geckoboard/oauth2-cli/pkg/oauth2cli"
+	"golang.org/x/oauth2"
+)
+
+const (
+	formatJSON       = "json"
+	formatCurlConfig = "curl-config"
+	formatAWS        = "aws-credential-process"
+	formatToken      = "token"
+	formatEnv        = "env"
+	formatExport     = "export"
+	formatHeader     = "header"
+	formatKubeExec   = "kubeexec"
+	formatTemplate   = "template"
+)
+
+func validFormat(format string) bool {
+	switch format {
+	case formatJSON, formatCurlConfig, formatAWS, formatToken, formatEnv, formatExport, formatHeader, formatKubeExec, formatTemplate:
+		return true
+	}
+	return false
+}
+
+func validAWSTokenField(field string) bool {
+	switch field {
+	case "AccessKeyId", "SecretAccessKey", "SessionToken":
+		return true
+	}
+	return false
+}
+
+// emitToken writes the token to its configured destination in the configured
+// format, returning its JSON.
+func emitToken(conf config, token *oauth2.Token) ([]byte, error) {
+	if conf.Verbose {
+		if expiry, ok := refreshTokenExpiry(token, time.Now()); ok {
+			log.Printf("refresh token expires at %s\n", expiry.Format(time.RFC3339))
+		}
+	}
+
+	tokenJSON, err := json.MarshalIndent(jsonToken{token, callbackParams(token)}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	output := append(tokenJSON, '\n')
+	if conf.Format != formatJSON {
+		var buf bytes.Buffer
+		if err := writeToken(&buf, conf, token); err != nil {
+			return nil, err
+		}
+		output = buf.Bytes()
+	}
+
+	if conf.Clipboard != "" {
+		if err := copyToken(conf.Clipboard, token); err != nil {
+			log.Printf("warning: failed to copy the %s to the clipboard: %s\n", conf.Clipboard, err)
+		} else if !conf.Quiet {
+			log.Printf("Copied the %s to the clipboard\n", conf.Clipboard)
+		}
+	}
+
+	switch {
+	case conf.Out != "":
+		err = writeOutput(conf.Out, output)
+	case conf.Format == formatJSON && conf.SummaryOnly:
+		// Already summarized by the flow.
+	case conf.Format == formatJSON && !conf.Quiet:
+		log.Printf("result:\n%s\n", tokenJSON)
+	case conf.NoStdout:
+	default:
+		_, err = os.Stdout.Write(output)
+	}
+	return tokenJSON, err
+}
+
+// jsonToken is the JSON output, with the -callback-param params.
+type jsonToken struct {
+	*oauth2.Token
+	CallbackParams map[string]interface{} `json:"callback_params,omitempty"`
+}
+
+// callbackParams returns the -callback-param params of the callback that
+// the token was issued for.
+func callbackParams(token *oauth2.Token) map[string]interface{} {
+	params, _ := token.Extra(oauth2cli.CallbackParamsExtra).(map[string]interface{})
+	return params
+}
+
+// awsCredentials is the output of an AWS credential_process.
+type awsCredentials struct {
+	Version         int
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string `json:",omitempty"`
+	Expiration      string `json:",omitempty"`
+}
+
+// execCredential is the output of a client-go exec credential plugin.
+type execCredential struct {
+	APIVersion string               `json:"apiVersion"`
+	Kind       string               `json:"kind"`
+	Status     execCredentialStatus `json:"status"`
+}
+
+type execCredentialStatus struct {
+	Token               string `json:"token"`
+	ExpirationTimestamp string `json:"expirationTimestamp,omitempty"`
+}
+
+// writeToken writes the token to w in one of the non-JSON output formats.
+func writeToken(w io.Writer, conf config, token *oauth2.Token) error {
+	switch conf.Format {
+	case formatAWS:
+		creds := awsCredentials{Version: 1}
+		switch conf.AWSTokenField {
+		case "AccessKeyId":
+			creds.AccessKeyId = token.AccessToken
+		case "SecretAccessKey":
+			creds.SecretAccessKey = token.AccessToken
+		case "SessionToken":
+			creds.SessionToken = token.AccessToken
+		default:
+			return fmt.Errorf("unknown -aws-token-field %q", conf.AWSTokenField)
+		}
+		if !token.Expiry.IsZero() {
+			creds.Expiration = token.Expiry.UTC().Format(time.RFC3339)
+		}
+		return json.NewEncoder(w).Encode(creds)
+
+	case formatKubeExec:
+		// OIDC clusters authenticate with the id_token rather than the
+		// access token.
+		cred := execCredential{
+			APIVersion: "client.authentication.k8s.io/v1",
+			Kind:       "ExecCredential",
+			Status:     execCredentialStatus{Token: token.AccessToken},
+		}
+		if idToken, ok := token.Extra("id_token").(string); ok && idToken != "" {
+			cred.Status.Token = idToken
+		}
+		if !token.Expiry.IsZero() {
+			cred.Status.ExpirationTimestamp = token.Expiry.UTC().Format(time.RFC3339)
+		}
+		return json.NewEncoder(w).Encode(cred)
+
+	case formatToken:
+		// With -id-token-only, the id_token is all there is.
+		value := token.AccessToken
+		if value == "" {
+			value, _ = token.Extra("id_token").(string)
+		}
+		_, err := fmt.Fprintln(w, value)
+		return err
+
+	case formatHeader:
+		_, err := fmt.Fprintf(w, "Authorization: %s %s\n", token.Type(), token.AccessToken)
+		return err
+
+	case formatEnv, formatExport:
+		// For eval in a POSIX shell.
+		exports := [][2]string{{"ACCESS_TOKEN", token.AccessToken}}
+		if token.RefreshToken != "" {
+			exports = append(exports, [2]string{"REFRESH_TOKEN", token.RefreshToken})
+		}
+		if !token.Expiry.IsZero() {
+			exports = append(exports, [2]string{"TOKEN_EXPIRY", token.Expiry.UTC().Format(time.RFC3339)})
+		}
+		for _, e := range exports {
+			if _, err := fmt.Fprintf(w, "export %s=%s\n", e[0], shellQuote(e[1])); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case formatTemplate:
+		tmpl, err := parseTemplate(conf.Template)
+		if err != nil {
+			return err
+		}
+		return tmpl.Execute(w, newTemplateToken(token))
+
+	case formatCurlConfig:
+		// Usable with `curl -K`, which treats backslash as an escape inside
+		// double quoted values.
+		header := fmt.Sprintf("Authorization: %s %s", token.Type(), token.AccessToken)
+		header = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(header)
+		_, err := fmt.Fprintf(w, "header = \"%s\"\n", header)
+		return err
+	}
+	return fmt.Errorf("unknown format %q", conf.Format)
+}
+
+// templateFuncs are the functions of -template, besides the text/template
+// builtins.
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"shellquote": shellQuote,
+}
+
+// parseTemplate parses the -template of -format template.
+func parseTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("-template").Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// templateToken is what -template is executed with. The claims of the
+// id_token, and of the access token if it is a JWT, are decoded without
+// verifying them.
+type templateToken struct {
+	AccessToken  string
+	TokenType    string
+	RefreshToken string
+	IDToken      string
+	Expiry       time.Time
+	// ExpiresIn is the number of seconds until Expiry, or 0 without one.
+	ExpiresIn         int64
+	Claims            map[string]interface{}
+	AccessTokenClaims map[string]interface{}
+	// CallbackParams are the -callback-param params of the callback.
+	CallbackParams map[string]interface{}
+
+	token *oauth2.Token
+}
+
+func newTemplateToken(token *oauth2.Token) templateToken {
+	t := templateToken{
+		AccessToken:    token.AccessToken,
+		TokenType:      token.Type(),
+		RefreshToken:   token.RefreshToken,
+		Expiry:         token.Expiry,
+		CallbackParams: callbackParams(token),
+		token:          token,
+	}
+	if !token.Expiry.IsZero() {
+		t.ExpiresIn = int64(time.Until(token.Expiry).Round(time.Second).Seconds())
+	}
+	t.IDToken, _ = token.Extra("id_token").(string)
+	if decoded, err := oauth2cli.DecodeJWT(t.IDToken); err == nil {
+		t.Claims = decoded.Claims
+	}
+	if decoded, err := oauth2cli.DecodeJWT(token.AccessToken); err == nil {
+		t.AccessTokenClaims = decoded.Claims
+	}
+	return t
+}
+
+// Extra returns a field of the token response, such as {{.Extra "scope"}}.
+func (t templateToken) Extra(name string) interface{} {
+	return t.token.Extra(name)
+}
+
+// shellQuote single quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// refreshTokenExpiry returns when the refresh token expires if the provider
+// sent a refresh_token_expires_in extra, as Azure AD does.
+func refreshTokenExpiry(token *oauth2.Token, now time.Time) (time.Time, bool) {
+	var seconds int64
+	switch v := token.Extra("refresh_token_expires_in").(type) {
+	case float64:
+		seconds = int64(v)
+	case string:
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		seconds = n
+	default:
+		return time.Time{}, false
+	}
+	return now.Add(time.Duration(seconds) * time.Second), true
+}
+
+// writeOutput writes data to path, or stdout if path is "-". Files are
+// written to a temporary file and renamed into place so that readers never
+// see a partial token.
+func writeOutput(path string, data []byte) error {
+	if path == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".oauth2-cli-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/geckoboard/oauth2-cli/pkg/oauth2cli"
+)
+
+// initProfile is the profile that the init command writes.
+type initProfile struct {
+	Provider     string `json:"provider,omitempty"`
+	Issuer       string `json:"issuer,omitempty"`
+	AuthURL      string `json:"auth_url,omitempty"`
+	TokenURL     string `json:"token_url,omitempty"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret,omitempty"`
+	Scope        string `json:"scopes,omitempty"`
+	PKCE         bool   `json:"pkce,omitempty"`
+	Keyring      bool   `json:"keyring,omitempty"`
+}
+
+// prompter asks the questions of the init command on stderr, reading the
+// answers from stdin.
+type prompter struct {
+	in *bufio.Reader
+}
+
+// ask returns the answer to question, or def if it's left empty.
+func (p *prompter) ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(os.Stderr, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: ", question)
+	}
+	line, err := p.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		if err == io.EOF {
+			err = fmt.Errorf("no answer to %q", question)
+		}
+		return "", err
+	}
+	if answer := strings.TrimSpace(line); answer != "" {
+		return answer, nil
+	}
+	return def, nil
+}
+
+// required asks question until it's answered.
+func (p *prompter) required(question, def string) (string, error) {
+	for {
+		answer, err := p.ask(question, def)
+		if err != nil || answer != "" {
+			return answer, err
+		}
+		fmt.Fprintln(os.Stderr, "This is required.")
+	}
+}
+
+// confirm asks a yes or no question.
+func (p *prompter) confirm(question string, def bool) (bool, error) {
+	choices := "y/N"
+	if def {
+		choices = "Y/n"
+	}
+	for {
+		answer, err := p.ask(question+" ("+choices+")", "")
+		if err != nil {
+			return false, err
+		}
+		switch strings.ToLower(answer) {
+		case "":
+			return def, nil
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+	}
+}
+
+// secret asks question without echoing the answer in a terminal.
+func (p *prompter) secret(question string) (string, error) {
+	if isTerminal(os.Stdin) {
+		answer, err := readHidden(question + ": ")
+		if err != errNoTerminal {
+			return strings.TrimSpace(answer), err
+		}
+	}
+	return p.ask(question, "")
+}
+
+// initWizard walks through setting up a profile for the init command: the
+// provider preset or issuer, the client and the scopes, offering those the
+// issuer's discovery document lists. The profile's current settings are the
+// defaults. It's written to -config, or the user config file, and the first
+// authorization is run with it if wanted.
+func initWizard(conf config) int {
+	path, explicit := configPath(os.Args[1:])
+	if !explicit {
+		dir := userConfigDir()
+		if dir == "" {
+			log.Println("error: there's no user config directory, give the file to write with -config")
+			return 1
+		}
+		// An older oauth2-cli.json is added to if it's the one in use.
+		path = filepath.Join(dir, "oauth2-cli", "config.json")
+		if paths := defaultConfigPaths(); fileExists(paths[len(paths)-1]) {
+			path = paths[len(paths)-1]
+		}
+	}
+	p := &prompter{in: bufio.NewReader(os.Stdin)}
+	name, authorize, err := runWizard(conf, p, path)
+	if err != nil {
+		log.Printf("error: %s\n", err)
+		return 1
+	}
+	if !authorize {
+		return 0
+	}
+	return runAuth(name, path, explicit)
+}
+
+// runWizard asks the questions of initWizard and writes the profile,
+// returning its name and whether to authorize with it.
+func runWizard(conf config, p *prompter, path string) (string, bool, error) {
+	name, err := p.required("Profile name", firstNonEmpty(conf.Profile, conf.Provider, "default"))
+	if err != nil {
+		return "", false, err
+	}
+	file, profiles, err := readProfiles(path)
+	if err != nil {
+		return "", false, err
+	}
+	if _, ok := profiles[name]; ok {
+		replace, err := p.confirm(fmt.Sprintf("Replace profile %q in %s?", name, path), false)
+		if err != nil || !replace {
+			return name, false, err
+		}
+	}
+
+	var profile initProfile
+	issuer := ""
+	for {
+		answer, err := p.ask(fmt.Sprintf("Provider (%s), or issuer URL, or empty to enter the endpoints", strings.Join(oauth2cli.ProviderNames(), ", ")), firstNonEmpty(conf.Provider, conf.Issuer))
+		if err != nil {
+			return "", false, err
+		}
+		if preset, ok := oauth2cli.Providers[answer]; ok {
+			profile.Provider, issuer = answer, preset.Issuer
+			break
+		}
+		if answer == "" || strings.HasPrefix(answer, "https://") || strings.HasPrefix(answer, "http://") {
+			profile.Issuer, issuer = answer, answer
+			break
+		}
+		fmt.Fprintf(os.Stderr, "Unknown provider %q.\n", answer)
+	}
+
+	var discovery *oauth2cli.Discovery
+	if issuer != "" {
+		flow := oauth2cli.Flow{Config: conf.Config}
+		flow.Config.Issuer = issuer
+		if discovery, err = flow.Discover(context.Background()); err != nil {
+			log.Printf("warning: %s\n", err)
+		} else if profile.Issuer != "" {
+			log.Printf("Discovered the auth URL %s and token URL %s\n", discovery.AuthorizationEndpoint, discovery.TokenEndpoint)
+		}
+	}
+	// Without a preset or discovery, the endpoints are asked for.
+	if profile.Provider == "" && (discovery == nil || discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "") {
+		profile.Issuer = ""
+		if profile.AuthURL, err = p.required("Auth URL", conf.AuthURL); err != nil {
+			return "", false, err
+		}
+		if profile.TokenURL, err = p.required("Token URL", conf.TokenURL); err != nil {
+			return "", false, err
+		}
+	}
+
+	if profile.ClientID, err = p.required("Client ID", conf.ClientID); err != nil {
+		return "", false, err
+	}
+	question := "Client secret, empty for a public client"
+	if conf.ClientSecret != "" {
+		question = "Client secret, empty to keep the current one"
+	}
+	if profile.ClientSecret, err = p.secret(question); err != nil {
+		return "", false, err
+	}
+	if profile.ClientSecret == "" {
+		profile.ClientSecret = conf.ClientSecret
+	}
+	// Public clients can't keep a secret, so they prove the code is theirs.
+	profile.PKCE = conf.PKCE || profile.ClientSecret == ""
+
+	scope := string(conf.Scope)
+	if discovery != nil && len(discovery.ScopesSupported) > 0 {
+		log.Printf("The provider supports the scopes: %s\n", strings.Join(discovery.ScopesSupported, " "))
+		if scope == "" && contains(discovery.ScopesSupported, "openid") {
+			scope = "openid"
+		}
+	}
+	if profile.Scope, err = p.ask("Scopes, space separated", scope); err != nil {
+		return "", false, err
+	}
+
+	if conf.Keyring && profile.ClientSecret != "" {
+		if err := keyringSet(keyringSecretAccount(profile.ClientID), profile.ClientSecret); err != nil {
+			return "", false, fmt.Errorf("failed to keep the client secret in the keyring: %w", err)
+		}
+		profile.ClientSecret, profile.Keyring = "", true
+	}
+	if err := writeProfile(path, file, profiles, name, profile); err != nil {
+		return "", false, err
+	}
+	log.Printf("Wrote profile %q to %s\n", name, path)
+
+	authorize, err := p.confirm("Authorize with it now?", true)
+	return name, authorize, err
+}
+
+// readProfiles reads the config file at path, if it exists, returning its
+// fields and its profiles.
+func readProfiles(path string) (map[string]json.RawMessage, map[string]json.RawMessage, error) {
+	file := map[string]json.RawMessage{}
+	profiles := map[string]json.RawMessage{}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return file, profiles, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse %q: %w", path, err)
+	}
+	if raw, ok := file["profiles"]; ok {
+		if err := json.Unmarshal(raw, &profiles); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse %q: profiles: %w", path, err)
+		}
+	}
+	return file, profiles, nil
+}
+
+// writeProfile writes the config file at path with profile added under
+// name, keeping its other fields and profiles. The file may hold the client
+// secret, so only the user can read it.
+func writeProfile(path string, file, profiles map[string]json.RawMessage, name string, profile initProfile) error {
+	raw, err := json.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	profiles[name] = raw
+	if file["profiles"], err = json.Marshal(profiles); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0600)
+}
+
+// runAuth runs the auth command with the profile, as the user would,
+// returning its exit code.
+func runAuth(profile, path string, explicit bool) int {
+	executable, err := os.Executable()
+	if err != nil {
+		log.Printf("error: %s\n", err)
+		return 1
+	}
+	args := []string{"auth", "-profile", profile}
+	if explicit {
+		args = append(args, "-config", path)
+	}
+	cmd := exec.Command(executable, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		log.Printf("error: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// fileExists reports whether there's a file at path.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// firstNonEmpty returns the first of values that isn't empty.
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// contains reports whether list has s.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Init", func() {
+	var (
+		issuer string
+		dir    string
+	)
+
+	// start runs init in a fresh user config directory, answering its
+	// questions with answers.
+	start := func(answers string, args ...string) *gexec.Session {
+		command := exec.Command(cmdPath, append([]string{"init"}, args...)...)
+		command.Env = append(os.Environ(), "XDG_CONFIG_HOME="+dir)
+		command.Stdin = strings.NewReader(answers)
+		session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+		return session
+	}
+
+	readProfiles := func() map[string]map[string]interface{} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "oauth2-cli", "config.json"))
+		Expect(err).ToNot(HaveOccurred())
+		var config struct {
+			Port     int                               `json:"port"`
+			Profiles map[string]map[string]interface{} `json:"profiles"`
+		}
+		Expect(json.Unmarshal(data, &config)).To(Succeed())
+		return config.Profiles
+	}
+
+	BeforeEach(func() {
+		port, err := EphemeralPort()
+		Expect(err).ToNot(HaveOccurred())
+		issuer = fmt.Sprintf("http://127.0.0.1:%d", port)
+		command := exec.Command(cmdPath, "mock-server", "-serve-addr", fmt.Sprintf("127.0.0.1:%d", port))
+		session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+		Eventually(session.Err).Should(gbytes.Say("Serving a mock provider"))
+
+		dir, err = ioutil.TempDir("", "oauth2-cli-init")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		gexec.TerminateAndWait()
+		os.RemoveAll(dir)
+	})
+
+	It("should write a profile for an issuer, offering its scopes", func() {
+		session := start("work\n" + issuer + "\nmy-client\n\n\nn\n")
+		Eventually(session).Should(gexec.Exit(0))
+		Expect(session.Err).To(gbytes.Say("Discovered the auth URL " + regexp.QuoteMeta(issuer+"/authorize")))
+		Expect(session.Err).To(gbytes.Say("The provider supports the scopes: openid"))
+		Expect(session.Err).To(gbytes.Say(`Scopes, space separated \[openid\]`))
+
+		Expect(readProfiles()["work"]).To(Equal(map[string]interface{}{
+			"issuer":    issuer,
+			"client_id": "my-client",
+			"scopes":    "openid",
+			"pkce":      true,
+		}))
+	})
+
+	It("should keep the other profiles, and write a preset", func() {
+		Eventually(start("work\n" + issuer + "\nmy-client\n\n\nn\n")).Should(gexec.Exit(0))
+		session := start("gh\ngithub\ngh-client\ngh-secret\nrepo\nn\n")
+		Eventually(session).Should(gexec.Exit(0))
+
+		profiles := readProfiles()
+		Expect(profiles).To(HaveKey("work"))
+		Expect(profiles["gh"]).To(Equal(map[string]interface{}{
+			"provider":      "github",
+			"client_id":     "gh-client",
+			"client_secret": "gh-secret",
+			"scopes":        "repo",
+		}))
+	})
+
+	It("should ask for the endpoints without an issuer", func() {
+		session := start("manual\nnope\n\n" + issuer + "/authorize\n" + issuer + "/token\nmy-client\n\n\nn\n")
+		Eventually(session).Should(gexec.Exit(0))
+		Expect(session.Err).To(gbytes.Say(`Unknown provider "nope"`))
+
+		profile := readProfiles()["manual"]
+		Expect(profile["auth_url"]).To(Equal(issuer + "/authorize"))
+		Expect(profile["token_url"]).To(Equal(issuer + "/token"))
+		Expect(profile).ToNot(HaveKey("issuer"))
+	})
+
+	It("should run the first authorization with the profile", func() {
+		port, err := EphemeralPort()
+		Expect(err).ToNot(HaveOccurred())
+		// The callback port isn't asked for, so it's given in the config.
+		Expect(os.MkdirAll(filepath.Join(dir, "oauth2-cli"), 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "oauth2-cli", "config.json"), []byte(fmt.Sprintf(`{"port": %d}`, port)), 0600)).To(Succeed())
+
+		session := start("work\n"+issuer+"\nmy-client\n\nopenid email\n\n", "-profile", "work")
+		re := regexp.MustCompile(regexp.QuoteMeta(issuer+"/authorize") + `\?\S+`)
+		Eventually(func() []byte { return re.Find(session.Err.Contents()) }).ShouldNot(BeNil())
+
+		res, err := http.Get(string(re.Find(session.Err.Contents())))
+		Expect(err).ToNot(HaveOccurred())
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Eventually(session).Should(gexec.Exit(0))
+		Expect(session.Err).To(gbytes.Say("access_token"))
+		Expect(readProfiles()).To(HaveKey("work"))
+		Expect(ioutil.ReadFile(filepath.Join(dir, "oauth2-cli", "config.json"))).To(ContainSubstring(fmt.Sprintf(`"port": %d`, port)))
+	})
+
+	It("should fail when the answers run out", func() {
+		session := start("work\n")
+		Eventually(session).Should(gexec.Exit(1))
+		Expect(session.Err).To(gbytes.Say(`error: no answer to "Provider`))
+	})
+})
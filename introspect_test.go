@@ -0,0 +1,98 @@
+package main_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Introspection command", func() {
+	var (
+		args    []string
+		stdin   string
+		session *gexec.Session
+		server  *ghttp.Server
+	)
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		stdin = ""
+		args = []string{
+			"-id", "123",
+			"-secret", "abc",
+			"-introspect-url", server.URL() + "/oauth/introspect",
+		}
+	})
+
+	JustBeforeEach(func() {
+		command := exec.Command(cmdPath, args...)
+		command.Stdin = strings.NewReader(stdin)
+
+		var err error
+		session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		gexec.TerminateAndWait()
+		server.Close()
+	})
+
+	Context("with an active token", func() {
+		BeforeEach(func() {
+			args = append(args, "introspect", "-")
+			stdin = "sometoken\n"
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", "/oauth/introspect"),
+				ghttp.VerifyBasicAuth("123", "abc"),
+				ghttp.VerifyFormKV("token", "sometoken"),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+					"active":    true,
+					"scope":     "read",
+					"client_id": "123",
+				}),
+			))
+		})
+
+		It("should print the response", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			var response map[string]interface{}
+			Expect(json.Unmarshal(session.Out.Contents(), &response)).To(Succeed())
+			Expect(response).To(HaveKeyWithValue("scope", "read"))
+			Expect(session.Err).ToNot(gbytes.Say("warning"))
+		})
+	})
+
+	Context("with an inactive token", func() {
+		BeforeEach(func() {
+			args = append(args, "introspect", "oldtoken")
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyFormKV("token", "oldtoken"),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{"active": false}),
+			))
+		})
+
+		It("should warn", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say("warning: the token is not active"))
+		})
+	})
+
+	Context("without a token or cache", func() {
+		BeforeEach(func() {
+			args = append(args, "introspect")
+		})
+
+		It("should fail", func() {
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say("-introspect-token is a required flag"))
+		})
+	})
+})
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// keyringService is the service that -keyring entries are stored under.
+const keyringService = "oauth2-cli"
+
+// keyringCache is the prefix of the -cache path that -keyring sets, followed
+// by the client ID, so that the cache functions keep the token in the OS
+// credential store instead of a file.
+const keyringCache = "keyring:"
+
+// keyringTokenAccount returns the keyring account of the token in a
+// keyringCache path, under the profile if given, and whether path is one.
+func keyringTokenAccount(path, profile string) (string, bool) {
+	if !strings.HasPrefix(path, keyringCache) {
+		return "", false
+	}
+	account := "token/" + strings.TrimPrefix(path, keyringCache)
+	if profile != "" {
+		account += "/" + profile
+	}
+	return account, true
+}
+
+// keyringSecretAccount returns the keyring account of the client secret of
+// clientID.
+func keyringSecretAccount(clientID string) string {
+	return "client_secret/" + clientID
+}
+
+// readKeyringCache reads the token kept in the keyring account. As with
+// files, the error is os.ErrNotExist when there isn't one.
+func readKeyringCache(account string) (cacheEntry, error) {
+	data, err := keyringGetParts(account)
+	if err != nil {
+		return cacheEntry{}, err
+	}
+	entry := cacheEntry{}
+	err = json.Unmarshal([]byte(data), &entry)
+	if err == nil && entry.Token == nil {
+		err = os.ErrNotExist
+	}
+	return entry, err
+}
+
+// writeKeyringCache keeps the token in the keyring account, or removes it
+// if entry is nil.
+func writeKeyringCache(account string, entry *cacheEntry) error {
+	if entry == nil {
+		return keyringDeleteParts(account)
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return keyringSetParts(account, string(data))
+}
+
+// keyringPartsPrefix starts the value of an account whose secret is split
+// into parts, followed by their number.
+const keyringPartsPrefix = "oauth2-cli-parts:"
+
+// keyringPartAccount returns the account of part i, from 1, of a split
+// secret.
+func keyringPartAccount(account string, i int) string {
+	return fmt.Sprintf("%s#%d", account, i)
+}
+
+// splitKeyringSecret returns the values to keep secret in an account and
+// its parts when the keyring keeps at most max bytes in one, or secret on
+// its own if it fits or max is 0. The first value has the number of parts.
+func splitKeyringSecret(secret string, max int) []string {
+	if max == 0 || len(secret) <= max {
+		return []string{secret}
+	}
+	var parts []string
+	for len(secret) > max {
+		parts = append(parts, secret[:max])
+		secret = secret[max:]
+	}
+	parts = append(parts, secret)
+	return append([]string{keyringPartsPrefix + strconv.Itoa(len(parts))}, parts...)
+}
+
+// keyringParts returns the number of parts that value, that of an account,
+// says its secret is split into, or 0 if it's the secret itself.
+func keyringParts(value string) int {
+	if !strings.HasPrefix(value, keyringPartsPrefix) {
+		return 0
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(value, keyringPartsPrefix))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// keyringSetParts is keyringSet split across as many accounts as it takes
+// for the keyring to keep the secret, which a token with an id_token can be
+// too long for, removing the parts that a longer secret had.
+func keyringSetParts(account, secret string) error {
+	previous, _ := keyringGet(account)
+	values := splitKeyringSecret(secret, keyringMaxSecret)
+	for i, value := range values[1:] {
+		if err := keyringSet(keyringPartAccount(account, i+1), value); err != nil {
+			return err
+		}
+	}
+	if err := keyringSet(account, values[0]); err != nil {
+		return err
+	}
+	return deleteKeyringParts(account, len(values)-1, keyringParts(previous))
+}
+
+// keyringGetParts is keyringGet joining the parts of a split secret.
+func keyringGetParts(account string) (string, error) {
+	value, err := keyringGet(account)
+	n := keyringParts(value)
+	if err != nil || n == 0 {
+		return value, err
+	}
+	var b strings.Builder
+	for i := 1; i <= n; i++ {
+		part, err := keyringGet(keyringPartAccount(account, i))
+		if err != nil {
+			return "", fmt.Errorf("keyring: part %d of %d: %w", i, n, err)
+		}
+		b.WriteString(part)
+	}
+	return b.String(), nil
+}
+
+// keyringDeleteParts is keyringDelete with the parts of a split secret.
+func keyringDeleteParts(account string) error {
+	value, _ := keyringGet(account)
+	if err := deleteKeyringParts(account, 0, keyringParts(value)); err != nil {
+		return err
+	}
+	return keyringDelete(account)
+}
+
+// deleteKeyringParts deletes the parts of account after the first keep, up
+// to part n.
+func deleteKeyringParts(account string, keep, n int) error {
+	for i := keep + 1; i <= n; i++ {
+		if err := keyringDelete(keyringPartAccount(account, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
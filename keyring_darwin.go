@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// The macOS Keychain is used through security(1). Its exit status when the
+// item isn't found.
+const securityNotFound = 44
+
+// keyringMaxSecret is 0 as the Keychain keeps secrets of any length.
+const keyringMaxSecret = 0
+
+func keyringGet(account string) (string, error) {
+	out, err := security(nil, "find-generic-password", "-s", keyringService, "-a", account, "-w")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+func keyringSet(account, secret string) error {
+	// Given in security's interactive mode, the secret isn't in the
+	// arguments that other processes can see.
+	command := fmt.Sprintf("add-generic-password -U -s %s -a %s -w %s\n",
+		strconv.Quote(keyringService), strconv.Quote(account), strconv.Quote(secret))
+	_, err := security(strings.NewReader(command), "-i")
+	return err
+}
+
+func keyringDelete(account string) error {
+	_, err := security(nil, "delete-generic-password", "-s", keyringService, "-a", account)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func security(stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.Command("security", args...)
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		if exit.ExitCode() == securityNotFound {
+			return nil, os.ErrNotExist
+		}
+		return nil, fmt.Errorf("keychain: %s", strings.TrimSpace(stderr.String()))
+	}
+	return out, err
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("splitKeyringSecret", func() {
+	It("should keep a secret that fits as it is", func() {
+		Expect(splitKeyringSecret("secret", 6)).To(Equal([]string{"secret"}))
+		Expect(splitKeyringSecret(strings.Repeat("x", 5000), 0)).To(HaveLen(1))
+	})
+
+	It("should split a longer secret into parts that each fit", func() {
+		// A cache entry with an id_token can be more than the 2560 bytes
+		// that one credential keeps on Windows.
+		const max = 2560
+		secret := strings.Repeat("0123456789", 600)
+		values := splitKeyringSecret(secret, max)
+		Expect(values).To(HaveLen(4))
+		Expect(keyringParts(values[0])).To(Equal(3))
+		for _, value := range values {
+			Expect(len(value)).To(BeNumerically("<=", max))
+		}
+		Expect(strings.Join(values[1:], "")).To(Equal(secret))
+	})
+
+	It("should tell a secret from the number of its parts", func() {
+		Expect(keyringParts(`{"token":{}}`)).To(Equal(0))
+		Expect(keyringParts(keyringPartsPrefix + "x")).To(Equal(0))
+	})
+})
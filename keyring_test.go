@@ -0,0 +1,148 @@
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+	"github.com/onsi/gomega/ghttp"
+	"golang.org/x/oauth2"
+)
+
+var _ = Describe("Keyring", func() {
+	var (
+		args    []string
+		dir     string
+		session *gexec.Session
+		server  *ghttp.Server
+	)
+
+	// entry is the file that the fake secret-tool keeps an account in.
+	entry := func(account string) string {
+		return filepath.Join(dir, "keyring", account)
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "keyring")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.Mkdir(filepath.Join(dir, "keyring"), 0700)).To(Succeed())
+		script := fmt.Sprintf(`#!/bin/sh
+cmd=$1
+shift
+[ "$cmd" = store ] && shift
+file="%s/$(echo "$4" | tr / _)"
+case $cmd in
+store) cat > "$file" ;;
+lookup) [ -f "$file" ] || exit 1; cat "$file" ;;
+clear) rm -f "$file" ;;
+esac
+`, filepath.Join(dir, "keyring"))
+		Expect(ioutil.WriteFile(filepath.Join(dir, "secret-tool"), []byte(script), 0755)).To(Succeed())
+
+		server = ghttp.NewServer()
+		args = []string{
+			"-flow", "client_credentials",
+			"-token", server.URL() + "/oauth/token",
+			"-id", "123",
+			"-keyring",
+		}
+	})
+
+	JustBeforeEach(func() {
+		command := exec.Command(cmdPath, args...)
+		command.Env = append(os.Environ(), "PATH="+dir+":"+os.Getenv("PATH"), "HOME="+dir)
+		var err error
+		session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		gexec.TerminateAndWait()
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	Context("with a secret", func() {
+		BeforeEach(func() {
+			args = append(args, "-secret", "abc")
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyBasicAuth("123", "abc"),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "newtoken",
+					TokenType:   "Bearer",
+				}),
+			))
+		})
+
+		It("should keep the secret and the token in the keyring", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "newtoken"`))
+
+			secret, err := ioutil.ReadFile(entry("client_secret_123"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(secret)).To(Equal("abc"))
+			token, err := ioutil.ReadFile(entry("token_123"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(token)).To(ContainSubstring(`"access_token":"newtoken"`))
+		})
+	})
+
+	Context("with a secret in the keyring", func() {
+		BeforeEach(func() {
+			Expect(ioutil.WriteFile(entry("client_secret_123"), []byte("kept"), 0600)).To(Succeed())
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyBasicAuth("123", "kept"),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "newtoken",
+					TokenType:   "Bearer",
+				}),
+			))
+		})
+
+		It("should use it", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "newtoken"`))
+		})
+	})
+
+	Context("with a valid token in the keyring", func() {
+		BeforeEach(func() {
+			args = append(args, "-secret", "abc", "-profile", "work")
+			data, err := json.Marshal(oauth2.Token{
+				AccessToken: "cachedtoken",
+				TokenType:   "Bearer",
+				Expiry:      time.Now().Add(time.Hour),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ioutil.WriteFile(entry("token_123_work"), data, 0600)).To(Succeed())
+		})
+
+		It("should output it without running the flow", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "cachedtoken"`))
+			Expect(server.ReceivedRequests()).To(BeEmpty())
+			Expect(filepath.Join(dir, ".config")).ToNot(BeAnExistingFile())
+		})
+	})
+
+	Context("with -cache", func() {
+		BeforeEach(func() {
+			args = append(args, "-secret", "abc", "-cache", filepath.Join(dir, "token.json"))
+		})
+
+		It("should fail", func() {
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say("-cache and -keyring can't be used together"))
+		})
+	})
+})
@@ -0,0 +1,67 @@
+//go:build !darwin && !windows
+// +build !darwin,!windows
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Elsewhere, the keyring is the Secret Service, such as GNOME Keyring or
+// KWallet, used through libsecret's secret-tool(1).
+
+// keyringMaxSecret is 0 as the Secret Service keeps secrets of any length.
+const keyringMaxSecret = 0
+
+func keyringGet(account string) (string, error) {
+	out, err := secretTool(nil, "lookup", "service", keyringService, "account", account)
+	if err != nil {
+		return "", err
+	}
+	// secret-tool exits 1 without a message when there's no such secret.
+	if len(out) == 0 {
+		return "", os.ErrNotExist
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+func keyringSet(account, secret string) error {
+	// Read from stdin, the secret isn't in the arguments that other
+	// processes can see.
+	_, err := secretTool(strings.NewReader(secret), "store", "--label="+keyringService+" "+account,
+		"service", keyringService, "account", account)
+	return err
+}
+
+func keyringDelete(account string) error {
+	_, err := secretTool(nil, "clear", "service", keyringService, "account", account)
+	return err
+}
+
+func secretTool(stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.Command("secret-tool", args...)
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, errors.New("keyring: secret-tool isn't installed, it's in libsecret-tools or libsecret")
+	}
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("keyring: %s", msg)
+		}
+		if args[0] == "lookup" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("keyring: secret-tool %s failed: %s", args[0], err)
+	}
+	return out, err
+}
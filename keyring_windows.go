@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// On Windows, the keyring is the Credential Manager, with generic
+// credentials targeting oauth2-cli:<account>.
+var (
+	advapi32       = syscall.NewLazyDLL("advapi32.dll")
+	procCredRead   = advapi32.NewProc("CredReadW")
+	procCredWrite  = advapi32.NewProc("CredWriteW")
+	procCredDelete = advapi32.NewProc("CredDeleteW")
+	procCredFree   = advapi32.NewProc("CredFree")
+)
+
+const (
+	credTypeGeneric         = 1
+	credPersistLocalMachine = 2
+	// credMaxBlobSize is CRED_MAX_CREDENTIAL_BLOB_SIZE.
+	credMaxBlobSize = 5 * 512
+	// keyringMaxSecret is what one credential keeps, the rest of a longer
+	// secret going in more of them.
+	keyringMaxSecret = credMaxBlobSize
+	errorNotFound    = syscall.Errno(1168)
+)
+
+// credentialW is CREDENTIALW.
+type credentialW struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+func keyringTarget(account string) (*uint16, error) {
+	return syscall.UTF16PtrFromString(keyringService + ":" + account)
+}
+
+func keyringGet(account string) (string, error) {
+	target, err := keyringTarget(account)
+	if err != nil {
+		return "", err
+	}
+	var cred *credentialW
+	r, _, err := procCredRead.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred)))
+	if r == 0 {
+		return "", credError(err)
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+	if cred.CredentialBlobSize == 0 {
+		return "", nil
+	}
+	blob := (*[credMaxBlobSize]byte)(unsafe.Pointer(cred.CredentialBlob))[:cred.CredentialBlobSize:cred.CredentialBlobSize]
+	return string(blob), nil
+}
+
+func keyringSet(account, secret string) error {
+	if len(secret) > credMaxBlobSize {
+		return fmt.Errorf("keyring: %d bytes is more than the Credential Manager keeps", len(secret))
+	}
+	target, err := keyringTarget(account)
+	if err != nil {
+		return err
+	}
+	user, err := syscall.UTF16PtrFromString(account)
+	if err != nil {
+		return err
+	}
+	blob := []byte(secret)
+	cred := credentialW{
+		Type:               credTypeGeneric,
+		TargetName:         target,
+		CredentialBlobSize: uint32(len(blob)),
+		Persist:            credPersistLocalMachine,
+		UserName:           user,
+	}
+	if len(blob) > 0 {
+		cred.CredentialBlob = &blob[0]
+	}
+	if r, _, err := procCredWrite.Call(uintptr(unsafe.Pointer(&cred)), 0); r == 0 {
+		return credError(err)
+	}
+	return nil
+}
+
+func keyringDelete(account string) error {
+	target, err := keyringTarget(account)
+	if err != nil {
+		return err
+	}
+	if r, _, err := procCredDelete.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0); r == 0 {
+		if err = credError(err); !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func credError(err error) error {
+	if err == errorNotFound {
+		return os.ErrNotExist
+	}
+	return fmt.Errorf("keyring: %w", err)
+}
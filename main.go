@@ -2,200 +2,913 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
-	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
+	"runtime"
 	"strings"
-	"sync"
+	"syscall"
 
+	"github.com/geckoboard/oauth2-cli/pkg/oauth2cli"
 	"golang.org/x/oauth2"
 )
 
 const configDefaults = "/etc/oauth2-cli.json"
 
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// Exit codes for failures that scripts may want to tell apart.
+const (
+	// exitSilentAuth is used when prompt=none was requested but the provider
+	// needs the user to interact.
+	exitSilentAuth = 3
+	// exitCallbackTimeout is used when no callback arrived in -callback-wait,
+	// or the flow wasn't completed within -timeout.
+	exitCallbackTimeout = 4
+	// exitAuthorizationError is used when the provider redirected back with
+	// an error, such as access_denied.
+	exitAuthorizationError = 5
+	// exitInvalidState is used when the callback's state isn't the
+	// authorization's.
+	exitInvalidState = 6
+	// exitTokenError is used when the token endpoint answered with an error,
+	// such as invalid_grant or invalid_client.
+	exitTokenError = 7
+	// exitUnreachable is used when the provider couldn't be reached.
+	exitUnreachable = 8
+	// exitValidation is used when the callback or the token failed a check,
+	// such as of the id_token, the nonce or the required scopes.
+	exitValidation = 9
+)
+
+// flowRevoke revokes -revoke-token, flowIntrospect introspects
+// -introspect-token, flowDecode decodes the JWT argument of the decode
+// command and flowLogout ends the provider session of -id-token-hint,
+// instead of running a grant.
+const (
+	flowRevoke     = "revoke"
+	flowIntrospect = "introspect"
+	flowDecode     = "decode"
+	flowLogout     = "logout"
+)
+
+// grantTypes maps the token endpoint grant_type names to -flow values, so
+// that -grant refresh_token works as well as -grant refresh.
+var grantTypes = map[string]string{
+	"authorization_code":                              oauth2cli.FlowCode,
+	"urn:ietf:params:oauth:grant-type:device_code":    oauth2cli.FlowDevice,
+	"refresh_token":                                   oauth2cli.FlowRefresh,
+	"urn:ietf:params:oauth:grant-type:token-exchange": oauth2cli.FlowTokenExchange,
+}
+
+// config is the flow config plus the options of the command itself.
 type config struct {
-	Interface    string `json:"interface"`
-	Port         int    `json:"port"`
-	Callback     string `json:"callback"`
-	ClientID     string `json:"client_id"`
-	ClientSecret string `json:"client_secret"`
-	AuthURL      string `json:"auth_url"`
-	TokenURL     string `json:"token_url"`
-	CodeParam    string `json:"code_param"`
-	Scope        string `json:"scopes"`
-	OIDCNonce    bool   `json:"nonce"`
-	Verbose      bool   `json:"verbose"`
-}
-
-func loadConfig() config {
+	oauth2cli.Config
+	Format        string `json:"format"`
+	Template      string `json:"template"`
+	AWSTokenField string `json:"aws_token_field"`
+	Out           string `json:"out"`
+	// NoStdout never writes the token to stdout, for wrappers that only
+	// read Out.
+	NoStdout   bool   `json:"no_stdout"`
+	Exec       string `json:"exec"`
+	LogPrefix  string `json:"log_prefix"`
+	SecretFile string `json:"secret_file"`
+	IDFile     string `json:"id_file"`
+	// ScopeSeparator also splits the scopes on it, for comma separated lists
+	// such as read,write that would otherwise be sent as one scope.
+	ScopeSeparator string `json:"scope_separator"`
+	// SummaryOnly logs just the summary of the token, not its JSON.
+	SummaryOnly bool `json:"summary_only"`
+	// RefreshInterval keeps refreshing the token at least this often, and
+	// before it expires, outputting each one, until interrupted.
+	RefreshInterval oauth2cli.Duration `json:"refresh_interval"`
+	// IDTokenOnly asks for just an id_token, with response_type id_token,
+	// and outputs it without a token request.
+	IDTokenOnly bool `json:"id_token_only"`
+	// ErrorFormat is json to log a failed flow as an errorJSON.
+	ErrorFormat string `json:"error_format"`
+	// Clipboard is the token field copied to the clipboard, access_token or
+	// id_token.
+	Clipboard string `json:"clipboard"`
+	// RevokeToken and RevokeTokenType are the token revoked by -flow revoke.
+	RevokeToken     string `json:"revoke_token"`
+	RevokeTokenType string `json:"revoke_token_type"`
+	// IntrospectToken is the token introspected by -flow introspect.
+	IntrospectToken string `json:"introspect_token"`
+	// IDTokenHint is the id_token whose session -flow logout ends.
+	IDTokenHint string `json:"id_token_hint"`
+	// RevokeAfter revokes the issued tokens once they have been used.
+	RevokeAfter bool `json:"revoke_after"`
+	// Probe is an API URL requested with the token before -exec, with
+	// ProbeMethod and ProbeBody, to check that the token works.
+	Probe       string `json:"probe"`
+	ProbeMethod string `json:"probe_method"`
+	ProbeBody   string `json:"probe_body"`
+	// Cache is a file the token is kept in between runs, unless Force is
+	// set.
+	Cache string `json:"cache"`
+	Force bool   `json:"force"`
+	// Keyring keeps the token and the client secret in the OS credential
+	// store, instead of Cache and plaintext files.
+	Keyring bool `json:"keyring"`
+	// TokenFile is Cache encrypted with Passphrase, for where there's no
+	// keyring.
+	TokenFile  string `json:"token_file"`
+	Passphrase string `json:"passphrase"`
+	// Profile keys the token in Cache, so that one file holds the tokens of
+	// several clients or accounts.
+	Profile string `json:"profile"`
+	// Check compares the config with the issuer's discovery document
+	// instead of running a flow.
+	Check bool `json:"check"`
+	// PrintJWKS prints the keys that id_tokens are verified with instead of
+	// running a flow.
+	PrintJWKS bool `json:"print_jwks"`
+	// Provider is the name of an oauth2cli.Providers preset for the
+	// endpoints that aren't configured.
+	Provider string `json:"provider"`
+	// Quiet drops the log output but errors, so that the token is all
+	// there is.
+	Quiet bool `json:"quiet"`
+	// LogLevel is error, info or debug, setting Quiet and Verbose.
+	LogLevel string `json:"log_level"`
+	// ExecArgs is the command given after --, run without a shell like
+	// Exec, with the token in its environment.
+	ExecArgs oauth2cli.StringList `json:"exec_args"`
+	// ServeAddr is where the serve command serves the token, and where the
+	// proxy command takes the requests it forwards to Upstream.
+	ServeAddr string `json:"serve_addr"`
+	Upstream  string `json:"upstream"`
+	// AllowOrigins are the origins of the web pages that may read the token
+	// that serve serves. Requests from other origins are rejected.
+	AllowOrigins oauth2cli.StringList `json:"allow_origins"`
+	// MockClaims is a JSON object of claims that the mock-server command
+	// adds to the tokens it issues, which last MockExpiresIn.
+	MockClaims    string             `json:"mock_claims"`
+	MockExpiresIn oauth2cli.Duration `json:"mock_expires_in"`
+}
+
+// loadConfigs loads the config of each -profile when it's repeated, or else
+// just the one.
+func loadConfigs() ([]config, []string) {
+	profiles := flagValues(os.Args[1:], "profile")
+	if len(profiles) < 2 {
+		conf, args := loadConfig("")
+		return []config{conf}, args
+	}
+	var (
+		confs []config
+		args  []string
+	)
+	for i, profile := range profiles {
+		for _, other := range profiles[:i] {
+			if other == profile {
+				log.Fatalf("-profile %s is given twice\n", profile)
+			}
+		}
+		// The flags are bound to the config they're parsed into.
+		if i > 0 {
+			flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+			flag.CommandLine.Usage = usage
+		}
+		var conf config
+		conf, args = loadConfig(profile)
+		confs = append(confs, conf)
+	}
+	return confs, args
+}
+
+// loadConfig loads the config of profile, or of the -profile flag or
+// OAUTH2_CLI_PROFILE if it's empty.
+func loadConfig(profile string) (config, []string) {
 	conf := config{
-		Interface: "127.0.0.1",
-		Port:      8081,
-		Callback:  "/oauth/callback",
-		CodeParam: "code",
+		Config:          oauth2cli.DefaultConfig(),
+		Format:          formatJSON,
+		AWSTokenField:   "SessionToken",
+		RevokeTokenType: oauth2cli.HintAccessToken,
+		ServeAddr:       "127.0.0.1:8082",
 	}
+	conf.UserAgent = "oauth2-cli/" + version
+	conf.Open = isTerminal(os.Stdout)
 
-	defaultsFile, err := os.Open(configDefaults)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			log.Fatalf("failed to open %q: %s\n", configDefaults, err)
+	// Each config file overrides the last: the system file, the user's, then
+	// -config. The profile picks its settings from each, before the
+	// environment and flags override them.
+	paths := defaultConfigPaths()
+	path, explicit := configPath(os.Args[1:])
+	if explicit {
+		paths = append(paths, path)
+	}
+	if profile == "" {
+		var ok bool
+		if profile, ok = flagValue(os.Args[1:], "profile"); !ok {
+			profile = os.Getenv(envPrefix + "PROFILE")
 		}
+	}
+	for i, path := range paths {
+		if err := loadConfigFile(path, &conf, profile, explicit && i == len(paths)-1); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if err := loadEnv(&conf); err != nil {
+		log.Fatalln(err)
+	}
+
+	noOpen := defineFlags(&conf, path)
+	args, execArgs := splitExecArgs(os.Args[1:])
+	args, set := parseArgs(args)
+	// The last of a repeated -profile is the one parsed.
+	if set["profile"] {
+		conf.Profile = profile
+	}
+	if len(execArgs) > 0 {
+		conf.ExecArgs = execArgs
+	}
+	if conf.Exec != "" && len(conf.ExecArgs) > 0 {
+		log.Fatalln("-exec and a command after -- can't be combined")
+	}
+
+	if *noOpen {
+		conf.Open = false
+	}
+	if conf.LogPrefix != "" {
+		log.SetPrefix(conf.LogPrefix + " ")
+	}
+	switch conf.LogLevel {
+	case "":
+	case "error":
+		conf.Quiet, conf.Verbose = true, false
+	case "info":
+		conf.Quiet, conf.Verbose = false, false
+	case "debug":
+		conf.Quiet, conf.Verbose = false, true
+	default:
+		log.Fatalf("unknown -log-level %q, expected error, info or debug\n", conf.LogLevel)
+	}
+
+	if set["secret"] && set["secret-file"] {
+		log.Fatalln("-secret and -secret-file can't be used together")
+	}
+	if set["id"] && set["id-file"] {
+		log.Fatalln("-id and -id-file can't be used together")
+	}
+	if conf.Keyring && conf.Cache != "" {
+		log.Fatalln("-cache and -keyring can't be used together")
+	}
+	if conf.TokenFile != "" && (conf.Cache != "" || conf.Keyring) {
+		log.Fatalln("-token-file can't be used with -cache or -keyring")
+	}
+	if conf.NoStdout && conf.Out == "-" {
+		log.Fatalln("-no-stdout and -out - can't be used together")
+	}
+	if conf.RefreshInterval > 0 && conf.Loop != 0 {
+		log.Fatalln("-refresh-interval and -loop can't be used together")
+	}
+	if conf.RefreshInterval > 0 && len(conf.ExecArgs) > 0 {
+		log.Fatalln("-refresh-interval runs -exec with each token, not a command after --")
+	}
+	var err error
+	if conf.ClientSecret == "-" {
+		if conf.ClientSecret, err = readSecretFile("-"); err != nil {
+			log.Fatalf("failed to read -secret from stdin: %s\n", err)
+		}
+	}
+	if conf.SecretFile != "" {
+		if conf.ClientSecret, err = readSecretFile(conf.SecretFile); err != nil {
+			log.Fatalf("failed to read -secret-file: %s\n", err)
+		}
+	}
+	if conf.IDFile != "" {
+		if conf.ClientID, err = readSecretFile(conf.IDFile); err != nil {
+			log.Fatalf("failed to read -id-file: %s\n", err)
+		}
+	}
+
+	if conf.ScopeSeparator != "" {
+		conf.Scope = splitScopes(conf.Scope, conf.ScopeSeparator)
+	}
+
+	// Commands run their -flow. The revoke and introspect commands are -flow
+	// revoke and -flow introspect, with the token as their argument, as is
+	// the subject token of token-exchange.
+	if len(args) > 0 {
+		// Commands that don't run a flow, such as doctor, keep -flow.
+		if cmd, ok := subcommands[args[0]]; ok && cmd.flow != "" {
+			conf.Flow = cmd.flow
+		}
+		switch args[0] {
+		case flowRevoke:
+			conf.RevokeToken = commandToken(args, conf.RevokeToken)
+		case flowIntrospect:
+			conf.IntrospectToken = commandToken(args, conf.IntrospectToken)
+		case "token-exchange":
+			conf.SubjectToken = commandToken(args, conf.SubjectToken)
+		case flowLogout:
+			conf.IDTokenHint = commandToken(args, conf.IDTokenHint)
+		case "proxy":
+			if len(args) > 1 {
+				conf.Upstream = args[1]
+			}
+		case "mock-server":
+			// The mock provider is configured by its own flags, and the
+			// client ones it checks requests against.
+			return conf, args
+		case "init":
+			// The wizard asks for what's missing, defaulting to what's set.
+			return conf, args
+		case "resume":
+			conf.Resume = true
+			// The redirect URL or code to complete it with is read as if
+			// pasted.
+			if len(args) > 1 {
+				conf.Manual = true
+			}
+		}
+	}
+
+	if conf.Provider != "" {
+		if err := oauth2cli.ApplyProvider(conf.Provider, &conf.Config); err != nil {
+			log.Fatalf("error: %s\n", err)
+		}
+	}
+	if conf.Check {
+		required("issuer", conf.Issuer)
+		return conf, args
+	}
+	if conf.PrintJWKS {
+		if conf.JWKSURL == "" && conf.JWKSFile == "" {
+			required("issuer", conf.Issuer)
+		}
+		return conf, args
+	}
+	// doctor reports what's missing instead of requiring it.
+	if len(args) > 0 && args[0] == "doctor" {
+		if flow, ok := grantTypes[conf.Flow]; ok {
+			conf.Flow = flow
+		}
+		return conf, args
+	}
+	if flow, ok := grantTypes[conf.Flow]; ok {
+		conf.Flow = flow
+	}
+	if conf.Issuer != "" && missingEndpoint(conf) {
+		flow := oauth2cli.Flow{Config: conf.Config}
+		discovery, err := flow.Discover(context.Background())
+		if err != nil {
+			log.Fatalf("error: %s\n", err)
+		}
+		discovery.Apply(&conf.Config)
+	}
+
+	// Without a configured secret, the one kept in the keyring is used.
+	keyringSecret := false
+	if conf.Keyring && conf.ClientID != "" && conf.ClientSecret == "" {
+		secret, err := keyringGet(keyringSecretAccount(conf.ClientID))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("warning: failed to read the client secret from the keyring: %s\n", err)
+		}
+		conf.ClientSecret, keyringSecret = secret, secret != ""
+	}
+
+	if conf.IDTokenOnly {
+		switch {
+		case conf.Flow != oauth2cli.FlowCode:
+			log.Fatalf("-id-token-only can't be used with -flow %s\n", conf.Flow)
+		case !conf.OIDCNonce:
+			log.Fatalln("-id-token-only needs -oidc-nonce, as the id_token is only as good as its nonce")
+		case conf.ResponseType != "" && conf.ResponseType != "id_token":
+			log.Fatalln("-id-token-only and -response-type can't be used together")
+		}
+		conf.ResponseType, conf.DecodeIDToken = "id_token", true
+	}
+
+	switch conf.Flow {
+	case oauth2cli.FlowCode:
+		required("auth", conf.AuthURL)
+		if conf.PAR {
+			required("par-url", conf.PARURL)
+		}
+		if conf.RequestObject {
+			required("client-key", conf.ClientKey)
+		}
+		if strings.HasSuffix(conf.ResponseMode, "jwt") && conf.JWKSURL == "" && conf.JWKSFile == "" {
+			required("issuer", conf.Issuer)
+		}
+		if conf.Resume {
+			required("pending-file", conf.PendingFile)
+		}
+		// Public clients have no secret, and use PKCE instead. Without a
+		// token request, there's nothing to authenticate.
+		if !conf.PKCE && !conf.IDTokenOnly {
+			requiredSecret(&conf)
+		}
+	case oauth2cli.FlowDevice:
+		// Device flow clients are usually public, so have no secret.
+		required("device-auth", conf.DeviceAuthURL)
+	case oauth2cli.FlowClientCredentials:
+		requiredSecret(&conf)
+	case oauth2cli.FlowRefresh:
+		required("refresh-token", conf.RefreshToken)
+	case oauth2cli.FlowTokenExchange:
+		required("subject-token", conf.SubjectToken)
+	case flowRevoke:
+		required("revoke-url", conf.RevokeURL)
+		// Without a token, the cached one is revoked.
+		if conf.Cache == "" && conf.Profile == "" && !conf.Keyring && conf.TokenFile == "" {
+			required("revoke-token", conf.RevokeToken)
+		}
+	case flowIntrospect:
+		required("introspect-url", conf.IntrospectURL)
+		// Without a token, the cached access token is introspected.
+		if conf.Cache == "" && conf.Profile == "" && !conf.Keyring && conf.TokenFile == "" {
+			required("introspect-token", conf.IntrospectToken)
+		}
+	case flowLogout:
+		required("end-session-url", conf.EndSessionURL)
+	case flowDecode:
+		if conf.VerifyIDToken && conf.JWKSURL == "" && conf.JWKSFile == "" {
+			required("issuer", conf.Issuer)
+		}
+	default:
+		log.Fatalf("unknown -flow %q\n", conf.Flow)
+	}
+	if grant(conf.Flow) && !conf.IDTokenOnly {
+		required("token", conf.TokenURL)
+	}
+	if conf.Flow != flowDecode {
+		required("id", conf.ClientID)
+	}
+	if conf.RevokeAfter {
+		required("revoke-url", conf.RevokeURL)
+	}
+	if conf.Introspect {
+		required("introspect-url", conf.IntrospectURL)
+	}
+	if conf.Userinfo {
+		required("userinfo-url", conf.UserinfoURL)
+	}
+	if conf.VerifyIDToken && conf.JWKSURL == "" && conf.JWKSFile == "" && conf.Issuer == "" {
+		log.Fatalln("-verify-id-token needs -issuer, -jwks-url or -jwks-file")
+	}
+
+	if conf.Keyring && conf.ClientID != "" {
+		conf.Cache = keyringCache + conf.ClientID
+		// A secret given some other way is kept for the next run.
+		if conf.ClientSecret != "" && !keyringSecret {
+			if err := keyringSet(keyringSecretAccount(conf.ClientID), conf.ClientSecret); err != nil {
+				log.Printf("warning: failed to keep the client secret in the keyring: %s\n", err)
+			}
+		}
+	}
+	if conf.TokenFile != "" {
+		conf.Cache = conf.TokenFile
+		requiredPassphrase(&conf)
 	} else {
-		if err := json.NewDecoder(defaultsFile).Decode(&conf); err != nil {
-			log.Fatalf("failed to parse %q: %s", configDefaults, err)
+		// The passphrase is only for -token-file, -cache is plaintext.
+		conf.Passphrase = ""
+	}
+	if conf.Profile != "" && conf.Cache == "" {
+		if conf.Cache = defaultTokenStore(); conf.Cache == "" {
+			log.Fatalln("-profile needs -cache when there's no home directory")
 		}
 	}
 
+	if conf.SummaryOnly {
+		conf.Summary = true
+	}
+	if conf.ErrorFormat != "" && conf.ErrorFormat != errorFormatText && conf.ErrorFormat != errorFormatJSON {
+		log.Fatalf("unknown -error-format %q, expected text or json\n", conf.ErrorFormat)
+	}
+	if !validFormat(conf.Format) {
+		log.Fatalf("unknown -format %q\n", conf.Format)
+	}
+	if conf.Format == formatAWS && !validAWSTokenField(conf.AWSTokenField) {
+		log.Fatalf("unknown -aws-token-field %q, expected AccessKeyId, SecretAccessKey or SessionToken\n", conf.AWSTokenField)
+	}
+	if conf.Clipboard != "" {
+		// Normalizes a config file or environment value such as true.
+		if err := (&clipboardFlag{field: &conf.Clipboard}).Set(conf.Clipboard); err != nil {
+			log.Fatalf("invalid clipboard: %s\n", err)
+		}
+	}
+	if conf.Format == formatTemplate {
+		if conf.Template == "" {
+			log.Fatalln("-format template needs a -template")
+		}
+		if _, err := parseTemplate(conf.Template); err != nil {
+			log.Fatalf("error: %s\n", err)
+		}
+	}
+
+	return conf, args
+}
+
+// defineFlags defines the flags on flag.CommandLine, defaulting to conf and
+// parsing into it, and returns -no-open, which only turns -open off.
+func defineFlags(conf *config, path string) *bool {
+	// Already read by configPath, registered so that flag parsing accepts it.
+	flag.String("config", path, "Config file, loaded over "+configDefaults+" and oauth2-cli/config.json in the user config directory")
 	flag.StringVar(&conf.Interface, "interface", conf.Interface, "Listening interface")
-	flag.IntVar(&conf.Port, "port", conf.Port, "Listening port")
+	flag.IntVar(&conf.Port, "port", conf.Port, "Listening port, 0 to pick a free one")
 	flag.StringVar(&conf.Callback, "callback", conf.Callback, "Callback URL")
 	flag.StringVar(&conf.ClientID, "id", conf.ClientID, "Client ID")
-	flag.StringVar(&conf.ClientSecret, "secret", conf.ClientSecret, "Client Secret")
+	flag.StringVar(&conf.ClientSecret, "secret", conf.ClientSecret, "Client Secret, or - to read it from stdin (prompted for when omitted in a terminal)")
+	flag.StringVar(&conf.IDFile, "id-file", conf.IDFile, "File to read the client ID from, or - for stdin")
+	flag.StringVar(&conf.SecretFile, "secret-file", conf.SecretFile, "File to read the client secret from, or - for stdin")
+	flag.StringVar(&conf.AuthStyle, "auth-style", conf.AuthStyle, "How to send the client credentials to the token endpoint: auto, header (or basic), params (or post), none, private_key_jwt, tls_client_auth or self_signed_tls_client_auth")
+	flag.StringVar(&conf.AuthStyle, "client-auth", conf.AuthStyle, "Alias for -auth-style, which also takes private_key_jwt with -client-key")
+	flag.StringVar(&conf.ClientKey, "client-key", conf.ClientKey, "RSA or P-256 EC private key PEM file to sign the client_assertion of -client-auth private_key_jwt, and -request-object")
+	flag.StringVar(&conf.ClientKeyID, "client-key-id", conf.ClientKeyID, "Key ID (kid) of -client-key")
+	flag.StringVar(&conf.Flow, "flow", conf.Flow, "Grant flow: code, device, client_credentials, refresh or token_exchange, or revoke or introspect for -revoke-token or -introspect-token")
+	flag.StringVar(&conf.Flow, "grant", conf.Flow, "Alias for -flow")
+	flag.StringVar(&conf.Provider, "provider", conf.Provider, "Preset for the endpoints of a common provider: "+strings.Join(oauth2cli.ProviderNames(), ", "))
 	flag.StringVar(&conf.AuthURL, "auth", conf.AuthURL, "Provider auth URL")
-	flag.StringVar(&conf.TokenURL, "token", conf.AuthURL, "Provider token URL")
+	flag.StringVar(&conf.RefreshToken, "refresh-token", conf.RefreshToken, "Refresh token to exchange with -flow refresh")
+	flag.StringVar(&conf.PriorIDToken, "prior-id-token", conf.PriorIDToken, "id_token issued with -refresh-token, whose sub the refreshed id_token must have")
+	flag.StringVar(&conf.SubjectToken, "subject-token", conf.SubjectToken, "Token to exchange with -flow token_exchange")
+	flag.StringVar(&conf.SubjectTokenType, "subject-token-type", conf.SubjectTokenType, "Type of -subject-token, a URN or access_token, refresh_token, id_token, jwt, saml1 or saml2 (default access_token)")
+	flag.StringVar(&conf.ActorToken, "actor-token", conf.ActorToken, "Token of the party acting for the subject, for delegation with -flow token_exchange")
+	flag.StringVar(&conf.ActorTokenType, "actor-token-type", conf.ActorTokenType, "Type of -actor-token, as for -subject-token-type (default access_token)")
+	flag.StringVar(&conf.RequestedTokenType, "requested-token-type", conf.RequestedTokenType, "Type of token to ask for with -flow token_exchange, as for -subject-token-type")
+	flag.Var(&listFlag{list: &conf.Resources}, "resource", "Resource URI (RFC 8707) to request a token for, sent with the auth and token requests, can be repeated")
+	flag.StringVar(&conf.DeviceAuthURL, "device-auth", conf.DeviceAuthURL, "Provider device authorization URL")
+	flag.Var(&conf.DevicePollJitter, "device-poll-jitter", "Random extra wait of up to this long before each poll of the device flow, e.g. 2s")
+	flag.Var(&conf.DeviceMaxInterval, "device-max-interval", "Longest wait between polls of the device flow that slow_down backs off to, e.g. 30s")
+	flag.StringVar(&conf.TokenURL, "token", conf.TokenURL, "Provider token URL")
+	flag.StringVar(&conf.IntrospectURL, "introspect-url", conf.IntrospectURL, "Provider token introspection URL")
+	flag.BoolVar(&conf.Introspect, "introspect", conf.Introspect, "Log the introspection response for the access token")
+	flag.StringVar(&conf.UserinfoURL, "userinfo-url", conf.UserinfoURL, "OpenID Connect userinfo URL, discovered from -issuer by default")
+	flag.BoolVar(&conf.Userinfo, "userinfo", conf.Userinfo, "Log the userinfo claims for the access token")
+	flag.StringVar(&conf.PARURL, "par-url", conf.PARURL, "Pushed authorization request URL, discovered from -issuer by default")
+	flag.BoolVar(&conf.DPoP, "dpop", conf.DPoP, "Bind the token to an ephemeral key with DPoP proofs, also sent with -probe")
+	flag.BoolVar(&conf.PAR, "par", conf.PAR, "Push the authorization params to -par-url, for providers that require it")
+	flag.BoolVar(&conf.RequestObject, "request-object", conf.RequestObject, "Send the authorization params as a request object JWT signed with -client-key (RFC 9101), pushed with -par")
+	flag.StringVar(&conf.RevokeURL, "revoke-url", conf.RevokeURL, "Provider token revocation URL")
+	flag.StringVar(&conf.RevokeToken, "revoke-token", conf.RevokeToken, "Token to revoke with -flow revoke")
+	flag.StringVar(&conf.RevokeTokenType, "revoke-token-type", conf.RevokeTokenType, "Type of -revoke-token: access_token or refresh_token")
+	flag.StringVar(&conf.IntrospectToken, "introspect-token", conf.IntrospectToken, "Token to introspect with -flow introspect")
+	flag.StringVar(&conf.EndSessionURL, "end-session-url", conf.EndSessionURL, "OpenID Connect end session URL for -flow logout, discovered from -issuer by default")
+	flag.StringVar(&conf.IDTokenHint, "id-token-hint", conf.IDTokenHint, "id_token whose session to end with -flow logout")
+	flag.BoolVar(&conf.RevokeAfter, "revoke-after", conf.RevokeAfter, "Revoke the issued tokens before exiting")
 	flag.StringVar(&conf.CodeParam, "code", conf.CodeParam, "Query param to read code from")
-	flag.StringVar(&conf.Scope, "scope", conf.Scope, "oAuth scope to authorize")
+	flag.StringVar(&conf.StateParam, "state-param", conf.StateParam, "Query param to read the state from")
+	flag.Var(&listFlag{list: &conf.CallbackParams}, "callback-param", "Callback param, such as session_state, to include in the output, can be repeated")
+	flag.StringVar(&conf.Prompt, "prompt", conf.Prompt, "OpenID Connect prompt, such as none, login or consent")
+	flag.StringVar(&conf.MaxAge, "max-age", conf.MaxAge, "OpenID Connect max_age in seconds, the id_token auth_time is checked against")
+	flag.StringVar(&conf.LoginHint, "login-hint", conf.LoginHint, "OpenID Connect login_hint, such as the user's email address")
+	flag.StringVar(&conf.ACRValues, "acr-values", conf.ACRValues, "Space separated OpenID Connect acr_values, one of which the id_token acr is checked to be")
+	flag.StringVar(&conf.UILocales, "ui-locales", conf.UILocales, "Space separated OpenID Connect ui_locales")
+	flag.StringVar(&conf.ResponseType, "response-type", conf.ResponseType, "response_type, such as token or \"code id_token\" for the implicit and hybrid flows (default code)")
+	flag.StringVar(&conf.PreferIDToken, "prefer-id-token", conf.PreferIDToken, "Which id_token of the hybrid flow to check and output when the callback has one too: response or fragment (default response)")
+	flag.StringVar(&conf.Offline, "offline", conf.Offline, "How to ask for a refresh token: auto sends access_type=offline, or the offline_access scope when the -issuer lists it, on sends both and off neither")
+	flag.StringVar(&conf.ResponseMode, "response-mode", conf.ResponseMode, "response_mode auth param, such as form_post for the provider to post the code to the callback, or jwt for a JARM response verified against the JWKS")
+	flag.Var(&scopeFlag{scope: &conf.Scope}, "scope", "oAuth scope to authorize, can be repeated or space separated")
+	flag.StringVar(&conf.ScopeSeparator, "scope-separator", conf.ScopeSeparator, "Also split -scope on this, such as , to send read,write as two scopes (default just spaces)")
 	flag.BoolVar(&conf.OIDCNonce, "oidc-nonce", conf.OIDCNonce, "include and then validate the OIDC nonce param")
+	flag.BoolVar(&conf.IDTokenOnly, "id-token-only", conf.IDTokenOnly, "Ask for just an id_token, with response_type id_token and -oidc-nonce, and print its claims without a token request")
+	flag.BoolVar(&conf.PKCE, "pkce", conf.PKCE, "use PKCE (RFC 7636)")
+	flag.StringVar(&conf.PKCEMethod, "pkce-method", conf.PKCEMethod, "PKCE code challenge method: S256 or plain")
+	flag.BoolVar(&conf.Manual, "manual", conf.Manual, "read the pasted code or redirect URL from stdin instead of serving the callback")
+	flag.StringVar(&conf.PendingFile, "pending-file", conf.PendingFile, "File to keep the state and PKCE verifier of the authorization in until its callback arrives, for -resume")
+	flag.BoolVar(&conf.Resume, "resume", conf.Resume, "complete the authorization pending in -pending-file, such as after being interrupted, instead of starting one")
+	flag.Var(&loopFlag{loop: &conf.Loop}, "loop", "keep serving callbacks, printing each token, until interrupted or for -loop=N authorizations")
+	flag.StringVar(&conf.ServeAddr, "serve-addr", conf.ServeAddr, "Address the serve command serves GET /token on, and the proxy and mock-server commands listen on")
+	flag.StringVar(&conf.Upstream, "upstream", conf.Upstream, "API base URL that the proxy command forwards requests to")
+	flag.Var(&listFlag{list: &conf.AllowOrigins}, "allow-origin", "Origin of a web page, such as http://localhost:3000, allowed to read the token that serve serves, can be repeated")
+	flag.StringVar(&conf.MockClaims, "mock-claims", conf.MockClaims, `JSON object of claims that mock-server adds to its tokens and userinfo, e.g. '{"email":"dev@example.com"}'`)
+	flag.Var(&conf.MockExpiresIn, "mock-expires-in", "Lifetime of the access tokens that mock-server issues (default 1h)")
+	flag.BoolVar(&conf.Open, "open", conf.Open, "open the auth URL in the default browser (default true when stdout is a terminal)")
+	flag.BoolVar(&conf.QR, "qr", conf.QR, "Also show the auth URL as a QR code, to scan with a phone")
+	noOpen := flag.Bool("no-open", false, "don't open the auth URL in the browser, just print it")
+	flag.StringVar(&conf.Cache, "cache", conf.Cache, "File to keep the token in between runs, reused while valid and refreshed when expired")
+	flag.BoolVar(&conf.Keyring, "keyring", conf.Keyring, "Keep the token and client secret in the macOS Keychain, Windows Credential Manager or libsecret Secret Service instead of -cache")
+	flag.StringVar(&conf.TokenFile, "token-file", conf.TokenFile, "File to keep the token in like -cache, encrypted with a passphrase from OAUTH2_CLI_PASSPHRASE or prompted for")
+	flag.BoolVar(&conf.Force, "force", conf.Force, "ignore the -cache token and run the flow")
+	flag.StringVar(&conf.Profile, "profile", conf.Profile, "Name to keep the token under in -cache, which defaults to oauth2-cli/tokens.json in the user config directory, repeated to authorize several at once")
+	flag.StringVar(&conf.Out, "out", conf.Out, "File to write the token to, or - for stdout")
+	flag.BoolVar(&conf.NoStdout, "no-stdout", conf.NoStdout, "never write the token to stdout, such as with -quiet, only to -out")
 	flag.BoolVar(&conf.Verbose, "verbose", conf.Verbose, "enable verbose logging")
-	flag.Parse()
-
-	required("auth", conf.AuthURL)
-	required("token", conf.TokenURL)
-	required("id", conf.ClientID)
-	required("secret", conf.ClientSecret)
-
-	return conf
+	flag.BoolVar(&conf.NoRedact, "no-redact", conf.NoRedact, "Log secrets and tokens in verbose logging")
+	flag.BoolVar(&conf.NoRedact, "log-unsafe", conf.NoRedact, "Alias for -no-redact")
+	flag.StringVar(&conf.LogLevel, "log-level", conf.LogLevel, "error (as -quiet), info, or debug (as -verbose)")
+	flag.BoolVar(&conf.VerifyIDToken, "verify-id-token", conf.VerifyIDToken, "Verify the id_token signature and claims against the provider's JWKS")
+	flag.StringVar(&conf.JWKSURL, "jwks-url", conf.JWKSURL, "JWKS URL for -verify-id-token, discovered from -issuer by default")
+	flag.StringVar(&conf.JWKSFile, "jwks-file", conf.JWKSFile, "JWKS file for -verify-id-token, used instead of -jwks-url or discovery")
+	flag.StringVar(&conf.Issuer, "issuer", conf.Issuer, "OpenID Connect issuer URL, whose discovery document sets -auth and -token when they aren't given")
+	flag.BoolVar(&conf.Check, "check", conf.Check, "Check the endpoints against the -issuer discovery document and exit")
+	flag.BoolVar(&conf.PrintJWKS, "print-jwks", conf.PrintJWKS, "Print the kid, alg and use of each key of -jwks-file, -jwks-url or the -issuer JWKS and exit")
+	flag.BoolVar(&conf.DecodeIDToken, "decode-id-token", conf.DecodeIDToken, "Log the decoded id_token claims")
+	flag.StringVar(&conf.Format, "format", conf.Format, "Output format: json, token, header, env (or export), curl-config, aws-credential-process, kubeexec or template")
+	flag.Var(&clipboardFlag{field: &conf.Clipboard}, "clipboard", "Copy the access token to the clipboard, or the id_token with -clipboard=id_token")
+	flag.StringVar(&conf.ErrorFormat, "error-format", conf.ErrorFormat, "Format of the error a failed flow logs: text, or json for an object with its class and exit code")
+	flag.StringVar(&conf.Template, "template", conf.Template, "Go text/template for -format template, e.g. '{{.AccessToken}}'")
+	flag.BoolVar(&conf.Summary, "summary", conf.Summary, "log a summary of the token type, scopes, expiry and the tokens issued")
+	flag.BoolVar(&conf.SummaryOnly, "summary-only", conf.SummaryOnly, "log the summary instead of the JSON token")
+	flag.BoolVar(&conf.Quiet, "quiet", conf.Quiet, "don't log anything but errors, and print the JSON token to stdout")
+	flag.StringVar(&conf.AWSTokenField, "aws-token-field", conf.AWSTokenField, "aws-credential-process field to put the access token in")
+	flag.StringVar(&conf.SuccessTemplate, "success-template", conf.SuccessTemplate, "html/template file for the page shown in the browser once authorized")
+	flag.StringVar(&conf.ErrorTemplate, "error-template", conf.ErrorTemplate, "html/template file for the page shown in the browser when the provider returns an error")
+	flag.StringVar(&conf.ResultTemplate, "result-template", conf.ResultTemplate, "html/template file for both the page shown once authorized and, with .Error set, the one for a provider error, unless -success-template or -error-template is given")
+	flag.BoolVar(&conf.NoBrowserToken, "no-browser-token", conf.NoBrowserToken, "deprecated, the token is never written to the browser")
+	flag.BoolVar(&conf.Strict, "strict", conf.Strict, "treat validation warnings as errors")
+	flag.Var(&listFlag{list: &conf.TokenHeaders}, "token-header", "Extra 'Name: Value' header for requests to the provider, can be repeated")
+	flag.StringVar(&conf.TokenResponseMap, "token-response-map", conf.TokenResponseMap, "JSON object of token response fields to take from dotted paths in the response instead, such as '{\"access_token\": \"authed_user.access_token\"}'")
+	flag.StringVar(&conf.HeaderFile, "header-file", conf.HeaderFile, "File of 'Name: Value' headers to send to the token endpoint")
+	flag.StringVar(&conf.ScopeRequired, "scope-required", conf.ScopeRequired, "Space separated scopes the grant must include")
+	flag.BoolVar(&conf.Cookies, "cookies", conf.Cookies, "keep cookies set by the provider across requests")
+	flag.BoolVar(&conf.StrictParams, "strict-callback-params", conf.StrictParams, "fail on unexpected callback query params")
+	flag.StringVar(&conf.Probe, "probe", conf.Probe, "API URL to request with the token, logging the response")
+	flag.StringVar(&conf.ProbeMethod, "probe-method", conf.ProbeMethod, "HTTP method of the -probe request (default GET)")
+	flag.StringVar(&conf.ProbeBody, "probe-body", conf.ProbeBody, "Body of the -probe request, sent as JSON if it parses as JSON or as a form otherwise")
+	flag.StringVar(&conf.Exec, "exec", conf.Exec, "Command to run with the token in its environment")
+	flag.Var(&conf.RefreshInterval, "refresh-interval", "Keep refreshing the token this often, e.g. 15m, and before it expires, outputting each one and running -exec with it, until interrupted")
+	flag.StringVar(&conf.AllowHosts, "allow-token-host", conf.AllowHosts, "Comma separated token URL hosts allowed to differ from the auth URL host")
+	flag.BoolVar(&conf.TLS, "tls", conf.TLS, "Serve the callback over HTTPS with a self-signed certificate")
+	flag.StringVar(&conf.TLSCert, "tls-cert", conf.TLSCert, "Certificate file to serve the callback over HTTPS with")
+	flag.StringVar(&conf.TLSKey, "tls-key", conf.TLSKey, "Key file for -tls-cert")
+	flag.StringVar(&conf.Tunnel, "tunnel", conf.Tunnel, "Serve the callback through a public HTTPS tunnel, for providers that refuse loopback redirect URLs: ngrok, cloudflared, or a command with {addr} that prints the URL")
+	flag.BoolVar(&conf.TLS, "callback-tls", conf.TLS, "Alias for -tls")
+	flag.StringVar(&conf.TLSCert, "callback-cert", conf.TLSCert, "Alias for -tls-cert")
+	flag.StringVar(&conf.TLSKey, "callback-key", conf.TLSKey, "Alias for -tls-key")
+	flag.Var(&conf.Timeout, "timeout", "How long to allow for the whole flow, e.g. 2m (0 for no limit)")
+	flag.Var(&conf.CallbackWait, "callback-wait", "How long to wait for the browser callback, e.g. 2m (default forever)")
+	flag.IntVar(&conf.Retries, "retries", conf.Retries, "How many times to retry token requests after 5xx or 429 responses or network errors")
+	flag.Var(&conf.RetryBackoff, "retry-backoff", "How long to wait before the first retry, doubled for each one after, e.g. 1s (default 500ms)")
+	flag.Var(&conf.HTTPTimeout, "http-timeout", "Timeout for requests to the provider, e.g. 30s (default none)")
+	flag.StringVar(&conf.DecryptKey, "id-token-decrypt-key", conf.DecryptKey, "RSA private key PEM file for encrypted id_tokens and JARM responses")
+	flag.StringVar(&conf.RequestSpec, "export-request-spec", conf.RequestSpec, "File to write a JSON description of the requests to, for bug reports")
+	flag.StringVar(&conf.DebugOut, "debug-out", conf.DebugOut, "File to write the requests of the flow to, as HAR if it ends in .har or else as curl commands")
+	flag.Var(&listFlag{list: &conf.AuthParams}, "auth-param", "Extra key=value parameter for the auth URL, can be repeated")
+	flag.Var(&listFlag{list: &conf.TokenParams}, "token-param", "Extra key=value parameter for the token exchange, can be repeated")
+	flag.Var(&listFlag{list: &conf.RequireClaims}, "require-claim", "name=value the id_token claims must have, failing the flow otherwise, can be repeated")
+	flag.Var(&listFlag{list: &conf.Audiences}, "audience", "Audience to request a token for, can be repeated")
+	flag.Var(&conf.CallbackDelay, "callback-delay", "Delay before the token exchange, for testing timeouts")
+	flag.BoolVar(&conf.AcceptAnyPath, "accept-any-path", conf.AcceptAnyPath, "handle the callback on any path, not just the -callback path")
+	flag.StringVar(&conf.Proxy, "proxy", conf.Proxy, "http, https or socks5 proxy URL for requests to the provider (default from HTTPS_PROXY and HTTP_PROXY)")
+	flag.StringVar(&conf.ClientCert, "mtls-cert", conf.ClientCert, "Client certificate PEM file for mutual TLS with the provider")
+	flag.StringVar(&conf.ClientCertKey, "mtls-key", conf.ClientCertKey, "Key PEM file for -mtls-cert")
+	flag.StringVar(&conf.CACert, "ca-cert", conf.CACert, "PEM bundle of extra CAs to trust for requests to the provider")
+	flag.BoolVar(&conf.Insecure, "insecure", conf.Insecure, "skip TLS certificate verification for requests to the provider, for development only")
+	flag.BoolVar(&conf.Insecure, "insecure-skip-verify", conf.Insecure, "Alias for -insecure")
+	flag.Var(&listFlag{list: &conf.CertPins}, "pin-cert-sha256", "SHA-256 of the token endpoint certificate or public key to require, can be repeated")
+	flag.StringVar(&conf.UserAgent, "user-agent", conf.UserAgent, "User-Agent for requests to the provider")
+	flag.StringVar(&conf.LogPrefix, "log-prefix", conf.LogPrefix, "Prefix for every log line, e.g. a run ID")
+	return noOpen
 }
 
 func main() {
-	conf := loadConfig()
-
-	callbackURL, err := url.Parse(conf.Callback)
-	if err != nil {
-		log.Fatalln(err)
+	confs, args := loadConfigs()
+	if len(confs) > 1 {
+		os.Exit(authorizeProfiles(confs, args))
 	}
-	if callbackURL.Scheme == "" {
-		callbackURL.Scheme = "http"
+	conf := confs[0]
+	if conf.Check {
+		os.Exit(check(conf))
 	}
-	if callbackURL.Host == "" {
-		callbackURL.Host = fmt.Sprintf("%s:%d", conf.Interface, conf.Port)
+	if conf.PrintJWKS {
+		os.Exit(printJWKS(conf))
 	}
 
-	config := &oauth2.Config{
-		ClientID:     conf.ClientID,
-		ClientSecret: conf.ClientSecret,
-		Scopes:       []string{conf.Scope},
-		RedirectURL:  callbackURL.String(),
-		Endpoint: oauth2.Endpoint{
-			AuthURL:  conf.AuthURL,
-			TokenURL: conf.TokenURL,
+	flow := oauth2cli.Flow{
+		Config: conf.Config,
+		OnToken: func(token *oauth2.Token) error {
+			if _, err := emitToken(conf, token); err != nil {
+				return fmt.Errorf("failed to write token: %w", err)
+			}
+			if conf.Cache != "" {
+				if err := writeCache(conf, token); err != nil {
+					return fmt.Errorf("failed to write token cache: %w", err)
+				}
+			}
+			return nil
 		},
 	}
-
-	var nonce string
-	opts := []oauth2.AuthCodeOption{oauth2.AccessTypeOffline}
-	if conf.OIDCNonce {
-		nonce = randString()
-		opts = append(opts, oauth2.SetAuthURLParam("nonce", nonce))
+	if conf.Quiet {
+		flow.Logger = log.New(ioutil.Discard, "", 0)
 	}
-
-	state := randString()
-	visitURL := config.AuthCodeURL(state, opts...)
-	log.Printf("Visit this URL in your browser:\n%s\n\n", visitURL)
-
-	ctx := context.Background()
-	var wg sync.WaitGroup
-	wg.Add(1)
-
-	http.HandleFunc(callbackURL.Path, func(w http.ResponseWriter, r *http.Request) {
-		defer wg.Done()
-
-		if conf.Verbose {
-			log.Printf("Got callback: %s\n", r.URL.RequestURI())
-			http.DefaultTransport = loggingTransport{Transport: http.DefaultTransport}
+	command := ""
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch command {
+	case "", "auth", "device", "refresh", "token-exchange":
+	case "resume":
+		if len(args) > 1 {
+			flow.Input = strings.NewReader(args[1] + "\n")
+		}
+	case "serve":
+		os.Exit(serve(conf, flow))
+	case "mock-server":
+		os.Exit(mockServer(conf))
+	case "init":
+		os.Exit(initWizard(conf))
+	case "doctor":
+		os.Exit(doctor(conf, &flow))
+	case "proxy":
+		os.Exit(proxyCommand(conf, flow))
+	case "credential":
+		os.Exit(credential(conf, flow, args[1:]))
+	case flowRevoke, flowIntrospect, flowLogout:
+		// Set up as their -flow by loadConfig.
+	case flowDecode:
+		os.Exit(decode(conf, &flow, commandToken(args, "")))
+	default:
+		log.Fatalf("unknown command %q\n", command)
+	}
+	if conf.Flow == flowRevoke {
+		if conf.RevokeToken == "" {
+			os.Exit(revokeCached(conf, &flow))
+		}
+		if err := flow.Revoke(context.Background(), conf.RevokeToken, conf.RevokeTokenType); err != nil {
+			log.Fatalf("error: revocation failed: %s\n", err)
 		}
+		log.Printf("Revoked %s\n", conf.RevokeTokenType)
+		os.Exit(0)
+	}
 
-		query := r.URL.Query()
+	if conf.Flow == flowIntrospect {
+		os.Exit(introspect(conf, &flow))
+	}
+	if conf.Flow == flowLogout {
+		os.Exit(logout(conf, &flow))
+	}
 
-		if s := query.Get("state"); s != state {
-			http.Error(w, fmt.Sprintf("Invalid state: %s", s), http.StatusUnauthorized)
-			return
-		}
+	// Interrupting or terminating stops the callback server cleanly, ending
+	// -loop and -refresh-interval.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-		code := query.Get(conf.CodeParam)
-		token, err := config.Exchange(ctx, code)
+	// A cached token doesn't complete a pending authorization.
+	var token *oauth2.Token
+	ok := false
+	if conf.Cache != "" && !conf.Force && !conf.Resume {
+		token, ok = cachedToken(conf, flow)
+	}
+	if !ok {
+		var err error
+		token, err = flow.Authorize(ctx)
+		if err != nil && ctx.Err() != nil {
+			os.Exit(reportError(conf, errInterrupted))
+		}
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Exchange error: %s", err), http.StatusServiceUnavailable)
-			return
+			os.Exit(reportError(conf, err))
 		}
+	}
+	if conf.RefreshInterval > 0 {
+		os.Exit(refreshEvery(ctx, conf, flow, token))
+	}
+	exit(conf, &flow, token)
+}
 
-		if nonce != "" {
-			if err := checkNonce(nonce, token); err != nil {
-				http.Error(w, fmt.Sprintf("OIDC nonce error: %s", err), http.StatusUnauthorized)
-				return
+// exit requests -probe and runs the -exec command, or the one after --, with
+// the token, if there are any, revokes the token with -revoke-after, and
+// exits with the command's status.
+func exit(conf config, flow *oauth2cli.Flow, token *oauth2.Token) {
+	code := 0
+	if conf.Probe != "" {
+		if err := probe(context.Background(), conf, token, flow.DPoPKey); err != nil {
+			log.Printf("error: probe failed: %s\n", err)
+			code = 1
+		}
+	}
+	if conf.Exec != "" && code == 0 {
+		var err error
+		if code, err = runWithToken(conf.Exec, token); err != nil {
+			log.Printf("failed to run %q: %s\n", conf.Exec, err)
+			code = 1
+		}
+	}
+	if len(conf.ExecArgs) > 0 && code == 0 {
+		var err error
+		if code, err = execWithToken(conf.ExecArgs, token); err != nil {
+			log.Printf("failed to run %q: %s\n", conf.ExecArgs[0], err)
+			code = 1
+		}
+	}
+	if conf.RevokeAfter {
+		if err := revokeAll(flow, token); err != nil {
+			log.Printf("error: revocation failed: %s\n", err)
+			if code == 0 {
+				code = 1
 			}
 		}
+	}
+	os.Exit(code)
+}
 
-		tokenJSON, err := json.MarshalIndent(token, "", "  ")
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Token parse error: %s", err), http.StatusServiceUnavailable)
-			return
+// revokeAll revokes the access token and the refresh token, if there is one.
+func revokeAll(flow *oauth2cli.Flow, token *oauth2.Token) error {
+	if err := flow.Revoke(context.Background(), token.AccessToken, oauth2cli.HintAccessToken); err != nil {
+		return err
+	}
+	log.Printf("Revoked %s\n", oauth2cli.HintAccessToken)
+	if token.RefreshToken != "" {
+		if err := flow.Revoke(context.Background(), token.RefreshToken, oauth2cli.HintRefreshToken); err != nil {
+			return err
 		}
-
-		log.Printf("result:\n%s\n", tokenJSON)
-
-		_, _ = w.Write(tokenJSON)
-	})
-
-	server := http.Server{
-		Addr: fmt.Sprintf("%s:%d", conf.Interface, conf.Port),
+		log.Printf("Revoked %s\n", oauth2cli.HintRefreshToken)
 	}
+	return nil
+}
 
-	go func() {
-		if err := server.ListenAndServe(); err != http.ErrServerClosed {
-			log.Fatalln(err)
+// commandToken returns the token given as the argument of a command, read
+// from stdin for "-", or the flag's token if there is no argument.
+func commandToken(args []string, flagToken string) string {
+	token := ""
+	if len(args) > 1 {
+		token = args[1]
+	}
+	switch token {
+	case "":
+		return flagToken
+	case "-":
+		token, err := readSecretFile("-")
+		if err != nil {
+			log.Fatalf("failed to read the token from stdin: %s\n", err)
 		}
-	}()
-
-	wg.Wait()
-	if err := server.Shutdown(ctx); err != nil {
-		log.Fatalln(err)
+		return token
+	default:
+		return token
 	}
 }
 
-func checkNonce(nonce string, token *oauth2.Token) error {
-	idToken, ok := token.Extra("id_token").(string)
-	if !ok {
-		return fmt.Errorf("missing OIDC id_token")
+// introspect prints the introspection response for -introspect-token, or
+// the cached access token.
+func introspect(conf config, flow *oauth2cli.Flow) int {
+	token, hint := conf.IntrospectToken, ""
+	if token == "" {
+		cached, err := readCache(conf)
+		if err != nil {
+			log.Printf("error: no cached token to introspect: %s\n", err)
+			return 1
+		}
+		token, hint = cached.AccessToken, oauth2cli.HintAccessToken
 	}
-	splitToken := strings.SplitN(idToken, ".", 3)
-	log.Printf("%q", splitToken[1])
-	payload, err := base64.RawURLEncoding.DecodeString(splitToken[1])
+	response, err := flow.Introspect(context.Background(), token, hint)
 	if err != nil {
-		return fmt.Errorf("id_token payload decode: %w", err)
+		log.Printf("error: introspection failed: %s\n", err)
+		return 1
 	}
-	var decodeToken struct {
-		Nonce string
+	pretty, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		log.Printf("error: %s\n", err)
+		return 1
 	}
-	if err := json.Unmarshal(payload, &decodeToken); err != nil {
-		return fmt.Errorf("id_token payload decode: %w", err)
+	fmt.Printf("%s\n", pretty)
+	if active, _ := response["active"].(bool); !active {
+		log.Println("warning: the token is not active")
 	}
-	if decodeToken.Nonce != nonce {
-		return fmt.Errorf("%q != %q", decodeToken.Nonce, nonce)
+	return 0
+}
+
+// logout ends the session of -id-token-hint, or of the cached id_token which
+// is then removed from the cache, so that the next run logs in afresh.
+func logout(conf config, flow *oauth2cli.Flow) int {
+	idToken, cached := conf.IDTokenHint, false
+	if idToken == "" && (conf.Cache != "" || conf.Profile != "") {
+		token, err := readCache(conf)
+		if err != nil {
+			log.Printf("error: no cached token to log out: %s\n", err)
+			return 1
+		}
+		idToken, _ = token.Extra("id_token").(string)
+		cached = true
 	}
-	return nil
+	if err := flow.Logout(context.Background(), idToken); err != nil {
+		return reportError(conf, fmt.Errorf("logout failed: %w", err))
+	}
+	log.Println("Logged out")
+	if cached {
+		if err := eraseCache(conf); err != nil {
+			log.Printf("error: failed to erase the token cache: %s\n", err)
+			return 1
+		}
+	}
+	return 0
 }
 
-func randString() string {
-	buf := make([]byte, 32)
-	rand.Read(buf)
-	return base64.StdEncoding.EncodeToString(buf)
+// revokeCached revokes the tokens in -cache and removes them from it.
+func revokeCached(conf config, flow *oauth2cli.Flow) int {
+	token, err := readCache(conf)
+	if err != nil {
+		log.Printf("error: no cached token to revoke: %s\n", err)
+		return 1
+	}
+	if err := revokeAll(flow, token); err != nil {
+		log.Printf("error: revocation failed: %s\n", err)
+		return 1
+	}
+	if err := eraseCache(conf); err != nil {
+		log.Printf("error: failed to erase the token cache: %s\n", err)
+		return 1
+	}
+	return 0
 }
 
 func required(flag string, value string) {
@@ -203,3 +916,75 @@ func required(flag string, value string) {
 		log.Fatalf("-%s is a required flag\n", flag)
 	}
 }
+
+// requiredSecret prompts for the client secret when it isn't configured and
+// there's a terminal to type it in, and otherwise requires -secret, unless
+// the client authenticates without one.
+func requiredSecret(conf *config) {
+	switch conf.AuthStyle {
+	case oauth2cli.AuthNone:
+		return
+	case oauth2cli.AuthPrivateKeyJWT:
+		required("client-key", conf.ClientKey)
+		return
+	case oauth2cli.AuthTLSClient, oauth2cli.AuthSelfSignedTLS:
+		required("mtls-cert", conf.ClientCert)
+		return
+	}
+	if conf.ClientSecret == "" && isTerminal(os.Stdin) && runtime.GOOS != "windows" {
+		secret, err := readHidden("Client secret: ")
+		if err != nil && err != errNoTerminal {
+			log.Fatalf("failed to read the client secret: %s\n", err)
+		}
+		conf.ClientSecret = secret
+	}
+	required("secret", conf.ClientSecret)
+}
+
+// requiredPassphrase prompts for the -token-file passphrase when it isn't
+// set in OAUTH2_CLI_PASSPHRASE and there's a terminal to type it in.
+func requiredPassphrase(conf *config) {
+	if conf.Passphrase == "" && isTerminal(os.Stdin) && runtime.GOOS != "windows" {
+		passphrase, err := readHidden("Passphrase for " + conf.TokenFile + ": ")
+		if err != nil && err != errNoTerminal {
+			log.Fatalf("failed to read the passphrase: %s\n", err)
+		}
+		conf.Passphrase = passphrase
+	}
+	if conf.Passphrase == "" {
+		log.Fatalln("-token-file needs a passphrase, from OAUTH2_CLI_PASSPHRASE or typed in a terminal")
+	}
+}
+
+// grant reports whether flow gets a token from the token endpoint.
+func grant(flow string) bool {
+	switch flow {
+	case flowRevoke, flowIntrospect, flowDecode, flowLogout:
+		return false
+	}
+	return true
+}
+
+// missingEndpoint reports whether an endpoint that the flow needs isn't
+// configured, so should be discovered from -issuer.
+func missingEndpoint(conf config) bool {
+	switch {
+	case conf.TokenURL == "" && grant(conf.Flow):
+		return true
+	case conf.AuthURL == "" && conf.Flow == oauth2cli.FlowCode:
+		return true
+	case conf.DeviceAuthURL == "" && conf.Flow == oauth2cli.FlowDevice:
+		return true
+	case conf.RevokeURL == "" && (conf.Flow == flowRevoke || conf.RevokeAfter):
+		return true
+	case conf.IntrospectURL == "" && (conf.Introspect || conf.Flow == flowIntrospect):
+		return true
+	case conf.UserinfoURL == "" && conf.Userinfo:
+		return true
+	case conf.EndSessionURL == "" && conf.Flow == flowLogout:
+		return true
+	case conf.PARURL == "" && conf.PAR && conf.Flow == oauth2cli.FlowCode:
+		return true
+	}
+	return false
+}
@@ -1,16 +1,37 @@
 package main_test
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"strings"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
 	"github.com/onsi/gomega/gexec"
 	"github.com/onsi/gomega/ghttp"
 	"golang.org/x/oauth2"
@@ -32,9 +53,88 @@ func EphemeralPort() (int, error) {
 	return sock.Addr().(*net.TCPAddr).Port, nil
 }
 
+// FakeJWT builds an unsigned JWT carrying the given claims.
+func FakeJWT(claims map[string]interface{}) string {
+	payload, err := json.Marshal(claims)
+	Expect(err).ToNot(HaveOccurred())
+
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." + enc.EncodeToString(payload) + "."
+}
+
+// SignedJWT builds an RS256 JWT carrying the given claims.
+func SignedJWT(key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	payload, err := json.Marshal(claims)
+	Expect(err).ToNot(HaveOccurred())
+
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString([]byte(fmt.Sprintf(`{"alg":"RS256","kid":%q}`, kid))) + "." + enc.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	Expect(err).ToNot(HaveOccurred())
+	return signed + "." + enc.EncodeToString(signature)
+}
+
+// JWKS is a JWK set holding the RSA public key with the given kid.
+func JWKS(key *rsa.PublicKey, kid string) map[string]interface{} {
+	return map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": kid,
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	}
+}
+
+// EncryptJWE encrypts plaintext to a compact JWE using RSA-OAEP-256 and the
+// given A256GCM or A128CBC-HS256 content encryption.
+func EncryptJWE(plaintext string, key *rsa.PublicKey, enc string) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"alg":"RSA-OAEP-256","enc":%q}`, enc)))
+
+	var cek, iv, ciphertext, tag []byte
+	switch enc {
+	case "A256GCM":
+		cek, iv = make([]byte, 32), make([]byte, 12)
+		rand.Read(cek)
+		rand.Read(iv)
+		block, err := aes.NewCipher(cek)
+		Expect(err).ToNot(HaveOccurred())
+		gcm, err := cipher.NewGCM(block)
+		Expect(err).ToNot(HaveOccurred())
+		sealed := gcm.Seal(nil, iv, []byte(plaintext), []byte(header))
+		ciphertext, tag = sealed[:len(sealed)-16], sealed[len(sealed)-16:]
+	case "A128CBC-HS256":
+		cek, iv = make([]byte, 32), make([]byte, 16)
+		rand.Read(cek)
+		rand.Read(iv)
+		block, err := aes.NewCipher(cek[16:])
+		Expect(err).ToNot(HaveOccurred())
+		padding := 16 - len(plaintext)%16
+		padded := append([]byte(plaintext), bytes.Repeat([]byte{byte(padding)}, padding)...)
+		ciphertext = make([]byte, len(padded))
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+		mac := hmac.New(sha256.New, cek[:16])
+		mac.Write([]byte(header))
+		mac.Write(iv)
+		mac.Write(ciphertext)
+		binary.Write(mac, binary.BigEndian, uint64(len(header))*8)
+		tag = mac.Sum(nil)[:16]
+	default:
+		Fail("unsupported enc " + enc)
+	}
+
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, cek, nil)
+	Expect(err).ToNot(HaveOccurred())
+
+	enc64 := base64.RawURLEncoding.EncodeToString
+	return strings.Join([]string{header, enc64(encryptedKey), enc64(iv), enc64(ciphertext), enc64(tag)}, ".")
+}
+
 var _ = Describe("Main", func() {
 	var (
 		args    []string
+		env     []string
 		session *gexec.Session
 		server  *ghttp.Server
 		authURL *url.URL
@@ -42,6 +142,7 @@ var _ = Describe("Main", func() {
 
 	BeforeEach(func() {
 		args = []string{"-scope", "public"}
+		env = nil
 		server = ghttp.NewServer()
 	})
 
@@ -58,6 +159,7 @@ var _ = Describe("Main", func() {
 			"-secret", "abc",
 		}...)
 		command := exec.Command(cmdPath, args...)
+		command.Env = append(os.Environ(), env...)
 
 		session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
 		Expect(err).ToNot(HaveOccurred())
@@ -77,6 +179,39 @@ var _ = Describe("Main", func() {
 		gexec.TerminateAndWait()
 	})
 
+	// callback simulates the provider redirecting back to the CLI with the
+	// given query params added to the redirect_uri.
+	callback := func(params url.Values) (int, string) {
+		callbackURL, err := url.Parse(authURL.Query().Get("redirect_uri"))
+		Expect(err).ToNot(HaveOccurred())
+
+		query := callbackURL.Query()
+		for k, v := range params {
+			query[k] = v
+		}
+		callbackURL.RawQuery = query.Encode()
+
+		// The callback may be served with a self-signed certificate.
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+		resp, err := client.Get(callbackURL.String())
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		return resp.StatusCode, string(body)
+	}
+
+	// validCallback is the query of a successful authorization redirect.
+	validCallback := func(code string) url.Values {
+		return url.Values{
+			"code":  {code},
+			"state": {authURL.Query().Get("state")},
+		}
+	}
+
 	Describe("successful token exchange", func() {
 		const (
 			expectedToken = "mytoken"
@@ -110,13 +245,11 @@ var _ = Describe("Main", func() {
 			body, err := ioutil.ReadAll(resp.Body)
 			Expect(err).ToNot(HaveOccurred())
 			Expect(resp.StatusCode).To(Equal(http.StatusOK), "got body: %s", body)
-			Expect(string(body)).To(Equal(fmt.Sprintf(`{
-  "access_token": "%s",
-  "token_type": "Bearer",
-  "expiry": "0001-01-01T00:00:00Z"
-}`, expectedToken)))
+			Expect(string(body)).To(ContainSubstring("Authentication complete"))
+			Expect(string(body)).ToNot(ContainSubstring(expectedToken))
 
 			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(fmt.Sprintf(`"access_token": "%s"`, expectedToken)))
 		})
 	})
 
@@ -138,7 +271,7 @@ var _ = Describe("Main", func() {
 			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized), "got body: %s", body)
 			Expect(string(body)).To(Equal("Invalid state: tampered with\n"))
 
-			Eventually(session).Should(gexec.Exit(0))
+			Eventually(session).Should(gexec.Exit(6))
 		})
 	})
 
@@ -179,7 +312,147 @@ var _ = Describe("Main", func() {
 Response: bad things happened
 `))
 
+			Eventually(session).Should(gexec.Exit(7))
+		})
+	})
+
+	Describe("error format", func() {
+		BeforeEach(func() {
+			args = append(args, "-error-format", "json")
+		})
+
+		errorObject := func() map[string]interface{} {
+			var e map[string]interface{}
+			re := regexp.MustCompile(`(?m)^\{"error".*$`)
+			Expect(json.Unmarshal(re.Find(session.Err.Contents()), &e)).To(Succeed())
+			return e
+		}
+
+		It("should log a state mismatch as invalid_state", func() {
+			status, _ := callback(url.Values{"code": {"abc"}, "state": {"forged"}})
+			Expect(status).To(Equal(http.StatusUnauthorized))
+
+			Eventually(session).Should(gexec.Exit(6))
+			e := errorObject()
+			Expect(e["error"]).To(Equal("invalid_state"))
+			Expect(e["exit_code"]).To(BeEquivalentTo(6))
+			Expect(e["message"]).To(Equal("Invalid state: forged"))
+		})
+
+		Context("when the token endpoint rejects the code", func() {
+			BeforeEach(func() {
+				server.AppendHandlers(
+					ghttp.RespondWith(http.StatusBadRequest, `{"error":"invalid_grant","error_description":"Code expired"}`,
+						http.Header{"Content-Type": {"application/json"}}),
+					ghttp.RespondWith(http.StatusBadRequest, `{"error":"invalid_grant","error_description":"Code expired"}`,
+						http.Header{"Content-Type": {"application/json"}}),
+				)
+			})
+
+			It("should log the error response as a token_error", func() {
+				status, _ := callback(validCallback("abc"))
+				Expect(status).To(Equal(http.StatusServiceUnavailable))
+
+				Eventually(session).Should(gexec.Exit(7))
+				e := errorObject()
+				Expect(e["error"]).To(Equal("token_error"))
+				Expect(e["status"]).To(BeEquivalentTo(400))
+				Expect(e["error_code"]).To(Equal("invalid_grant"))
+				Expect(e["error_description"]).To(Equal("Code expired"))
+			})
+		})
+
+		Context("when the token endpoint is unreachable", func() {
+			BeforeEach(func() {
+				args = append(args, "-retries", "0")
+			})
+
+			It("should exit as unreachable", func() {
+				server.Close()
+				callback(validCallback("abc"))
+				Eventually(session).Should(gexec.Exit(8))
+				Expect(errorObject()["error"]).To(Equal("unreachable"))
+			})
+		})
+	})
+
+	Describe("token response map", func() {
+		var response map[string]interface{}
+
+		BeforeEach(func() {
+			args = append(args,
+				"-auth-style", "params",
+				"-token-response-map", `{"access_token": "authed_user.access_token", "token_type": "authed_user.token_type"}`,
+			)
+			response = map[string]interface{}{
+				"ok":           true,
+				"access_token": "xoxb-bot",
+				"token_type":   "bot",
+				"authed_user":  map[string]interface{}{"id": "U123", "access_token": "xoxp-user", "token_type": "user"},
+			}
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", "/oauth/token"),
+				func(w http.ResponseWriter, r *http.Request) {
+					ghttp.RespondWithJSONEncoded(http.StatusOK, response)(w, r)
+				},
+			))
+		})
+
+		It("should take the token from the mapped paths", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "xoxp-user"`))
+			Expect(session.Err).To(gbytes.Say(`"token_type": "user"`))
+		})
+
+		Context("when the paths aren't in the response", func() {
+			BeforeEach(func() {
+				response["authed_user"] = map[string]interface{}{"id": "U123"}
+			})
+
+			It("should keep the token at the top", func() {
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(session.Err).To(gbytes.Say(`"access_token": "xoxb-bot"`))
+			})
+		})
+
+		Context("when the response is an error despite the 200", func() {
+			BeforeEach(func() {
+				response = map[string]interface{}{"ok": false, "error": "invalid_code"}
+			})
+
+			It("should fail with the error", func() {
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusServiceUnavailable))
+				Expect(body).To(ContainSubstring("400 Bad Request"))
+				Expect(body).To(ContainSubstring(`"error":"invalid_code"`))
+
+				Eventually(session).Should(gexec.Exit(7))
+			})
+		})
+	})
+
+	Describe("form encoded token response", func() {
+		BeforeEach(func() {
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", "/oauth/token"),
+				ghttp.RespondWith(http.StatusOK, "access_token=gho_mytoken&scope=repo&token_type=bearer", http.Header{
+					"Content-Type": {"application/x-www-form-urlencoded; charset=utf-8"},
+				}),
+			))
+		})
+
+		It("should parse the token as GitHub's", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
 			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "gho_mytoken"`))
 		})
 	})
 
@@ -195,6 +468,19 @@ Response: bad things happened
 		})
 	})
 
+	Describe("repeated scope arguments", func() {
+		BeforeEach(func() {
+			args = []string{
+				"-scope", "public",
+				"-scope", "private",
+			}
+		})
+
+		It("should space separate them in auth URL", func() {
+			Expect(authURL.Query().Get("scope")).To(Equal("public private"))
+		})
+	})
+
 	Describe("comma separated scope argument", func() {
 		BeforeEach(func() {
 			args = []string{
@@ -206,4 +492,2979 @@ Response: bad things happened
 			Expect(authURL.Query().Get("scope")).To(Equal("public,private"))
 		})
 	})
+
+	Describe("token summary", func() {
+		BeforeEach(func() {
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token":  "mytoken",
+				"token_type":    "Bearer",
+				"refresh_token": "myrefresh",
+				"expires_in":    3600,
+			}))
+		})
+
+		It("should log it alongside the JSON", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`Token summary:\s+type:\s+Bearer\s+scopes:\s+public \(requested, none were in the response\)\s+expires:\s+\S+, in 1h\s+refresh token: yes\s+id_token:\s+no`))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "mytoken"`))
+		})
+
+		Context("with -summary-only", func() {
+			BeforeEach(func() {
+				args = append(args, "-summary-only")
+			})
+
+			It("should leave out the JSON", func() {
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(session.Err).To(gbytes.Say("Token summary:"))
+				Expect(session.Err.Contents()).ToNot(ContainSubstring("mytoken"))
+				Expect(session.Out.Contents()).To(BeEmpty())
+			})
+		})
+
+		Context("with -summary=false", func() {
+			BeforeEach(func() {
+				args = append(args, "-summary=false")
+			})
+
+			It("should only log the JSON", func() {
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(session.Err).To(gbytes.Say(`"access_token": "mytoken"`))
+				Expect(session.Err.Contents()).ToNot(ContainSubstring("Token summary"))
+			})
+		})
+	})
+
+	Describe("curl-config format", func() {
+		BeforeEach(func() {
+			args = append(args, "-format", "curl-config")
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+				AccessToken: "mytoken",
+				TokenType:   "bearer",
+			}))
+		})
+
+		It("should output a curl config with the bearer header", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+			Eventually(session).Should(gexec.Exit(0))
+
+			re := regexp.MustCompile(`(?m)^header = "(.*)"$`)
+			match := re.FindSubmatch(session.Out.Contents())
+			Expect(match).ToNot(BeNil(), "got stdout: %s", session.Out.Contents())
+			Expect(string(match[1])).To(Equal("Authorization: Bearer mytoken"))
+		})
+	})
+
+	Describe("template format", func() {
+		BeforeEach(func() {
+			args = append(args, "-format", "template", "-template", `{{.TokenType}} {{.AccessToken}} {{.Claims.email}} {{.Extra "scope"}} {{json .Claims.groups}} {{if .RefreshToken}}refresh{{end}}`)
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token": "mytoken",
+				"token_type":   "Bearer",
+				"scope":        "public",
+				"id_token":     FakeJWT(map[string]interface{}{"email": "me@example.com", "groups": []string{"a", "b"}}),
+			}))
+		})
+
+		It("should execute the template with the token", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(string(session.Out.Contents())).To(Equal(`Bearer mytoken me@example.com public ["a","b"] `))
+		})
+	})
+
+	Describe("token format", func() {
+		BeforeEach(func() {
+			args = append(args, "-format", "token")
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+				AccessToken: "mytoken",
+				TokenType:   "Bearer",
+			}))
+		})
+
+		It("should output only the access token", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(string(session.Out.Contents())).To(Equal("mytoken\n"))
+		})
+	})
+
+	Describe("header format", func() {
+		BeforeEach(func() {
+			args = append(args, "-format", "header")
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+				AccessToken: "mytoken",
+				TokenType:   "bearer",
+			}))
+		})
+
+		It("should output the Authorization header", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(string(session.Out.Contents())).To(Equal("Authorization: Bearer mytoken\n"))
+		})
+	})
+
+	Describe("kubeexec format", func() {
+		BeforeEach(func() {
+			args = append(args, "-format", "kubeexec")
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token": "mytoken",
+				"token_type":   "Bearer",
+				"id_token":     "header.payload.signature",
+				"expires_in":   3600,
+			}))
+		})
+
+		It("should output an ExecCredential with the id_token", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+			Eventually(session).Should(gexec.Exit(0))
+
+			var cred struct {
+				APIVersion string `json:"apiVersion"`
+				Kind       string `json:"kind"`
+				Status     struct {
+					Token               string    `json:"token"`
+					ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+				} `json:"status"`
+			}
+			Expect(json.Unmarshal(session.Out.Contents(), &cred)).To(Succeed())
+			Expect(cred.APIVersion).To(Equal("client.authentication.k8s.io/v1"))
+			Expect(cred.Kind).To(Equal("ExecCredential"))
+			Expect(cred.Status.Token).To(Equal("header.payload.signature"))
+			Expect(cred.Status.ExpirationTimestamp).To(BeTemporally("~", time.Now().Add(time.Hour), time.Minute))
+		})
+	})
+
+	Describe("env format", func() {
+		BeforeEach(func() {
+			args = append(args, "-format", "env")
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token":  "mytoken",
+				"token_type":    "Bearer",
+				"refresh_token": "it's-refresh",
+				"expires_in":    3600,
+			}))
+		})
+
+		It("should output shell exports", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(session.Out).To(gbytes.Say(`export ACCESS_TOKEN='mytoken'\n`))
+			Expect(session.Out).To(gbytes.Say(`export REFRESH_TOKEN='it'\\''s-refresh'\n`))
+			Expect(session.Out).To(gbytes.Say(`export TOKEN_EXPIRY='\d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ'\n`))
+		})
+	})
+
+	Describe("no browser token", func() {
+		BeforeEach(func() {
+			args = append(args, "-no-browser-token")
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+				AccessToken: "mytoken",
+				TokenType:   "Bearer",
+			}))
+		})
+
+		It("should not write the token to the browser", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+			Expect(body).ToNot(ContainSubstring("mytoken"))
+			Expect(body).To(ContainSubstring("Authentication complete"))
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(string(session.Err.Contents())).To(ContainSubstring("mytoken"))
+		})
+	})
+
+	Describe("id_token authorized party", func() {
+		BeforeEach(func() {
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token": "mytoken",
+				"token_type":   "Bearer",
+				"id_token":     FakeJWT(map[string]interface{}{"azp": "someone-else"}),
+			}))
+		})
+
+		It("should warn on mismatch", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(string(session.Err.Contents())).To(ContainSubstring(`warning: OIDC azp: "someone-else" != "123"`))
+		})
+
+		Context("in strict mode", func() {
+			BeforeEach(func() {
+				args = append(args, "-strict")
+			})
+
+			It("should fail on mismatch", func() {
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusUnauthorized), "got body: %s", body)
+				Expect(body).To(Equal(`OIDC azp error: "someone-else" != "123"` + "\n"))
+				Expect(body).ToNot(ContainSubstring("mytoken"))
+
+				Eventually(session).Should(gexec.Exit(9))
+			})
+		})
+	})
+
+	Describe("required claims", func() {
+		BeforeEach(func() {
+			args = append(args, "-require-claim", "email=someone@example.com", "-require-claim", "groups=admins")
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token": "mytoken",
+				"token_type":   "Bearer",
+				"id_token": FakeJWT(map[string]interface{}{
+					"email":  "someone@example.com",
+					"groups": []string{"users"},
+				}),
+			}))
+		})
+
+		It("should fail with each claim that doesn't match", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusForbidden), "got body: %s", body)
+			Expect(body).To(ContainSubstring(`groups: got ["users"], want "admins"`))
+			Expect(body).ToNot(ContainSubstring("email"))
+
+			Eventually(session).Should(gexec.Exit(9))
+			Expect(session.Err).To(gbytes.Say(`id_token claims don't match`))
+		})
+	})
+
+	Describe("header file", func() {
+		var headerFile string
+
+		BeforeEach(func() {
+			f, err := ioutil.TempFile("", "headers")
+			Expect(err).ToNot(HaveOccurred())
+			headerFile = f.Name()
+
+			_, err = f.WriteString("# extra headers\n\nAccept: application/json\nX-Tenant:  acme \n")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(f.Close()).To(Succeed())
+
+			args = append(args, "-header-file", headerFile)
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", "/oauth/token"),
+				ghttp.VerifyHeaderKV("Accept", "application/json"),
+				ghttp.VerifyHeaderKV("X-Tenant", "acme"),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "mytoken",
+					TokenType:   "Bearer",
+				}),
+			))
+		})
+
+		AfterEach(func() {
+			os.Remove(headerFile)
+		})
+
+		It("should send the headers on the exchange request", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+			Eventually(session).Should(gexec.Exit(0))
+		})
+	})
+
+	Describe("token headers", func() {
+		BeforeEach(func() {
+			args = append(args, "-token-header", "Accept: application/json", "-token-header", "X-Tenant: acme")
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", "/oauth/token"),
+				ghttp.VerifyHeaderKV("Accept", "application/json"),
+				ghttp.VerifyHeaderKV("X-Tenant", "acme"),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "mytoken",
+					TokenType:   "Bearer",
+				}),
+			))
+		})
+
+		It("should send the headers on the exchange request", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+			Eventually(session).Should(gexec.Exit(0))
+		})
+	})
+
+	Describe("required scopes", func() {
+		BeforeEach(func() {
+			args = append(args, "-scope-required", "read write")
+		})
+
+		Context("when a required scope is not granted", func() {
+			BeforeEach(func() {
+				server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+					"access_token": "mytoken",
+					"token_type":   "Bearer",
+					"scope":        "read",
+				}))
+			})
+
+			It("should fail", func() {
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusForbidden), "got body: %s", body)
+				Expect(body).To(Equal("Missing required scopes: write\n"))
+
+				Eventually(session).Should(gexec.Exit(9))
+			})
+		})
+
+		Context("when all required scopes are granted in the access token", func() {
+			BeforeEach(func() {
+				server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+					"access_token": FakeJWT(map[string]interface{}{"scp": []string{"read", "write", "admin"}}),
+					"token_type":   "Bearer",
+				}))
+			})
+
+			It("should succeed", func() {
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+				Eventually(session).Should(gexec.Exit(0))
+			})
+		})
+	})
+
+	Describe("cookies", func() {
+		BeforeEach(func() {
+			args = append(args, "-cookies", "-verbose")
+			server.AppendHandlers(
+				// The first client auth style fails and sets a cookie that the
+				// retry with the other style should send back.
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("POST", "/oauth/token"),
+					ghttp.RespondWith(http.StatusBadRequest, "try again", http.Header{
+						"Set-Cookie": {"affinity=node-1; Path=/"},
+					}),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("POST", "/oauth/token"),
+					ghttp.VerifyHeaderKV("Cookie", "affinity=node-1"),
+					ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+						AccessToken: "mytoken",
+						TokenType:   "Bearer",
+					}),
+				),
+			)
+		})
+
+		It("should keep cookies across requests", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`cookie received: affinity`))
+		})
+	})
+
+	Describe("unexpected callback params", func() {
+		BeforeEach(func() {
+			args = append(args, "-verbose")
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+				AccessToken: "mytoken",
+				TokenType:   "Bearer",
+			}))
+		})
+
+		It("should warn", func() {
+			params := validCallback("mycode")
+			params.Set("utm_source", "email")
+			status, body := callback(params)
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say("warning: unexpected callback params: utm_source"))
+		})
+
+		Context("in strict mode", func() {
+			BeforeEach(func() {
+				args = append(args, "-strict-callback-params")
+			})
+
+			It("should fail", func() {
+				params := validCallback("mycode")
+				params.Set("utm_source", "email")
+				status, body := callback(params)
+				Expect(status).To(Equal(http.StatusBadRequest), "got body: %s", body)
+				Expect(body).To(Equal("Unexpected callback params: utm_source\n"))
+
+				Eventually(session).Should(gexec.Exit(1))
+			})
+		})
+	})
+
+	Describe("callback params", func() {
+		BeforeEach(func() {
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token": "mytoken",
+				"token_type":   "Bearer",
+				"scope":        "public",
+			}))
+		})
+
+		Context("with -state-param", func() {
+			BeforeEach(func() {
+				args = append(args, "-state-param", "st")
+			})
+
+			It("should read the state from it", func() {
+				status, body := callback(url.Values{"code": {"mycode"}, "st": {authURL.Query().Get("state")}})
+				Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(session.Err).To(gbytes.Say(`"access_token": "mytoken"`))
+			})
+
+			It("should ignore the standard state param", func() {
+				status, _ := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusUnauthorized))
+
+				Eventually(session).Should(gexec.Exit(6))
+			})
+		})
+
+		Context("with -callback-param", func() {
+			BeforeEach(func() {
+				args = append(args,
+					"-callback-param", "session_state",
+					"-format", "template",
+					"-template", `{{.AccessToken}} {{.CallbackParams.session_state}} {{.Extra "scope"}}`,
+				)
+			})
+
+			It("should include them in the output", func() {
+				params := validCallback("mycode")
+				params.Set("session_state", "abc.123")
+				status, body := callback(params)
+				Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(session.Out).To(gbytes.Say("mytoken abc.123 public"))
+			})
+
+			Context("in JSON", func() {
+				BeforeEach(func() {
+					args = append(args, "-format", "json")
+				})
+
+				It("should add callback_params", func() {
+					params := validCallback("mycode")
+					params.Set("session_state", "abc.123")
+					status, body := callback(params)
+					Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+					Eventually(session).Should(gexec.Exit(0))
+					Expect(session.Err).To(gbytes.Say(`"callback_params": {\s+"session_state": "abc.123"`))
+				})
+			})
+		})
+
+		Context("with an iss param", func() {
+			BeforeEach(func() {
+				args = append(args, "-issuer", "https://issuer.example")
+			})
+
+			It("should accept the configured issuer", func() {
+				params := validCallback("mycode")
+				params.Set("iss", "https://issuer.example")
+				status, body := callback(params)
+				Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+				Eventually(session).Should(gexec.Exit(0))
+			})
+
+			It("should reject another issuer", func() {
+				params := validCallback("mycode")
+				params.Set("iss", "https://attacker.example")
+				status, body := callback(params)
+				Expect(status).To(Equal(http.StatusUnauthorized))
+				Expect(body).To(Equal("Invalid issuer: https://attacker.example, expected https://issuer.example\n"))
+
+				Eventually(session).Should(gexec.Exit(9))
+				Expect(server.ReceivedRequests()).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("refresh token expiry", func() {
+		BeforeEach(func() {
+			args = append(args, "-verbose")
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token":             "mytoken",
+				"token_type":               "Bearer",
+				"refresh_token":            "myrefresh",
+				"refresh_token_expires_in": 7200,
+			}))
+		})
+
+		It("should report when the refresh token expires", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+			Eventually(session).Should(gexec.Exit(0))
+
+			match := regexp.MustCompile(`refresh token expires at (\S+)`).FindSubmatch(session.Err.Contents())
+			Expect(match).ToNot(BeNil())
+			expiry, err := time.Parse(time.RFC3339, string(match[1]))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(expiry).To(BeTemporally("~", time.Now().Add(2*time.Hour), time.Minute))
+		})
+	})
+
+	Describe("silent authentication", func() {
+		It("should exit with a dedicated code when login is required", func() {
+			status, body := callback(url.Values{
+				"error":             {"login_required"},
+				"error_description": {"no session"},
+				"state":             {authURL.Query().Get("state")},
+			})
+			Expect(status).To(Equal(http.StatusUnauthorized), "got body: %s", body)
+			Expect(body).To(ContainSubstring("<code>login_required</code>: no session"))
+
+			Eventually(session).Should(gexec.Exit(3))
+			Expect(session.Err).To(gbytes.Say("Silent authentication not possible: login_required"))
+		})
+	})
+
+	Describe("authorization error", func() {
+		It("should report the error instead of exchanging a missing code", func() {
+			status, body := callback(url.Values{
+				"error":             {"access_denied"},
+				"error_description": {"The user denied consent"},
+				"error_uri":         {"https://provider.example/errors/access_denied"},
+				"state":             {authURL.Query().Get("state")},
+			})
+			Expect(status).To(Equal(http.StatusUnauthorized), "got body: %s", body)
+			Expect(body).To(ContainSubstring("<h1>Authentication failed</h1>"))
+			Expect(body).To(ContainSubstring("<code>access_denied</code>: The user denied consent"))
+			Expect(body).To(ContainSubstring(`<a href="https://provider.example/errors/access_denied">`))
+
+			Eventually(session).Should(gexec.Exit(5))
+			Expect(session.Err).To(gbytes.Say(`Authorization error: access_denied: The user denied consent \(https://provider.example/errors/access_denied\)`))
+			Expect(server.ReceivedRequests()).To(BeEmpty())
+		})
+
+		It("should escape the provider's error", func() {
+			status, body := callback(url.Values{
+				"error":             {"<script>"},
+				"error_description": {"<b>bold</b>"},
+				"error_uri":         {"javascript:alert(1)"},
+				"state":             {authURL.Query().Get("state")},
+			})
+			Expect(status).To(Equal(http.StatusUnauthorized), "got body: %s", body)
+			Expect(body).ToNot(ContainSubstring("<script>"))
+			Expect(body).ToNot(ContainSubstring("<b>"))
+			Expect(body).ToNot(ContainSubstring(`href="javascript:`))
+		})
+	})
+
+	Describe("exec", func() {
+		BeforeEach(func() {
+			args = append(args, "-exec", `echo "token is $ACCESS_TOKEN"; exit 7`)
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+				AccessToken: "mytoken",
+				TokenType:   "Bearer",
+			}))
+		})
+
+		It("should run the command with the token in its environment", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+			Eventually(session).Should(gexec.Exit(7))
+			Expect(session.Out).To(gbytes.Say("token is mytoken"))
+		})
+	})
+
+	Describe("aws-credential-process format", func() {
+		BeforeEach(func() {
+			args = append(args, "-format", "aws-credential-process")
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token": "mytoken",
+				"token_type":   "Bearer",
+				"expires_in":   3600,
+			}))
+		})
+
+		var creds map[string]interface{}
+
+		JustBeforeEach(func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+			Eventually(session).Should(gexec.Exit(0))
+
+			creds = nil
+			Expect(json.Unmarshal(session.Out.Contents(), &creds)).To(Succeed())
+			Expect(creds).To(HaveKeyWithValue("Version", BeEquivalentTo(1)))
+			Expect(creds).To(HaveKey("AccessKeyId"))
+			Expect(creds).To(HaveKey("SecretAccessKey"))
+
+			expiration, err := time.Parse(time.RFC3339, creds["Expiration"].(string))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(expiration).To(BeTemporally("~", time.Now().Add(time.Hour), time.Minute))
+		})
+
+		It("should put the token in the session token", func() {
+			Expect(creds).To(HaveKeyWithValue("SessionToken", "mytoken"))
+		})
+
+		Context("with the token mapped to another field", func() {
+			BeforeEach(func() {
+				args = append(args, "-aws-token-field", "SecretAccessKey")
+			})
+
+			It("should put the token in that field", func() {
+				Expect(creds).To(HaveKeyWithValue("SecretAccessKey", "mytoken"))
+				Expect(creds).ToNot(HaveKey("SessionToken"))
+			})
+		})
+	})
+
+	Describe("encrypted id_token", func() {
+		var (
+			key     *rsa.PrivateKey
+			keyFile string
+		)
+
+		BeforeEach(func() {
+			var err error
+			key, err = rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+
+			f, err := ioutil.TempFile("", "decrypt-key")
+			Expect(err).ToNot(HaveOccurred())
+			keyFile = f.Name()
+			Expect(pem.Encode(f, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})).To(Succeed())
+			Expect(f.Close()).To(Succeed())
+
+			args = append(args, "-oidc-nonce")
+		})
+
+		AfterEach(func() {
+			os.Remove(keyFile)
+		})
+
+		respondWithJWE := func(enc string) {
+			idToken := FakeJWT(map[string]interface{}{"nonce": authURL.Query().Get("nonce")})
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token": "mytoken",
+				"token_type":   "Bearer",
+				"id_token":     EncryptJWE(idToken, &key.PublicKey, enc),
+			}))
+		}
+
+		Context("with a decryption key", func() {
+			BeforeEach(func() {
+				args = append(args, "-id-token-decrypt-key", keyFile)
+			})
+
+			for _, enc := range []string{"A256GCM", "A128CBC-HS256"} {
+				enc := enc
+				It("should validate the nonce of the decrypted "+enc+" id_token", func() {
+					respondWithJWE(enc)
+					status, body := callback(validCallback("mycode"))
+					Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+					Eventually(session).Should(gexec.Exit(0))
+				})
+			}
+		})
+
+		Context("without a decryption key", func() {
+			It("should fail clearly", func() {
+				respondWithJWE("A256GCM")
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusUnauthorized), "got body: %s", body)
+				Expect(body).To(ContainSubstring("encrypted id_token, key required"))
+
+				Eventually(session).Should(gexec.Exit(9))
+			})
+		})
+	})
+
+	Describe("request spec export", func() {
+		var specFile string
+
+		BeforeEach(func() {
+			dir, err := ioutil.TempDir("", "spec")
+			Expect(err).ToNot(HaveOccurred())
+			specFile = dir + "/spec.json"
+			args = append(args, "-export-request-spec", specFile)
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(filepath.Dir(specFile))
+		})
+
+		It("should describe the authorization and token requests", func() {
+			var spec struct {
+				Authorization struct {
+					URL    string
+					Params map[string]string
+				} `json:"authorization_request"`
+				Token struct {
+					Params map[string]string
+				} `json:"token_request"`
+			}
+			data, err := ioutil.ReadFile(specFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(json.Unmarshal(data, &spec)).To(Succeed())
+
+			Expect(spec.Authorization.URL).To(Equal(server.URL() + "/oauth/authorize"))
+			Expect(spec.Authorization.Params).To(HaveKeyWithValue("client_id", "123"))
+			Expect(spec.Authorization.Params).To(HaveKeyWithValue("scope", "public"))
+			Expect(spec.Authorization.Params).To(HaveKeyWithValue("response_type", "code"))
+			Expect(spec.Token.Params).To(HaveKeyWithValue("grant_type", "authorization_code"))
+			Expect(spec.Token.Params).To(HaveKeyWithValue("client_secret", "***"))
+			Expect(string(data)).ToNot(ContainSubstring("abc"))
+		})
+	})
+
+	Describe("debug output", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "debug")
+			Expect(err).ToNot(HaveOccurred())
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+				AccessToken:  "mytoken",
+				TokenType:    "Bearer",
+				RefreshToken: "myrefresh",
+			}))
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		Context("to a HAR file", func() {
+			BeforeEach(func() {
+				args = append(args, "-debug-out", dir+"/flow.har")
+			})
+
+			It("should record the auth URL, callback and token request, redacted", func() {
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+				Eventually(session).Should(gexec.Exit(0))
+
+				var har struct {
+					Log struct {
+						Version string
+						Entries []struct {
+							Request struct {
+								Method   string
+								URL      string
+								PostData struct{ Text string }
+							}
+							Response struct {
+								Status  int
+								Content struct{ Text string }
+							}
+							Comment string
+						}
+					}
+				}
+				data, err := ioutil.ReadFile(dir + "/flow.har")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(json.Unmarshal(data, &har)).To(Succeed())
+				Expect(har.Log.Version).To(Equal("1.2"))
+
+				entries := har.Log.Entries
+				Expect(entries).To(HaveLen(3))
+				Expect(entries[0].Comment).To(Equal("opened in the browser"))
+				Expect(entries[0].Request.URL).To(HavePrefix(server.URL() + "/oauth/authorize?"))
+				Expect(entries[1].Request.Method).To(Equal("POST"))
+				Expect(entries[1].Request.URL).To(Equal(server.URL() + "/oauth/token"))
+				Expect(entries[1].Request.PostData.Text).To(ContainSubstring("grant_type=authorization_code"))
+				Expect(entries[1].Response.Status).To(Equal(http.StatusOK))
+				Expect(entries[1].Response.Content.Text).To(ContainSubstring("access_token"))
+				Expect(entries[2].Comment).To(Equal("callback from the browser"))
+				Expect(entries[2].Request.URL).To(ContainSubstring("/oauth/callback?"))
+				Expect(entries[2].Response.Status).To(Equal(http.StatusOK))
+
+				Expect(string(data)).ToNot(ContainSubstring("mycode"))
+				Expect(string(data)).ToNot(ContainSubstring("mytoken"))
+				Expect(string(data)).ToNot(ContainSubstring("myrefresh"))
+			})
+		})
+
+		Context("to a curl file", func() {
+			BeforeEach(func() {
+				args = append(args, "-debug-out", dir+"/flow.sh")
+			})
+
+			It("should write the token request as a curl command", func() {
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+				Eventually(session).Should(gexec.Exit(0))
+
+				data, err := ioutil.ReadFile(dir + "/flow.sh")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(data)).To(ContainSubstring("# Opened in the browser:\n# " + server.URL() + "/oauth/authorize?"))
+				Expect(string(data)).To(ContainSubstring("curl -X POST '" + server.URL() + "/oauth/token'"))
+				Expect(string(data)).To(MatchRegexp(`--data-raw '[^']*grant_type=authorization_code`))
+				Expect(string(data)).ToNot(ContainSubstring("mycode"))
+			})
+		})
+	})
+
+	Describe("audiences", func() {
+		BeforeEach(func() {
+			args = append(args, "-audience", "https://api.example.com", "-audience", "https://other.example.com")
+		})
+
+		It("should space separate them in the auth URL", func() {
+			Expect(authURL.Query().Get("audience")).To(Equal("https://api.example.com https://other.example.com"))
+		})
+	})
+
+	Describe("callback delay", func() {
+		BeforeEach(func() {
+			args = append(args, "-callback-delay", "500ms")
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+				AccessToken: "mytoken",
+				TokenType:   "Bearer",
+			}))
+		})
+
+		It("should delay the exchange", func() {
+			start := time.Now()
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+			Expect(time.Since(start)).To(BeNumerically(">=", 500*time.Millisecond))
+
+			Eventually(session).Should(gexec.Exit(0))
+		})
+
+		Context("longer than -timeout", func() {
+			BeforeEach(func() {
+				args = append(args, "-callback-delay", "1m", "-timeout", "1s")
+			})
+
+			It("should stop waiting at the timeout", func() {
+				start := time.Now()
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusServiceUnavailable), "got body: %s", body)
+				Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+
+				Eventually(session).Should(gexec.Exit(4))
+				Expect(server.ReceivedRequests()).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("accept any path", func() {
+		BeforeEach(func() {
+			args = append(args, "-accept-any-path")
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+				AccessToken: "mytoken",
+				TokenType:   "Bearer",
+			}))
+		})
+
+		It("should handle the callback on an unexpected path", func() {
+			callbackURL, err := url.Parse(authURL.Query().Get("redirect_uri"))
+			Expect(err).ToNot(HaveOccurred())
+
+			resp, err := http.Get(callbackURL.ResolveReference(&url.URL{Path: "/favicon.ico"}).String())
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+
+			callbackURL.Path = "/callback"
+			callbackURL.RawQuery = validCallback("mycode").Encode()
+			resp, err = http.Get(callbackURL.String())
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say("Got callback on /callback instead of /oauth/callback"))
+		})
+	})
+
+	Describe("certificate pinning", func() {
+		var (
+			certFile string
+			certSum  [32]byte
+		)
+
+		BeforeEach(func() {
+			server.Close()
+			server = ghttp.NewTLSServer()
+			server.AllowUnhandledRequests = true
+
+			cert := server.HTTPTestServer.Certificate()
+			certSum = sha256.Sum256(cert.Raw)
+
+			// Trust the test server the usual way so that only the pin is
+			// being tested.
+			f, err := ioutil.TempFile("", "cert")
+			Expect(err).ToNot(HaveOccurred())
+			certFile = f.Name()
+			Expect(pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})).To(Succeed())
+			Expect(f.Close()).To(Succeed())
+			env = append(env, "SSL_CERT_FILE="+certFile)
+		})
+
+		AfterEach(func() {
+			os.Remove(certFile)
+		})
+
+		Context("with a matching pin", func() {
+			BeforeEach(func() {
+				args = append(args, "-pin-cert-sha256", hex.EncodeToString(certSum[:]))
+				server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "mytoken",
+					TokenType:   "Bearer",
+				}))
+			})
+
+			It("should allow the connection", func() {
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+				Eventually(session).Should(gexec.Exit(0))
+			})
+		})
+
+		Context("with a mismatched pin", func() {
+			BeforeEach(func() {
+				args = append(args, "-pin-cert-sha256", strings.Repeat("ab", 32))
+			})
+
+			It("should block the connection", func() {
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusServiceUnavailable), "got body: %s", body)
+				Expect(body).To(ContainSubstring("does not match any pin"))
+				Expect(server.ReceivedRequests()).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("private CA", func() {
+		var certFile string
+
+		BeforeEach(func() {
+			server.Close()
+			server = ghttp.NewTLSServer()
+			server.AllowUnhandledRequests = true
+
+			f, err := ioutil.TempFile("", "ca")
+			Expect(err).ToNot(HaveOccurred())
+			certFile = f.Name()
+			cert := server.HTTPTestServer.Certificate()
+			Expect(pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})).To(Succeed())
+			Expect(f.Close()).To(Succeed())
+		})
+
+		AfterEach(func() {
+			os.Remove(certFile)
+		})
+
+		respond := func() {
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+				AccessToken: "mytoken",
+				TokenType:   "Bearer",
+			}))
+		}
+
+		It("should fail the exchange when the CA isn't trusted", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusServiceUnavailable), "got body: %s", body)
+			Expect(body).To(ContainSubstring("x509"))
+		})
+
+		Context("with -ca-cert", func() {
+			BeforeEach(func() {
+				args = append(args, "-ca-cert", certFile)
+				respond()
+			})
+
+			It("should trust the CA", func() {
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+				Eventually(session).Should(gexec.Exit(0))
+			})
+		})
+
+		Context("with -insecure", func() {
+			BeforeEach(func() {
+				args = append(args, "-insecure")
+				respond()
+			})
+
+			It("should skip verification with a warning", func() {
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(session.Err).To(gbytes.Say("warning: TLS certificate verification is disabled"))
+			})
+		})
+
+		Context("with -insecure-skip-verify", func() {
+			BeforeEach(func() {
+				args = append(args, "-insecure-skip-verify")
+				respond()
+			})
+
+			It("should skip verification like -insecure", func() {
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+				Eventually(session).Should(gexec.Exit(0))
+			})
+		})
+	})
+
+	Describe("introspection", func() {
+		respond := func(response map[string]interface{}) {
+			server.AppendHandlers(
+				ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "mytoken",
+					TokenType:   "Bearer",
+				}),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("POST", "/oauth/introspect"),
+					ghttp.VerifyBasicAuth("123", "abc"),
+					ghttp.VerifyFormKV("token", "mytoken"),
+					ghttp.RespondWithJSONEncoded(http.StatusOK, response),
+				),
+			)
+		}
+
+		BeforeEach(func() {
+			args = append(args, "-introspect", "-introspect-url", server.URL()+"/oauth/introspect")
+		})
+
+		It("should log the introspection response", func() {
+			respond(map[string]interface{}{"active": true, "sub": "someone"})
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`introspection:`))
+			Expect(session.Err).To(gbytes.Say(`"sub": "someone"`))
+			Expect(server.ReceivedRequests()).To(HaveLen(2))
+		})
+
+		It("should only warn about an inactive token", func() {
+			respond(map[string]interface{}{"active": false})
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say("warning: the introspection endpoint reports the token as not active"))
+		})
+	})
+
+	Describe("userinfo", func() {
+		BeforeEach(func() {
+			args = append(args, "-userinfo", "-userinfo-url", server.URL()+"/oauth/userinfo")
+			server.AppendHandlers(
+				ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "mytoken",
+					TokenType:   "Bearer",
+				}),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/oauth/userinfo"),
+					ghttp.VerifyHeaderKV("Authorization", "Bearer mytoken"),
+					ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+						"sub":   "someone",
+						"email": "someone@example.com",
+					}),
+				),
+			)
+		})
+
+		It("should log the userinfo claims for the access token", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`userinfo:`))
+			Expect(session.Err).To(gbytes.Say(`"email": "someone@example.com"`))
+			Expect(server.ReceivedRequests()).To(HaveLen(2))
+		})
+	})
+
+	Describe("authentication params", func() {
+		BeforeEach(func() {
+			args = append(args,
+				"-prompt", "login",
+				"-max-age", "0",
+				"-login-hint", "someone@example.com",
+				"-acr-values", "mfa",
+				"-ui-locales", "fr",
+				"-strict",
+			)
+		})
+
+		It("should send them with the auth URL", func() {
+			query := authURL.Query()
+			Expect(query.Get("prompt")).To(Equal("login"))
+			Expect(query.Get("max_age")).To(Equal("0"))
+			Expect(query.Get("login_hint")).To(Equal("someone@example.com"))
+			Expect(query.Get("acr_values")).To(Equal("mfa"))
+			Expect(query.Get("ui_locales")).To(Equal("fr"))
+		})
+
+		It("should reject a token without an id_token to check with -strict", func() {
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+				AccessToken: "mytoken",
+				TokenType:   "Bearer",
+			}))
+			status, _ := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusUnauthorized))
+			Eventually(session).Should(gexec.Exit(9))
+			Expect(session.Err).To(gbytes.Say(`OIDC authentication error`))
+		})
+	})
+
+	Describe("resource indicators", func() {
+		BeforeEach(func() {
+			args = append(args, "-resource", "https://api-a.example/", "-resource", "https://api-b.example/")
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyFormKV("resource", "https://api-a.example/", "https://api-b.example/"),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "mytoken",
+					TokenType:   "Bearer",
+				}),
+			))
+		})
+
+		It("should send each resource with the auth and token requests", func() {
+			Expect(authURL.Query()["resource"]).To(Equal([]string{"https://api-a.example/", "https://api-b.example/"}))
+
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+			Eventually(session).Should(gexec.Exit(0))
+		})
+	})
+
+	Describe("DPoP", func() {
+		BeforeEach(func() {
+			args = append(args, "-dpop", "-verbose", "-probe", server.URL()+"/api/me")
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("POST", "/oauth/token"),
+					func(w http.ResponseWriter, r *http.Request) {
+						Expect(r.Header.Get("DPoP")).ToNot(BeEmpty())
+					},
+					ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+						AccessToken: "mytoken",
+						TokenType:   "DPoP",
+					}),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/api/me"),
+					ghttp.VerifyHeaderKV("Authorization", "DPoP mytoken"),
+					func(w http.ResponseWriter, r *http.Request) {
+						Expect(r.Header.Get("DPoP")).ToNot(BeEmpty())
+					},
+					ghttp.RespondWith(http.StatusOK, `{}`),
+				),
+			)
+		})
+
+		It("should send proofs with the token request and the probe", func() {
+			Expect(session.Err).To(gbytes.Say(`DPoP key thumbprint: \S{43}`))
+
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`DPoP proof for POST`))
+			Expect(server.ReceivedRequests()).To(HaveLen(2))
+		})
+	})
+
+	Describe("pushed authorization request", func() {
+		var pushed url.Values
+
+		BeforeEach(func() {
+			args = append(args, "-par", "-par-url", server.URL()+"/oauth/par")
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("POST", "/oauth/par"),
+					ghttp.VerifyBasicAuth("123", "abc"),
+					func(w http.ResponseWriter, r *http.Request) {
+						Expect(r.ParseForm()).To(Succeed())
+						pushed = r.PostForm
+					},
+					ghttp.RespondWithJSONEncoded(http.StatusCreated, map[string]interface{}{
+						"request_uri": "urn:ietf:params:oauth:request_uri:abc",
+						"expires_in":  60,
+					}),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyFormKV("code", "mycode"),
+					ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+						AccessToken: "mytoken",
+						TokenType:   "Bearer",
+					}),
+				),
+			)
+		})
+
+		It("should push the params and leave just the request_uri in the auth URL", func() {
+			Expect(authURL.Query()).To(Equal(url.Values{
+				"client_id":   {"123"},
+				"request_uri": {"urn:ietf:params:oauth:request_uri:abc"},
+			}))
+			Expect(pushed.Get("response_type")).To(Equal("code"))
+			Expect(pushed.Get("state")).ToNot(BeEmpty())
+
+			callbackURL, err := url.Parse(pushed.Get("redirect_uri"))
+			Expect(err).ToNot(HaveOccurred())
+			callbackURL.RawQuery = url.Values{"code": {"mycode"}, "state": {pushed.Get("state")}}.Encode()
+			resp, err := http.Get(callbackURL.String())
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "mytoken"`))
+		})
+	})
+
+	Describe("request object", func() {
+		var (
+			key *rsa.PrivateKey
+			dir string
+		)
+
+		BeforeEach(func() {
+			var err error
+			key, err = rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+			dir, err = ioutil.TempDir("", "request-object")
+			Expect(err).ToNot(HaveOccurred())
+			keyFile := filepath.Join(dir, "key.pem")
+			keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+			Expect(ioutil.WriteFile(keyFile, keyPEM, 0600)).To(Succeed())
+
+			args = append(args, "-request-object", "-client-key", keyFile, "-client-key-id", "ro-1")
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyFormKV("code", "mycode"),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "mytoken",
+					TokenType:   "Bearer",
+				}),
+			))
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should sign the params into the request param", func() {
+			Expect(authURL.Query()).To(HaveLen(2))
+			Expect(authURL.Query().Get("client_id")).To(Equal("123"))
+			parts := strings.Split(authURL.Query().Get("request"), ".")
+			Expect(parts).To(HaveLen(3))
+
+			digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature)).To(Succeed())
+
+			header, err := base64.RawURLEncoding.DecodeString(parts[0])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(header).To(MatchJSON(`{"alg":"RS256","kid":"ro-1","typ":"oauth-authz-req+jwt"}`))
+			payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+			Expect(err).ToNot(HaveOccurred())
+			var claims map[string]interface{}
+			Expect(json.Unmarshal(payload, &claims)).To(Succeed())
+			Expect(claims).To(HaveKeyWithValue("iss", "123"))
+			Expect(claims).To(HaveKeyWithValue("aud", server.URL()+"/oauth/authorize"))
+			Expect(claims).To(HaveKeyWithValue("client_id", "123"))
+			Expect(claims).To(HaveKeyWithValue("response_type", "code"))
+			Expect(claims).To(HaveKeyWithValue("scope", "public"))
+			Expect(claims).To(HaveKey("exp"))
+
+			callbackURL, err := url.Parse(claims["redirect_uri"].(string))
+			Expect(err).ToNot(HaveOccurred())
+			callbackURL.RawQuery = url.Values{"code": {"mycode"}, "state": {claims["state"].(string)}}.Encode()
+			resp, err := http.Get(callbackURL.String())
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "mytoken"`))
+		})
+	})
+
+	Describe("JARM", func() {
+		var key *rsa.PrivateKey
+
+		BeforeEach(func() {
+			var err error
+			key, err = rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+
+			args = append(args, "-response-mode", "jwt", "-issuer", server.URL())
+			server.RouteToHandler("GET", "/.well-known/openid-configuration", ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]string{
+				"issuer":   server.URL(),
+				"jwks_uri": server.URL() + "/jwks",
+			}))
+			server.RouteToHandler("GET", "/jwks", ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"keys": []map[string]string{{
+					"kty": "RSA",
+					"kid": "key-1",
+					"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+				}},
+			}))
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyFormKV("code", "mycode"),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "mytoken",
+					TokenType:   "Bearer",
+				}),
+			))
+		})
+
+		response := func(key *rsa.PrivateKey) string {
+			return SignedJWT(key, "key-1", map[string]interface{}{
+				"iss":   server.URL(),
+				"aud":   "123",
+				"exp":   time.Now().Add(time.Minute).Unix(),
+				"code":  "mycode",
+				"state": authURL.Query().Get("state"),
+			})
+		}
+
+		It("should ask for a JWT response", func() {
+			Expect(authURL.Query().Get("response_mode")).To(Equal("jwt"))
+		})
+
+		It("should take the code and state from the verified response", func() {
+			status, body := callback(url.Values{"response": {response(key)}})
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "mytoken"`))
+		})
+
+		It("should reject a response signed by another key", func() {
+			other, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+			status, body := callback(url.Values{"response": {response(other)}})
+			Expect(status).To(Equal(http.StatusUnauthorized))
+			Expect(body).To(HavePrefix("JARM response verification error: no key matches the RS256 signature"))
+
+			Eventually(session).Should(gexec.Exit(9))
+		})
+
+		It("should reject a plain callback", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusUnauthorized))
+			Expect(body).To(HavePrefix("JARM: no response param in the callback"))
+
+			Eventually(session).Should(gexec.Exit(9))
+		})
+	})
+
+	Describe("probe", func() {
+		var probeStatus int
+
+		BeforeEach(func() {
+			probeStatus = http.StatusOK
+			args = append(args, "-probe", server.URL()+"/api/me", "-probe-method", "post", "-probe-body", `{"q":1}`)
+			server.AppendHandlers(
+				ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "mytoken",
+					TokenType:   "Bearer",
+				}),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("POST", "/api/me"),
+					ghttp.VerifyHeaderKV("Authorization", "Bearer mytoken"),
+					ghttp.VerifyContentType("application/json"),
+					ghttp.VerifyBody([]byte(`{"q":1}`)),
+					ghttp.RespondWithPtr(&probeStatus, nil),
+				),
+			)
+		})
+
+		It("should log the response to the request with the token", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`probe: POST .+/api/me: 200 OK`))
+		})
+
+		Context("when the API rejects the token", func() {
+			BeforeEach(func() {
+				probeStatus = http.StatusUnauthorized
+			})
+
+			It("should exit with an error", func() {
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+				Eventually(session).Should(gexec.Exit(1))
+				Expect(session.Err).To(gbytes.Say(`probe: POST .+/api/me: 401 Unauthorized`))
+				Expect(session.Err).To(gbytes.Say(`error: probe failed: POST .+/api/me: 401 Unauthorized`))
+			})
+		})
+	})
+
+	Describe("loop mode", func() {
+		BeforeEach(func() {
+			args = append(args, "-loop=2", "-pkce")
+			for _, token := range []string{"firsttoken", "secondtoken"} {
+				server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: token,
+					TokenType:   "Bearer",
+				}))
+			}
+		})
+
+		It("should authorize again with a fresh state until the count is reached", func() {
+			firstState := authURL.Query().Get("state")
+			firstChallenge := authURL.Query().Get("code_challenge")
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+			Eventually(session.Err).Should(gbytes.Say(`"access_token": "firsttoken"`))
+
+			re := regexp.MustCompile(regexp.QuoteMeta(server.URL()+"/oauth/authorize") + `.+`)
+			Eventually(func() int {
+				return len(re.FindAll(session.Err.Contents(), -1))
+			}).Should(Equal(2))
+			var err error
+			authURL, err = url.Parse(string(re.FindAll(session.Err.Contents(), -1)[1]))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(authURL.Query().Get("state")).ToNot(Equal(firstState))
+			Expect(authURL.Query().Get("code_challenge")).ToNot(Equal(firstChallenge))
+
+			// The first state can't be replayed.
+			status, _ = callback(url.Values{"code": {"mycode"}, "state": {firstState}})
+			Expect(status).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should exit after the last authorization", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+			re := regexp.MustCompile(regexp.QuoteMeta(server.URL()+"/oauth/authorize") + `.+`)
+			Eventually(func() int {
+				return len(re.FindAll(session.Err.Contents(), -1))
+			}).Should(Equal(2))
+			var err error
+			authURL, err = url.Parse(string(re.FindAll(session.Err.Contents(), -1)[1]))
+			Expect(err).ToNot(HaveOccurred())
+
+			status, body = callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "firsttoken"`))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "secondtoken"`))
+		})
+
+		Context("without a count", func() {
+			BeforeEach(func() {
+				args = append(args, "-loop")
+			})
+
+			It("should exit cleanly when interrupted", func() {
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+				Eventually(session.Err).Should(gbytes.Say(`"access_token": "firsttoken"`))
+
+				session.Interrupt()
+				Eventually(session).Should(gexec.Exit(0))
+			})
+		})
+	})
+
+	Describe("proxy", func() {
+		var proxy *ghttp.Server
+
+		BeforeEach(func() {
+			proxy = ghttp.NewServer()
+			args = append(args, "-proxy", proxy.URL(), "-verbose")
+		})
+
+		AfterEach(func() {
+			proxy.Close()
+		})
+
+		It("should send the exchange through the proxy", func() {
+			providerHost := strings.TrimPrefix(server.URL(), "http://")
+			proxy.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", "/oauth/token"),
+				func(w http.ResponseWriter, r *http.Request) {
+					Expect(r.Host).To(Equal(providerHost))
+				},
+				ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "mytoken",
+					TokenType:   "Bearer",
+				}),
+			))
+
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say("using proxy " + regexp.QuoteMeta(proxy.URL()) + " for " + regexp.QuoteMeta(providerHost)))
+			Expect(server.ReceivedRequests()).To(BeEmpty())
+		})
+	})
+
+	Describe("redirect to the wrong path", func() {
+		It("should explain the callback path", func() {
+			callbackURL, err := url.Parse(authURL.Query().Get("redirect_uri"))
+			Expect(err).ToNot(HaveOccurred())
+			callbackURL.Path = "/callback"
+			callbackURL.RawQuery = validCallback("mycode").Encode()
+
+			resp, err := http.Get(callbackURL.String())
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+			Expect(string(body)).To(ContainSubstring("the callback is on /oauth/callback"))
+			Eventually(session.Err).Should(gbytes.Say("warning: got a request for /callback, but the callback is on /oauth/callback"))
+			Expect(server.ReceivedRequests()).To(BeEmpty())
+		})
+	})
+
+	Describe("success template", func() {
+		var templateFile string
+
+		BeforeEach(func() {
+			f, err := ioutil.TempFile("", "success")
+			Expect(err).ToNot(HaveOccurred())
+			templateFile = f.Name()
+			_, err = f.WriteString(`<p>Welcome back, scopes: {{range .Scopes}}{{.}};{{end}} refresh: {{.HasRefreshToken}}</p>`)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(f.Close()).To(Succeed())
+
+			args = append(args, "-success-template", templateFile)
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token":  "mytoken",
+				"token_type":    "Bearer",
+				"refresh_token": "myrefresh",
+				"scope":         "public <b>",
+			}))
+		})
+
+		AfterEach(func() {
+			os.Remove(templateFile)
+		})
+
+		It("should render it with the token details", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+			Expect(body).To(Equal(`<p>Welcome back, scopes: public;&lt;b&gt;; refresh: true</p>`))
+
+			Eventually(session).Should(gexec.Exit(0))
+		})
+	})
+
+	Describe("error template", func() {
+		var templateFile string
+
+		BeforeEach(func() {
+			f, err := ioutil.TempFile("", "error")
+			Expect(err).ToNot(HaveOccurred())
+			templateFile = f.Name()
+			_, err = f.WriteString(`<p>Denied: {{.Code}}, {{.Description}}</p>`)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(f.Close()).To(Succeed())
+
+			args = append(args, "-error-template", templateFile)
+		})
+
+		AfterEach(func() {
+			os.Remove(templateFile)
+		})
+
+		It("should render it with the provider's error", func() {
+			status, body := callback(url.Values{
+				"error":             {"access_denied"},
+				"error_description": {"no <thanks>"},
+				"state":             {authURL.Query().Get("state")},
+			})
+			Expect(status).To(Equal(http.StatusUnauthorized), "got body: %s", body)
+			Expect(body).To(Equal(`<p>Denied: access_denied, no &lt;thanks&gt;</p>`))
+
+			Eventually(session).Should(gexec.Exit(5))
+		})
+	})
+
+	Describe("result template", func() {
+		var templateFile string
+
+		BeforeEach(func() {
+			f, err := ioutil.TempFile("", "result")
+			Expect(err).ToNot(HaveOccurred())
+			templateFile = f.Name()
+			_, err = f.WriteString(`{{if .Error}}<p>Denied: {{.Error.Code}}</p>{{else}}<p>Done, refresh: {{.HasRefreshToken}}</p>{{end}}`)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(f.Close()).To(Succeed())
+
+			args = append(args, "-result-template", templateFile)
+		})
+
+		AfterEach(func() {
+			os.Remove(templateFile)
+		})
+
+		It("should render the success page with it", func() {
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token":  "mytoken",
+				"token_type":    "Bearer",
+				"refresh_token": "myrefresh",
+			}))
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+			Expect(body).To(Equal(`<p>Done, refresh: true</p>`))
+
+			Eventually(session).Should(gexec.Exit(0))
+		})
+
+		It("should render the error page with it", func() {
+			status, body := callback(url.Values{
+				"error": {"access_denied"},
+				"state": {authURL.Query().Get("state")},
+			})
+			Expect(status).To(Equal(http.StatusUnauthorized), "got body: %s", body)
+			Expect(body).To(Equal(`<p>Denied: access_denied</p>`))
+
+			Eventually(session).Should(gexec.Exit(5))
+		})
+	})
+
+	Describe("token exchange retries", func() {
+		BeforeEach(func() {
+			// A single style, so that each attempt is a single request.
+			args = append(args, "-auth-style", "header", "-verbose")
+		})
+
+		It("should retry 5xx responses", func() {
+			server.AppendHandlers(
+				ghttp.RespondWith(http.StatusServiceUnavailable, "busy"),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "mytoken",
+					TokenType:   "Bearer",
+				}),
+			)
+
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say("token request failed, retry 1 of 3 in 500ms"))
+			Expect(server.ReceivedRequests()).To(HaveLen(2))
+		})
+
+		It("should fail fast on other responses", func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusUnauthorized, "invalid_client"))
+
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusServiceUnavailable), "got body: %s", body)
+			Eventually(session).Should(gexec.Exit(7))
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+		})
+
+		Context("with -retry-backoff", func() {
+			BeforeEach(func() {
+				args = append(args, "-retries", "1", "-retry-backoff", "10ms")
+			})
+
+			It("should wait that long and report the last error", func() {
+				server.AppendHandlers(
+					ghttp.RespondWith(http.StatusBadGateway, "busy"),
+					ghttp.RespondWith(http.StatusServiceUnavailable, "still busy"),
+				)
+
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusServiceUnavailable), "got body: %s", body)
+				Eventually(session).Should(gexec.Exit(7))
+				Expect(session.Err).To(gbytes.Say("token request failed, retry 1 of 1 in 10ms"))
+				Expect(session.Err).To(gbytes.Say("still busy"))
+				Expect(server.ReceivedRequests()).To(HaveLen(2))
+			})
+		})
+
+		Context("with -retries 0", func() {
+			BeforeEach(func() {
+				args = append(args, "-retries", "0")
+			})
+
+			It("should not retry", func() {
+				server.AppendHandlers(ghttp.RespondWith(http.StatusServiceUnavailable, "busy"))
+
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusServiceUnavailable), "got body: %s", body)
+				Eventually(session).Should(gexec.Exit(7))
+				Expect(server.ReceivedRequests()).To(HaveLen(1))
+			})
+		})
+	})
+
+	Describe("serve", func() {
+		var serveAddr string
+
+		BeforeEach(func() {
+			port, err := EphemeralPort()
+			Expect(err).ToNot(HaveOccurred())
+			serveAddr = fmt.Sprintf("127.0.0.1:%d", port)
+			args = []string{"serve", "-scope", "public", "-serve-addr", serveAddr}
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyFormKV("grant_type", "authorization_code"),
+					ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+						"access_token":  "firsttoken",
+						"token_type":    "Bearer",
+						"refresh_token": "myrefresh",
+						"expires_in":    2,
+					}),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyFormKV("grant_type", "refresh_token"),
+					ghttp.VerifyFormKV("refresh_token", "myrefresh"),
+					ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+						"access_token": "secondtoken",
+						"token_type":   "Bearer",
+						"expires_in":   3600,
+					}),
+				),
+			)
+		})
+
+		getToken := func() string {
+			resp, err := http.Get("http://" + serveAddr + "/token")
+			if err != nil {
+				return err.Error()
+			}
+			defer resp.Body.Close()
+			var token oauth2.Token
+			Expect(json.NewDecoder(resp.Body).Decode(&token)).To(Succeed())
+			return token.AccessToken
+		}
+
+		It("should serve the token and refresh it before it expires", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+			Eventually(session.Err).Should(gbytes.Say("Serving the token on http://" + regexp.QuoteMeta(serveAddr) + "/token"))
+
+			Expect(getToken()).To(Equal("firsttoken"))
+			Eventually(getToken, 5*time.Second).Should(Equal("secondtoken"))
+			Expect(session.Err).To(gbytes.Say("Refreshed the token"))
+
+			session.Terminate()
+			Eventually(session).Should(gexec.Exit(0))
+		})
+
+		Context("with requests from web pages", func() {
+			tokenRequest := func(host, origin string) *http.Response {
+				req, err := http.NewRequest("GET", "http://"+serveAddr+"/token", nil)
+				Expect(err).ToNot(HaveOccurred())
+				req.Host = host
+				if origin != "" {
+					req.Header.Set("Origin", origin)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ToNot(HaveOccurred())
+				resp.Body.Close()
+				return resp
+			}
+
+			BeforeEach(func() {
+				args = append(args, "-allow-origin", "http://localhost:3000")
+			})
+
+			JustBeforeEach(func() {
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+				Eventually(session.Err).Should(gbytes.Say("Serving the token"))
+			})
+
+			It("should reject a foreign Host, as a DNS rebinding page sends", func() {
+				_, port, err := net.SplitHostPort(serveAddr)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tokenRequest("attacker.example:"+port, "").StatusCode).To(Equal(http.StatusMisdirectedRequest))
+				Expect(tokenRequest("localhost:"+port, "").StatusCode).To(Equal(http.StatusOK))
+			})
+
+			It("should only serve the origins of -allow-origin", func() {
+				Expect(tokenRequest(serveAddr, "https://attacker.example").StatusCode).To(Equal(http.StatusForbidden))
+
+				resp := tokenRequest(serveAddr, "http://localhost:3000")
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(resp.Header.Get("Access-Control-Allow-Origin")).To(Equal("http://localhost:3000"))
+			})
+		})
+	})
+
+	Describe("proxy command", func() {
+		var proxyAddr string
+
+		BeforeEach(func() {
+			port, err := EphemeralPort()
+			Expect(err).ToNot(HaveOccurred())
+			proxyAddr = fmt.Sprintf("127.0.0.1:%d", port)
+			args = []string{"proxy", "-scope", "public", "-serve-addr", proxyAddr, "-upstream", server.URL() + "/api"}
+			server.AppendHandlers(
+				ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "mytoken",
+					TokenType:   "Bearer",
+				}),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("POST", "/api/things", "page=2"),
+					ghttp.VerifyHeaderKV("Authorization", "Bearer mytoken"),
+					ghttp.VerifyBody([]byte(`{"name":"x"}`)),
+					ghttp.RespondWith(http.StatusCreated, `{"id":1}`),
+				),
+			)
+		})
+
+		It("should forward requests to the upstream with the token", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+			Eventually(session.Err).Should(gbytes.Say("Proxying http://" + regexp.QuoteMeta(proxyAddr) + " to " + regexp.QuoteMeta(server.URL()+"/api")))
+
+			req, err := http.NewRequest("POST", "http://"+proxyAddr+"/things?page=2", strings.NewReader(`{"name":"x"}`))
+			Expect(err).ToNot(HaveOccurred())
+			req.Header.Set("Authorization", "Bearer stale")
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			data, err := ioutil.ReadAll(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+			Expect(string(data)).To(Equal(`{"id":1}`))
+		})
+
+		It("should not forward requests from web pages", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+			Eventually(session.Err).Should(gbytes.Say("Proxying"))
+
+			_, port, err := net.SplitHostPort(proxyAddr)
+			Expect(err).ToNot(HaveOccurred())
+			req, err := http.NewRequest("POST", "http://"+proxyAddr+"/things?page=2", strings.NewReader(`{"name":"x"}`))
+			Expect(err).ToNot(HaveOccurred())
+			req.Host = "attacker.example:" + port
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusMisdirectedRequest))
+
+			req, err = http.NewRequest("POST", "http://"+proxyAddr+"/things?page=2", strings.NewReader(`{"name":"x"}`))
+			Expect(err).ToNot(HaveOccurred())
+			req.Header.Set("Origin", "https://attacker.example")
+			resp, err = http.DefaultClient.Do(req)
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+		})
+	})
+
+	Describe("cancelling", func() {
+		It("should stop waiting for the callback when terminated", func() {
+			session.Terminate()
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say("error: interrupted before the flow completed"))
+		})
+
+		It("should stop waiting for the callback when interrupted", func() {
+			session.Interrupt()
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say("error: interrupted before the flow completed"))
+		})
+	})
+
+	Describe("form_post response mode", func() {
+		BeforeEach(func() {
+			args = append(args, "-response-mode", "form_post")
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyFormKV("code", "postedcode"),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "mytoken",
+					TokenType:   "Bearer",
+				}),
+			))
+		})
+
+		It("should request form_post and read the posted callback params", func() {
+			Expect(authURL.Query().Get("response_mode")).To(Equal("form_post"))
+
+			resp, err := http.PostForm(authURL.Query().Get("redirect_uri"), validCallback("postedcode"))
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "mytoken"`))
+		})
+	})
+
+	Describe("implicit flow", func() {
+		BeforeEach(func() {
+			args = append(args, "-response-type", "token")
+		})
+
+		It("should relay the fragment from a page and use the token it carries", func() {
+			Expect(authURL.Query().Get("response_type")).To(Equal("token"))
+
+			status, body := callback(url.Values{})
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring("window.location.hash"))
+
+			resp, err := http.PostForm(authURL.Query().Get("redirect_uri"), url.Values{
+				"access_token": {"implicittoken"},
+				"token_type":   {"Bearer"},
+				"expires_in":   {"3600"},
+				"state":        {authURL.Query().Get("state")},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "implicittoken"`))
+			Expect(server.ReceivedRequests()).To(BeEmpty())
+		})
+
+		It("should reject a callback without a token", func() {
+			resp, err := http.PostForm(authURL.Query().Get("redirect_uri"), url.Values{
+				"state": {authURL.Query().Get("state")},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Describe("id_token only", func() {
+		post := func(idToken string) int {
+			resp, err := http.PostForm(authURL.Query().Get("redirect_uri"), url.Values{
+				"id_token": {idToken},
+				"state":    {authURL.Query().Get("state")},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		BeforeEach(func() {
+			args = append(args, "-id-token-only", "-oidc-nonce", "-format", "token")
+		})
+
+		It("should ask for an id_token and print it without a token request", func() {
+			Expect(authURL.Query().Get("response_type")).To(Equal("id_token"))
+			idToken := FakeJWT(map[string]interface{}{"sub": "alice", "nonce": authURL.Query().Get("nonce")})
+			Expect(post(idToken)).To(Equal(http.StatusOK))
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`id_token claims:(.|\n)*"sub": "alice"`))
+			Expect(session.Out).To(gbytes.Say(regexp.QuoteMeta(idToken)))
+			Expect(server.ReceivedRequests()).To(BeEmpty())
+		})
+
+		It("should reject an id_token for another nonce", func() {
+			Expect(post(FakeJWT(map[string]interface{}{"sub": "alice", "nonce": "replayed"}))).To(Equal(http.StatusUnauthorized))
+			Eventually(session).Should(gexec.Exit(9))
+			Expect(session.Err).To(gbytes.Say("OIDC nonce error"))
+		})
+	})
+
+	Describe("hybrid flow", func() {
+		BeforeEach(func() {
+			args = append(args, "-response-type", "code token")
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyFormKV("code", "hybridcode"),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "mytoken",
+					TokenType:   "Bearer",
+				}),
+			))
+		})
+
+		It("should exchange the relayed code", func() {
+			Expect(authURL.Query().Get("response_type")).To(Equal("code token"))
+
+			resp, err := http.PostForm(authURL.Query().Get("redirect_uri"), validCallback("hybridcode"))
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "mytoken"`))
+		})
+	})
+
+	Describe("hybrid flow with an id_token in the callback", func() {
+		var fragmentIDToken, responseIDToken string
+
+		post := func() {
+			params := validCallback("hybridcode")
+			params.Set("id_token", fragmentIDToken)
+			resp, err := http.PostForm(authURL.Query().Get("redirect_uri"), params)
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		}
+
+		BeforeEach(func() {
+			args = append(args, "-response-type", "code id_token", "-decode-id-token")
+		})
+
+		JustBeforeEach(func() {
+			nonce := authURL.Query().Get("nonce")
+			Expect(nonce).ToNot(BeEmpty())
+			fragmentIDToken = FakeJWT(map[string]interface{}{"iss": "https://issuer.example", "sub": "alice", "nonce": nonce})
+			responseIDToken = FakeJWT(map[string]interface{}{"iss": "https://issuer.example", "sub": "mallory", "nonce": nonce})
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token": "mytoken",
+				"token_type":   "Bearer",
+				"id_token":     responseIDToken,
+			}))
+		})
+
+		It("should warn that the two id_tokens differ, and output the response's", func() {
+			post()
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`warning: the id_token of the callback has sub "alice", but that of the token response "mallory"`))
+			Expect(session.Err).To(gbytes.Say(`id_token claims:(.|\n)*"sub": "mallory"`))
+		})
+
+		Context("with -prefer-id-token fragment", func() {
+			BeforeEach(func() {
+				args = append(args, "-prefer-id-token", "fragment")
+			})
+
+			It("should output the callback's", func() {
+				post()
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(session.Err).To(gbytes.Say(`warning: the id_token of the callback has sub "alice"`))
+				Expect(session.Err).To(gbytes.Say(`id_token claims:(.|\n)*"sub": "alice"`))
+			})
+		})
+	})
+
+	Describe("user agent", func() {
+		respond := func(userAgent string) {
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyHeaderKV("User-Agent", userAgent),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "mytoken",
+					TokenType:   "Bearer",
+				}),
+			))
+		}
+
+		It("should default to the tool's name and version", func() {
+			respond("oauth2-cli/dev")
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+		})
+
+		Context("when configured", func() {
+			BeforeEach(func() {
+				args = append(args, "-user-agent", "my-agent/1.0")
+			})
+
+			It("should send it on the exchange request", func() {
+				respond("my-agent/1.0")
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+			})
+		})
+	})
+
+	Describe("PKCE", func() {
+		var verifier string
+
+		BeforeEach(func() {
+			args = append(args, "-pkce")
+			server.AppendHandlers(ghttp.CombineHandlers(
+				func(w http.ResponseWriter, r *http.Request) {
+					Expect(r.ParseForm()).To(Succeed())
+					verifier = r.PostForm.Get("code_verifier")
+				},
+				ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "mytoken",
+					TokenType:   "Bearer",
+				}),
+			))
+		})
+
+		It("should send an S256 challenge and then the verifier", func() {
+			Expect(authURL.Query().Get("code_challenge_method")).To(Equal("S256"))
+
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+			Expect(verifier).To(MatchRegexp(`^[A-Za-z0-9._~-]{43,128}$`))
+
+			sum := sha256.Sum256([]byte(verifier))
+			Expect(authURL.Query().Get("code_challenge")).To(Equal(base64.RawURLEncoding.EncodeToString(sum[:])))
+		})
+
+		Context("with the plain method", func() {
+			BeforeEach(func() {
+				args = append(args, "-pkce-method", "plain")
+			})
+
+			It("should send the verifier as the challenge", func() {
+				Expect(authURL.Query().Get("code_challenge_method")).To(Equal("plain"))
+
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+				Expect(authURL.Query().Get("code_challenge")).To(Equal(verifier))
+			})
+		})
+	})
+
+	Describe("QR code", func() {
+		BeforeEach(func() {
+			args = append(args, "-qr")
+		})
+
+		It("should show the auth URL as a QR code too", func() {
+			Eventually(session.Err).Should(gbytes.Say("Or scan this QR code:\n\x1b\\[30;47m"))
+			Expect(session.Err.Contents()).To(ContainSubstring("▀"))
+		})
+	})
+
+	Describe("opening the browser", func() {
+		var binDir string
+
+		BeforeEach(func() {
+			var err error
+			binDir, err = ioutil.TempDir("", "bin")
+			Expect(err).ToNot(HaveOccurred())
+			env = append(env, "PATH="+binDir)
+			args = append(args, "-open")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(binDir)
+		})
+
+		Context("with an opener", func() {
+			BeforeEach(func() {
+				script := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %s/opened\n", binDir)
+				for _, name := range []string{"open", "xdg-open"} {
+					Expect(ioutil.WriteFile(filepath.Join(binDir, name), []byte(script), 0755)).To(Succeed())
+				}
+			})
+
+			It("should open the auth URL", func() {
+				Eventually(func() string {
+					opened, _ := ioutil.ReadFile(filepath.Join(binDir, "opened"))
+					return strings.TrimSpace(string(opened))
+				}).Should(Equal(authURL.String()))
+			})
+		})
+
+		Context("without an opener", func() {
+			It("should warn and keep waiting for the callback", func() {
+				Eventually(session.Err).Should(gbytes.Say("warning: failed to open browser"))
+				Consistently(session).ShouldNot(gexec.Exit())
+			})
+		})
+
+		Context("with -no-open", func() {
+			BeforeEach(func() {
+				args = append(args, "-no-open")
+			})
+
+			It("should only print the auth URL", func() {
+				Eventually(session.Err).Should(gbytes.Say("Visit this URL in your browser"))
+				Consistently(session.Err).ShouldNot(gbytes.Say("warning: failed to open browser"))
+			})
+		})
+	})
+
+	Describe("clipboard", func() {
+		var binDir string
+
+		BeforeEach(func() {
+			var err error
+			binDir, err = ioutil.TempDir("", "bin")
+			Expect(err).ToNot(HaveOccurred())
+			script := fmt.Sprintf("#!/bin/sh\n/bin/cat > %s/copied\n", binDir)
+			for _, name := range []string{"pbcopy", "xclip"} {
+				Expect(ioutil.WriteFile(filepath.Join(binDir, name), []byte(script), 0755)).To(Succeed())
+			}
+			env = append(env, "PATH="+binDir, "WAYLAND_DISPLAY=")
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token": "mytoken",
+				"token_type":   "Bearer",
+				"id_token":     "myidtoken",
+			}))
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(binDir)
+		})
+
+		copied := func() string {
+			data, _ := ioutil.ReadFile(filepath.Join(binDir, "copied"))
+			return string(data)
+		}
+
+		Context("on its own", func() {
+			BeforeEach(func() {
+				args = append(args, "-clipboard")
+			})
+
+			It("should copy the access token", func() {
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(copied()).To(Equal("mytoken"))
+				Expect(session.Err).To(gbytes.Say(`"access_token": "mytoken"`))
+			})
+		})
+
+		Context("with id_token", func() {
+			BeforeEach(func() {
+				args = append(args, "-clipboard=id_token")
+			})
+
+			It("should copy the id_token", func() {
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(copied()).To(Equal("myidtoken"))
+			})
+		})
+	})
+
+	Describe("output file", func() {
+		var outDir string
+
+		BeforeEach(func() {
+			var err error
+			outDir, err = ioutil.TempDir("", "out")
+			Expect(err).ToNot(HaveOccurred())
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+				AccessToken: "mytoken",
+				TokenType:   "Bearer",
+			}))
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(outDir)
+		})
+
+		Context("with a path", func() {
+			BeforeEach(func() {
+				args = append(args, "-out", filepath.Join(outDir, "token.json"))
+			})
+
+			It("should write the token JSON to the file", func() {
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+				Eventually(session).Should(gexec.Exit(0))
+
+				info, err := os.Stat(filepath.Join(outDir, "token.json"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+
+				data, err := ioutil.ReadFile(filepath.Join(outDir, "token.json"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(data).To(MatchJSON(`{"access_token": "mytoken", "token_type": "Bearer", "expiry": "0001-01-01T00:00:00Z"}`))
+
+				files, err := ioutil.ReadDir(outDir)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(files).To(HaveLen(1), "temporary file left behind")
+			})
+		})
+
+		Context("with -", func() {
+			BeforeEach(func() {
+				args = append(args, "-out", "-")
+			})
+
+			It("should write the token JSON to stdout", func() {
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+				Eventually(session).Should(gexec.Exit(0))
+
+				Expect(session.Out.Contents()).To(MatchJSON(`{"access_token": "mytoken", "token_type": "Bearer", "expiry": "0001-01-01T00:00:00Z"}`))
+			})
+		})
+
+		Context("with -no-stdout", func() {
+			BeforeEach(func() {
+				args = append(args, "-no-stdout", "-out", filepath.Join(outDir, "token.json"))
+			})
+
+			It("should only write the token to the file", func() {
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+				Eventually(session).Should(gexec.Exit(0))
+
+				Expect(session.Out.Contents()).To(BeEmpty())
+				data, err := ioutil.ReadFile(filepath.Join(outDir, "token.json"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(data).To(MatchJSON(`{"access_token": "mytoken", "token_type": "Bearer", "expiry": "0001-01-01T00:00:00Z"}`))
+			})
+		})
+
+		Context("with -no-stdout and -format token", func() {
+			BeforeEach(func() {
+				args = append(args, "-no-stdout", "-format", "token", "-cache", filepath.Join(outDir, "cache.json"))
+			})
+
+			It("should print nothing", func() {
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+				Eventually(session).Should(gexec.Exit(0))
+
+				Expect(session.Out.Contents()).To(BeEmpty())
+				Expect(ioutil.ReadFile(filepath.Join(outDir, "cache.json"))).To(ContainSubstring("mytoken"))
+			})
+		})
+
+		Context("when the file can't be written", func() {
+			BeforeEach(func() {
+				args = append(args, "-out", filepath.Join(outDir, "missing", "token.json"))
+			})
+
+			It("should exit non-zero", func() {
+				status, _ := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusInternalServerError))
+
+				Eventually(session).Should(gexec.Exit(1))
+				Expect(session.Err).To(gbytes.Say("failed to write token"))
+			})
+		})
+	})
+
+	Describe("decoding the id_token", func() {
+		BeforeEach(func() {
+			args = append(args, "-decode-id-token")
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token": "mytoken",
+				"token_type":   "Bearer",
+				"id_token":     FakeJWT(map[string]interface{}{"sub": "user-1", "exp": 1700000000}),
+			}))
+		})
+
+		It("should log the claims with readable timestamps", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say("id_token claims:"))
+			Expect(session.Err).To(gbytes.Say(`"exp": "2023-11-14T22:13:20Z"`))
+			Expect(session.Err).To(gbytes.Say(`"sub": "user-1"`))
+		})
+	})
+
+	Describe("self-signed TLS callback", func() {
+		BeforeEach(func() {
+			args = append(args, "-tls")
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+				AccessToken: "mytoken",
+				TokenType:   "Bearer",
+			}))
+		})
+
+		It("should serve the callback over HTTPS", func() {
+			Expect(authURL.Query().Get("redirect_uri")).To(HavePrefix("https://127.0.0.1:"))
+
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "mytoken"`))
+		})
+
+		Context("with -callback-tls", func() {
+			BeforeEach(func() {
+				args[len(args)-1] = "-callback-tls"
+			})
+
+			It("should serve the callback over HTTPS like -tls", func() {
+				Expect(authURL.Query().Get("redirect_uri")).To(HavePrefix("https://127.0.0.1:"))
+			})
+		})
+	})
+
+	Describe("extra auth and token parameters", func() {
+		BeforeEach(func() {
+			args = append(args,
+				"-auth-param", "prompt=consent",
+				"-auth-param", "hd=example.com",
+				"-token-param", "resource=https://api.example.com",
+			)
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyFormKV("resource", "https://api.example.com"),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "mytoken",
+					TokenType:   "Bearer",
+				}),
+			))
+		})
+
+		It("should add them to the auth URL and token request", func() {
+			Expect(authURL.Query().Get("prompt")).To(Equal("consent"))
+			Expect(authURL.Query().Get("hd")).To(Equal("example.com"))
+			Expect(authURL.Query().Get("access_type")).To(Equal("offline"))
+
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+			Eventually(session).Should(gexec.Exit(0))
+		})
+
+		Context("when access_type is given", func() {
+			BeforeEach(func() {
+				args = append(args, "-auth-param", "access_type=online")
+			})
+
+			It("should override offline access", func() {
+				Expect(authURL.Query().Get("access_type")).To(Equal("online"))
+			})
+		})
+	})
+
+	Describe("offline access", func() {
+		BeforeEach(func() {
+			args = append(args, "-scope", "openid", "-issuer", server.URL())
+			server.RouteToHandler("GET", "/.well-known/openid-configuration", ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"issuer":           server.URL(),
+				"scopes_supported": []string{"openid", "offline_access"},
+			}))
+		})
+
+		It("should ask for the offline_access scope when the issuer lists it", func() {
+			Expect(authURL.Query().Get("scope")).To(Equal("public openid offline_access"))
+			Expect(authURL.Query()).ToNot(HaveKey("access_type"))
+		})
+
+		Context("when the issuer doesn't list offline_access", func() {
+			BeforeEach(func() {
+				server.RouteToHandler("GET", "/.well-known/openid-configuration", ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+					"issuer":           server.URL(),
+					"scopes_supported": []string{"openid"},
+				}))
+			})
+
+			It("should send access_type=offline", func() {
+				Expect(authURL.Query().Get("scope")).To(Equal("public openid"))
+				Expect(authURL.Query().Get("access_type")).To(Equal("offline"))
+			})
+		})
+
+		Context("when it's on", func() {
+			BeforeEach(func() {
+				args = append(args, "-offline", "on")
+			})
+
+			It("should ask for both", func() {
+				Expect(authURL.Query().Get("scope")).To(Equal("public openid offline_access"))
+				Expect(authURL.Query().Get("access_type")).To(Equal("offline"))
+			})
+		})
+
+		Context("when it's off", func() {
+			BeforeEach(func() {
+				args = append(args, "-offline", "off")
+			})
+
+			It("should ask for neither", func() {
+				Expect(authURL.Query().Get("scope")).To(Equal("public openid"))
+				Expect(authURL.Query()).ToNot(HaveKey("access_type"))
+			})
+		})
+	})
+
+	Describe("verbose logging", func() {
+		BeforeEach(func() {
+			args = append(args, "-verbose", "-format", "curl-config")
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token":  "mytoken",
+				"token_type":    "Bearer",
+				"refresh_token": "myrefresh",
+			}))
+		})
+
+		It("should redact secrets and tokens", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+			Eventually(session).Should(gexec.Exit(0))
+			logs := string(session.Err.Contents())
+			Expect(logs).To(ContainSubstring("Authorization: [Basic ***]"))
+			Expect(logs).To(ContainSubstring("code=***"))
+			Expect(logs).To(ContainSubstring(`"access_token":"***"`))
+			Expect(logs).ToNot(ContainSubstring("mycode"))
+			Expect(logs).ToNot(ContainSubstring("mytoken"))
+			Expect(logs).ToNot(ContainSubstring("myrefresh"))
+		})
+
+		Context("with -no-redact", func() {
+			BeforeEach(func() {
+				args = append(args, "-no-redact")
+			})
+
+			It("should log the raw request and response", func() {
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+				Eventually(session).Should(gexec.Exit(0))
+				logs := string(session.Err.Contents())
+				Expect(logs).To(ContainSubstring("code=mycode"))
+				Expect(logs).To(ContainSubstring(`"access_token":"mytoken"`))
+			})
+		})
+	})
+
+	Describe("id_token verification", func() {
+		var (
+			key     *rsa.PrivateKey
+			idToken string
+		)
+
+		BeforeEach(func() {
+			var err error
+			key, err = rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+
+			args = append(args, "-verify-id-token", "-issuer", server.URL())
+			server.RouteToHandler("GET", "/.well-known/openid-configuration", ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]string{
+				"issuer":   server.URL(),
+				"jwks_uri": server.URL() + "/jwks",
+			}))
+			server.RouteToHandler("GET", "/jwks", ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"keys": []map[string]string{{
+					"kty": "RSA",
+					"kid": "key-1",
+					"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+				}},
+			}))
+			idToken = SignedJWT(key, "key-1", map[string]interface{}{
+				"iss": server.URL(),
+				"aud": "123",
+				"exp": time.Now().Add(time.Hour).Unix(),
+			})
+		})
+
+		JustBeforeEach(func() {
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token": "mytoken",
+				"token_type":   "Bearer",
+				"id_token":     idToken,
+			}))
+		})
+
+		It("should accept a token signed by the provider", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say("id_token claims:"))
+			Expect(session.Err).To(gbytes.Say(`"aud": "123"`))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "mytoken"`))
+		})
+
+		Context("when the id_token has been tampered with", func() {
+			BeforeEach(func() {
+				parts := strings.Split(idToken, ".")
+				parts[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"` + server.URL() + `","aud":"123","exp":9999999999,"sub":"admin"}`))
+				idToken = strings.Join(parts, ".")
+			})
+
+			It("should reject it", func() {
+				status, body := callback(validCallback("mycode"))
+				Expect(status).To(Equal(http.StatusUnauthorized), "got body: %s", body)
+				Expect(body).To(HavePrefix("OIDC id_token verification error: no key matches the RS256 signature"))
+				Expect(body).ToNot(ContainSubstring("mytoken"))
+
+				Eventually(session).Should(gexec.Exit(9))
+			})
+		})
+	})
+
+	Describe("config file and environment", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "oauth2-cli")
+			Expect(err).ToNot(HaveOccurred())
+
+			configFile := filepath.Join(dir, "config.json")
+			Expect(ioutil.WriteFile(configFile, []byte(`{"auth_params": ["hd=file.example"], "pkce": true}`), 0600)).To(Succeed())
+			args = append(args, "-config", configFile)
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should load the config file given with -config", func() {
+			Expect(authURL.Query().Get("hd")).To(Equal("file.example"))
+			Expect(authURL.Query().Get("code_challenge")).ToNot(BeEmpty())
+		})
+
+		Context("with a user config file", func() {
+			BeforeEach(func() {
+				Expect(os.MkdirAll(filepath.Join(dir, "oauth2-cli"), 0700)).To(Succeed())
+				userFile := filepath.Join(dir, "oauth2-cli", "config.json")
+				Expect(ioutil.WriteFile(userFile, []byte(`{"auth_params": ["hd=user.example"], "nonce": true}`), 0600)).To(Succeed())
+				env = append(env, "XDG_CONFIG_HOME="+dir)
+			})
+
+			It("should load it under the -config file", func() {
+				Expect(authURL.Query().Get("hd")).To(Equal("file.example"))
+				Expect(authURL.Query().Get("nonce")).ToNot(BeEmpty())
+			})
+		})
+
+		Context("when overridden by the environment", func() {
+			BeforeEach(func() {
+				env = append(env, "OAUTH2_CLI_AUTH_PARAMS=hd=env.example", "OAUTH2_CLI_SCOPES=from-env")
+			})
+
+			It("should prefer the environment to the file, and flags to both", func() {
+				Expect(authURL.Query().Get("hd")).To(Equal("env.example"))
+				Expect(authURL.Query().Get("scope")).To(Equal("public"))
+			})
+		})
+	})
+
+	Describe("token endpoint auth style", func() {
+		BeforeEach(func() {
+			args = append(args, "-auth-style", "params")
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyFormKV("client_id", "123"),
+				ghttp.VerifyFormKV("client_secret", "abc"),
+				func(w http.ResponseWriter, r *http.Request) {
+					Expect(r.Header.Get("Authorization")).To(BeEmpty())
+				},
+				ghttp.RespondWith(http.StatusBadRequest, `{"error":"invalid_grant"}`),
+			))
+		})
+
+		It("should send the credentials in the body without retrying", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusServiceUnavailable), "got body: %s", body)
+
+			Eventually(session).Should(gexec.Exit())
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+		})
+	})
+
+	Describe("client authentication method", func() {
+		BeforeEach(func() {
+			args = append(args, "-client-auth", "none")
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyFormKV("client_id", "123"),
+				func(w http.ResponseWriter, r *http.Request) {
+					Expect(r.Header.Get("Authorization")).To(BeEmpty())
+					Expect(r.PostForm).ToNot(HaveKey("client_secret"))
+				},
+				ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "mytoken",
+					TokenType:   "Bearer",
+				}),
+			))
+		})
+
+		It("should send just the client_id for none", func() {
+			status, body := callback(validCallback("mycode"))
+			Expect(status).To(Equal(http.StatusOK), "got body: %s", body)
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+		})
+	})
+})
+
+var _ = Describe("Startup", func() {
+	var (
+		args    []string
+		port    int
+		session *gexec.Session
+	)
+
+	BeforeEach(func() {
+		args = []string{}
+		var err error
+		port, err = EphemeralPort()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		// Defaults come first so that the flags of each test override them.
+		args = append([]string{
+			"-port", fmt.Sprintf("%d", port),
+			"-auth", "https://provider.example/oauth/authorize",
+			"-token", "https://provider.example/oauth/token",
+			"-id", "123",
+			"-secret", "abc",
+		}, args...)
+		session, err = gexec.Start(exec.Command(cmdPath, args...), GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		gexec.TerminateAndWait()
+	})
+
+	Describe("redirect URL validation", func() {
+		Context("with a loopback http callback", func() {
+			BeforeEach(func() {
+				args = append(args, "-strict", "-callback", fmt.Sprintf("http://127.0.0.1:%d/oauth/callback", port))
+			})
+
+			It("should be allowed", func() {
+				Eventually(session.Err).Should(gbytes.Say("Visit this URL"))
+				Expect(string(session.Err.Contents())).ToNot(ContainSubstring("insecure redirect URL"))
+			})
+		})
+
+		Context("with a callback on another port", func() {
+			BeforeEach(func() {
+				args = append(args, "-callback", "http://localhost:1/oauth/callback")
+			})
+
+			It("should warn that the redirect won't reach the server", func() {
+				Eventually(session.Err).Should(gbytes.Say("warning: callback URL http://localhost:1/oauth/callback doesn't point at the callback server"))
+				Eventually(session.Err).Should(gbytes.Say("Visit this URL"))
+			})
+		})
+
+		Context("with a callback on the root path", func() {
+			BeforeEach(func() {
+				args = append(args, "-callback", "/")
+			})
+
+			It("should warn", func() {
+				Eventually(session.Err).Should(gbytes.Say("warning: callback URL .* is on the root path"))
+			})
+		})
+
+		Context("with a non-loopback http callback", func() {
+			BeforeEach(func() {
+				args = append(args, "-callback", "http://example.com/oauth/callback")
+			})
+
+			It("should warn", func() {
+				Eventually(session.Err).Should(gbytes.Say("warning: insecure redirect URL http://example.com/oauth/callback"))
+				Eventually(session.Err).Should(gbytes.Say("Visit this URL"))
+			})
+
+			Context("in strict mode", func() {
+				BeforeEach(func() {
+					args = append(args, "-strict")
+				})
+
+				It("should exit with an error", func() {
+					Eventually(session).Should(gexec.Exit(1))
+					Expect(session.Err).To(gbytes.Say("error: insecure redirect URL http://example.com/oauth/callback"))
+				})
+			})
+		})
+	})
+
+	Describe("port 0", func() {
+		BeforeEach(func() {
+			args = append(args, "-port", "0")
+		})
+
+		It("should listen on a free port and use it in the redirect URL", func() {
+			re := regexp.MustCompile(`Listening on 127\.0\.0\.1:(\d+) for the callback to http://127\.0\.0\.1:(\d+)/oauth/callback`)
+			Eventually(func() [][]byte { return re.FindSubmatch(session.Err.Contents()) }).ShouldNot(BeNil())
+			match := re.FindSubmatch(session.Err.Contents())
+			Expect(string(match[1])).ToNot(Equal("0"))
+			Expect(match[2]).To(Equal(match[1]))
+
+			Eventually(session.Err).Should(gbytes.Say("Visit this URL"))
+			Expect(string(session.Err.Contents())).To(ContainSubstring(url.QueryEscape("http://127.0.0.1:" + string(match[1]) + "/oauth/callback")))
+		})
+	})
+
+	Describe("log prefix", func() {
+		BeforeEach(func() {
+			args = append(args, "-log-prefix", "[run-42]")
+		})
+
+		It("should prefix every log line", func() {
+			Eventually(session.Err).Should(gbytes.Say("Visit this URL"))
+			lines := strings.Split(strings.TrimSpace(string(session.Err.Contents())), "\n")
+			for _, line := range lines {
+				if line == "" || strings.HasPrefix(line, "https://") {
+					// Blank and URL lines are part of the multi-line message.
+					continue
+				}
+				Expect(line).To(HavePrefix("[run-42] "))
+			}
+		})
+	})
+
+	Describe("endpoint host validation", func() {
+		BeforeEach(func() {
+			args = append(args, "-verbose")
+		})
+
+		Context("with matching hosts", func() {
+			It("should not warn", func() {
+				Eventually(session.Err).Should(gbytes.Say("Visit this URL"))
+				Expect(string(session.Err.Contents())).ToNot(ContainSubstring("differs from token URL host"))
+			})
+		})
+
+		Context("with mismatched hosts", func() {
+			BeforeEach(func() {
+				args = append(args, "-token", "https://other.example/oauth/token")
+			})
+
+			It("should warn", func() {
+				Eventually(session.Err).Should(gbytes.Say(`warning: auth URL host "provider.example" differs from token URL host "other.example"`))
+			})
+
+			Context("when the token host is allowed", func() {
+				BeforeEach(func() {
+					args = append(args, "-allow-token-host", "other.example")
+				})
+
+				It("should not warn", func() {
+					Eventually(session.Err).Should(gbytes.Say("Visit this URL"))
+					Expect(string(session.Err.Contents())).ToNot(ContainSubstring("differs from token URL host"))
+				})
+			})
+		})
+	})
+
+	Describe("callback wait", func() {
+		BeforeEach(func() {
+			args = append(args, "-callback-wait", "200ms")
+		})
+
+		It("should exit with the callback timeout status when no redirect arrives", func() {
+			Eventually(session).Should(gexec.Exit(4))
+			Expect(session.Err).To(gbytes.Say("timed out after 200ms waiting for the callback"))
+		})
+	})
+
+	Describe("overall timeout", func() {
+		BeforeEach(func() {
+			args = append(args, "-timeout", "200ms")
+		})
+
+		It("should exit with the timeout status when the flow is not completed", func() {
+			Eventually(session).Should(gexec.Exit(4))
+			Expect(session.Err).To(gbytes.Say("timed out after 200ms"))
+		})
+	})
+})
+
+var _ = Describe("Public clients", func() {
+	start := func(args ...string) *gexec.Session {
+		port, err := EphemeralPort()
+		Expect(err).ToNot(HaveOccurred())
+		args = append(args,
+			"-port", fmt.Sprintf("%d", port),
+			"-auth", "https://provider.example/oauth/authorize",
+			"-token", "https://provider.example/oauth/token",
+			"-id", "123",
+		)
+		session, err := gexec.Start(exec.Command(cmdPath, args...), GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+		return session
+	}
+
+	AfterEach(func() {
+		gexec.TerminateAndWait()
+	})
+
+	It("should need a secret without PKCE", func() {
+		session := start()
+		Eventually(session).Should(gexec.Exit(1))
+		Expect(session.Err).To(gbytes.Say("-secret is a required flag"))
+	})
+
+	It("should not need a secret with PKCE", func() {
+		session := start("-pkce")
+		Eventually(session.Err).Should(gbytes.Say("Visit this URL"))
+	})
+})
+
+var _ = Describe("-id-token-only", func() {
+	AfterEach(func() {
+		gexec.TerminateAndWait()
+	})
+
+	It("should need -oidc-nonce", func() {
+		session, err := gexec.Start(exec.Command(cmdPath, "-id-token-only", "-auth", "https://provider.example/oauth/authorize", "-id", "123"), GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+		Eventually(session).Should(gexec.Exit(1))
+		Expect(session.Err).To(gbytes.Say("-id-token-only needs -oidc-nonce"))
+	})
+
+	It("should need neither a secret nor a token URL", func() {
+		port, err := EphemeralPort()
+		Expect(err).ToNot(HaveOccurred())
+		session, err := gexec.Start(exec.Command(cmdPath, "-id-token-only", "-oidc-nonce", "-port", fmt.Sprintf("%d", port), "-auth", "https://provider.example/oauth/authorize", "-id", "123"), GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+		Eventually(session.Err).Should(gbytes.Say("Visit this URL"))
+	})
+})
+
+var _ = Describe("-aws-token-field", func() {
+	var server *ghttp.Server
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+	})
+
+	AfterEach(func() {
+		gexec.TerminateAndWait()
+		server.Close()
+	})
+
+	It("should fail on an unknown field before authorizing", func() {
+		session, err := gexec.Start(exec.Command(cmdPath,
+			"-flow", "client_credentials", "-token", server.URL()+"/oauth/token", "-id", "123", "-secret", "456",
+			"-format", "aws-credential-process", "-aws-token-field", "SessionTokn",
+		), GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+		Eventually(session).Should(gexec.Exit(1))
+		Expect(session.Err).To(gbytes.Say(`unknown -aws-token-field "SessionTokn"`))
+		Expect(server.ReceivedRequests()).To(BeEmpty())
+	})
 })
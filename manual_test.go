@@ -0,0 +1,90 @@
+package main_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"regexp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+	"github.com/onsi/gomega/ghttp"
+	"golang.org/x/oauth2"
+)
+
+var _ = Describe("Manual mode", func() {
+	const oob = "urn:ietf:wg:oauth:2.0:oob"
+
+	var (
+		session *gexec.Session
+		server  *ghttp.Server
+		stdin   io.WriteCloser
+		authURL *url.URL
+	)
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		server.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyRequest("POST", "/oauth/token"),
+			ghttp.VerifyFormKV("code", "mycode"),
+			ghttp.VerifyFormKV("redirect_uri", oob),
+			ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+				AccessToken: "mytoken",
+				TokenType:   "Bearer",
+			}),
+		))
+	})
+
+	JustBeforeEach(func() {
+		command := exec.Command(cmdPath,
+			"-manual",
+			"-callback", oob,
+			"-auth", server.URL()+"/oauth/authorize",
+			"-token", server.URL()+"/oauth/token",
+			"-id", "123",
+			"-secret", "abc",
+		)
+		var err error
+		stdin, err = command.StdinPipe()
+		Expect(err).ToNot(HaveOccurred())
+		session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(session.Err).Should(gbytes.Say("Paste the authorization code"))
+		re := regexp.MustCompile(regexp.QuoteMeta(server.URL()+"/oauth/authorize") + `.+`)
+		authURL, err = url.Parse(string(re.Find(session.Err.Contents())))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		gexec.TerminateAndWait()
+		server.Close()
+	})
+
+	It("should exchange a pasted code", func() {
+		Expect(authURL.Query().Get("redirect_uri")).To(Equal(oob))
+		fmt.Fprintln(stdin, "mycode")
+
+		Eventually(session).Should(gexec.Exit(0))
+		Expect(session.Err).To(gbytes.Say(`"access_token": "mytoken"`))
+	})
+
+	It("should check the state of a pasted redirect URL", func() {
+		fmt.Fprintf(stdin, "http://localhost/?code=mycode&state=%s\n", authURL.Query().Get("state"))
+
+		Eventually(session).Should(gexec.Exit(0))
+		Expect(session.Err).To(gbytes.Say(`"access_token": "mytoken"`))
+	})
+
+	It("should reject a pasted redirect URL with the wrong state", func() {
+		fmt.Fprintln(stdin, "http://localhost/?code=mycode&state=forged")
+
+		Eventually(session).Should(gexec.Exit(6))
+		Expect(session.Err).To(gbytes.Say("Invalid state: forged"))
+		Expect(server.ReceivedRequests()).To(BeEmpty())
+	})
+})
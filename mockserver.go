@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/geckoboard/oauth2-cli/pkg/oauth2cli"
+)
+
+// mockServer serves an oauth2cli.MockServer on -serve-addr until
+// interrupted. Its issuer is -issuer, or the address it listens on.
+func mockServer(conf config) int {
+	var claims map[string]interface{}
+	if conf.MockClaims != "" {
+		if err := json.Unmarshal([]byte(conf.MockClaims), &claims); err != nil {
+			log.Printf("error: invalid -mock-claims: %s\n", err)
+			return 1
+		}
+	}
+	listener, err := net.Listen("tcp", conf.ServeAddr)
+	if err != nil {
+		log.Printf("error: %s\n", err)
+		return 1
+	}
+	issuer := conf.Issuer
+	if issuer == "" {
+		issuer = "http://" + listener.Addr().String()
+	}
+	mock, err := oauth2cli.NewMockServer(issuer)
+	if err != nil {
+		log.Printf("error: %s\n", err)
+		return 1
+	}
+	mock.ClientID = conf.ClientID
+	mock.ClientSecret = conf.ClientSecret
+	mock.Claims = claims
+	mock.ExpiresIn = time.Duration(conf.MockExpiresIn)
+	if !conf.Quiet {
+		mock.Logger = log.Default()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	server := http.Server{Handler: mock}
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			log.Printf("error: %s\n", err)
+			stop()
+		}
+	}()
+	log.Printf("Serving a mock provider with issuer %s\n", mock.Issuer)
+	<-ctx.Done()
+	_ = server.Shutdown(context.Background())
+	return 0
+}
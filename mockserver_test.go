@@ -0,0 +1,80 @@
+package main_test
+
+import (
+	"fmt"
+	"net/http"
+	"os/exec"
+	"regexp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Mock server", func() {
+	var (
+		issuer string
+		flags  []string
+	)
+
+	start := func(args ...string) *gexec.Session {
+		session, err := gexec.Start(exec.Command(cmdPath, args...), GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+		return session
+	}
+
+	BeforeEach(func() {
+		flags = []string{"-mock-claims", `{"email":"dev@example.com"}`}
+	})
+
+	JustBeforeEach(func() {
+		port, err := EphemeralPort()
+		Expect(err).ToNot(HaveOccurred())
+		issuer = fmt.Sprintf("http://127.0.0.1:%d", port)
+		session := start(append([]string{"mock-server", "-serve-addr", fmt.Sprintf("127.0.0.1:%d", port)}, flags...)...)
+		Eventually(session.Err).Should(gbytes.Say("Serving a mock provider with issuer " + regexp.QuoteMeta(issuer)))
+	})
+
+	AfterEach(func() {
+		gexec.TerminateAndWait()
+	})
+
+	It("should issue a verifiable id_token through the code flow", func() {
+		port, err := EphemeralPort()
+		Expect(err).ToNot(HaveOccurred())
+		session := start("auth", "-issuer", issuer, "-id", "myclient", "-pkce", "-scope", "openid",
+			"-port", fmt.Sprint(port), "-verify-id-token", "-userinfo", "-format", "token")
+		re := regexp.MustCompile(regexp.QuoteMeta(issuer+"/authorize") + `\S+`)
+		Eventually(func() []byte { return re.Find(session.Err.Contents()) }).ShouldNot(BeNil())
+
+		// The mock approves right away, so following its redirect is the
+		// callback.
+		res, err := http.Get(string(re.Find(session.Err.Contents())))
+		Expect(err).ToNot(HaveOccurred())
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+		Eventually(session).Should(gexec.Exit(0))
+		Expect(session.Err).To(gbytes.Say(`"email": "dev@example.com"`))
+		Expect(session.Out.Contents()).To(MatchRegexp(`^eyJ\S+\.\S+\.\S+\n$`))
+	})
+
+	Context("with a client secret", func() {
+		BeforeEach(func() {
+			flags = append(flags, "-id", "myclient", "-secret", "abc")
+		})
+
+		It("should issue tokens for the client_credentials grant", func() {
+			session := start("-flow", "client_credentials", "-token", issuer+"/token", "-id", "myclient", "-secret", "abc")
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "eyJ`))
+		})
+
+		It("should reject another secret", func() {
+			session := start("-flow", "client_credentials", "-token", issuer+"/token", "-id", "myclient", "-secret", "wrong")
+			Eventually(session).Should(gexec.Exit(7))
+			Expect(session.Err).To(gbytes.Say("invalid_client"))
+		})
+	})
+})
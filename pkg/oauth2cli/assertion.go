@@ -0,0 +1,163 @@
+package oauth2cli
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// AuthPrivateKeyJWT is the Config.AuthStyle of clients that authenticate
+// with a client_assertion JWT signed by Config.ClientKey (RFC 7523).
+const AuthPrivateKeyJWT = "private_key_jwt"
+
+const (
+	clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	// assertionLifetime is how long a client_assertion is valid for. Each
+	// request gets its own, so it only needs to cover clock skew.
+	assertionLifetime = 2 * time.Minute
+)
+
+// loadClientKey reads an RSA or P-256 EC private key from a PKCS#1, SEC 1 or
+// PKCS#8 PEM file.
+func loadClientKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return signingKey(path, key)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return signingKey(path, key)
+}
+
+// signingKey checks that key can sign a client_assertion.
+func signingKey(path string, key interface{}) (crypto.Signer, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("%s: only P-256 EC keys are supported", path)
+		}
+		return k, nil
+	}
+	return nil, fmt.Errorf("%s: not an RSA or EC private key", path)
+}
+
+// clientAssertion returns a client_assertion for clientID, signed with RS256
+// or ES256 depending on the key.
+func clientAssertion(key crypto.Signer, keyID, clientID, audience string, now time.Time) (string, error) {
+	header := map[string]interface{}{"typ": "JWT"}
+	if keyID != "" {
+		header["kid"] = keyID
+	}
+	claims := map[string]interface{}{
+		"iss": clientID,
+		"sub": clientID,
+		"aud": audience,
+		"jti": randString(),
+		"iat": now.Unix(),
+		"exp": now.Add(assertionLifetime).Unix(),
+	}
+	return signJWT(key, header, claims)
+}
+
+// signJWT returns the JWS of claims, setting the alg of header to RS256 or
+// ES256 depending on the key.
+func signJWT(key crypto.Signer, header, claims map[string]interface{}) (string, error) {
+	header["alg"] = "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		header["alg"] = "ES256"
+	}
+	var parts []string
+	for _, v := range []interface{}{header, claims} {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, base64.RawURLEncoding.EncodeToString(b))
+	}
+	digest := sha256.Sum256([]byte(strings.Join(parts, ".")))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			return "", err
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			return "", err
+		}
+		// JWS ECDSA signatures are the fixed size R and S concatenated.
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	default:
+		return "", errors.New("unsupported signing key")
+	}
+	return strings.Join(append(parts, base64.RawURLEncoding.EncodeToString(signature)), "."), nil
+}
+
+// assertionTransport adds a fresh client_assertion to the form posts that
+// authenticate the client, which are those with its client_id.
+type assertionTransport struct {
+	Key       crypto.Signer
+	KeyID     string
+	ClientID  string
+	Audience  string
+	Transport http.RoundTripper
+}
+
+func (a assertionTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Method != "POST" || r.Body == nil || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return a.Transport.RoundTrip(r)
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	form, err := url.ParseQuery(string(body))
+	if err == nil && form.Get("client_id") == a.ClientID {
+		assertion, err := clientAssertion(a.Key, a.KeyID, a.ClientID, a.Audience, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("client_assertion: %w", err)
+		}
+		form.Set("client_assertion_type", clientAssertionType)
+		form.Set("client_assertion", assertion)
+		body = []byte(form.Encode())
+	}
+	r = r.Clone(r.Context())
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return a.Transport.RoundTrip(r)
+}
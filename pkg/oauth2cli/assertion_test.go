@@ -0,0 +1,73 @@
+package oauth2cli
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("clientAssertion", func() {
+	const tokenURL = "https://issuer.example/token"
+	now := time.Unix(1700000000, 0)
+
+	It("should sign with RS256 for an RSA key", func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+		keys := []jwk{{
+			Kty: "RSA",
+			Kid: "rsa-1",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}
+
+		assertion, err := clientAssertion(key, "rsa-1", "123", tokenURL, now)
+		Expect(err).ToNot(HaveOccurred())
+		// The client is both the issuer and the subject, for the token
+		// endpoint.
+		Expect(verifyIDToken(assertion, keys, "123", tokenURL, now)).To(Succeed())
+
+		decoded, err := DecodeJWT(assertion)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(decoded.Header).To(HaveKeyWithValue("alg", "RS256"))
+		Expect(decoded.Header).To(HaveKeyWithValue("kid", "rsa-1"))
+		Expect(decoded.Claims).To(HaveKeyWithValue("sub", "123"))
+		Expect(decoded.Claims).To(HaveKey("jti"))
+		Expect(decoded.Expiry).To(Equal(now.Add(assertionLifetime)))
+	})
+
+	It("should sign with ES256 for a P-256 key", func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		keys := []jwk{{
+			Kty: "EC",
+			Crv: "P-256",
+			X:   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+			Y:   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+		}}
+
+		assertion, err := clientAssertion(key, "", "123", tokenURL, now)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(verifyIDToken(assertion, keys, "123", tokenURL, now)).To(Succeed())
+	})
+
+	It("should use a new jti for each assertion", func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+
+		first, err := clientAssertion(key, "", "123", tokenURL, now)
+		Expect(err).ToNot(HaveOccurred())
+		second, err := clientAssertion(key, "", "123", tokenURL, now)
+		Expect(err).ToNot(HaveOccurred())
+
+		a, _ := DecodeJWT(first)
+		b, _ := DecodeJWT(second)
+		Expect(a.Claims["jti"]).ToNot(Equal(b.Claims["jti"]))
+	})
+})
@@ -0,0 +1,79 @@
+package oauth2cli
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CallbackServer serves the callbacks of several code flows on one port,
+// routing each request to the flow whose redirect URL has its path, so that
+// the flows can be authorized at the same time. It's set as
+// Flow.CallbackServer.
+type CallbackServer struct {
+	listener net.Listener
+	server   http.Server
+
+	mu       sync.Mutex
+	handlers map[string]http.Handler
+}
+
+// ListenCallbacks returns a CallbackServer listening on iface and port, or a
+// free port if it's 0, which serves until it's closed.
+func ListenCallbacks(iface string, port int) (*CallbackServer, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(iface, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	s := &CallbackServer{listener: listener, handlers: map[string]http.Handler{}}
+	s.server.Handler = s
+	go func() { _ = s.server.Serve(listener) }()
+	return s, nil
+}
+
+// Addr is the address the server listens on.
+func (s *CallbackServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops the server.
+func (s *CallbackServer) Close() error {
+	return s.server.Shutdown(context.Background())
+}
+
+func (s *CallbackServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	h := s.handlers[r.URL.Path]
+	paths := make([]string, 0, len(s.handlers))
+	for path := range s.handlers {
+		paths = append(paths, path)
+	}
+	s.mu.Unlock()
+	if h == nil {
+		sort.Strings(paths)
+		http.Error(w, fmt.Sprintf("Not found: the callbacks are on %s, check the redirect URL registered with the provider", strings.Join(paths, ", ")), http.StatusNotFound)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+// handle routes the requests for path to h until the returned func is
+// called.
+func (s *CallbackServer) handle(path string, h http.Handler) (func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.handlers[path]; ok {
+		return nil, fmt.Errorf("another flow already has the callback on %s", path)
+	}
+	s.handlers[path] = h
+	return func() {
+		s.mu.Lock()
+		delete(s.handlers, path)
+		s.mu.Unlock()
+	}, nil
+}
@@ -0,0 +1,352 @@
+package oauth2cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Grant flows for Config.Flow.
+const (
+	FlowCode              = "code"
+	FlowDevice            = "device"
+	FlowClientCredentials = "client_credentials"
+	FlowRefresh           = "refresh"
+	FlowTokenExchange     = "token_exchange"
+)
+
+// AuthNone is the Config.AuthStyle of public clients, which send just their
+// client_id to the token endpoint.
+const AuthNone = "none"
+
+// authStyles maps Config.AuthStyle to how the client credentials are sent to
+// the token endpoint. Auto detection retries with the other style on failure.
+// The OpenID Connect token_endpoint_auth_method names are accepted too.
+var authStyles = map[string]oauth2.AuthStyle{
+	"auto":                oauth2.AuthStyleAutoDetect,
+	"header":              oauth2.AuthStyleInHeader,
+	"basic":               oauth2.AuthStyleInHeader,
+	"client_secret_basic": oauth2.AuthStyleInHeader,
+	"params":              oauth2.AuthStyleInParams,
+	"post":                oauth2.AuthStyleInParams,
+	"client_secret_post":  oauth2.AuthStyleInParams,
+	AuthNone:              oauth2.AuthStyleInParams,
+	AuthPrivateKeyJWT:     oauth2.AuthStyleInParams,
+	AuthTLSClient:         oauth2.AuthStyleInParams,
+	AuthSelfSignedTLS:     oauth2.AuthStyleInParams,
+}
+
+// Config.AuthStyle of clients that authenticate with their ClientCert, which
+// is issued by a CA or registered with the provider (RFC 8705 section 2).
+const (
+	AuthTLSClient     = "tls_client_auth"
+	AuthSelfSignedTLS = "self_signed_tls_client_auth"
+)
+
+// clientSecret is the secret to authenticate with, none for the styles that
+// don't use one even if one is configured.
+func (c Config) clientSecret() string {
+	switch c.AuthStyle {
+	case AuthNone, AuthPrivateKeyJWT, AuthTLSClient, AuthSelfSignedTLS:
+		return ""
+	}
+	return c.ClientSecret
+}
+
+// Config configures a Flow. The JSON names are those of the oauth2-cli
+// config file.
+type Config struct {
+	Flow          string `json:"flow"`
+	ClientID      string `json:"client_id"`
+	ClientSecret  string `json:"client_secret"`
+	AuthURL       string `json:"auth_url"`
+	TokenURL      string `json:"token_url"`
+	DeviceAuthURL string `json:"device_auth_url"`
+	RefreshToken  string `json:"refresh_token"`
+	// PriorIDToken is the id_token issued along with RefreshToken. The sub
+	// of the one FlowRefresh issues must be the same (OpenID Connect Core
+	// section 12.2), else it's warned about, or fails with Strict.
+	PriorIDToken string `json:"prior_id_token"`
+	// SubjectToken, and the optional ActorToken, are exchanged for a token
+	// of RequestedTokenType by FlowTokenExchange (RFC 8693). The types are
+	// URNs, or short names such as access_token or jwt.
+	SubjectToken       string `json:"subject_token"`
+	SubjectTokenType   string `json:"subject_token_type"`
+	ActorToken         string `json:"actor_token"`
+	ActorTokenType     string `json:"actor_token_type"`
+	RequestedTokenType string `json:"requested_token_type"`
+	// TokenResponseMap is a JSON object of the token response fields to
+	// take from elsewhere in the response instead, as dotted paths such as
+	// {"access_token": "authed_user.access_token"} for Slack's user token.
+	// Fields whose path isn't in a response are left as they are.
+	TokenResponseMap string `json:"token_response_map"`
+	// IntrospectURL is the RFC 7662 endpoint that Introspect posts the
+	// access token to once it is issued.
+	IntrospectURL string `json:"introspect_url"`
+	Introspect    bool   `json:"introspect"`
+	// RevokeURL is the RFC 7009 endpoint used by Revoke.
+	RevokeURL string `json:"revoke_url"`
+	// EndSessionURL is the OpenID Connect end_session_endpoint that Logout
+	// sends the browser to.
+	EndSessionURL string `json:"end_session_url"`
+	// UserinfoURL is the OpenID Connect userinfo endpoint whose claims for
+	// the access token are logged with Userinfo.
+	UserinfoURL string `json:"userinfo_url"`
+	Userinfo    bool   `json:"userinfo"`
+	// PARURL is the RFC 9126 endpoint that the authorization params are
+	// pushed to with PAR, leaving just a request_uri in the auth URL.
+	PARURL string `json:"par_url"`
+	PAR    bool   `json:"par"`
+	// RequestObject sends the authorization params as a request object JWT
+	// signed with ClientKey (JAR, RFC 9101), which PAR pushes in turn.
+	RequestObject bool `json:"request_object"`
+	// AuthStyle is how the client credentials are sent to the token
+	// endpoint: auto, header (or basic), params (or post), none,
+	// private_key_jwt, tls_client_auth or self_signed_tls_client_auth.
+	AuthStyle string `json:"auth_style"`
+	// ClientKey is the PEM private key that signs the client_assertion of
+	// private_key_jwt and the request object of RequestObject, with its JWKS
+	// key ID in ClientKeyID.
+	ClientKey   string `json:"client_key"`
+	ClientKeyID string `json:"client_key_id"`
+	// Scope is a space separated list of scopes.
+	Scope       SpaceList  `json:"scopes"`
+	Audiences   StringList `json:"audiences"`
+	Resources   StringList `json:"resources"`
+	AuthParams  StringList `json:"auth_params"`
+	TokenParams StringList `json:"token_params"`
+
+	// Interface, Port and Callback are where the callback server listens
+	// and what redirect URL is sent to the provider.
+	Interface     string `json:"interface"`
+	Port          int    `json:"port"`
+	Callback      string `json:"callback"`
+	CodeParam     string `json:"code_param"`
+	StateParam    string `json:"state_param"`
+	AcceptAnyPath bool   `json:"accept_any_path"`
+	TLS           bool   `json:"tls"`
+	TLSCert       string `json:"tls_cert"`
+	TLSKey        string `json:"tls_key"`
+	// Tunnel forwards a public HTTPS URL to the callback server, for
+	// providers that refuse loopback redirect URLs, by running ngrok,
+	// cloudflared, or a command with {addr} for the server's address that
+	// prints the URL.
+	Tunnel string `json:"tunnel"`
+	// CallbackParams are callback params, such as session_state, that are
+	// kept in the token's CallbackParamsExtra.
+	CallbackParams StringList `json:"callback_params"`
+	// Loop keeps the callback server running for that many authorizations,
+	// or until the context is done if negative, passing each token to
+	// Flow.OnToken.
+	Loop int `json:"loop"`
+	// Open opens the auth URL in the default browser.
+	Open bool `json:"open"`
+	// QR also shows the auth URL, or the device flow's verification URL, as
+	// a QR code, to scan with a phone when the terminal is remote.
+	QR bool `json:"qr"`
+	// SuccessTemplate is an html/template file for the page shown in the
+	// browser once the token is issued, rendered with a SuccessPage.
+	SuccessTemplate string `json:"success_template"`
+	// ErrorTemplate is an html/template file for the page shown when the
+	// provider redirects back with an error, rendered with the
+	// AuthorizationError.
+	ErrorTemplate string `json:"error_template"`
+	// ResultTemplate is an html/template file for both of those pages,
+	// rendered with a ResultPage, where SuccessTemplate or ErrorTemplate
+	// isn't given.
+	ResultTemplate string `json:"result_template"`
+	// NoBrowserToken is kept for older configs, the token is never shown
+	// in the browser.
+	NoBrowserToken bool `json:"no_browser_token"`
+	// Manual reads the code pasted by the user instead of serving the
+	// callback, for when no port can be opened or the provider only allows
+	// an out-of-band redirect.
+	Manual bool `json:"manual"`
+	// PendingFile is a file that the state, nonce, PKCE verifier and
+	// redirect URL of each authorization are kept in until its callback
+	// arrives. With Resume, the authorization pending in it is completed
+	// instead of starting a new one, such as after the process was killed.
+	PendingFile string `json:"pending_file"`
+	Resume      bool   `json:"resume"`
+	// Prompt, MaxAge (in seconds), LoginHint, ACRValues and UILocales are
+	// the OpenID Connect params for how the user is authenticated. The
+	// id_token must then have a recent enough auth_time and one of the acr
+	// values, which is a warning unless Strict is set.
+	Prompt    string `json:"prompt"`
+	MaxAge    string `json:"max_age"`
+	LoginHint string `json:"login_hint"`
+	ACRValues string `json:"acr_values"`
+	UILocales string `json:"ui_locales"`
+	// ResponseType is the space separated response_type, code by default,
+	// or token, id_token or a combination for the implicit and hybrid
+	// flows. Their response arrives in the URL fragment, which a page
+	// served by the callback posts back.
+	ResponseType string `json:"response_type"`
+	// PreferIDToken is which id_token of the hybrid flow is checked and
+	// output when the callback and the token response both have one:
+	// response, the default, or fragment.
+	PreferIDToken string `json:"prefer_id_token"`
+	// Offline is how offline access, a refresh token, is asked for: auto by
+	// default, on, or off for providers that reject access_type=offline or
+	// the offline_access scope.
+	Offline string `json:"offline"`
+	// ResponseMode is sent as response_mode, such as form_post for the
+	// provider to post the callback params rather than put them in the
+	// query, or jwt, query.jwt, fragment.jwt or form_post.jwt for them to
+	// arrive as a JWT (JARM) that's verified against the JWKS.
+	ResponseMode string `json:"response_mode"`
+
+	PKCE          bool       `json:"pkce"`
+	PKCEMethod    string     `json:"pkce_method"`
+	OIDCNonce     bool       `json:"nonce"`
+	DecryptKey    string     `json:"id_token_decrypt_key"`
+	VerifyIDToken bool       `json:"verify_id_token"`
+	JWKSURL       string     `json:"jwks_url"`
+	JWKSFile      string     `json:"jwks_file"`
+	Issuer        string     `json:"issuer"`
+	DecodeIDToken bool       `json:"decode_id_token"`
+	ScopeRequired string     `json:"scope_required"`
+	RequireClaims StringList `json:"require_claims"`
+	Strict        bool       `json:"strict"`
+	StrictParams  bool       `json:"strict_callback_params"`
+	AllowHosts    string     `json:"allow_token_hosts"`
+	CertPins      StringList `json:"pin_cert_sha256"`
+	// DPoP sends DPoP proofs with the token requests, for tokens bound to
+	// the Flow.DPoPKey (RFC 9449).
+	DPoP bool `json:"dpop"`
+	// Summary logs the token type, granted scopes, expiry and which tokens
+	// were issued once the token is.
+	Summary bool `json:"summary"`
+	// ClientCert and ClientCertKey are the PEM certificate and key that
+	// authenticate requests to the provider with mutual TLS (RFC 8705).
+	ClientCert    string `json:"client_cert"`
+	ClientCertKey string `json:"client_cert_key"`
+	// CACert is a PEM bundle of extra CAs to trust for requests to the
+	// provider. Insecure skips certificate verification altogether.
+	CACert   string `json:"ca_cert"`
+	Insecure bool   `json:"insecure"`
+	// Proxy is the proxy URL for requests to the provider, overriding the
+	// HTTP_PROXY and HTTPS_PROXY environment variables.
+	Proxy string `json:"proxy"`
+
+	HeaderFile  string `json:"header_file"`
+	UserAgent   string `json:"user_agent"`
+	Cookies     bool   `json:"cookies"`
+	Verbose     bool   `json:"verbose"`
+	NoRedact    bool   `json:"no_redact"`
+	RequestSpec string `json:"export_request_spec"`
+	// DebugOut is a file that Authorize writes its requests to, with the
+	// auth URL and the callback: a HAR file if it ends in .har, otherwise
+	// the equivalent curl commands. They are redacted unless NoRedact.
+	DebugOut string `json:"debug_out"`
+	// TokenHeaders are "Name: Value" headers sent to the provider, after
+	// those of HeaderFile.
+	TokenHeaders StringList `json:"token_headers"`
+
+	// Retries is how many times a token request is retried after a 5xx or
+	// 429 response or network error, with exponential backoff from
+	// RetryBackoff (500ms if zero) unless the response has a Retry-After.
+	Retries      int      `json:"retries"`
+	RetryBackoff Duration `json:"retry_backoff"`
+	// DevicePollJitter adds a random wait of up to its length to each poll
+	// of the device flow, and DeviceMaxInterval caps how far slow_down backs
+	// the polling off, though never below the provider's interval.
+	DevicePollJitter  Duration `json:"device_poll_jitter"`
+	DeviceMaxInterval Duration `json:"device_max_interval"`
+
+	// Timeout limits the whole flow, CallbackWait just the wait for the
+	// callback and HTTPTimeout each request to the provider.
+	Timeout       Duration `json:"timeout"`
+	CallbackWait  Duration `json:"callback_wait"`
+	HTTPTimeout   Duration `json:"http_timeout"`
+	CallbackDelay Duration `json:"callback_delay"`
+}
+
+// DefaultConfig returns a Config with the defaults of oauth2-cli.
+func DefaultConfig() Config {
+	return Config{
+		Flow:       FlowCode,
+		AuthStyle:  "auto",
+		Interface:  "127.0.0.1",
+		Port:       8081,
+		Callback:   "/oauth/callback",
+		CodeParam:  "code",
+		StateParam: "state",
+		PKCEMethod: PKCES256,
+		Offline:    OfflineAuto,
+		Summary:    true,
+		Retries:    3,
+		Timeout:    Duration(5 * time.Minute),
+	}
+}
+
+// StringList is a list of config values.
+type StringList []string
+
+// SpaceList is a space separated list, which can also be given as a JSON
+// array for providers whose scopes are easier to read one per entry.
+type SpaceList string
+
+func (l *SpaceList) UnmarshalJSON(b []byte) error {
+	var list []string
+	if err := json.Unmarshal(b, &list); err == nil {
+		*l = SpaceList(strings.Join(list, " "))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("must be a string or an array of strings: %w", err)
+	}
+	*l = SpaceList(s)
+	return nil
+}
+
+// Duration is a time.Duration that can be set from a flag or a JSON string
+// such as "2m".
+type Duration time.Duration
+
+func (d *Duration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"2m\": %w", err)
+	}
+	return d.Set(s)
+}
+
+// scopes splits a space separated scope string, dropping empty entries.
+func scopes(scope SpaceList) []string {
+	fields := strings.Fields(string(scope))
+	if len(fields) == 0 {
+		return []string{}
+	}
+	return fields
+}
+
+// paramOptions parses key=value pairs given with -auth-param or -token-param.
+func paramOptions(params StringList) ([]oauth2.AuthCodeOption, error) {
+	var opts []oauth2.AuthCodeOption
+	for _, param := range params {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid parameter %q, expected key=value", param)
+		}
+		opts = append(opts, oauth2.SetAuthURLParam(kv[0], kv[1]))
+	}
+	return opts, nil
+}
@@ -0,0 +1,52 @@
+package oauth2cli
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("scopes", func() {
+	It("should split on whitespace", func() {
+		Expect(scopes(" openid  email\tprofile ")).To(Equal([]string{"openid", "email", "profile"}))
+	})
+
+	It("should return an empty slice for an empty scope", func() {
+		Expect(scopes("")).To(Equal([]string{}))
+	})
+})
+
+var _ = Describe("paramOptions", func() {
+	It("should reject parameters without a value", func() {
+		_, err := paramOptions(StringList{"prompt"})
+		Expect(err).To(MatchError(`invalid parameter "prompt", expected key=value`))
+	})
+
+	It("should allow empty values", func() {
+		opts, err := paramOptions(StringList{"prompt=", "hd=example.com"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(opts).To(HaveLen(2))
+	})
+})
+
+var _ = Describe("ApplyProvider", func() {
+	It("should fill in the endpoints that aren't set", func() {
+		conf := DefaultConfig()
+		conf.TokenURL = "https://proxy.example/token"
+		Expect(ApplyProvider("dropbox", &conf)).To(Succeed())
+		Expect(conf.AuthURL).To(Equal("https://www.dropbox.com/oauth2/authorize"))
+		Expect(conf.TokenURL).To(Equal("https://proxy.example/token"))
+		Expect(conf.AuthStyle).To(Equal("header"))
+		Expect(conf.AuthParams).To(Equal(StringList{"token_access_type=offline"}))
+	})
+
+	It("should keep auth params that are given", func() {
+		conf := Config{AuthParams: StringList{"token_access_type=online"}}
+		Expect(ApplyProvider("dropbox", &conf)).To(Succeed())
+		Expect(conf.AuthParams).To(Equal(StringList{"token_access_type=online"}))
+	})
+
+	It("should reject unknown providers", func() {
+		conf := DefaultConfig()
+		Expect(ApplyProvider("example", &conf)).To(MatchError(ContainSubstring(`unknown provider "example"`)))
+	})
+})
@@ -0,0 +1,304 @@
+package oauth2cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recorder keeps the requests of a flow for Config.DebugOut: those to the
+// provider, the auth URL opened in the browser and the callback. Unless
+// disabled, they are redacted as the verbose logs are.
+type recorder struct {
+	redact bool
+
+	mu      sync.Mutex
+	entries []harEntry
+}
+
+// The parts of a HAR 1.2 log (http://www.softwareishard.com/blog/har-12-spec/)
+// that the flow fills in.
+type harLog struct {
+	Log struct {
+		Version string     `json:"version"`
+		Creator harCreator `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            int64       `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string       `json:"method"`
+	URL         string       `json:"url"`
+	HTTPVersion string       `json:"httpVersion"`
+	Headers     []harPair    `json:"headers"`
+	QueryString []harPair    `json:"queryString"`
+	Cookies     []harPair    `json:"cookies"`
+	PostData    *harPostData `json:"postData,omitempty"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int        `json:"status"`
+	StatusText  string     `json:"statusText"`
+	HTTPVersion string     `json:"httpVersion"`
+	Headers     []harPair  `json:"headers"`
+	Cookies     []harPair  `json:"cookies"`
+	Content     harContent `json:"content"`
+	RedirectURL string     `json:"redirectURL"`
+	HeadersSize int        `json:"headersSize"`
+	BodySize    int        `json:"bodySize"`
+}
+
+type harPair struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harTimings struct {
+	Send    int64 `json:"send"`
+	Wait    int64 `json:"wait"`
+	Receive int64 `json:"receive"`
+}
+
+// add records a request, with its response if there was one.
+func (rec *recorder) add(comment string, r *http.Request, body []byte, status int, header http.Header, resBody []byte, start time.Time) {
+	u := *r.URL
+	if u.Host == "" {
+		// Requests to the callback server have just the path.
+		u.Scheme, u.Host = "http", r.Host
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+	}
+	if rec.redact {
+		u.RawQuery = string(redactBody([]byte(u.RawQuery)))
+		body = redactBody(body)
+		resBody = redactBody(resBody)
+	}
+	elapsed := time.Since(start).Milliseconds()
+	entry := harEntry{
+		StartedDateTime: start,
+		Time:            elapsed,
+		Request: harRequest{
+			Method:      r.Method,
+			URL:         u.String(),
+			HTTPVersion: "HTTP/1.1",
+			Headers:     rec.headers(r.Header),
+			QueryString: pairs(u.Query()),
+			Cookies:     []harPair{},
+			HeadersSize: -1,
+			BodySize:    len(body),
+		},
+		Response: harResponse{
+			Status:      status,
+			StatusText:  http.StatusText(status),
+			HTTPVersion: "HTTP/1.1",
+			Headers:     rec.headers(header),
+			Cookies:     []harPair{},
+			Content:     harContent{Size: len(resBody), MimeType: header.Get("Content-Type"), Text: string(resBody)},
+			RedirectURL: header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    len(resBody),
+		},
+		Timings: harTimings{Wait: elapsed},
+		Comment: comment,
+	}
+	if len(body) > 0 {
+		entry.Request.PostData = &harPostData{MimeType: r.Header.Get("Content-Type"), Text: string(body)}
+	}
+	rec.mu.Lock()
+	rec.entries = append(rec.entries, entry)
+	rec.mu.Unlock()
+}
+
+// browser records the auth URL shown to the user, which the browser requests
+// rather than the flow.
+func (rec *recorder) browser(visitURL string) {
+	r, err := http.NewRequest("GET", visitURL, nil)
+	if err != nil {
+		return
+	}
+	rec.add("opened in the browser", r, nil, 0, http.Header{}, nil, time.Now())
+}
+
+func (rec *recorder) headers(header http.Header) []harPair {
+	list := []harPair{}
+	for name, values := range header {
+		for _, v := range values {
+			if rec.redact {
+				v = redactHeader(name, v)
+			}
+			list = append(list, harPair{name, v})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func pairs(values url.Values) []harPair {
+	list := []harPair{}
+	for name, vs := range values {
+		for _, v := range vs {
+			list = append(list, harPair{name, v})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// write saves the requests to path, as a HAR file if it ends in .har and
+// otherwise as the equivalent curl commands.
+func (rec *recorder) write(path string) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	var data []byte
+	if strings.EqualFold(filepath.Ext(path), ".har") {
+		var har harLog
+		har.Log.Version = "1.2"
+		har.Log.Creator = harCreator{Name: "oauth2-cli", Version: "1"}
+		har.Log.Entries = rec.entries
+		if har.Log.Entries == nil {
+			har.Log.Entries = []harEntry{}
+		}
+		var err error
+		if data, err = json.MarshalIndent(har, "", "  "); err != nil {
+			return err
+		}
+	} else {
+		data = rec.curl()
+	}
+	// The dump may hold secrets, with -no-redact at least.
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// curl returns the recorded requests as curl commands, with the browser's
+// noted in comments.
+func (rec *recorder) curl() []byte {
+	var b bytes.Buffer
+	for _, e := range rec.entries {
+		if e.Response.Status == 0 {
+			fmt.Fprintf(&b, "# %s:\n# %s\n\n", sentence(e.Comment), e.Request.URL)
+			continue
+		}
+		if e.Comment != "" {
+			fmt.Fprintf(&b, "# %s\n", sentence(e.Comment))
+		}
+		fmt.Fprintf(&b, "# %s %s: %d %s\n", e.Request.Method, e.Request.URL, e.Response.Status, e.Response.StatusText)
+		fmt.Fprintf(&b, "curl -X %s %s", e.Request.Method, quoteArg(e.Request.URL))
+		for _, h := range e.Request.Headers {
+			fmt.Fprintf(&b, " \\\n  -H %s", quoteArg(h.Name+": "+h.Value))
+		}
+		if e.Request.PostData != nil {
+			fmt.Fprintf(&b, " \\\n  --data-raw %s", quoteArg(e.Request.PostData.Text))
+		}
+		b.WriteString("\n\n")
+	}
+	return b.Bytes()
+}
+
+// sentence capitalizes the first letter of a comment.
+func sentence(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// quoteArg single quotes s for a POSIX shell.
+func quoteArg(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// recordTransport records the requests to the provider and their responses.
+type recordTransport struct {
+	Recorder  *recorder
+	Transport http.RoundTripper
+}
+
+func (t recordTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+		r.Body.Close()
+		r = r.Clone(r.Context())
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	start := time.Now()
+	res, err := t.Transport.RoundTrip(r)
+	if err != nil {
+		t.Recorder.add("failed: "+err.Error(), r, body, 0, http.Header{}, nil, start)
+		return nil, err
+	}
+	resBody, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(resBody))
+	t.Recorder.add("", r, body, res.StatusCode, res.Header, resBody, start)
+	return res, nil
+}
+
+// recordHandler records the requests to the callback server and the status
+// they are answered with.
+func recordHandler(rec *recorder, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body []byte
+		if r.Body != nil {
+			body, _ = ioutil.ReadAll(r.Body)
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r)
+		rec.add("callback from the browser", r, body, sw.status, w.Header(), nil, start)
+	})
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
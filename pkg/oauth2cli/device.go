@@ -0,0 +1,216 @@
+package oauth2cli
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const deviceGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// deviceAuth is a device authorization response (RFC 8628 section 3.2).
+type deviceAuth struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	// VerificationURL is what Google calls verification_uri.
+	VerificationURL string `json:"verification_url"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+}
+
+// deviceFlow runs the device authorization grant, printing the code for the
+// user to enter and then polling the token endpoint until it's issued.
+func (f *Flow) deviceFlow(ctx context.Context, client *http.Client) (*oauth2.Token, error) {
+	conf := f.Config
+	params := url.Values{"client_id": {conf.ClientID}}
+	if s := scopes(conf.Scope); len(s) > 0 {
+		params.Set("scope", strings.Join(s, " "))
+	}
+	if secret := conf.clientSecret(); secret != "" {
+		params.Set("client_secret", secret)
+	}
+
+	var auth deviceAuth
+	resp, body, err := postForm(ctx, client, conf.DeviceAuthURL, params)
+	if err != nil {
+		return nil, classify(ErrUnreachable, fmt.Errorf("device authorization: %w", err))
+	}
+	if status := resp.StatusCode; status != http.StatusOK {
+		return nil, fmt.Errorf("device authorization: %d %s\nResponse: %s", status, http.StatusText(status), body)
+	}
+	if err := json.Unmarshal(body, &auth); err != nil {
+		return nil, fmt.Errorf("device authorization: %w", err)
+	}
+	if auth.VerificationURI == "" {
+		auth.VerificationURI = auth.VerificationURL
+	}
+
+	f.logf("To authorize, visit %s and enter the code: %s\n", auth.VerificationURI, auth.UserCode)
+	openURL := auth.VerificationURI
+	if auth.VerificationURIComplete != "" {
+		f.logf("Or visit this URL in your browser:\n%s\n\n", auth.VerificationURIComplete)
+		openURL = auth.VerificationURIComplete
+	}
+	if conf.QR {
+		f.showQR(openURL)
+	}
+	if conf.Open {
+		if err := openBrowser(openURL); err != nil {
+			f.logf("warning: failed to open browser: %s\n", err)
+		}
+	}
+
+	interval := time.Duration(auth.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	limit := time.Duration(conf.DeviceMaxInterval)
+	if limit > 0 && limit < interval {
+		limit = interval
+	}
+	deadline := time.Now().Add(time.Duration(auth.ExpiresIn) * time.Second)
+
+	params.Del("scope")
+	params.Set("grant_type", deviceGrantType)
+	params.Set("device_code", auth.DeviceCode)
+	wait := pollWait(interval, time.Duration(conf.DevicePollJitter), limit, randFloat)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-clockAfter(wait):
+		}
+		if auth.ExpiresIn > 0 && time.Now().After(deadline) {
+			return nil, fmt.Errorf("device code expired after %ds", auth.ExpiresIn)
+		}
+
+		resp, body, err := postForm(ctx, client, conf.TokenURL, params)
+		if err != nil {
+			return nil, classify(ErrUnreachable, fmt.Errorf("device token: %w", err))
+		}
+		status := resp.StatusCode
+		if status == http.StatusOK {
+			return parseToken(body)
+		}
+
+		var tokenErr struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+			URI         string `json:"error_uri"`
+		}
+		_ = json.Unmarshal(body, &tokenErr)
+		reason := tokenErr.Error
+		// A rate limit is waited out for as long as Retry-After asks, and
+		// is otherwise as good as a slow_down.
+		limited, hasRetryAfter := time.Duration(0), false
+		if status == http.StatusTooManyRequests {
+			limited, hasRetryAfter = retryAfter(resp)
+			reason = fmt.Sprintf("%d %s", status, http.StatusText(status))
+		}
+		switch {
+		case hasRetryAfter:
+		case tokenErr.Error == "authorization_pending":
+		case tokenErr.Error == "slow_down" || status == http.StatusTooManyRequests:
+			interval += 5 * time.Second
+			if limit > 0 && interval > limit {
+				interval = limit
+			}
+		case tokenErr.Error == "access_denied":
+			// The user denied the request, as they would on a callback.
+			return nil, &AuthorizationError{Code: tokenErr.Error, Description: tokenErr.Description, URI: tokenErr.URI}
+		default:
+			return nil, fmt.Errorf("device token: %d %s\nResponse: %s", status, http.StatusText(status), body)
+		}
+		wait = pollWait(interval, time.Duration(conf.DevicePollJitter), limit, randFloat)
+		if limited > wait {
+			wait = limited
+		}
+		if conf.Verbose {
+			f.logf("device token: %s, polling again in %s\n", reason, wait)
+		}
+	}
+}
+
+// pollWait returns how long to wait before the next poll of the device
+// flow: interval plus up to jitter, scaled by random's value in [0, 1), but
+// no more than limit if it's set.
+func pollWait(interval, jitter, limit time.Duration, random func() float64) time.Duration {
+	wait := interval
+	if jitter > 0 {
+		wait += time.Duration(random() * float64(jitter))
+	}
+	if limit > 0 && wait > limit {
+		wait = limit
+	}
+	return wait
+}
+
+// randFloat returns a random number in [0, 1).
+func randFloat() float64 {
+	var buf [8]byte
+	rand.Read(buf[:])
+	return float64(binary.BigEndian.Uint64(buf[:])>>11) / (1 << 53)
+}
+
+// postForm POSTs params to endpoint, returning the response, whose body is
+// read and closed, and the body.
+func postForm(ctx context.Context, client *http.Client, endpoint string, params url.Values) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp, body, err
+}
+
+// parseToken parses a JSON token response, keeping the raw fields as extras
+// as golang.org/x/oauth2 does.
+func parseToken(body []byte) (*oauth2.Token, error) {
+	var tj struct {
+		AccessToken  string      `json:"access_token"`
+		TokenType    string      `json:"token_type"`
+		RefreshToken string      `json:"refresh_token"`
+		ExpiresIn    json.Number `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tj); err != nil {
+		return nil, fmt.Errorf("token response: %w", err)
+	}
+	if tj.AccessToken == "" {
+		return nil, fmt.Errorf("token response has no access_token: %s", body)
+	}
+
+	token := &oauth2.Token{
+		AccessToken:  tj.AccessToken,
+		TokenType:    tj.TokenType,
+		RefreshToken: tj.RefreshToken,
+	}
+	if secs, err := tj.ExpiresIn.Int64(); err == nil && secs > 0 {
+		token.Expiry = time.Now().Add(time.Duration(secs) * time.Second)
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+	return token.WithExtra(raw), nil
+}
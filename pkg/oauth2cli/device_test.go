@@ -0,0 +1,98 @@
+package oauth2cli
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+	"golang.org/x/oauth2"
+)
+
+var _ = Describe("pollWait", func() {
+	fixed := func(v float64) func() float64 {
+		return func() float64 { return v }
+	}
+
+	It("should wait for the interval without jitter", func() {
+		Expect(pollWait(5*time.Second, 0, 0, fixed(0.9))).To(Equal(5 * time.Second))
+	})
+
+	It("should add up to the jitter", func() {
+		Expect(pollWait(5*time.Second, 2*time.Second, 0, fixed(0))).To(Equal(5 * time.Second))
+		Expect(pollWait(5*time.Second, 2*time.Second, 0, fixed(0.5))).To(Equal(6 * time.Second))
+		for i := 0; i < 100; i++ {
+			wait := pollWait(5*time.Second, 2*time.Second, 0, randFloat)
+			Expect(wait).To(BeNumerically(">=", 5*time.Second))
+			Expect(wait).To(BeNumerically("<", 7*time.Second))
+		}
+	})
+
+	It("should wait no longer than the limit", func() {
+		Expect(pollWait(5*time.Second, 2*time.Second, 6*time.Second, fixed(0.9))).To(Equal(6 * time.Second))
+		Expect(pollWait(10*time.Second, 0, 6*time.Second, fixed(0))).To(Equal(6 * time.Second))
+		Expect(pollWait(5*time.Second, 2*time.Second, 6*time.Second, fixed(0.25))).To(Equal(5500 * time.Millisecond))
+	})
+})
+
+var _ = Describe("deviceFlow", func() {
+	var server *ghttp.Server
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+			"device_code":      "mydevicecode",
+			"user_code":        "ABCD-EFGH",
+			"verification_uri": "https://provider.example/device",
+			"expires_in":       60,
+			"interval":         1,
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	run := func() (*oauth2.Token, error) {
+		f := &Flow{
+			Config: Config{
+				ClientID:      "123",
+				DeviceAuthURL: server.URL() + "/oauth/device",
+				TokenURL:      server.URL() + "/oauth/token",
+			},
+			Logger: log.New(ioutil.Discard, "", 0),
+		}
+		return f.deviceFlow(context.Background(), http.DefaultClient)
+	}
+
+	It("should wait for as long as a 429's Retry-After asks", func() {
+		waits, restore := recordWaits()
+		defer restore()
+		server.AppendHandlers(
+			ghttp.RespondWith(http.StatusTooManyRequests, "", http.Header{"Retry-After": {"2"}}),
+			ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{AccessToken: "mytoken"}),
+		)
+
+		token, err := run()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(token.AccessToken).To(Equal("mytoken"))
+		Expect(*waits).To(Equal([]time.Duration{time.Second, 2 * time.Second}))
+	})
+
+	It("should back off as for slow_down after a 429 without Retry-After", func() {
+		waits, restore := recordWaits()
+		defer restore()
+		server.AppendHandlers(
+			ghttp.RespondWith(http.StatusTooManyRequests, ""),
+			ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{AccessToken: "mytoken"}),
+		)
+
+		_, err := run()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(*waits).To(Equal([]time.Duration{time.Second, 6 * time.Second}))
+	})
+})
@@ -0,0 +1,91 @@
+package oauth2cli
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Discovery is the part of an OpenID Connect discovery document that
+// oauth2-cli uses.
+type Discovery struct {
+	Issuer                      string   `json:"issuer"`
+	AuthorizationEndpoint       string   `json:"authorization_endpoint"`
+	TokenEndpoint               string   `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint string   `json:"device_authorization_endpoint"`
+	IntrospectionEndpoint       string   `json:"introspection_endpoint"`
+	RevocationEndpoint          string   `json:"revocation_endpoint"`
+	UserinfoEndpoint            string   `json:"userinfo_endpoint"`
+	PAREndpoint                 string   `json:"pushed_authorization_request_endpoint"`
+	EndSessionEndpoint          string   `json:"end_session_endpoint"`
+	JWKSURI                     string   `json:"jwks_uri"`
+	ScopesSupported             []string `json:"scopes_supported"`
+	GrantTypesSupported         []string `json:"grant_types_supported"`
+}
+
+// Discover fetches the discovery document of Config.Issuer.
+func (f *Flow) Discover(ctx context.Context) (*Discovery, error) {
+	client, err := newHTTPClient(f.Config, f.logger(), nil)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(ctx, f.Config.Timeout)
+	defer cancel()
+	return discover(ctx, client, f.Config.Issuer)
+}
+
+func discover(ctx context.Context, client *http.Client, issuer string) (*Discovery, error) {
+	var discovery Discovery
+	wellKnown := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	if err := getJSON(ctx, client, wellKnown, &discovery); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if discovery.Issuer != issuer {
+		return nil, fmt.Errorf("discovery: issuer %q != %q", discovery.Issuer, issuer)
+	}
+	return &discovery, nil
+}
+
+// Apply sets the endpoints of conf that aren't set from the discovery
+// document.
+func (d *Discovery) Apply(conf *Config) {
+	for _, e := range d.endpoints(conf) {
+		if *e.configured == "" {
+			*e.configured = e.discovered
+		}
+	}
+}
+
+// Check returns an error for each endpoint of conf that is set but differs
+// from the discovery document.
+func (d *Discovery) Check(conf Config) []error {
+	var errs []error
+	for _, e := range d.endpoints(&conf) {
+		if *e.configured != "" && e.discovered != "" && *e.configured != e.discovered {
+			errs = append(errs, fmt.Errorf("%s %q != discovered %s %q", e.name, *e.configured, e.discoveryName, e.discovered))
+		}
+	}
+	return errs
+}
+
+type endpoint struct {
+	name          string
+	configured    *string
+	discoveryName string
+	discovered    string
+}
+
+func (d *Discovery) endpoints(conf *Config) []endpoint {
+	return []endpoint{
+		{"auth URL", &conf.AuthURL, "authorization_endpoint", d.AuthorizationEndpoint},
+		{"token URL", &conf.TokenURL, "token_endpoint", d.TokenEndpoint},
+		{"device auth URL", &conf.DeviceAuthURL, "device_authorization_endpoint", d.DeviceAuthorizationEndpoint},
+		{"introspection URL", &conf.IntrospectURL, "introspection_endpoint", d.IntrospectionEndpoint},
+		{"revocation URL", &conf.RevokeURL, "revocation_endpoint", d.RevocationEndpoint},
+		{"userinfo URL", &conf.UserinfoURL, "userinfo_endpoint", d.UserinfoEndpoint},
+		{"PAR URL", &conf.PARURL, "pushed_authorization_request_endpoint", d.PAREndpoint},
+		{"end session URL", &conf.EndSessionURL, "end_session_endpoint", d.EndSessionEndpoint},
+		{"JWKS URL", &conf.JWKSURL, "jwks_uri", d.JWKSURI},
+	}
+}
@@ -0,0 +1,228 @@
+package oauth2cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Levels of a Finding.
+const (
+	LevelOK      = "ok"
+	LevelWarning = "warning"
+	LevelError   = "error"
+)
+
+// Finding is the outcome of one of the checks of Flow.Doctor, with Fix
+// saying what to change when it isn't ok.
+type Finding struct {
+	Level   string
+	Message string
+	Fix     string
+}
+
+// doctor collects the findings of Flow.Doctor.
+type doctor struct {
+	findings []Finding
+}
+
+func (d *doctor) ok(format string, v ...interface{}) {
+	d.findings = append(d.findings, Finding{Level: LevelOK, Message: fmt.Sprintf(format, v...)})
+}
+
+func (d *doctor) warn(fix, format string, v ...interface{}) {
+	d.findings = append(d.findings, Finding{Level: LevelWarning, Message: fmt.Sprintf(format, v...), Fix: fix})
+}
+
+func (d *doctor) fail(fix, format string, v ...interface{}) {
+	d.findings = append(d.findings, Finding{Level: LevelError, Message: fmt.Sprintf(format, v...), Fix: fix})
+}
+
+// Doctor checks the config without running the flow: that the issuer's
+// discovery document resolves and agrees with it, that the endpoints the
+// flow needs respond, that the redirect URL is valid and its port can be
+// listened on, and that the scopes are ones the provider supports.
+func (f *Flow) Doctor(ctx context.Context) []Finding {
+	conf := f.Config
+	d := &doctor{}
+	client, err := newHTTPClient(conf, f.logger(), nil)
+	if err != nil {
+		d.fail("check the TLS and proxy flags", "%s", err)
+		return d.findings
+	}
+	// The endpoints' own redirects, such as to a login page, are answers.
+	noRedirects := *client
+	noRedirects.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	ctx, cancel := withTimeout(ctx, conf.Timeout)
+	defer cancel()
+
+	if conf.ClientID == "" {
+		d.fail("set -id, -id-file or OAUTH2_CLI_CLIENT_ID", "no client ID")
+	}
+
+	var discovery *Discovery
+	if conf.Issuer != "" {
+		if discovery, err = discover(ctx, client, conf.Issuer); err != nil {
+			d.fail("check -issuer, which is the URL before /.well-known/openid-configuration", "%s", err)
+		} else {
+			d.ok("discovery document of %s", conf.Issuer)
+			for _, err := range discovery.Check(conf) {
+				d.warn("use the discovered URL, or leave the flag out to discover it", "%s", err)
+			}
+			discovery.Apply(&conf)
+		}
+	}
+
+	for _, e := range doctorEndpoints(conf) {
+		d.checkEndpoint(ctx, &noRedirects, e.flag, e.url, e.method)
+	}
+	if conf.Flow == FlowCode || conf.Flow == "" {
+		d.checkRedirect(conf)
+	}
+
+	if discovery != nil && len(discovery.ScopesSupported) > 0 {
+		unsupported := 0
+		for _, scope := range strings.Fields(string(conf.Scope)) {
+			if !contains(discovery.ScopesSupported, scope) {
+				d.warn("check its spelling, though providers may accept scopes they don't list", "scope %q isn't in the provider's scopes_supported", scope)
+				unsupported++
+			}
+		}
+		if unsupported == 0 && conf.Scope != "" {
+			d.ok("scopes %s are supported", conf.Scope)
+		}
+	}
+	if discovery != nil && len(discovery.GrantTypesSupported) > 0 {
+		if grant := doctorGrantTypes[conf.Flow]; grant != "" && !contains(discovery.GrantTypesSupported, grant) {
+			d.warn("use a flow in grant_types_supported: "+strings.Join(discovery.GrantTypesSupported, " "), "grant type %s isn't in the provider's grant_types_supported", grant)
+		}
+	}
+	return d.findings
+}
+
+// doctorGrantTypes are the grant types of the flows.
+var doctorGrantTypes = map[string]string{
+	"":                    "authorization_code",
+	FlowCode:              "authorization_code",
+	FlowDevice:            "urn:ietf:params:oauth:grant-type:device_code",
+	FlowClientCredentials: "client_credentials",
+	FlowRefresh:           "refresh_token",
+	FlowTokenExchange:     "urn:ietf:params:oauth:grant-type:token-exchange",
+}
+
+type doctorEndpoint struct {
+	flag, url, method string
+}
+
+// doctorEndpoints are the endpoints that the flow of conf needs.
+func doctorEndpoints(conf Config) []doctorEndpoint {
+	token := doctorEndpoint{"token", conf.TokenURL, "POST"}
+	switch conf.Flow {
+	case "", FlowCode:
+		return []doctorEndpoint{{"auth", conf.AuthURL, "GET"}, token}
+	case FlowDevice:
+		return []doctorEndpoint{{"device-auth", conf.DeviceAuthURL, "POST"}, token}
+	}
+	return []doctorEndpoint{token}
+}
+
+// checkEndpoint checks that the URL of -flag is one that credentials can be
+// sent to, and that it responds.
+func (d *doctor) checkEndpoint(ctx context.Context, client *http.Client, flag, rawURL, method string) {
+	if rawURL == "" {
+		d.fail(fmt.Sprintf("set -%s, or -issuer to discover it", flag), "no -%s URL", flag)
+		return
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		d.fail("use an absolute https URL", "-%s %s isn't an http or https URL", flag, rawURL)
+		return
+	}
+	if u.Scheme == "http" && !isLoopback(u.Hostname()) {
+		d.warn("use https", "-%s %s is unencrypted, exposing the code or credentials", flag, rawURL)
+	}
+
+	var body io.Reader
+	if method == "POST" {
+		body = strings.NewReader("")
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		d.fail("check the URL", "-%s: %s", flag, err)
+		return
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		d.fail("check the URL, and -proxy or -ca-cert if it's behind a proxy or private CA", "-%s %s didn't respond: %s", flag, rawURL, err)
+		return
+	}
+	res.Body.Close()
+	// Without parameters, the endpoints are expected to answer with an
+	// error, but not one saying there's nothing there.
+	switch {
+	case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusMethodNotAllowed:
+		d.fail(fmt.Sprintf("check the path of -%s", flag), "%s %s answered %s", method, rawURL, res.Status)
+	case res.StatusCode >= 500:
+		d.warn("try again later, or check the URL with the provider", "%s %s answered %s", method, rawURL, res.Status)
+	default:
+		d.ok("-%s %s responds (%s)", flag, rawURL, res.Status)
+	}
+}
+
+// checkRedirect checks the redirect URL that the code flow would send, the
+// same way the flow does, and that its port can be listened on.
+func (d *doctor) checkRedirect(conf Config) {
+	callbackURL, err := url.Parse(conf.Callback)
+	if err != nil {
+		d.fail("set -callback to an absolute URL, or just a path", "invalid callback URL %q: %s", conf.Callback, err)
+		return
+	}
+	if callbackURL.Scheme == "" {
+		callbackURL.Scheme = "http"
+		if conf.TLS || conf.TLSCert != "" {
+			callbackURL.Scheme = "https"
+		}
+	}
+	if callbackURL.Fragment != "" {
+		d.fail("remove the #fragment from -callback", "callback URL %s has a fragment, which redirect URLs can't", callbackURL)
+	}
+
+	port := conf.Port
+	if !conf.Manual {
+		addr := net.JoinHostPort(conf.Interface, fmt.Sprint(conf.Port))
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			d.fail("pick another -port, or stop what is listening on it", "can't listen on %s for the callback: %s", addr, err)
+			return
+		}
+		port = listener.Addr().(*net.TCPAddr).Port
+		listener.Close()
+		if conf.Port == 0 {
+			d.warn("set a fixed -port, as providers match the registered redirect URL exactly", "-port 0 picks a different port each run")
+		} else {
+			d.ok("can listen on %s for the callback", addr)
+		}
+	}
+
+	if callbackURL.Host == "" && callbackURL.Opaque == "" {
+		callbackURL.Host = fmt.Sprintf("%s:%d", conf.Interface, port)
+	}
+	if err := checkRedirectURL(callbackURL); err != nil {
+		d.warn("use -tls, or a loopback -interface", "%s", err)
+	}
+	if !conf.Manual {
+		if err := checkCallbackURL(callbackURL, conf.Interface, port); err != nil {
+			d.warn("change -callback to match -interface and -port", "%s", err)
+		}
+	}
+	d.ok("redirect URL %s, which has to be registered with the provider", callbackURL)
+}
@@ -0,0 +1,182 @@
+package oauth2cli
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DPoPKey is the key pair that DPoP proofs are signed with, binding the
+// tokens issued to it (RFC 9449).
+type DPoPKey struct {
+	key *ecdsa.PrivateKey
+	jwk map[string]interface{}
+
+	mu sync.Mutex
+	// nonce is the last DPoP-Nonce the provider asked for.
+	nonce string
+}
+
+// NewDPoPKey generates an ephemeral P-256 key pair.
+func NewDPoPKey() (*DPoPKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+	return &DPoPKey{
+		key: key,
+		jwk: map[string]interface{}{
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(x),
+			"y":   base64.RawURLEncoding.EncodeToString(y),
+		},
+	}, nil
+}
+
+// Thumbprint is the RFC 7638 JWK thumbprint of the public key, which is the
+// jkt that bound tokens carry.
+func (k *DPoPKey) Thumbprint() string {
+	// The required members, which json.Marshal sorts as RFC 7638 needs.
+	b, _ := json.Marshal(k.jwk)
+	sum := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Proof returns a DPoP proof for a request, bound to accessToken if it isn't
+// empty.
+func (k *DPoPKey) Proof(method, uri, accessToken string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	// htu leaves out the query and fragment (RFC 9449 section 4.2).
+	u.RawQuery = ""
+	u.Fragment = ""
+	header := map[string]interface{}{"typ": "dpop+jwt", "jwk": k.jwk}
+	claims := map[string]interface{}{
+		"jti": randString(),
+		"htm": method,
+		"htu": u.String(),
+		"iat": time.Now().Unix(),
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		claims["ath"] = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	k.mu.Lock()
+	if k.nonce != "" {
+		claims["nonce"] = k.nonce
+	}
+	k.mu.Unlock()
+	return signJWT(k.key, header, claims)
+}
+
+// SetProof sets the DPoP header of r to a proof for it, bound to the access
+// token in its Authorization header if that uses the DPoP scheme.
+func (k *DPoPKey) SetProof(r *http.Request) error {
+	accessToken := ""
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "DPoP ") {
+		accessToken = strings.TrimPrefix(auth, "DPoP ")
+	}
+	proof, err := k.Proof(r.Method, r.URL.String(), accessToken)
+	if err != nil {
+		return fmt.Errorf("DPoP proof: %w", err)
+	}
+	r.Header.Set("DPoP", proof)
+	return nil
+}
+
+// useNonce keeps the DPoP-Nonce of a response, and reports whether it is a
+// new one that the request should be retried with.
+func (k *DPoPKey) useNonce(res *http.Response) bool {
+	nonce := res.Header.Get("DPoP-Nonce")
+	if nonce == "" {
+		return false
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	changed := nonce != k.nonce
+	k.nonce = nonce
+	return changed && (res.StatusCode == http.StatusBadRequest || res.StatusCode == http.StatusUnauthorized)
+}
+
+// dpopTransport adds DPoP proofs to the requests to the token endpoint and
+// to those made with a DPoP bound access token. A request the provider
+// answers with a new DPoP-Nonce is retried once with it.
+type dpopTransport struct {
+	Key      *DPoPKey
+	TokenURL string
+	// Log, if set, receives each proof.
+	Log       *log.Logger
+	Transport http.RoundTripper
+}
+
+func (d dpopTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	endpoint := *r.URL
+	endpoint.RawQuery = ""
+	if endpoint.String() != d.TokenURL && !strings.HasPrefix(r.Header.Get("Authorization"), "DPoP ") {
+		return d.Transport.RoundTrip(r)
+	}
+
+	res, err := d.send(r)
+	if err != nil || !d.Key.useNonce(res) || r.GetBody == nil {
+		return res, err
+	}
+	body, err := r.GetBody()
+	if err != nil {
+		return res, nil
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	r = r.Clone(r.Context())
+	r.Body = body
+	return d.send(r)
+}
+
+func (d dpopTransport) send(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	if err := d.Key.SetProof(r); err != nil {
+		return nil, err
+	}
+	if d.Log != nil {
+		d.Log.Printf("DPoP proof for %s %s:\n%s\n", r.Method, r.URL, r.Header.Get("DPoP"))
+	}
+	return d.Transport.RoundTrip(r)
+}
+
+// dpopClient returns client with DPoP proofs added, signed by Flow.DPoPKey
+// which is generated if it isn't set.
+func (f *Flow) dpopClient(client *http.Client) (*http.Client, error) {
+	if f.DPoPKey == nil {
+		key, err := NewDPoPKey()
+		if err != nil {
+			return nil, fmt.Errorf("DPoP key: %w", err)
+		}
+		f.DPoPKey = key
+	}
+	transport := dpopTransport{Key: f.DPoPKey, TokenURL: f.Config.TokenURL, Transport: client.Transport}
+	if f.Config.Verbose {
+		f.logf("DPoP key thumbprint: %s\n", f.DPoPKey.Thumbprint())
+		transport.Log = f.logger()
+	}
+	dpop := *client
+	dpop.Transport = transport
+	return &dpop, nil
+}
@@ -0,0 +1,94 @@
+package oauth2cli
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DPoPKey", func() {
+	var key *DPoPKey
+
+	BeforeEach(func() {
+		var err error
+		key, err = NewDPoPKey()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	// verify checks the proof is signed by the key in its header, which must
+	// be the DPoP key.
+	verify := func(proof string) *DecodedJWT {
+		decoded, err := DecodeJWT(proof)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(decoded.Header).To(HaveKeyWithValue("typ", "dpop+jwt"))
+		Expect(decoded.Header).To(HaveKeyWithValue("alg", "ES256"))
+		Expect(decoded.Header["jwk"]).To(HaveLen(4))
+		Expect(decoded.Header["jwk"]).To(HaveKeyWithValue("x", key.jwk["x"]))
+
+		parts := strings.Split(proof, ".")
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		Expect(err).ToNot(HaveOccurred())
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		public := jwk{Kty: "EC", Crv: "P-256", X: key.jwk["x"].(string), Y: key.jwk["y"].(string)}
+		Expect(verifySignature("ES256", public, digest[:], signature)).To(BeTrue())
+		return decoded
+	}
+
+	It("should sign a proof for the method and URL without its query", func() {
+		proof, err := key.Proof("POST", "https://issuer.example/token?x=1", "")
+		Expect(err).ToNot(HaveOccurred())
+
+		decoded := verify(proof)
+		Expect(decoded.Claims).To(HaveKeyWithValue("htm", "POST"))
+		Expect(decoded.Claims).To(HaveKeyWithValue("htu", "https://issuer.example/token"))
+		Expect(decoded.Claims).To(HaveKey("jti"))
+		Expect(decoded.Claims).To(HaveKey("iat"))
+		Expect(decoded.Claims).ToNot(HaveKey("ath"))
+	})
+
+	It("should bind the proof to a DPoP access token", func() {
+		req := httptest.NewRequest("GET", "https://api.example/me", nil)
+		req.Header.Set("Authorization", "DPoP mytoken")
+		Expect(key.SetProof(req)).To(Succeed())
+
+		sum := sha256.Sum256([]byte("mytoken"))
+		decoded := verify(req.Header.Get("DPoP"))
+		Expect(decoded.Claims).To(HaveKeyWithValue("ath", base64.RawURLEncoding.EncodeToString(sum[:])))
+	})
+
+	It("should have a stable thumbprint", func() {
+		Expect(key.Thumbprint()).To(HaveLen(43))
+		Expect(key.Thumbprint()).To(Equal(key.Thumbprint()))
+	})
+
+	It("should retry a token request with the nonce the provider asks for", func() {
+		var nonces []interface{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			decoded, err := DecodeJWT(r.Header.Get("DPoP"))
+			Expect(err).ToNot(HaveOccurred())
+			nonces = append(nonces, decoded.Claims["nonce"])
+			Expect(r.ParseForm()).To(Succeed())
+			Expect(r.PostForm.Get("grant_type")).To(Equal("refresh_token"))
+			if decoded.Claims["nonce"] == nil {
+				w.Header().Set("DPoP-Nonce", "n1")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		client := &http.Client{Transport: dpopTransport{Key: key, TokenURL: server.URL + "/token", Transport: http.DefaultTransport}}
+		resp, err := client.PostForm(server.URL+"/token", url.Values{"grant_type": {"refresh_token"}})
+		Expect(err).ToNot(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(nonces).To(Equal([]interface{}{nil, "n1"}))
+	})
+})
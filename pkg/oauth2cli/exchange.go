@@ -0,0 +1,99 @@
+package oauth2cli
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	// tokenTypePrefix is that of the token type URNs registered by RFC 8693
+	// section 3, which can be given by just their last part.
+	tokenTypePrefix = "urn:ietf:params:oauth:token-type:"
+)
+
+// tokenType expands the short names of the RFC 8693 token types, such as
+// access_token or jwt, to their URN. Other types are returned as they are.
+func tokenType(t string) string {
+	switch t {
+	case "access_token", "refresh_token", "id_token", "saml1", "saml2", "jwt":
+		return tokenTypePrefix + t
+	}
+	return t
+}
+
+// tokenExchangeFlow exchanges Config.SubjectToken, and ActorToken if set, for
+// a token as described by RFC 8693.
+func (f *Flow) tokenExchangeFlow(ctx context.Context, client *http.Client) (*oauth2.Token, error) {
+	conf := f.Config
+	subjectType := conf.SubjectTokenType
+	if subjectType == "" {
+		subjectType = "access_token"
+	}
+	form := url.Values{
+		"grant_type":         {tokenExchangeGrantType},
+		"subject_token":      {conf.SubjectToken},
+		"subject_token_type": {tokenType(subjectType)},
+	}
+	if conf.ActorToken != "" {
+		actorType := conf.ActorTokenType
+		if actorType == "" {
+			actorType = "access_token"
+		}
+		form.Set("actor_token", conf.ActorToken)
+		form.Set("actor_token_type", tokenType(actorType))
+	}
+	if conf.RequestedTokenType != "" {
+		form.Set("requested_token_type", tokenType(conf.RequestedTokenType))
+	}
+	// Unlike the other grants, each audience and resource is its own param.
+	for _, audience := range conf.Audiences {
+		form.Add("audience", audience)
+	}
+	for _, resource := range conf.Resources {
+		form.Add("resource", resource)
+	}
+	if s := scopes(conf.Scope); len(s) > 0 {
+		form.Set("scope", strings.Join(s, " "))
+	}
+	for _, param := range conf.TokenParams {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("token params: invalid parameter %q, expected key=value", param)
+		}
+		form.Set(kv[0], kv[1])
+	}
+
+	token, err := f.retryToken(ctx, func() (*oauth2.Token, error) {
+		req, err := f.clientFormRequest(ctx, conf.TokenURL, form)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, &oauth2.RetrieveError{Response: resp, Body: body}
+		}
+		return parseToken(body)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if issued, ok := token.Extra("issued_token_type").(string); ok && conf.Verbose {
+		f.logf("Issued token type: %s\n", issued)
+	}
+	return token, nil
+}
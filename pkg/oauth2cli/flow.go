@@ -0,0 +1,1118 @@
+// Package oauth2cli runs OAuth2 grants from the command line, or from other
+// programs, as the oauth2-cli tool does: the authorization code flow with a
+// local callback server, the device flow, client credentials and refresh.
+package oauth2cli
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// ErrTimeout is returned, wrapped, when the flow wasn't completed within
+// Config.Timeout or no callback arrived within Config.CallbackWait.
+var ErrTimeout = errors.New("timed out")
+
+// ErrInvalidState is returned, wrapped, when the state of the callback isn't
+// that of the authorization, as with a forged callback or one of another
+// authorization.
+var ErrInvalidState = errors.New("Invalid state")
+
+// ErrUnreachable is returned, wrapped, when a request to the provider got no
+// response, such as from a DNS, connection or TLS error.
+var ErrUnreachable = errors.New("provider unreachable")
+
+// ErrValidation is returned, wrapped, when the callback or the issued token
+// fails a check, such as of the issuer, the id_token, the nonce or the
+// required scopes.
+var ErrValidation = errors.New("validation failed")
+
+// classifiedError is an error that Is one of the errors above, keeping its
+// own message.
+type classifiedError struct {
+	err, class error
+}
+
+func (e *classifiedError) Error() string        { return e.err.Error() }
+func (e *classifiedError) Unwrap() error        { return e.err }
+func (e *classifiedError) Is(target error) bool { return target == e.class }
+
+// classify returns err as a class of error, such as ErrValidation.
+func classify(class, err error) error {
+	return &classifiedError{err: err, class: class}
+}
+
+// AuthorizationError is an error response from the provider on the callback,
+// such as the user denying consent.
+type AuthorizationError struct {
+	Code        string
+	Description string
+	// URI is the provider's page about the error, if it gave one.
+	URI string
+}
+
+func (e *AuthorizationError) Error() string {
+	msg := fmt.Sprintf("Authorization error: %s", e.Code)
+	if e.InteractionRequired() {
+		msg = fmt.Sprintf("Silent authentication not possible: %s", e.Code)
+	}
+	if e.Description != "" {
+		msg += ": " + e.Description
+	}
+	if e.URI != "" {
+		msg += " (" + e.URI + ")"
+	}
+	return msg
+}
+
+// InteractionRequired reports whether silent authentication (prompt=none)
+// failed because the user must interact.
+func (e *AuthorizationError) InteractionRequired() bool {
+	switch e.Code {
+	case "login_required", "interaction_required", "consent_required", "account_selection_required":
+		return true
+	}
+	return false
+}
+
+// Flow runs the grant described by its Config.
+type Flow struct {
+	Config Config
+	// Logger receives the instructions for the user, warnings and verbose
+	// logging. It defaults to the standard logger.
+	Logger *log.Logger
+	// OnToken, if set, is called with the token before Authorize returns,
+	// and in the authorization code flow before the browser is answered, so
+	// that a failure to store the token is shown there too.
+	OnToken func(*oauth2.Token) error
+	// Input is where the code is read from in manual mode. It defaults to
+	// stdin.
+	Input io.Reader
+	// DPoPKey signs the DPoP proofs sent with Config.DPoP. Authorize
+	// generates one if it isn't set, for the requests made with the token
+	// afterwards.
+	DPoPKey *DPoPKey
+	// CallbackServer, if set, serves the callback of the code flow instead
+	// of a server of its own on Config.Interface and Config.Port, so that
+	// several flows can share one.
+	CallbackServer *CallbackServer
+
+	// recorder keeps the requests for Config.DebugOut.
+	recorder *recorder
+}
+
+// GetToken runs the grant described by conf, logging to the standard
+// logger, and returns the token. Use a Flow for more control.
+func GetToken(ctx context.Context, conf Config) (*oauth2.Token, error) {
+	f := Flow{Config: conf}
+	return f.Authorize(ctx)
+}
+
+// Authorize runs the grant and returns the token. For the authorization code
+// flow it serves the callback until the provider redirects back, then shuts
+// the server down.
+func (f *Flow) Authorize(ctx context.Context) (*oauth2.Token, error) {
+	conf := f.Config
+	if _, ok := authStyles[conf.AuthStyle]; !ok {
+		return nil, fmt.Errorf("unknown auth style %q", conf.AuthStyle)
+	}
+
+	if conf.DebugOut != "" {
+		f.recorder = &recorder{redact: !conf.NoRedact}
+		defer func() {
+			if err := f.recorder.write(conf.DebugOut); err != nil {
+				f.logf("warning: failed to write %s: %s\n", conf.DebugOut, err)
+			}
+			f.recorder = nil
+		}()
+	}
+	client, err := newHTTPClient(conf, f.logger(), f.recorder)
+	if err != nil {
+		return nil, err
+	}
+	if conf.DPoP {
+		if client, err = f.dpopClient(client); err != nil {
+			return nil, err
+		}
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, client)
+
+	// The deadline also cancels an in-flight exchange.
+	ctx, cancel := withTimeout(ctx, conf.Timeout)
+	defer cancel()
+
+	var token *oauth2.Token
+	switch conf.Flow {
+	case FlowCode:
+		token, err = f.authorizeCode(ctx, client)
+	case FlowDevice:
+		token, err = f.deviceFlow(ctx, client)
+	case FlowClientCredentials:
+		token, err = f.clientCredentialsFlow(ctx)
+	case FlowRefresh:
+		token, err = f.refreshFlow(ctx)
+	case FlowTokenExchange:
+		token, err = f.tokenExchangeFlow(ctx, client)
+	default:
+		return nil, fmt.Errorf("unknown flow %q", conf.Flow)
+	}
+	if token == nil && ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("%w after %s", ErrTimeout, &conf.Timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if conf.Flow != FlowCode {
+		// The code flow checks its token before answering the callback.
+		var decryptKey *rsa.PrivateKey
+		if conf.DecryptKey != "" {
+			if decryptKey, err = loadDecryptKey(conf.DecryptKey); err != nil {
+				return nil, err
+			}
+		}
+		idToken, _, err := f.checkIDToken(ctx, client, token, "", decryptKey)
+		if err != nil {
+			return nil, err
+		}
+		if conf.Flow == FlowRefresh {
+			if err := f.checkSubject(idToken, decryptKey); err != nil {
+				return nil, err
+			}
+		}
+		if err := f.checkRequired(token, idToken, scopes(conf.Scope)); err != nil {
+			return nil, err
+		}
+		if (conf.DecodeIDToken || conf.VerifyIDToken) && idToken != "" {
+			f.logIDTokenClaims(idToken)
+		}
+
+		var introspection map[string]interface{}
+		if conf.Introspect {
+			if introspection, err = f.introspect(ctx, client, token); err != nil {
+				return nil, fmt.Errorf("introspection: %w", err)
+			}
+		}
+		if conf.Userinfo {
+			if err := f.userinfo(ctx, client, token); err != nil {
+				return nil, fmt.Errorf("userinfo: %w", err)
+			}
+		}
+		f.logSummary(token, scopes(conf.Scope), introspection)
+		if err := f.onToken(token); err != nil {
+			return nil, err
+		}
+	}
+	return token, nil
+}
+
+func (f *Flow) onToken(token *oauth2.Token) error {
+	if f.OnToken == nil {
+		return nil
+	}
+	return f.OnToken(token)
+}
+
+func (f *Flow) logger() *log.Logger {
+	if f.Logger != nil {
+		return f.Logger
+	}
+	return log.Default()
+}
+
+func (f *Flow) logf(format string, v ...interface{}) {
+	f.logger().Printf(format, v...)
+}
+
+// callbackResult is the outcome of the authorization code callback.
+type callbackResult struct {
+	token *oauth2.Token
+	err   error
+}
+
+// authorizeCode runs the authorization code flow.
+func (f *Flow) authorizeCode(ctx context.Context, client *http.Client) (*oauth2.Token, error) {
+	conf := f.Config
+
+	callbackURL, err := url.Parse(conf.Callback)
+	if err != nil {
+		return nil, err
+	}
+	if (conf.TLSCert == "") != (conf.TLSKey == "") {
+		return nil, errors.New("TLS certificate and key must be used together")
+	}
+	useTLS := conf.TLS || conf.TLSCert != ""
+	if callbackURL.Scheme == "" {
+		callbackURL.Scheme = "http"
+		if useTLS {
+			callbackURL.Scheme = "https"
+		}
+	}
+	var pending *pendingAuthorization
+	if conf.Resume {
+		if pending, err = readPending(conf.PendingFile); err != nil {
+			return nil, err
+		}
+		// The exchange has to send the redirect URL the authorization was
+		// started with, which is also where the callback will arrive.
+		if callbackURL, err = url.Parse(pending.RedirectURL); err != nil {
+			return nil, fmt.Errorf("invalid pending redirect URL: %w", err)
+		}
+	}
+
+	// Listen before building the callback URL so that port 0 can be resolved
+	// to the port picked, and before showing the auth URL so the callback
+	// can't arrive too early.
+	var listener net.Listener
+	port := conf.Port
+	if pending != nil && callbackURL.Port() != "" {
+		if port, err = strconv.Atoi(callbackURL.Port()); err != nil {
+			return nil, fmt.Errorf("invalid pending redirect URL: %w", err)
+		}
+	}
+	if conf.Tunnel != "" && (conf.Manual || pending != nil || useTLS || f.CallbackServer != nil) {
+		return nil, errors.New("a tunnel can't be used with manual mode, resuming, TLS or a shared callback server")
+	}
+	switch {
+	case conf.Manual:
+	case f.CallbackServer != nil:
+		if useTLS {
+			return nil, errors.New("a shared callback server can't serve the callback over TLS")
+		}
+		port = f.CallbackServer.Addr().(*net.TCPAddr).Port
+	default:
+		listener, err = net.Listen("tcp", fmt.Sprintf("%s:%d", conf.Interface, conf.Port))
+		if err != nil {
+			return nil, err
+		}
+		defer listener.Close()
+		port = listener.Addr().(*net.TCPAddr).Port
+	}
+
+	// Opaque URLs such as urn:ietf:wg:oauth:2.0:oob have no host.
+	if callbackURL.Host == "" && callbackURL.Opaque == "" {
+		callbackURL.Host = fmt.Sprintf("%s:%d", conf.Interface, port)
+	}
+	// The tunnel's public URL is the redirect URL, with the callback path.
+	if conf.Tunnel != "" {
+		tunnel, err := f.openTunnel(ctx, tunnelAddr(conf.Interface, port))
+		if err != nil {
+			return nil, err
+		}
+		defer tunnel.Close()
+		callbackURL.Scheme, callbackURL.Host = tunnel.URL.Scheme, tunnel.URL.Host
+		f.logf("Tunnelling %s to the callback, register this redirect URL with the provider:\n%s\n", tunnel.URL, callbackURL)
+	}
+	if err := checkRedirectURL(callbackURL); err != nil {
+		if err := f.warn(err); err != nil {
+			return nil, err
+		}
+	}
+	if !conf.Manual && conf.Tunnel == "" {
+		if err := checkCallbackURL(callbackURL, conf.Interface, port); err != nil {
+			if err := f.warn(err); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := checkEndpointHosts(conf.AuthURL, conf.TokenURL, strings.Split(conf.AllowHosts, ",")); err != nil && (conf.Strict || conf.Verbose) {
+		if err := f.warn(err); err != nil {
+			return nil, err
+		}
+	}
+
+	config := &oauth2.Config{
+		ClientID:     conf.ClientID,
+		ClientSecret: conf.clientSecret(),
+		Scopes:       scopes(conf.Scope),
+		RedirectURL:  callbackURL.String(),
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   conf.AuthURL,
+			TokenURL:  conf.TokenURL,
+			AuthStyle: authStyles[conf.AuthStyle],
+		},
+	}
+
+	success, errorPage, err := pages(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	var decryptKey *rsa.PrivateKey
+	if conf.DecryptKey != "" {
+		if decryptKey, err = loadDecryptKey(conf.DecryptKey); err != nil {
+			return nil, err
+		}
+	}
+
+	authParams, err := paramOptions(conf.AuthParams)
+	if err != nil {
+		return nil, fmt.Errorf("auth params: %w", err)
+	}
+	exchangeOpts, err := paramOptions(conf.TokenParams)
+	if err != nil {
+		return nil, fmt.Errorf("token params: %w", err)
+	}
+
+	// A later access_type param wins over that of offline access.
+	var opts []oauth2.AuthCodeOption
+	if config.Scopes, opts, err = f.offlineAccess(ctx, client, config.Scopes); err != nil {
+		return nil, err
+	}
+	opts = append(opts, authParams...)
+	if len(conf.Audiences) > 0 {
+		// Providers that accept several audiences take them space separated.
+		opts = append(opts, oauth2.SetAuthURLParam("audience", strings.Join(conf.Audiences, " ")))
+	}
+	authnParams, err := authenticationParams(conf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parseRequiredClaims(conf.RequireClaims); err != nil {
+		return nil, err
+	}
+	switch conf.PreferIDToken {
+	case "", PreferIDTokenResponse, PreferIDTokenFragment:
+	default:
+		return nil, fmt.Errorf("unknown id_token preference %q, expected response or fragment", conf.PreferIDToken)
+	}
+	opts = append(opts, authnParams...)
+	if conf.ResponseType != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("response_type", conf.ResponseType))
+	}
+	if conf.ResponseMode != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("response_mode", conf.ResponseMode))
+	}
+	fragment := fragmentResponse(conf)
+	jarm := jarmMode(conf.ResponseMode)
+	implicit := !contains(responseTypes(conf.ResponseType), "code")
+	expectedParams := append([]string{}, conf.CallbackParams...)
+	if fragment || implicit {
+		expectedParams = append(expectedParams, implicitParams...)
+	}
+
+	// The current attempt is replaced for each authorization in loop mode.
+	var (
+		mu      sync.Mutex
+		current *attempt
+	)
+	startAttempt := func() (string, error) {
+		a, err := f.newAttempt(opts, exchangeOpts)
+		if err != nil {
+			return "", err
+		}
+		mu.Lock()
+		current = a
+		mu.Unlock()
+		visitURL, err := f.authCodeURL(ctx, client, config, a)
+		if err != nil {
+			return "", err
+		}
+		return visitURL, f.savePending(a, config.RedirectURL)
+	}
+
+	if conf.Manual {
+		return f.authorizeManual(ctx, client, config, pending, opts, exchangeOpts, decryptKey)
+	}
+
+	// Only the first callback of an attempt is used; later ones are dropped.
+	results := make(chan callbackResult, 1)
+	finish := func(token *oauth2.Token, err error) {
+		select {
+		case results <- callbackResult{token, err}:
+		default:
+		}
+	}
+	fail := func(w http.ResponseWriter, status int, err error) {
+		http.Error(w, err.Error(), status)
+		finish(nil, err)
+	}
+
+	pattern := callbackURL.Path
+	if conf.AcceptAnyPath {
+		pattern = "/"
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if conf.AcceptAnyPath {
+			// Don't let requests such as /favicon.ico end the flow.
+			if r.URL.RawQuery == "" && r.Method != http.MethodPost && !fragment {
+				http.NotFound(w, r)
+				return
+			}
+			if r.URL.Path != callbackURL.Path {
+				f.logf("Got callback on %s instead of %s\n", r.URL.Path, callbackURL.Path)
+			}
+		}
+
+		// With response_mode=form_post the params are posted instead.
+		query := r.URL.Query()
+		if fragment && r.Method == http.MethodGet && len(query) == 0 {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = io.WriteString(w, fragmentRelayPage)
+			return
+		}
+		if r.Method == http.MethodPost {
+			if err := r.ParseForm(); err != nil {
+				fail(w, http.StatusBadRequest, fmt.Errorf("Invalid callback form: %s", err))
+				return
+			}
+			query = r.Form
+		}
+		if jarm {
+			var err error
+			if query, err = f.jarmParams(ctx, client, query, decryptKey); err != nil {
+				fail(w, http.StatusUnauthorized, err)
+				return
+			}
+		}
+
+		if conf.Verbose {
+			logged := *r.URL
+			if r.Method == http.MethodPost {
+				logged.RawQuery = r.PostForm.Encode()
+			}
+			if !conf.NoRedact {
+				logged.RawQuery = string(redactBody([]byte(logged.RawQuery)))
+			}
+			f.logf("Got callback: %s %s\n", r.Method, logged.RequestURI())
+		}
+
+		if unexpected := unexpectedParams(query, conf.CodeParam, conf.StateParam, expectedParams...); len(unexpected) > 0 {
+			if conf.StrictParams {
+				fail(w, http.StatusBadRequest, fmt.Errorf("Unexpected callback params: %s", strings.Join(unexpected, ", ")))
+				return
+			}
+			if conf.Verbose {
+				f.logf("warning: unexpected callback params: %s\n", strings.Join(unexpected, ", "))
+			}
+		}
+
+		// The state is used up by the first callback that presents it.
+		mu.Lock()
+		a := current
+		s := query.Get(conf.StateParam)
+		valid := a != nil && s == a.state
+		if valid {
+			current = nil
+		}
+		mu.Unlock()
+		if !valid {
+			fail(w, http.StatusUnauthorized, fmt.Errorf("%w: %s", ErrInvalidState, s))
+			return
+		}
+		f.clearPending()
+		if err := checkIssuerParam(query, conf.Issuer); err != nil {
+			fail(w, http.StatusUnauthorized, err)
+			return
+		}
+
+		if e := query.Get("error"); e != "" {
+			// The provider denied the request, so there is no code to exchange.
+			authErr := &AuthorizationError{Code: e, Description: query.Get("error_description"), URI: query.Get("error_uri")}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusUnauthorized)
+			if err := errorPage.Execute(w, authErr); err != nil {
+				f.logf("warning: failed to render the error page: %s\n", err)
+			}
+			finish(nil, authErr)
+			return
+		}
+
+		if conf.CallbackDelay > 0 {
+			select {
+			case <-time.After(time.Duration(conf.CallbackDelay)):
+			case <-ctx.Done():
+				fail(w, http.StatusServiceUnavailable, ctx.Err())
+				return
+			}
+		}
+
+		var (
+			token  *oauth2.Token
+			status int
+			err    error
+		)
+		if implicit {
+			// The implicit flow has no code to exchange, the tokens are in
+			// the callback.
+			if token, err = fragmentToken(query); err != nil {
+				fail(w, http.StatusBadRequest, err)
+				return
+			}
+			if token, status, err = f.checkToken(ctx, client, config, a, token, decryptKey); err == nil {
+				token = f.withCallbackParams(token, valuesFields(query), query)
+			}
+		} else {
+			token, status, err = f.exchangeCode(ctx, client, config, a, query.Get(conf.CodeParam), query, decryptKey)
+		}
+		if err != nil {
+			fail(w, status, err)
+			return
+		}
+
+		if err := f.onToken(token); err != nil {
+			http.Error(w, fmt.Sprintf("Token output error: %s", err), http.StatusInternalServerError)
+			finish(nil, err)
+			return
+		}
+
+		page := SuccessPage{
+			TokenType:       token.Type(),
+			Expiry:          token.Expiry,
+			Scopes:          grantedScopes(token, config.Scopes),
+			HasRefreshToken: token.RefreshToken != "",
+		}
+		if idToken, err := idTokenFrom(token, decryptKey); err == nil && idToken != "" {
+			// Checked by the exchange, so only shown if it decodes.
+			_ = decodeClaims(idToken, &page.Claims)
+		}
+		var buf bytes.Buffer
+		if err := success.Execute(&buf, page); err != nil {
+			fail(w, http.StatusInternalServerError, fmt.Errorf("Success template error: %s", err))
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(buf.Bytes())
+		finish(token, nil)
+	})
+
+	if pattern != "/" {
+		// Explain the 404 of a redirect to the wrong path, such as one
+		// registered differently with the provider.
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/favicon.ico" {
+				f.logf("warning: got a request for %s, but the callback is on %s\n", r.URL.Path, callbackURL.Path)
+			}
+			http.Error(w, fmt.Sprintf("Not found: the callback is on %s, check the redirect URL registered with the provider", callbackURL.Path), http.StatusNotFound)
+		})
+	}
+
+	var handler http.Handler = mux
+	if f.recorder != nil {
+		handler = recordHandler(f.recorder, mux)
+	}
+	if f.CallbackServer != nil {
+		remove, err := f.CallbackServer.handle(callbackURL.Path, handler)
+		if err != nil {
+			return nil, err
+		}
+		defer remove()
+		f.logf("Waiting on %s for the callback to %s\n", f.CallbackServer.Addr(), callbackURL)
+	} else {
+		server := http.Server{Handler: handler}
+		if useTLS && conf.TLSCert == "" {
+			cert, err := selfSignedCert(callbackURL.Hostname())
+			if err != nil {
+				return nil, err
+			}
+			server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+
+		go func() {
+			var err error
+			if useTLS {
+				err = server.ServeTLS(listener, conf.TLSCert, conf.TLSKey)
+			} else {
+				err = server.Serve(listener)
+			}
+			if err != http.ErrServerClosed {
+				finish(nil, err)
+			}
+		}()
+		defer server.Shutdown(context.Background())
+		f.logf("Listening on %s for the callback to %s\n", listener.Addr(), callbackURL)
+	}
+
+	// A resumed authorization was already visited, so there's no URL to
+	// show until the next one of loop mode.
+	var visitURL string
+	if pending != nil {
+		mu.Lock()
+		current = pending.attempt(exchangeOpts)
+		mu.Unlock()
+		f.logResume(pending)
+	} else {
+		if visitURL, err = startAttempt(); err != nil {
+			return nil, err
+		}
+		if err := f.writeRequestSpec(config, visitURL); err != nil {
+			return nil, err
+		}
+	}
+
+	var last *oauth2.Token
+	for n := 1; ; n++ {
+		if visitURL != "" {
+			f.showURL(visitURL)
+		}
+
+		var timeout <-chan time.Time
+		if conf.CallbackWait > 0 {
+			timeout = time.After(time.Duration(conf.CallbackWait))
+		}
+
+		select {
+		case result := <-results:
+			if result.err != nil || conf.Loop == 0 || n == conf.Loop {
+				return result.token, result.err
+			}
+			last = result.token
+		case <-timeout:
+			return nil, fmt.Errorf("%w after %s waiting for the callback", ErrTimeout, &conf.CallbackWait)
+		case <-ctx.Done():
+			// Interrupting loop mode ends it with the last token.
+			if last != nil {
+				return last, nil
+			}
+			return nil, ctx.Err()
+		}
+
+		if visitURL, err = startAttempt(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// authorizeManual runs the authorization code flow without a callback server.
+// The user pastes the code, or the URL they were redirected to, whose state is
+// then checked too. If pending isn't nil, its authorization is completed
+// instead of starting one.
+func (f *Flow) authorizeManual(ctx context.Context, client *http.Client, config *oauth2.Config, pending *pendingAuthorization, opts, exchangeOpts []oauth2.AuthCodeOption, decryptKey *rsa.PrivateKey) (*oauth2.Token, error) {
+	var a *attempt
+	if pending != nil {
+		a = pending.attempt(exchangeOpts)
+		f.logResume(pending)
+	} else {
+		var err error
+		if a, err = f.newAttempt(opts, exchangeOpts); err != nil {
+			return nil, err
+		}
+		visitURL, err := f.authCodeURL(ctx, client, config, a)
+		if err != nil {
+			return nil, err
+		}
+		if err := f.savePending(a, config.RedirectURL); err != nil {
+			return nil, err
+		}
+		if err := f.writeRequestSpec(config, visitURL); err != nil {
+			return nil, err
+		}
+		f.showURL(visitURL)
+	}
+	f.logf("Paste the authorization code, or the URL you were redirected to:\n")
+
+	line, err := f.readLine(ctx)
+	if err != nil {
+		return nil, err
+	}
+	code, query, err := f.pastedCode(ctx, client, line, a.state, decryptKey)
+	if err != nil {
+		return nil, err
+	}
+	f.clearPending()
+	token, _, err := f.exchangeCode(ctx, client, config, a, code, query, decryptKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.onToken(token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// readLine reads a line from Flow.Input, or stdin, giving up when ctx is done.
+func (f *Flow) readLine(ctx context.Context) (string, error) {
+	input := f.Input
+	if input == nil {
+		input = os.Stdin
+	}
+	lines := make(chan string, 1)
+	errs := make(chan error, 1)
+	go func() {
+		line, err := bufio.NewReader(input).ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			errs <- fmt.Errorf("failed to read the authorization code: %w", err)
+			return
+		}
+		lines <- strings.TrimSpace(line)
+	}()
+	select {
+	case line := <-lines:
+		return line, nil
+	case err := <-errs:
+		return "", err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// pastedCode returns the code from a pasted code or redirect URL, checking
+// the state, iss and error params of a URL, whose params are returned too.
+// Those of a JARM response are verified with decryptKey as the callback's
+// are.
+func (f *Flow) pastedCode(ctx context.Context, client *http.Client, pasted, state string, decryptKey *rsa.PrivateKey) (string, url.Values, error) {
+	if !strings.Contains(pasted, "=") {
+		return pasted, nil, nil
+	}
+	raw := pasted
+	if u, err := url.Parse(pasted); err == nil && u.RawQuery != "" {
+		raw = u.RawQuery
+	}
+	query, err := url.ParseQuery(raw)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid redirect URL: %w", err)
+	}
+	if jarmMode(f.Config.ResponseMode) {
+		if query, err = f.jarmParams(ctx, client, query, decryptKey); err != nil {
+			return "", nil, err
+		}
+	}
+	if s, ok := query[f.Config.StateParam]; ok && s[0] != state {
+		return "", nil, fmt.Errorf("%w: %s", ErrInvalidState, s[0])
+	}
+	if err := checkIssuerParam(query, f.Config.Issuer); err != nil {
+		return "", nil, err
+	}
+	if e := query.Get("error"); e != "" {
+		return "", nil, &AuthorizationError{Code: e, Description: query.Get("error_description"), URI: query.Get("error_uri")}
+	}
+	code := query.Get(f.Config.CodeParam)
+	if code == "" {
+		return "", nil, fmt.Errorf("no %s param in the pasted URL", f.Config.CodeParam)
+	}
+	return code, query, nil
+}
+
+// CallbackParamsExtra is the token extra with the Config.CallbackParams of
+// the callback, as a map[string]interface{} of their values.
+const CallbackParamsExtra = "callback_params"
+
+// withCallbackParams returns token with fields, those of its response, as
+// its extras, adding CallbackParamsExtra for the Config.CallbackParams in
+// callback.
+func (f *Flow) withCallbackParams(token *oauth2.Token, fields map[string]interface{}, callback url.Values) *oauth2.Token {
+	params := map[string]interface{}{}
+	for _, name := range f.Config.CallbackParams {
+		if v, ok := callback[name]; ok {
+			params[name] = v[0]
+		}
+	}
+	// Without the fields, the extras of the response would be lost.
+	if len(params) == 0 || fields == nil {
+		return token
+	}
+	extra := map[string]interface{}{CallbackParamsExtra: params}
+	for k, v := range fields {
+		if k != CallbackParamsExtra {
+			extra[k] = v
+		}
+	}
+	return token.WithExtra(extra)
+}
+
+// valuesFields returns the first value of each of values.
+func valuesFields(values url.Values) map[string]interface{} {
+	fields := map[string]interface{}{}
+	for k := range values {
+		fields[k] = values.Get(k)
+	}
+	return fields
+}
+
+// authCodeURL returns the URL to visit for attempt a, whose params are first
+// signed as a request object with Config.RequestObject, and pushed to the
+// provider with Config.PAR.
+func (f *Flow) authCodeURL(ctx context.Context, client *http.Client, config *oauth2.Config, a *attempt) (string, error) {
+	authURL, err := withResources(config.AuthCodeURL(a.state, a.authOpts...), f.Config.Resources)
+	if err != nil {
+		return "", err
+	}
+	if f.Config.RequestObject {
+		if authURL, err = f.requestObjectURL(authURL, time.Now()); err != nil {
+			return "", err
+		}
+	}
+	if !f.Config.PAR {
+		return authURL, nil
+	}
+	return f.pushAuthorization(ctx, client, authURL)
+}
+
+// showURL asks the user to visit the auth URL, opening it if configured to.
+func (f *Flow) showURL(visitURL string) {
+	if f.recorder != nil {
+		f.recorder.browser(visitURL)
+	}
+	f.logf("Visit this URL in your browser:\n%s\n\n", visitURL)
+	if f.Config.QR {
+		f.showQR(visitURL)
+	}
+	if f.Config.Open {
+		if err := openBrowser(visitURL); err != nil {
+			f.logf("warning: failed to open browser: %s\n", err)
+		}
+	}
+}
+
+func (f *Flow) writeRequestSpec(config *oauth2.Config, visitURL string) error {
+	if f.Config.RequestSpec == "" {
+		return nil
+	}
+	if err := writeRequestSpec(f.Config.RequestSpec, config, visitURL); err != nil {
+		return fmt.Errorf("failed to write request spec: %w", err)
+	}
+	return nil
+}
+
+// exchangeCode swaps the code of an attempt, from the callback params, for a
+// token and validates it. On failure it also returns the HTTP status to
+// answer the callback with.
+func (f *Flow) exchangeCode(ctx context.Context, client *http.Client, config *oauth2.Config, a *attempt, code string, callback url.Values, decryptKey *rsa.PrivateKey) (*oauth2.Token, int, error) {
+	var fields map[string]interface{}
+	ctx = context.WithValue(ctx, tokenFieldsKey{}, &fields)
+	token, err := f.retryToken(ctx, func() (*oauth2.Token, error) {
+		return config.Exchange(ctx, code, a.exchangeOpts...)
+	})
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, fmt.Errorf("Exchange error: %w", err)
+	}
+	if fragment := callback.Get("id_token"); fragment != "" {
+		// The hybrid flow's callback has an id_token too.
+		if idToken := f.hybridIDToken(token, fragment, decryptKey); idToken != token.Extra("id_token") {
+			if fields == nil {
+				fields = map[string]interface{}{}
+			}
+			fields["id_token"] = idToken
+			token = token.WithExtra(fields)
+		}
+	}
+	token, status, err := f.checkToken(ctx, client, config, a, token, decryptKey)
+	if err != nil {
+		return nil, status, err
+	}
+	return f.withCallbackParams(token, fields, callback), 0, nil
+}
+
+// checkToken checks the token issued for attempt a, and logs what was asked
+// for about it, returning the status to answer the callback with on
+// failure.
+func (f *Flow) checkToken(ctx context.Context, client *http.Client, config *oauth2.Config, a *attempt, token *oauth2.Token, decryptKey *rsa.PrivateKey) (*oauth2.Token, int, error) {
+	conf := f.Config
+
+	idToken, status, err := f.checkIDToken(ctx, client, token, a.nonce, decryptKey)
+	if err != nil {
+		return nil, status, err
+	}
+
+	if err := f.checkRequired(token, idToken, config.Scopes); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+
+	// Once verified, the claims are worth showing too.
+	if (conf.DecodeIDToken || conf.VerifyIDToken) && idToken != "" {
+		f.logIDTokenClaims(idToken)
+	}
+
+	var introspection map[string]interface{}
+	if conf.Introspect {
+		if introspection, err = f.introspect(ctx, client, token); err != nil {
+			return nil, http.StatusServiceUnavailable, fmt.Errorf("Introspection error: %s", err)
+		}
+	}
+	if conf.Userinfo {
+		if err := f.userinfo(ctx, client, token); err != nil {
+			return nil, http.StatusServiceUnavailable, fmt.Errorf("Userinfo error: %s", err)
+		}
+	}
+	f.logSummary(token, config.Scopes, introspection)
+	return token, 0, nil
+}
+
+// checkIDToken decrypts and checks the id_token of a token from any grant,
+// against nonce for the code flow, returning it and the status to answer the
+// callback with on failure. A token without an id_token passes.
+func (f *Flow) checkIDToken(ctx context.Context, client *http.Client, token *oauth2.Token, nonce string, decryptKey *rsa.PrivateKey) (string, int, error) {
+	conf := f.Config
+
+	idToken, err := idTokenFrom(token, decryptKey)
+	if err != nil {
+		return "", http.StatusUnauthorized, classify(ErrValidation, fmt.Errorf("OIDC id_token error: %s", err))
+	}
+
+	if conf.VerifyIDToken {
+		if err := f.verifyIDTokenFrom(ctx, client, idToken); err != nil {
+			return "", http.StatusUnauthorized, classify(ErrValidation, fmt.Errorf("OIDC id_token verification error: %s", err))
+		}
+	}
+
+	if nonce != "" {
+		if err := f.checkNonce(nonce, idToken); err != nil {
+			return "", http.StatusUnauthorized, classify(ErrValidation, fmt.Errorf("OIDC nonce error: %s", err))
+		}
+	}
+
+	if err := checkAZP(conf.ClientID, idToken); err != nil {
+		if conf.Strict {
+			return "", http.StatusUnauthorized, classify(ErrValidation, fmt.Errorf("OIDC azp error: %s", err))
+		}
+		f.logf("warning: OIDC azp: %s\n", err)
+	}
+
+	if err := checkAuthentication(idToken, conf.MaxAge, conf.ACRValues, time.Now()); err != nil {
+		if conf.Strict {
+			return "", http.StatusUnauthorized, classify(ErrValidation, fmt.Errorf("OIDC authentication error: %s", err))
+		}
+		f.logf("warning: OIDC authentication: %s\n", err)
+	}
+	return idToken, 0, nil
+}
+
+// checkRequired checks that the token of any grant has the claims of
+// Config.RequireClaims and the scopes of Config.ScopeRequired, the requested
+// scopes being those granted when the token doesn't say.
+func (f *Flow) checkRequired(token *oauth2.Token, idToken string, requested []string) error {
+	if err := checkRequiredClaims(idToken, f.Config.RequireClaims); err != nil {
+		return classify(ErrValidation, err)
+	}
+	if missing := missingScopes(strings.Fields(f.Config.ScopeRequired), grantedScopes(token, requested)); len(missing) > 0 {
+		return classify(ErrValidation, fmt.Errorf("Missing required scopes: %s", strings.Join(missing, " ")))
+	}
+	return nil
+}
+
+// logIDTokenClaims logs the claims of idToken.
+func (f *Flow) logIDTokenClaims(idToken string) {
+	claims, err := idTokenClaims(idToken)
+	if err != nil {
+		f.logf("warning: OIDC id_token claims: %s\n", err)
+		return
+	}
+	f.logf("id_token claims:\n%s\n", claims)
+}
+
+// attempt is a single authorization request of the code flow.
+type attempt struct {
+	state        string
+	nonce        string
+	verifier     string
+	authOpts     []oauth2.AuthCodeOption
+	exchangeOpts []oauth2.AuthCodeOption
+}
+
+// newAttempt returns an attempt with a fresh state, and nonce and PKCE
+// verifier when they are used.
+func (f *Flow) newAttempt(authOpts, exchangeOpts []oauth2.AuthCodeOption) (*attempt, error) {
+	a := &attempt{
+		state:        randString(),
+		authOpts:     append([]oauth2.AuthCodeOption{}, authOpts...),
+		exchangeOpts: append([]oauth2.AuthCodeOption{}, exchangeOpts...),
+	}
+	// OpenID Connect requires a nonce when the id_token comes from the
+	// authorization endpoint.
+	if f.Config.OIDCNonce || contains(responseTypes(f.Config.ResponseType), "id_token") {
+		a.nonce = randString()
+		a.authOpts = append(a.authOpts, oauth2.SetAuthURLParam("nonce", a.nonce))
+	}
+	if f.Config.PKCE {
+		verifier := newCodeVerifier()
+		challenge, err := codeChallenge(verifier, f.Config.PKCEMethod)
+		if err != nil {
+			return nil, err
+		}
+		a.authOpts = append(a.authOpts,
+			oauth2.SetAuthURLParam("code_challenge", challenge),
+			oauth2.SetAuthURLParam("code_challenge_method", f.Config.PKCEMethod),
+		)
+		a.exchangeOpts = append(a.exchangeOpts, oauth2.SetAuthURLParam("code_verifier", verifier))
+		a.verifier = verifier
+	}
+	return a, nil
+}
+
+// refreshFlow exchanges the refresh token for a new token. If the provider
+// rotates refresh tokens the new one is in the result.
+func (f *Flow) refreshFlow(ctx context.Context) (*oauth2.Token, error) {
+	config := &oauth2.Config{
+		ClientID:     f.Config.ClientID,
+		ClientSecret: f.Config.clientSecret(),
+		Endpoint: oauth2.Endpoint{
+			TokenURL:  f.Config.TokenURL,
+			AuthStyle: authStyles[f.Config.AuthStyle],
+		},
+	}
+	// Without an access token the token source always refreshes.
+	return f.retryToken(ctx, func() (*oauth2.Token, error) {
+		return config.TokenSource(ctx, &oauth2.Token{RefreshToken: f.Config.RefreshToken}).Token()
+	})
+}
+
+// clientCredentialsFlow fetches a token for the client itself.
+func (f *Flow) clientCredentialsFlow(ctx context.Context) (*oauth2.Token, error) {
+	config := clientcredentials.Config{
+		ClientID:     f.Config.ClientID,
+		ClientSecret: f.Config.clientSecret(),
+		TokenURL:     f.Config.TokenURL,
+		AuthStyle:    authStyles[f.Config.AuthStyle],
+		Scopes:       scopes(f.Config.Scope),
+	}
+	if len(f.Config.Audiences) > 0 {
+		config.EndpointParams = url.Values{"audience": {strings.Join(f.Config.Audiences, " ")}}
+	}
+	return f.retryToken(ctx, func() (*oauth2.Token, error) {
+		return config.Token(ctx)
+	})
+}
+
+// withTimeout returns ctx with the timeout as its deadline, if there is one.
+func withTimeout(ctx context.Context, timeout Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(timeout))
+}
+
+// verifyIDTokenFrom verifies the id_token with the keys of jwks.
+func (f *Flow) verifyIDTokenFrom(ctx context.Context, client *http.Client, idToken string) error {
+	if idToken == "" {
+		return fmt.Errorf("missing OIDC id_token")
+	}
+	keys, err := f.jwks(ctx, client)
+	if err != nil {
+		return err
+	}
+	return verifyIDToken(idToken, keys, f.Config.Issuer, f.Config.ClientID, time.Now())
+}
+
+// jwks returns the keys of the JWKS file, or from the JWKS URL, or those
+// discovered from the issuer, in that order.
+func (f *Flow) jwks(ctx context.Context, client *http.Client) ([]jwk, error) {
+	if f.Config.JWKSFile != "" {
+		return readJWKS(f.Config.JWKSFile)
+	}
+	jwksURL := f.Config.JWKSURL
+	if jwksURL == "" {
+		var err error
+		if jwksURL, err = discoverJWKSURL(ctx, client, f.Config.Issuer); err != nil {
+			return nil, err
+		}
+	}
+	return fetchJWKS(ctx, client, jwksURL)
+}
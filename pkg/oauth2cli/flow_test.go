@@ -0,0 +1,51 @@
+package oauth2cli
+
+import (
+	"context"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+	"golang.org/x/oauth2"
+)
+
+var _ = Describe("GetToken", func() {
+	var server *ghttp.Server
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should run the configured flow", func() {
+		server.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyRequest("POST", "/oauth/token"),
+			ghttp.VerifyFormKV("grant_type", "client_credentials"),
+			ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+				AccessToken: "mytoken",
+				TokenType:   "Bearer",
+			}),
+		))
+		conf := DefaultConfig()
+		conf.Flow = FlowClientCredentials
+		conf.ClientID = "123"
+		conf.ClientSecret = "abc"
+		conf.AuthStyle = "params"
+		conf.TokenURL = server.URL() + "/oauth/token"
+
+		token, err := GetToken(context.Background(), conf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(token.AccessToken).To(Equal("mytoken"))
+	})
+
+	It("should reject an unknown flow", func() {
+		conf := DefaultConfig()
+		conf.Flow = "implicit"
+		_, err := GetToken(context.Background(), conf)
+		Expect(err).To(MatchError(`unknown flow "implicit"`))
+	})
+})
@@ -0,0 +1,339 @@
+package oauth2cli
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// newHTTPClient returns the client used for requests to the provider, which
+// are kept by rec if it isn't nil.
+func newHTTPClient(conf Config, logger *log.Logger, rec *recorder) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	tlsConfig := &tls.Config{}
+	if conf.CACert != "" {
+		pool, err := loadCACert(conf.CACert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if conf.Insecure {
+		logger.Println("warning: TLS certificate verification is disabled, the token exchange can be intercepted")
+		tlsConfig.InsecureSkipVerify = true
+	}
+	if conf.ClientCert != "" || conf.ClientCertKey != "" {
+		cert, err := tls.LoadX509KeyPair(conf.ClientCert, conf.ClientCertKey)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	// The cloned transport already honours HTTP_PROXY, HTTPS_PROXY and
+	// NO_PROXY.
+	proxy := transport.Proxy
+	if conf.Proxy != "" {
+		proxyURL, err := url.Parse(conf.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		// The schemes that http.Transport can connect through.
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("invalid proxy URL %q: the scheme must be http, https or socks5", proxyURL.Redacted())
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+	if conf.Verbose {
+		proxy = loggingProxy(proxy, logger)
+	}
+	transport.Proxy = proxy
+
+	var rt http.RoundTripper = transport
+	if len(conf.CertPins) > 0 {
+		pins, err := parsePins(conf.CertPins)
+		if err != nil {
+			return nil, err
+		}
+		tokenURL, err := url.Parse(conf.TokenURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid token URL: %w", err)
+		}
+		// The pins are those of the token endpoint, so discovery and the
+		// other endpoints on other hosts aren't checked against them.
+		pinned := transport.Clone()
+		pinned.TLSClientConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return checkPins(pins, cs)
+		}
+		rt = pinTransport{Host: hostPort(tokenURL), Pinned: pinned, Transport: transport}
+	}
+	if rec != nil {
+		rt = recordTransport{Recorder: rec, Transport: rt}
+	}
+	if conf.Verbose {
+		rt = loggingTransport{Transport: rt, Redact: !conf.NoRedact, Log: logger}
+	}
+	// Outside the logging, which shows the response as the provider sent it.
+	responseMap, err := parseTokenResponseMap(conf.TokenResponseMap)
+	if err != nil {
+		return nil, err
+	}
+	rt = tokenResponseTransport{TokenURL: conf.TokenURL, Map: responseMap, Transport: rt}
+	if len(conf.Resources) > 0 {
+		rt = resourceTransport{TokenURL: conf.TokenURL, Resources: conf.Resources, Transport: rt}
+	}
+	if conf.AuthStyle == AuthPrivateKeyJWT {
+		if conf.ClientKey == "" {
+			return nil, errors.New("private_key_jwt needs a client key")
+		}
+		key, err := loadClientKey(conf.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("client key: %w", err)
+		}
+		// RFC 7523 section 3 allows the token endpoint as the audience.
+		rt = assertionTransport{Key: key, KeyID: conf.ClientKeyID, ClientID: conf.ClientID, Audience: conf.TokenURL, Transport: rt}
+	}
+	header := http.Header{}
+	if conf.HeaderFile != "" {
+		var err error
+		if header, err = readHeaderFile(conf.HeaderFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, line := range conf.TokenHeaders {
+		name, value, err := parseHeader(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid header %q, expected 'Name: Value'", line)
+		}
+		header.Add(name, value)
+	}
+	if conf.UserAgent != "" {
+		header.Set("User-Agent", conf.UserAgent)
+	}
+	rt = headerTransport{Header: header, Transport: rt}
+
+	client := &http.Client{
+		Transport: rt,
+		Timeout:   time.Duration(conf.HTTPTimeout),
+	}
+	if conf.Cookies {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			return nil, err
+		}
+		client.Jar = jar
+	}
+	return client, nil
+}
+
+// loggingProxy logs the proxy, if any, that proxy picks for each request.
+func loggingProxy(proxy func(*http.Request) (*url.URL, error), logger *log.Logger) func(*http.Request) (*url.URL, error) {
+	return func(r *http.Request) (*url.URL, error) {
+		proxyURL, err := proxy(r)
+		if proxyURL != nil {
+			logger.Printf("using proxy %s for %s\n", proxyURL.Redacted(), r.URL.Host)
+		}
+		return proxyURL, err
+	}
+}
+
+// loadCACert returns the system roots plus the certificates in a PEM bundle.
+func loadCACert(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %q", path)
+	}
+	return pool, nil
+}
+
+// parsePins decodes hex (optionally colon separated) or base64 SHA-256 pins.
+func parsePins(values []string) ([][]byte, error) {
+	var pins [][]byte
+	for _, v := range values {
+		pin, err := hex.DecodeString(strings.ReplaceAll(v, ":", ""))
+		if err != nil {
+			pin, err = base64.StdEncoding.DecodeString(v)
+		}
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid -pin-cert-sha256 %q, expected a hex or base64 SHA-256", v)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+var errPinMismatch = errors.New("does not match any pin")
+
+// checkPins errors unless the leaf certificate, or its public key, matches
+// one of the pins. It runs after the usual certificate verification.
+func checkPins(pins [][]byte, cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no peer certificate to check pins against")
+	}
+	leaf := cs.PeerCertificates[0]
+	certSum := sha256.Sum256(leaf.Raw)
+	keySum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if bytes.Equal(pin, certSum[:]) || bytes.Equal(pin, keySum[:]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate for %s %w (certificate SHA-256 %x)", cs.ServerName, errPinMismatch, certSum)
+}
+
+// pinTransport sends the requests to Host, the host and port of the token
+// endpoint, through Pinned, which checks the certificate pins, and the rest
+// through Transport.
+type pinTransport struct {
+	Host      string
+	Pinned    http.RoundTripper
+	Transport http.RoundTripper
+}
+
+func (p pinTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if hostPort(r.URL) == p.Host {
+		return p.Pinned.RoundTrip(r)
+	}
+	return p.Transport.RoundTrip(r)
+}
+
+// hostPort returns the host of u with its port, the default one for the
+// scheme if it has none.
+func hostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
+
+type loggingTransport struct {
+	Transport http.RoundTripper
+	// Redact masks credentials and tokens in the logged requests and
+	// responses.
+	Redact bool
+	Log    *log.Logger
+}
+
+func (l loggingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+
+	start := time.Now()
+	headers := ""
+	for k, v := range r.Header {
+		if l.Redact {
+			masked := make([]string, len(v))
+			for i := range v {
+				masked[i] = redactHeader(k, v[i])
+			}
+			v = masked
+		}
+		headers += fmt.Sprintf("%s: %v\n", k, v)
+	}
+	loggedBody := reqBody
+	if l.Redact {
+		loggedBody = redactBody(reqBody)
+	}
+	l.Log.Printf("request: %s %s\n%sbody:\n%s\n", r.Method, r.URL, headers, string(loggedBody))
+
+	res, err := l.Transport.RoundTrip(r)
+	duration := time.Since(start)
+	if err != nil {
+		l.Log.Printf("error: %s in %s\n", err, duration)
+	} else {
+		resBody, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		res.Body = ioutil.NopCloser(bytes.NewReader(resBody))
+		loggedBody := resBody
+		if l.Redact {
+			loggedBody = redactBody(resBody)
+		}
+		l.Log.Printf("response: %d in %s\nbody:\n%s\n", res.StatusCode, duration, loggedBody)
+		for _, c := range res.Cookies() {
+			l.Log.Printf("cookie received: %s (domain %q, path %q)\n", c.Name, c.Domain, c.Path)
+		}
+	}
+	return res, err
+}
+
+// headerTransport adds extra headers to every request.
+type headerTransport struct {
+	Header    http.Header
+	Transport http.RoundTripper
+}
+
+func (h headerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	for k, v := range h.Header {
+		r.Header[k] = v
+	}
+	return h.Transport.RoundTrip(r)
+}
+
+// readHeaderFile parses a file of "Name: Value" lines, ignoring blank lines
+// and lines starting with #.
+func readHeaderFile(path string) (http.Header, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header := http.Header{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, err := parseHeader(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: expected 'Name: Value'", path, n)
+		}
+		header.Add(name, value)
+	}
+	return header, scanner.Err()
+}
+
+// parseHeader splits a "Name: Value" line.
+func parseHeader(line string) (string, string, error) {
+	parts := strings.SplitN(line, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return "", "", errors.New("expected 'Name: Value'")
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]), nil
+}
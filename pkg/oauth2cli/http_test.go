@@ -0,0 +1,136 @@
+package oauth2cli
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("newHTTPClient", func() {
+	Describe("mutual TLS", func() {
+		var (
+			dir    string
+			server *httptest.Server
+			conf   Config
+		)
+
+		BeforeEach(func() {
+			server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, "%d", len(r.TLS.PeerCertificates))
+			}))
+			server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+			server.StartTLS()
+
+			var err error
+			dir, err = ioutil.TempDir("", "mtls")
+			Expect(err).ToNot(HaveOccurred())
+			cert, err := selfSignedCert("client.example")
+			Expect(err).ToNot(HaveOccurred())
+			keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+			Expect(err).ToNot(HaveOccurred())
+
+			conf = Config{
+				Insecure:      true,
+				ClientCert:    filepath.Join(dir, "cert.pem"),
+				ClientCertKey: filepath.Join(dir, "key.pem"),
+			}
+			Expect(ioutil.WriteFile(conf.ClientCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(conf.ClientCertKey, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			server.Close()
+			os.RemoveAll(dir)
+		})
+
+		It("should present the client certificate", func() {
+			client, err := newHTTPClient(conf, log.New(ioutil.Discard, "", 0), nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			resp, err := client.Get(server.URL)
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(body)).To(Equal("1"))
+		})
+
+		It("should fail for a missing key", func() {
+			conf.ClientCertKey = filepath.Join(dir, "missing.pem")
+			_, err := newHTTPClient(conf, log.New(ioutil.Discard, "", 0), nil)
+			Expect(err).To(MatchError(ContainSubstring("client certificate:")))
+		})
+	})
+
+	Describe("certificate pins", func() {
+		var (
+			discovery, token *httptest.Server
+			conf             Config
+		)
+
+		BeforeEach(func() {
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			discovery = httptest.NewTLSServer(handler)
+			token = httptest.NewTLSServer(handler)
+			conf = Config{
+				Insecure: true,
+				TokenURL: token.URL + "/token",
+				CertPins: StringList{strings.Repeat("ab", 32)},
+			}
+		})
+
+		AfterEach(func() {
+			discovery.Close()
+			token.Close()
+		})
+
+		It("should only check the connections to the token endpoint", func() {
+			client, err := newHTTPClient(conf, log.New(ioutil.Discard, "", 0), nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			resp, err := client.Get(discovery.URL + "/.well-known/openid-configuration")
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+
+			_, err = client.Post(conf.TokenURL, "application/x-www-form-urlencoded", nil)
+			Expect(errors.Is(err, errPinMismatch)).To(BeTrue(), "got %v", err)
+		})
+
+		It("should allow the token endpoint with a matching pin", func() {
+			sum := sha256.Sum256(token.Certificate().Raw)
+			conf.CertPins = StringList{hex.EncodeToString(sum[:])}
+			client, err := newHTTPClient(conf, log.New(ioutil.Discard, "", 0), nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			resp, err := client.Post(conf.TokenURL, "application/x-www-form-urlencoded", nil)
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+		})
+	})
+
+	Describe("proxy", func() {
+		It("should accept a socks5 proxy", func() {
+			_, err := newHTTPClient(Config{Proxy: "socks5://127.0.0.1:1080"}, log.New(ioutil.Discard, "", 0), nil)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should reject other schemes", func() {
+			_, err := newHTTPClient(Config{Proxy: "ftp://proxy.example:21"}, log.New(ioutil.Discard, "", 0), nil)
+			Expect(err).To(MatchError(ContainSubstring("the scheme must be http, https or socks5")))
+		})
+	})
+})
@@ -0,0 +1,144 @@
+package oauth2cli
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// The values of Config.PreferIDToken.
+const (
+	PreferIDTokenResponse = "response"
+	PreferIDTokenFragment = "fragment"
+)
+
+// implicitParams are the params of an authorization response that carries
+// tokens, from the implicit and hybrid flows.
+var implicitParams = []string{"access_token", "token_type", "expires_in", "id_token", "scope", "session_state"}
+
+// responseTypes returns the space separated values of Config.ResponseType,
+// which defaults to code.
+func responseTypes(responseType string) []string {
+	if types := strings.Fields(responseType); len(types) > 0 {
+		return types
+	}
+	return []string{"code"}
+}
+
+// fragmentResponse reports whether the provider redirects back with the
+// params in the URL fragment, as it does by default for response types
+// other than code (OAuth 2.0 Multiple Response Type Encoding Practices), and
+// for the JARM response modes likewise.
+func fragmentResponse(conf Config) bool {
+	types := responseTypes(conf.ResponseType)
+	plainCode := len(types) == 1 && types[0] == "code"
+	mode := strings.TrimSuffix(conf.ResponseMode, ".jwt")
+	return mode == "fragment" || ((mode == "" || mode == "jwt") && !plainCode)
+}
+
+// fragmentToken returns the token the implicit flow puts in the callback
+// params, rather than issuing it from the token endpoint.
+func fragmentToken(params url.Values) (*oauth2.Token, error) {
+	token := &oauth2.Token{
+		AccessToken: params.Get("access_token"),
+		TokenType:   params.Get("token_type"),
+	}
+	if token.AccessToken == "" && params.Get("id_token") == "" {
+		return nil, fmt.Errorf("no access_token or id_token in the callback")
+	}
+	if e := params.Get("expires_in"); e != "" {
+		seconds, err := strconv.Atoi(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expires_in %q", e)
+		}
+		token.Expiry = time.Now().Add(time.Duration(seconds) * time.Second)
+	}
+	return token.WithExtra(params), nil
+}
+
+// hybridIDToken returns the id_token of the hybrid flow that
+// Config.PreferIDToken picks, of fragment, the callback's, and that of the
+// token response, warning when they aren't about the same authentication:
+// OpenID Connect Core section 3.3.3.6 has them share iss and sub, and the
+// nonce is that of the same request.
+func (f *Flow) hybridIDToken(token *oauth2.Token, fragment string, decryptKey *rsa.PrivateKey) string {
+	response, _ := token.Extra("id_token").(string)
+	if response != "" && response != fragment {
+		var claims [2]struct {
+			Issuer  string `json:"iss"`
+			Subject string `json:"sub"`
+			Nonce   string `json:"nonce"`
+		}
+		for i, idToken := range []string{fragment, response} {
+			jwt, err := idTokenFrom((&oauth2.Token{}).WithExtra(map[string]interface{}{"id_token": idToken}), decryptKey)
+			if err == nil {
+				err = decodeClaims(jwt, &claims[i])
+			}
+			if err != nil {
+				// There's nothing to compare, and the checks of the
+				// preferred one fail it if it's the one that's broken.
+				return f.preferredIDToken(fragment, response)
+			}
+		}
+		for _, c := range []struct{ name, fragment, response string }{
+			{"iss", claims[0].Issuer, claims[1].Issuer},
+			{"sub", claims[0].Subject, claims[1].Subject},
+			{"nonce", claims[0].Nonce, claims[1].Nonce},
+		} {
+			if c.fragment != c.response {
+				f.logf("warning: the id_token of the callback has %s %q, but that of the token response %q\n", c.name, c.fragment, c.response)
+			}
+		}
+	}
+	return f.preferredIDToken(fragment, response)
+}
+
+// preferredIDToken returns the id_token of the fragment or of the response,
+// as Config.PreferIDToken has it, or the other when there's only one.
+func (f *Flow) preferredIDToken(fragment, response string) string {
+	if response == "" || f.Config.PreferIDToken == PreferIDTokenFragment {
+		return fragment
+	}
+	return response
+}
+
+// fragmentRelayPage posts the params in the URL fragment back to the
+// callback, since browsers don't send the fragment to the server.
+const fragmentRelayPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Completing authentication</title>
+<style>body { font-family: sans-serif; margin: 4em auto; max-width: 40em; }</style>
+</head>
+<body>
+<p id="message">Completing authentication&hellip;</p>
+<noscript><p>JavaScript is needed to pass the response in the URL fragment to oauth2-cli.</p></noscript>
+<script>
+var params = new URLSearchParams(window.location.hash.slice(1));
+if (!params.has("state")) {
+  document.getElementById("message").textContent = "No authorization response in the URL fragment.";
+} else {
+  var form = document.createElement("form");
+  form.method = "POST";
+  form.action = window.location.pathname;
+  params.forEach(function(value, name) {
+    var input = document.createElement("input");
+    input.type = "hidden";
+    input.name = name;
+    input.value = value;
+    form.appendChild(input);
+  });
+  document.body.appendChild(form);
+  history.replaceState(null, "", window.location.pathname);
+  form.submit();
+}
+</script>
+</body>
+</html>
+`
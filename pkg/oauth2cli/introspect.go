@@ -0,0 +1,105 @@
+package oauth2cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// Introspect posts token to Config.IntrospectURL, as described by RFC 7662,
+// and returns the response. hint is the token_type_hint, and may be empty.
+func (f *Flow) Introspect(ctx context.Context, token, hint string) (map[string]interface{}, error) {
+	client, err := newHTTPClient(f.Config, f.logger(), nil)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(ctx, f.Config.Timeout)
+	defer cancel()
+	return f.introspectToken(ctx, client, token, hint)
+}
+
+func (f *Flow) introspectToken(ctx context.Context, client *http.Client, token, hint string) (map[string]interface{}, error) {
+	form := url.Values{"token": {token}}
+	if hint != "" {
+		form.Set("token_type_hint", hint)
+	}
+	body, err := f.postClientForm(ctx, client, f.Config.IntrospectURL, form)
+	if err != nil {
+		return nil, err
+	}
+	var response map[string]interface{}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	return response, nil
+}
+
+// introspect logs the introspection response for the access token once it is
+// issued, and returns it. An inactive token is only a warning, as it was
+// issued all the same.
+func (f *Flow) introspect(ctx context.Context, client *http.Client, token *oauth2.Token) (map[string]interface{}, error) {
+	response, err := f.introspectToken(ctx, client, token.AccessToken, HintAccessToken)
+	if err != nil {
+		return nil, err
+	}
+	pretty, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	f.logf("introspection:\n%s\n", pretty)
+	if active, _ := response["active"].(bool); !active {
+		f.logf("warning: the introspection endpoint reports the token as not active\n")
+	}
+	return response, nil
+}
+
+// postClientForm posts form to endpoint with the client credentials, sent as
+// Config.AuthStyle says, and returns the body of a 2xx response.
+func (f *Flow) postClientForm(ctx context.Context, client *http.Client, endpoint string, form url.Values) ([]byte, error) {
+	req, err := f.clientFormRequest(ctx, endpoint, form)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s: %d %s\nResponse: %s", endpoint, resp.StatusCode, http.StatusText(resp.StatusCode), body)
+	}
+	return body, nil
+}
+
+// clientFormRequest returns a POST of form to endpoint with the client
+// credentials.
+func (f *Flow) clientFormRequest(ctx context.Context, endpoint string, form url.Values) (*http.Request, error) {
+	if authStyles[f.Config.AuthStyle] == oauth2.AuthStyleInParams {
+		form.Set("client_id", f.Config.ClientID)
+		if secret := f.Config.clientSecret(); secret != "" {
+			form.Set("client_secret", secret)
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if authStyles[f.Config.AuthStyle] != oauth2.AuthStyleInParams {
+		// As golang.org/x/oauth2 does, following RFC 6749 section 2.3.1.
+		req.SetBasicAuth(url.QueryEscape(f.Config.ClientID), url.QueryEscape(f.Config.clientSecret()))
+	}
+	return req, nil
+}
@@ -0,0 +1,142 @@
+package oauth2cli
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// requestObjectType is the typ of request objects (RFC 9101 section
+	// 10.8), which providers may require to tell them from other JWTs.
+	requestObjectType = "oauth-authz-req+jwt"
+	// requestObjectLifetime is how long a request object is valid for,
+	// well within the hour that FAPI allows.
+	requestObjectLifetime = 5 * time.Minute
+)
+
+// requestObjectURL returns authURL with its params moved into a request
+// object signed with Config.ClientKey, leaving just the client_id beside it
+// as RFC 9101 section 5 describes.
+func (f *Flow) requestObjectURL(authURL string, now time.Time) (string, error) {
+	conf := f.Config
+	if conf.ClientKey == "" {
+		return "", errors.New("a request object needs a client key to sign it")
+	}
+	key, err := loadClientKey(conf.ClientKey)
+	if err != nil {
+		return "", fmt.Errorf("client key: %w", err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return "", err
+	}
+	audience := conf.Issuer
+	if audience == "" {
+		audience = conf.AuthURL
+	}
+	claims := requestObjectClaims(u.Query())
+	claims["iss"] = conf.ClientID
+	claims["aud"] = audience
+	claims["jti"] = randString()
+	claims["iat"] = now.Unix()
+	claims["nbf"] = now.Unix()
+	claims["exp"] = now.Add(requestObjectLifetime).Unix()
+
+	header := map[string]interface{}{"typ": requestObjectType}
+	if conf.ClientKeyID != "" {
+		header["kid"] = conf.ClientKeyID
+	}
+	request, err := signJWT(key, header, claims)
+	if err != nil {
+		return "", fmt.Errorf("request object: %w", err)
+	}
+	if conf.Verbose {
+		f.logf("Signed the authorization params as a request object\n")
+	}
+	u.RawQuery = url.Values{
+		"client_id": {conf.ClientID},
+		"request":   {request},
+	}.Encode()
+	return u.String(), nil
+}
+
+// requestObjectClaims returns the auth params as request object claims.
+// Repeated params, such as resource, become arrays, and those that OpenID
+// Connect defines as JSON keep their type.
+func requestObjectClaims(params url.Values) map[string]interface{} {
+	claims := map[string]interface{}{}
+	for name, values := range params {
+		if len(values) > 1 {
+			claims[name] = values
+			continue
+		}
+		claims[name] = values[0]
+		switch name {
+		case "max_age":
+			if n, err := strconv.ParseInt(values[0], 10, 64); err == nil {
+				claims[name] = n
+			}
+		case "claims":
+			var v map[string]interface{}
+			if err := json.Unmarshal([]byte(values[0]), &v); err == nil {
+				claims[name] = v
+			}
+		}
+	}
+	return claims
+}
+
+// jarmMode reports whether the response_mode asks for the authorization
+// response as a JWT (JARM).
+func jarmMode(mode string) bool {
+	return mode == "jwt" || strings.HasSuffix(mode, ".jwt")
+}
+
+// jarmParams verifies the JWT in the response param of a JARM callback
+// against the provider's JWKS, decrypting it first with decryptKey if it's
+// encrypted, and returns its claims as the callback params.
+func (f *Flow) jarmParams(ctx context.Context, client *http.Client, query url.Values, decryptKey *rsa.PrivateKey) (url.Values, error) {
+	response := query.Get("response")
+	if response == "" {
+		return nil, classify(ErrValidation, errors.New("JARM: no response param in the callback"))
+	}
+	if strings.Count(response, ".") == 4 {
+		if decryptKey == nil {
+			return nil, classify(ErrValidation, errors.New("JARM: the response is encrypted, but there's no decrypt key"))
+		}
+		payload, err := decryptJWE(response, decryptKey)
+		if err != nil {
+			return nil, classify(ErrValidation, fmt.Errorf("JARM: %w", err))
+		}
+		response = string(payload)
+	}
+	keys, err := f.jwks(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("JARM: %w", err)
+	}
+	if err := verifyIDToken(response, keys, f.Config.Issuer, f.Config.ClientID, time.Now()); err != nil {
+		return nil, classify(ErrValidation, fmt.Errorf("JARM response verification error: %w", err))
+	}
+
+	var claims map[string]interface{}
+	if err := decodeClaims(response, &claims); err != nil {
+		return nil, classify(ErrValidation, fmt.Errorf("JARM: %w", err))
+	}
+	// The response params are the string claims, aud and the times being
+	// those of the JWT.
+	params := url.Values{}
+	for name, v := range claims {
+		if s, ok := v.(string); ok && name != "aud" {
+			params.Set(name, s)
+		}
+	}
+	return params, nil
+}
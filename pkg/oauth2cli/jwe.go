@@ -0,0 +1,180 @@
+package oauth2cli
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+var errEncryptedIDToken = errors.New("encrypted id_token, key required (-id-token-decrypt-key)")
+
+// idTokenFrom returns the id_token of the token response, decrypting it with
+// key first when it is a JWE. It returns "" when there is no id_token.
+func idTokenFrom(token *oauth2.Token, key *rsa.PrivateKey) (string, error) {
+	idToken, _ := token.Extra("id_token").(string)
+	if strings.Count(idToken, ".") != 4 {
+		return idToken, nil
+	}
+	if key == nil {
+		return "", errEncryptedIDToken
+	}
+	plaintext, err := decryptJWE(idToken, key)
+	if err != nil {
+		return "", fmt.Errorf("id_token decrypt: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// loadDecryptKey reads an RSA private key from a PKCS#1 or PKCS#8 PEM file.
+func loadDecryptKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA private key", path)
+	}
+	return rsaKey, nil
+}
+
+// decryptJWE decrypts a compact serialized JWE (RFC 7516) using the RSA-OAEP
+// key management algorithms with AES-GCM or AES-CBC-HMAC content encryption.
+func decryptJWE(jwe string, key *rsa.PrivateKey) ([]byte, error) {
+	parts := strings.Split(jwe, ".")
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("JWE has %d segments, expected 5", len(parts))
+	}
+	var decoded [5][]byte
+	for i, part := range parts {
+		b, err := base64.RawURLEncoding.DecodeString(part)
+		if err != nil {
+			return nil, fmt.Errorf("JWE segment %d: %w", i+1, err)
+		}
+		decoded[i] = b
+	}
+	encryptedKey, iv, ciphertext, tag := decoded[1], decoded[2], decoded[3], decoded[4]
+
+	var header struct {
+		Alg string `json:"alg"`
+		Enc string `json:"enc"`
+	}
+	if err := json.Unmarshal(decoded[0], &header); err != nil {
+		return nil, fmt.Errorf("JWE header: %w", err)
+	}
+
+	var oaepHash hash.Hash
+	switch header.Alg {
+	case "RSA-OAEP":
+		oaepHash = sha1.New()
+	case "RSA-OAEP-256":
+		oaepHash = sha256.New()
+	default:
+		return nil, fmt.Errorf("unsupported JWE alg %q", header.Alg)
+	}
+	cek, err := rsa.DecryptOAEP(oaepHash, rand.Reader, key, encryptedKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("JWE key decrypt: %w", err)
+	}
+
+	// The additional authenticated data is the encoded protected header.
+	aad := []byte(parts[0])
+	switch header.Enc {
+	case "A128GCM", "A192GCM", "A256GCM":
+		return decryptGCM(cek, iv, ciphertext, tag, aad)
+	case "A128CBC-HS256":
+		return decryptCBCHMAC(crypto.SHA256, cek, iv, ciphertext, tag, aad)
+	case "A192CBC-HS384":
+		return decryptCBCHMAC(crypto.SHA384, cek, iv, ciphertext, tag, aad)
+	case "A256CBC-HS512":
+		return decryptCBCHMAC(crypto.SHA512, cek, iv, ciphertext, tag, aad)
+	}
+	return nil, fmt.Errorf("unsupported JWE enc %q", header.Enc)
+}
+
+func decryptGCM(cek, iv, ciphertext, tag, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, iv, append(ciphertext, tag...), aad)
+}
+
+// decryptCBCHMAC implements the AES_CBC_HMAC_SHA2 algorithms of RFC 7518
+// section 5.2, where the first half of the key is used for the MAC.
+func decryptCBCHMAC(h crypto.Hash, cek, iv, ciphertext, tag, aad []byte) ([]byte, error) {
+	if len(cek) != h.Size() {
+		return nil, fmt.Errorf("content encryption key is %d bytes, expected %d", len(cek), h.Size())
+	}
+	macKey, encKey := cek[:len(cek)/2], cek[len(cek)/2:]
+
+	var newHash func() hash.Hash
+	switch h {
+	case crypto.SHA256:
+		newHash = sha256.New
+	case crypto.SHA384:
+		newHash = sha512.New384
+	default:
+		newHash = sha512.New
+	}
+	mac := hmac.New(newHash, macKey)
+	mac.Write(aad)
+	mac.Write(iv)
+	mac.Write(ciphertext)
+	al := make([]byte, 8)
+	binary.BigEndian.PutUint64(al, uint64(len(aad))*8)
+	mac.Write(al)
+	if subtle.ConstantTimeCompare(mac.Sum(nil)[:len(macKey)], tag) != 1 {
+		return nil, errors.New("JWE authentication tag mismatch")
+	}
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() || len(ciphertext) == 0 || len(ciphertext)%block.BlockSize() != 0 {
+		return nil, errors.New("invalid JWE ciphertext length")
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > block.BlockSize() {
+		return nil, errors.New("invalid JWE padding")
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
@@ -0,0 +1,238 @@
+package oauth2cli
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// jwk is a JSON Web Key as served from a provider's jwks_uri.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Key describes a key of the provider's JWKS.
+type Key struct {
+	ID        string
+	Type      string
+	Algorithm string
+	Use       string
+}
+
+// Keys returns the keys that id_tokens are verified with: those of
+// Config.JWKSFile or Config.JWKSURL, or those discovered from Config.Issuer.
+func (f *Flow) Keys(ctx context.Context) ([]Key, error) {
+	client, err := newHTTPClient(f.Config, f.logger(), nil)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(ctx, f.Config.Timeout)
+	defer cancel()
+	keys, err := f.jwks(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	described := make([]Key, len(keys))
+	for i, key := range keys {
+		described[i] = Key{ID: key.Kid, Type: key.Kty, Algorithm: key.Alg, Use: key.Use}
+	}
+	return described, nil
+}
+
+// discoverJWKSURL returns the jwks_uri from the issuer's OpenID Connect
+// discovery document.
+func discoverJWKSURL(ctx context.Context, client *http.Client, issuer string) (string, error) {
+	discovery, err := discover(ctx, client, issuer)
+	if err != nil {
+		return "", err
+	}
+	if discovery.JWKSURI == "" {
+		return "", errors.New("discovery: no jwks_uri")
+	}
+	return discovery.JWKSURI, nil
+}
+
+// fetchJWKS returns the keys served at jwksURL.
+func fetchJWKS(ctx context.Context, client *http.Client, jwksURL string) ([]jwk, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := getJSON(ctx, client, jwksURL, &set); err != nil {
+		return nil, fmt.Errorf("JWKS: %w", err)
+	}
+	return set.Keys, nil
+}
+
+// readJWKS returns the keys of the JWKS file at path.
+func readJWKS(path string) ([]jwk, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("JWKS: %w", err)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("JWKS: %s: %w", path, err)
+	}
+	return set.Keys, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %d %s", url, resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	return json.Unmarshal(body, v)
+}
+
+// verifyIDToken checks the RS256 or ES256 signature of the id_token against
+// keys, then that it was issued by issuer (when known) for clientID (when
+// known) and hasn't expired.
+func verifyIDToken(idToken string, keys []jwk, issuer, clientID string, now time.Time) error {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("JWT has %d segments, expected 3", len(parts))
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("header decode: %w", err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return fmt.Errorf("header decode: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("signature decode: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	verified := false
+	for _, key := range keys {
+		if header.Kid != "" && key.Kid != header.Kid {
+			continue
+		}
+		if verifySignature(header.Alg, key, digest[:], signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return fmt.Errorf("no key matches the %s signature (kid %q)", header.Alg, header.Kid)
+	}
+
+	var claims struct {
+		Iss string          `json:"iss"`
+		Aud json.RawMessage `json:"aud"`
+		Exp int64           `json:"exp"`
+	}
+	if err := decodeClaims(idToken, &claims); err != nil {
+		return err
+	}
+	if issuer != "" && claims.Iss != issuer {
+		return fmt.Errorf("iss %q != %q", claims.Iss, issuer)
+	}
+	if clientID != "" {
+		// aud is either a string or an array of strings.
+		var audiences []string
+		if err := json.Unmarshal(claims.Aud, &audiences); err != nil {
+			var aud string
+			if err := json.Unmarshal(claims.Aud, &aud); err != nil {
+				return fmt.Errorf("invalid aud %s", claims.Aud)
+			}
+			audiences = []string{aud}
+		}
+		if !contains(audiences, clientID) {
+			return fmt.Errorf("aud %q does not include %q", audiences, clientID)
+		}
+	}
+	if claims.Exp == 0 || now.After(time.Unix(claims.Exp, 0)) {
+		return fmt.Errorf("expired at %s", time.Unix(claims.Exp, 0).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// verifySignature reports whether signature is a valid alg signature of
+// digest by key.
+func verifySignature(alg string, key jwk, digest, signature []byte) bool {
+	switch {
+	case alg == "RS256" && key.Kty == "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return false
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			return false
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, signature) == nil
+
+	case alg == "ES256" && key.Kty == "EC" && key.Crv == "P-256":
+		x, err := base64.RawURLEncoding.DecodeString(key.X)
+		if err != nil {
+			return false
+		}
+		y, err := base64.RawURLEncoding.DecodeString(key.Y)
+		if err != nil {
+			return false
+		}
+		// JWS ECDSA signatures are the fixed size R and S concatenated.
+		if len(signature) != 64 {
+			return false
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(pub, digest, r, s)
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package oauth2cli
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("verifyIDToken", func() {
+	var (
+		key  *ecdsa.PrivateKey
+		keys []jwk
+		now  time.Time
+	)
+
+	// sign builds an ES256 JWT carrying the given claims.
+	sign := func(claims map[string]interface{}) string {
+		payload, err := json.Marshal(claims)
+		Expect(err).ToNot(HaveOccurred())
+
+		enc := base64.RawURLEncoding
+		signed := enc.EncodeToString([]byte(`{"alg":"ES256","kid":"ec-1"}`)) + "." + enc.EncodeToString(payload)
+		digest := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		Expect(err).ToNot(HaveOccurred())
+
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		return signed + "." + enc.EncodeToString(signature)
+	}
+
+	BeforeEach(func() {
+		var err error
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		keys = []jwk{{
+			Kty: "EC",
+			Kid: "ec-1",
+			Crv: "P-256",
+			X:   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+			Y:   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+		}}
+		now = time.Unix(1700000000, 0)
+	})
+
+	It("should accept a valid ES256 token", func() {
+		idToken := sign(map[string]interface{}{"iss": "https://issuer.example", "aud": []string{"other", "123"}, "exp": 1700000060})
+		Expect(verifyIDToken(idToken, keys, "https://issuer.example", "123", now)).To(Succeed())
+	})
+
+	It("should reject another issuer", func() {
+		idToken := sign(map[string]interface{}{"iss": "https://evil.example", "aud": "123", "exp": 1700000060})
+		Expect(verifyIDToken(idToken, keys, "https://issuer.example", "123", now)).To(MatchError(`iss "https://evil.example" != "https://issuer.example"`))
+	})
+
+	It("should reject another audience", func() {
+		idToken := sign(map[string]interface{}{"aud": "456", "exp": 1700000060})
+		Expect(verifyIDToken(idToken, keys, "", "123", now)).To(MatchError(`aud ["456"] does not include "123"`))
+	})
+
+	It("should reject an expired token", func() {
+		idToken := sign(map[string]interface{}{"aud": "123", "exp": 1699999940})
+		Expect(verifyIDToken(idToken, keys, "", "123", now)).To(MatchError("expired at 2023-11-14T22:12:20Z"))
+	})
+
+	It("should reject unsigned tokens", func() {
+		enc := base64.RawURLEncoding
+		idToken := enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." + enc.EncodeToString([]byte(`{"aud":"123"}`)) + "."
+		Expect(verifyIDToken(idToken, keys, "", "123", now)).To(MatchError(`no key matches the none signature (kid "")`))
+	})
+})
@@ -0,0 +1,109 @@
+package oauth2cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const loggedOutPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Logged out</title>
+<style>body { font-family: sans-serif; margin: 4em auto; max-width: 40em; }</style>
+</head>
+<body>
+<p>Logged out. You can close this window.</p>
+</body>
+</html>
+`
+
+// Logout ends the provider session at Config.EndSessionURL, as described by
+// OpenID Connect RP-Initiated Logout, and waits for the browser to be
+// redirected back to the callback. idToken is sent as the id_token_hint, and
+// may be empty for providers that ask the user to confirm instead.
+func (f *Flow) Logout(ctx context.Context, idToken string) error {
+	conf := f.Config
+	ctx, cancel := withTimeout(ctx, conf.Timeout)
+	defer cancel()
+
+	callbackURL, err := url.Parse(conf.Callback)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", conf.Interface, conf.Port))
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	if callbackURL.Scheme == "" {
+		callbackURL.Scheme = "http"
+	}
+	if callbackURL.Host == "" {
+		callbackURL.Host = fmt.Sprintf("%s:%d", conf.Interface, listener.Addr().(*net.TCPAddr).Port)
+	}
+
+	logoutURL, err := url.Parse(conf.EndSessionURL)
+	if err != nil {
+		return err
+	}
+	state := randString()
+	query := logoutURL.Query()
+	if idToken != "" {
+		query.Set("id_token_hint", idToken)
+	}
+	query.Set("client_id", conf.ClientID)
+	query.Set("post_logout_redirect_uri", callbackURL.String())
+	query.Set("state", state)
+	logoutURL.RawQuery = query.Encode()
+
+	done := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc(callbackURL.Path, func(w http.ResponseWriter, r *http.Request) {
+		// The state is only echoed back by providers that support it.
+		if s := r.URL.Query().Get("state"); s != "" && s != state {
+			http.Error(w, fmt.Sprintf("Invalid state: %s", s), http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = io.WriteString(w, loggedOutPage)
+		select {
+		case <-done:
+		default:
+			close(done)
+		}
+	})
+	server := http.Server{Handler: mux}
+	serveErr := make(chan error, 1)
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			serveErr <- err
+		}
+	}()
+	defer server.Shutdown(context.Background())
+	f.logf("Listening on %s for the redirect to %s\n", listener.Addr(), callbackURL)
+	f.showURL(logoutURL.String())
+
+	var timeout <-chan time.Time
+	if conf.CallbackWait > 0 {
+		timeout = time.After(time.Duration(conf.CallbackWait))
+	}
+	select {
+	case <-done:
+		return nil
+	case err := <-serveErr:
+		return err
+	case <-timeout:
+		return fmt.Errorf("%w after %s waiting for the logout redirect", ErrTimeout, &conf.CallbackWait)
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("%w after %s", ErrTimeout, &conf.Timeout)
+		}
+		return ctx.Err()
+	}
+}
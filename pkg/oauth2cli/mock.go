@@ -0,0 +1,388 @@
+package oauth2cli
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mockSubject is the sub of the user that MockServer authorizes, unless its
+// Claims set another.
+const mockSubject = "mock-user"
+
+// MockServer is a minimal OAuth 2.0 authorization server and OpenID
+// Provider to test clients against. It approves every authorization without
+// a login, and issues access tokens and id_tokens that are RS256 JWTs signed
+// by a key generated when it's created.
+//
+// It serves discovery, /authorize, /token (the authorization_code,
+// refresh_token and client_credentials grants), /jwks and /userinfo, keeping
+// what it issued in memory.
+type MockServer struct {
+	// Issuer is the base URL the server is reached at, which is the iss of
+	// the tokens and of the discovery document.
+	Issuer string
+	// ClientID and ClientSecret, if set, are the only client accepted.
+	ClientID     string
+	ClientSecret string
+	// Claims are added to those of the tokens issued and the userinfo
+	// response, replacing the defaults such as sub.
+	Claims map[string]interface{}
+	// ExpiresIn is the lifetime of the access tokens, an hour if zero.
+	ExpiresIn time.Duration
+	// Logger logs each token issued, if set.
+	Logger *log.Logger
+
+	key   *rsa.PrivateKey
+	keyID string
+
+	mu sync.Mutex
+	// codes, refreshTokens and accessTokens are the grants that each was
+	// issued for.
+	codes         map[string]*mockGrant
+	refreshTokens map[string]*mockGrant
+	accessTokens  map[string]*mockGrant
+}
+
+// mockGrant is an authorization that MockServer issued tokens for, by a
+// user unless it's for the client_credentials grant.
+type mockGrant struct {
+	clientID    string
+	scope       string
+	redirectURI string
+	nonce       string
+	challenge   string
+	method      string
+	authTime    time.Time
+	expiry      time.Time
+	user        bool
+}
+
+// NewMockServer returns a MockServer for issuer, with a new signing key.
+func NewMockServer(issuer string) (*MockServer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &MockServer{
+		Issuer:        strings.TrimSuffix(issuer, "/"),
+		key:           key,
+		keyID:         randString()[:16],
+		codes:         map[string]*mockGrant{},
+		refreshTokens: map[string]*mockGrant{},
+		accessTokens:  map[string]*mockGrant{},
+	}, nil
+}
+
+func (m *MockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration", "/.well-known/oauth-authorization-server":
+		m.serveDiscovery(w, r)
+	case "/authorize":
+		m.serveAuthorize(w, r)
+	case "/token":
+		m.serveToken(w, r)
+	case "/jwks":
+		m.serveJWKS(w, r)
+	case "/userinfo":
+		m.serveUserinfo(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *MockServer) serveDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                         m.Issuer,
+		"authorization_endpoint":                         m.Issuer + "/authorize",
+		"token_endpoint":                                 m.Issuer + "/token",
+		"jwks_uri":                                       m.Issuer + "/jwks",
+		"userinfo_endpoint":                              m.Issuer + "/userinfo",
+		"response_types_supported":                       []string{"code"},
+		"scopes_supported":                               []string{"openid"},
+		"grant_types_supported":                          []string{"authorization_code", "refresh_token", "client_credentials"},
+		"subject_types_supported":                        []string{"public"},
+		"id_token_signing_alg_values_supported":          []string{"RS256"},
+		"code_challenge_methods_supported":               []string{"S256", "plain"},
+		"token_endpoint_auth_methods_supported":          []string{"client_secret_basic", "client_secret_post", "none"},
+		"authorization_response_iss_parameter_supported": true,
+	})
+}
+
+// serveAuthorize approves the authorization right away, redirecting back
+// with a code, or with an error for a request it can't approve.
+func (m *MockServer) serveAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirectURI, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || !redirectURI.IsAbs() {
+		// Without somewhere to redirect to, the error is for the user.
+		http.Error(w, "Invalid or missing redirect_uri", http.StatusBadRequest)
+		return
+	}
+	clientID := q.Get("client_id")
+	if clientID == "" || (m.ClientID != "" && clientID != m.ClientID) {
+		http.Error(w, fmt.Sprintf("Unknown client_id %q", clientID), http.StatusBadRequest)
+		return
+	}
+
+	params := url.Values{}
+	if state := q.Get("state"); state != "" {
+		params.Set("state", state)
+	}
+	params.Set("iss", m.Issuer)
+	method := q.Get("code_challenge_method")
+	switch {
+	case q.Get("response_type") != "code":
+		params.Set("error", "unsupported_response_type")
+		params.Set("error_description", "Only the code response type is supported")
+	case q.Get("code_challenge") != "" && method != "" && method != "S256" && method != "plain":
+		params.Set("error", "invalid_request")
+		params.Set("error_description", "Unsupported code_challenge_method "+method)
+	default:
+		if method == "" {
+			method = "plain"
+		}
+		code := randString()
+		m.mu.Lock()
+		m.codes[code] = &mockGrant{
+			clientID:    clientID,
+			scope:       q.Get("scope"),
+			redirectURI: redirectURI.String(),
+			nonce:       q.Get("nonce"),
+			challenge:   q.Get("code_challenge"),
+			method:      method,
+			authTime:    time.Now(),
+			user:        true,
+		}
+		m.mu.Unlock()
+		params.Set("code", code)
+	}
+
+	query := redirectURI.Query()
+	for k, v := range params {
+		query[k] = v
+	}
+	redirectURI.RawQuery = query.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (m *MockServer) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		mockError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	clientID, secret, basic := r.BasicAuth()
+	if !basic {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID == "" || (m.ClientID != "" && clientID != m.ClientID) ||
+		(m.ClientSecret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(m.ClientSecret)) != 1) {
+		mockError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	var grant *mockGrant
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		grant = m.takeCode(r.PostForm.Get("code"))
+		if err := grant.checkCode(clientID, r.PostForm); err != "" {
+			mockError(w, http.StatusBadRequest, "invalid_grant", err)
+			return
+		}
+	case "refresh_token":
+		m.mu.Lock()
+		grant = m.refreshTokens[r.PostForm.Get("refresh_token")]
+		m.mu.Unlock()
+		if grant == nil || grant.clientID != clientID {
+			mockError(w, http.StatusBadRequest, "invalid_grant", "Unknown refresh_token")
+			return
+		}
+	case "client_credentials":
+		grant = &mockGrant{clientID: clientID, scope: r.PostForm.Get("scope")}
+	default:
+		mockError(w, http.StatusBadRequest, "unsupported_grant_type", "Unsupported grant_type "+r.PostForm.Get("grant_type"))
+		return
+	}
+
+	response, err := m.issue(grant)
+	if err != nil {
+		mockError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	if m.Logger != nil {
+		m.Logger.Printf("Issued a token to %s for %s, scope %q\n", clientID, r.PostForm.Get("grant_type"), grant.scope)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, response)
+}
+
+// takeCode returns the grant of code, which can only be used once.
+func (m *MockServer) takeCode(code string) *mockGrant {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	grant := m.codes[code]
+	delete(m.codes, code)
+	return grant
+}
+
+// checkCode returns why the token request form can't exchange the code that
+// g was issued for, if it can't.
+func (g *mockGrant) checkCode(clientID string, form url.Values) string {
+	switch {
+	case g == nil:
+		return "Unknown or already used code"
+	case g.clientID != clientID:
+		return "The code was issued to another client"
+	case form.Get("redirect_uri") != g.redirectURI:
+		return "redirect_uri doesn't match the authorization request"
+	}
+	verifier := form.Get("code_verifier")
+	if g.challenge == "" {
+		return ""
+	}
+	challenge := verifier
+	if g.method == "S256" {
+		sum := sha256.Sum256([]byte(verifier))
+		challenge = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	if verifier == "" || challenge != g.challenge {
+		return "Invalid code_verifier"
+	}
+	return ""
+}
+
+// issue returns the token response for grant: a JWT access token, and a
+// refresh token and an id_token when the user authorized it, the latter
+// with the openid scope.
+func (m *MockServer) issue(grant *mockGrant) (map[string]interface{}, error) {
+	now := time.Now()
+	expiresIn := m.ExpiresIn
+	if expiresIn <= 0 {
+		expiresIn = time.Hour
+	}
+	subject := mockSubject
+	if !grant.user {
+		subject = grant.clientID
+	}
+
+	claims := map[string]interface{}{
+		"iss":       m.Issuer,
+		"sub":       subject,
+		"aud":       grant.clientID,
+		"client_id": grant.clientID,
+		"iat":       now.Unix(),
+		"exp":       now.Add(expiresIn).Unix(),
+		"jti":       randString(),
+	}
+	if grant.scope != "" {
+		claims["scope"] = grant.scope
+	}
+	accessToken, err := m.sign(claims, "at+jwt")
+	if err != nil {
+		return nil, err
+	}
+	response := map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int64(expiresIn / time.Second),
+	}
+	if grant.scope != "" {
+		response["scope"] = grant.scope
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.accessTokens[accessToken] = &mockGrant{clientID: grant.clientID, scope: grant.scope, expiry: now.Add(expiresIn), user: grant.user}
+	if !grant.user {
+		return response, nil
+	}
+	refreshToken := randString()
+	m.refreshTokens[refreshToken] = grant
+	response["refresh_token"] = refreshToken
+
+	if contains(strings.Fields(grant.scope), "openid") {
+		idClaims := map[string]interface{}{
+			"iss":       m.Issuer,
+			"sub":       subject,
+			"aud":       grant.clientID,
+			"azp":       grant.clientID,
+			"iat":       now.Unix(),
+			"exp":       now.Add(expiresIn).Unix(),
+			"auth_time": grant.authTime.Unix(),
+		}
+		if grant.nonce != "" {
+			idClaims["nonce"] = grant.nonce
+		}
+		if response["id_token"], err = m.sign(idClaims, "JWT"); err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// sign returns the JWT of claims with Claims added.
+func (m *MockServer) sign(claims map[string]interface{}, typ string) (string, error) {
+	for k, v := range m.Claims {
+		claims[k] = v
+	}
+	return signJWT(m.key, map[string]interface{}{"typ": typ, "kid": m.keyID}, claims)
+}
+
+func (m *MockServer) serveJWKS(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": m.keyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}},
+	})
+}
+
+// serveUserinfo returns the claims of the user that the bearer access token
+// was issued for.
+func (m *MockServer) serveUserinfo(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	m.mu.Lock()
+	grant := m.accessTokens[token]
+	m.mu.Unlock()
+	if grant == nil || time.Now().After(grant.expiry) || !grant.user {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		mockError(w, http.StatusUnauthorized, "invalid_token", "Unknown or expired access token")
+		return
+	}
+	claims := map[string]interface{}{"sub": mockSubject}
+	for k, v := range m.Claims {
+		claims[k] = v
+	}
+	writeJSON(w, http.StatusOK, claims)
+}
+
+// mockError writes an OAuth 2.0 error response.
+func mockError(w http.ResponseWriter, status int, code, description string) {
+	writeJSON(w, status, map[string]string{"error": code, "error_description": description})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
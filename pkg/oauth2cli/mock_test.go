@@ -0,0 +1,140 @@
+package oauth2cli
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MockServer", func() {
+	var mock *MockServer
+
+	BeforeEach(func() {
+		var err error
+		mock, err = NewMockServer("http://mock.example/")
+		Expect(err).ToNot(HaveOccurred())
+		mock.Claims = map[string]interface{}{"email": "dev@example.com"}
+	})
+
+	serve := func(r *http.Request) (*httptest.ResponseRecorder, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		mock.ServeHTTP(w, r)
+		var body map[string]interface{}
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		return w, body
+	}
+
+	token := func(form url.Values) (int, map[string]interface{}) {
+		r := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w, body := serve(r)
+		return w.Code, body
+	}
+
+	// authorize returns the code that the mock redirects back with.
+	authorize := func(params url.Values) url.Values {
+		w, _ := serve(httptest.NewRequest("GET", "/authorize?"+params.Encode(), nil))
+		Expect(w.Code).To(Equal(http.StatusFound))
+		location, err := url.Parse(w.Header().Get("Location"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(location.Host).To(Equal("localhost:8080"))
+		return location.Query()
+	}
+
+	verifier := "myverifier"
+	sum := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"myclient"},
+		"redirect_uri":          {"http://localhost:8080/callback"},
+		"scope":                 {"openid email"},
+		"state":                 {"mystate"},
+		"nonce":                 {"mynonce"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+	exchange := func(code, verifier string) url.Values {
+		return url.Values{
+			"grant_type":    {"authorization_code"},
+			"client_id":     {"myclient"},
+			"code":          {code},
+			"redirect_uri":  {"http://localhost:8080/callback"},
+			"code_verifier": {verifier},
+		}
+	}
+
+	It("should serve discovery for its issuer", func() {
+		_, body := serve(httptest.NewRequest("GET", "/.well-known/openid-configuration", nil))
+		Expect(body).To(HaveKeyWithValue("issuer", "http://mock.example"))
+		Expect(body).To(HaveKeyWithValue("token_endpoint", "http://mock.example/token"))
+	})
+
+	It("should issue an id_token that its JWKS verifies", func() {
+		query := authorize(params)
+		Expect(query.Get("state")).To(Equal("mystate"))
+		Expect(query.Get("iss")).To(Equal("http://mock.example"))
+
+		status, body := token(exchange(query.Get("code"), verifier))
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(HaveKey("refresh_token"))
+
+		w, _ := serve(httptest.NewRequest("GET", "/jwks", nil))
+		var set struct{ Keys []jwk }
+		Expect(json.Unmarshal(w.Body.Bytes(), &set)).To(Succeed())
+		idToken := body["id_token"].(string)
+		Expect(verifyIDToken(idToken, set.Keys, "http://mock.example", "myclient", time.Now())).To(Succeed())
+		decoded, err := DecodeJWT(idToken)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(decoded.Claims).To(HaveKeyWithValue("nonce", "mynonce"))
+		Expect(decoded.Claims).To(HaveKeyWithValue("email", "dev@example.com"))
+
+		r := httptest.NewRequest("GET", "/userinfo", nil)
+		r.Header.Set("Authorization", "Bearer "+body["access_token"].(string))
+		_, userinfo := serve(r)
+		Expect(userinfo).To(Equal(map[string]interface{}{"sub": "mock-user", "email": "dev@example.com"}))
+	})
+
+	It("should check the PKCE verifier, and only exchange a code once", func() {
+		code := authorize(params).Get("code")
+		status, body := token(exchange(code, "wrong"))
+		Expect(status).To(Equal(http.StatusBadRequest))
+		Expect(body).To(HaveKeyWithValue("error", "invalid_grant"))
+
+		code = authorize(params).Get("code")
+		status, _ = token(exchange(code, verifier))
+		Expect(status).To(Equal(http.StatusOK))
+		status, body = token(exchange(code, verifier))
+		Expect(status).To(Equal(http.StatusBadRequest))
+		Expect(body).To(HaveKeyWithValue("error_description", "Unknown or already used code"))
+	})
+
+	It("should refresh the tokens it issued", func() {
+		_, body := token(exchange(authorize(params).Get("code"), verifier))
+		status, refreshed := token(url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {"myclient"},
+			"refresh_token": {body["refresh_token"].(string)},
+		})
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(refreshed).To(HaveKey("id_token"))
+		Expect(refreshed["access_token"]).ToNot(Equal(body["access_token"]))
+	})
+
+	It("should redirect an unsupported response type back with an error", func() {
+		query := authorize(url.Values{
+			"response_type": {"token"},
+			"client_id":     {"myclient"},
+			"redirect_uri":  {"http://localhost:8080/callback"},
+		})
+		Expect(query.Get("error")).To(Equal("unsupported_response_type"))
+		Expect(query.Get("code")).To(BeEmpty())
+	})
+})
@@ -0,0 +1,13 @@
+package oauth2cli
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestOauth2cli(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Oauth2cli Suite")
+}
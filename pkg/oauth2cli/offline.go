@@ -0,0 +1,67 @@
+package oauth2cli
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/oauth2"
+)
+
+// Offline access modes for Config.Offline.
+const (
+	OfflineAuto = "auto"
+	OfflineOn   = "on"
+	OfflineOff  = "off"
+)
+
+// offlineAccessScope is the OpenID Connect scope for a refresh token
+// (OpenID Connect Core section 11).
+const offlineAccessScope = "offline_access"
+
+// offlineAccess returns the scopes and auth params that ask for offline
+// access, a refresh token, as Config.Offline has it:
+//
+//   - on sends access_type=offline and adds the offline_access scope
+//   - off sends neither, for providers that reject what they don't know
+//   - auto adds the offline_access scope for an OpenID Connect scope when the
+//     discovery document of Config.Issuer lists it, and sends
+//     access_type=offline otherwise
+//
+// A scope that already has offline_access is left as it is.
+func (f *Flow) offlineAccess(ctx context.Context, client *http.Client, scopes []string) ([]string, []oauth2.AuthCodeOption, error) {
+	conf := f.Config
+	switch conf.Offline {
+	case OfflineOff:
+		return scopes, nil, nil
+	case OfflineOn:
+		return withScope(scopes, offlineAccessScope), []oauth2.AuthCodeOption{oauth2.AccessTypeOffline}, nil
+	case "", OfflineAuto:
+	default:
+		return nil, nil, fmt.Errorf("unknown offline mode %q, expected auto, on or off", conf.Offline)
+	}
+
+	if contains(scopes, offlineAccessScope) {
+		return scopes, nil, nil
+	}
+	if conf.Issuer != "" && contains(scopes, "openid") {
+		discovery, err := discover(ctx, client, conf.Issuer)
+		switch {
+		case err != nil:
+			if conf.Verbose {
+				f.logf("Sending access_type=offline, as the offline_access scope isn't known to be supported: %s\n", err)
+			}
+		case contains(discovery.ScopesSupported, offlineAccessScope):
+			return withScope(scopes, offlineAccessScope), nil, nil
+		}
+	}
+	return scopes, []oauth2.AuthCodeOption{oauth2.AccessTypeOffline}, nil
+}
+
+// withScope returns scopes with scope added if it's missing.
+func withScope(scopes []string, scope string) []string {
+	if contains(scopes, scope) {
+		return scopes
+	}
+	return append(append([]string{}, scopes...), scope)
+}
@@ -0,0 +1,344 @@
+package oauth2cli
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// checkNonce validates the nonce claim of the id_token. With verbose logging
+// the payload is logged too, redacted unless NoRedact is set.
+func (f *Flow) checkNonce(nonce string, idToken string) error {
+	if idToken == "" {
+		return fmt.Errorf("missing OIDC id_token")
+	}
+	payload, err := decodePayload(idToken)
+	if err != nil {
+		return err
+	}
+	if f.Config.Verbose {
+		logged := payload
+		if !f.Config.NoRedact {
+			logged = redactBody(payload)
+		}
+		f.logf("id_token payload: %s\n", logged)
+	}
+	var decodeToken struct {
+		Nonce string
+	}
+	if err := json.Unmarshal(payload, &decodeToken); err != nil {
+		return fmt.Errorf("id_token payload decode: %w", err)
+	}
+	if decodeToken.Nonce != nonce {
+		return fmt.Errorf("%q != %q", decodeToken.Nonce, nonce)
+	}
+	return nil
+}
+
+// checkAZP validates the authorized party claim of the id_token, if there is
+// one, against the client ID.
+func checkAZP(clientID string, idToken string) error {
+	if idToken == "" {
+		return nil
+	}
+	var claims struct {
+		AZP string `json:"azp"`
+	}
+	if err := decodeClaims(idToken, &claims); err != nil {
+		return err
+	}
+	if claims.AZP != "" && claims.AZP != clientID {
+		return fmt.Errorf("%q != %q", claims.AZP, clientID)
+	}
+	return nil
+}
+
+// checkSubject checks that the refreshed idToken has the sub of
+// Config.PriorIDToken, when there are both, as a change of sub means the
+// tokens are now someone else's. Without Strict that's only a warning.
+func (f *Flow) checkSubject(idToken string, decryptKey *rsa.PrivateKey) error {
+	if idToken == "" || f.Config.PriorIDToken == "" {
+		return nil
+	}
+	prior, err := idTokenFrom((&oauth2.Token{}).WithExtra(map[string]interface{}{"id_token": f.Config.PriorIDToken}), decryptKey)
+	var claims [2]struct {
+		Subject string `json:"sub"`
+	}
+	if err == nil {
+		err = decodeClaims(prior, &claims[0])
+	}
+	if err == nil {
+		err = decodeClaims(idToken, &claims[1])
+	}
+	if err == nil && claims[0].Subject != claims[1].Subject {
+		err = fmt.Errorf("the refreshed id_token has sub %q, but the prior one %q", claims[1].Subject, claims[0].Subject)
+	}
+	if err != nil {
+		if f.Config.Strict {
+			return classify(ErrValidation, fmt.Errorf("OIDC sub error: %s", err))
+		}
+		f.logf("warning: OIDC sub: %s\n", err)
+	}
+	return nil
+}
+
+// idTokenClaims returns the id_token claims as indented JSON, with the
+// exp, iat and nbf timestamps shown in RFC3339.
+func idTokenClaims(idToken string) ([]byte, error) {
+	var claims map[string]interface{}
+	if err := decodeClaims(idToken, &claims); err != nil {
+		return nil, err
+	}
+	readableTimes(claims)
+	return json.MarshalIndent(claims, "", "  ")
+}
+
+// readableTimes replaces the exp, iat and nbf timestamps of claims with
+// RFC3339 times.
+func readableTimes(claims map[string]interface{}) {
+	for _, name := range []string{"exp", "iat", "nbf"} {
+		if n, ok := claims[name].(float64); ok {
+			claims[name] = time.Unix(int64(n), 0).UTC().Format(time.RFC3339)
+		}
+	}
+}
+
+// DecodedJWT is a JWT decoded without verifying it.
+type DecodedJWT struct {
+	Header map[string]interface{} `json:"header"`
+	// Claims has the exp, iat and nbf timestamps as RFC3339 times.
+	Claims map[string]interface{} `json:"claims"`
+	// Expiry is the exp claim, or zero if there isn't one.
+	Expiry time.Time `json:"-"`
+}
+
+// DecodeJWT decodes the header and claims of any JWT, such as an access token
+// or id_token, without verifying it.
+func DecodeJWT(jwt string) (*DecodedJWT, error) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("JWT has %d segments, expected 3", len(parts))
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("header decode: %w", err)
+	}
+	var decoded DecodedJWT
+	if err := json.Unmarshal(headerJSON, &decoded.Header); err != nil {
+		return nil, fmt.Errorf("header decode: %w", err)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("payload decode: %w", err)
+	}
+	if err := json.Unmarshal(payload, &decoded.Claims); err != nil {
+		return nil, fmt.Errorf("payload decode: %w", err)
+	}
+	if exp, ok := decoded.Claims["exp"].(float64); ok {
+		decoded.Expiry = time.Unix(int64(exp), 0)
+	}
+	readableTimes(decoded.Claims)
+	return &decoded, nil
+}
+
+// VerifyJWT checks the signature of jwt against the keys of Config.JWKSFile
+// or Config.JWKSURL, or those discovered from Config.Issuer, then its iss and exp claims as for
+// an id_token. The aud claim is only checked if Config.ClientID is set.
+func (f *Flow) VerifyJWT(ctx context.Context, jwt string) error {
+	client, err := newHTTPClient(f.Config, f.logger(), nil)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, f.Config.Timeout)
+	defer cancel()
+	return f.verifyIDTokenFrom(ctx, client, jwt)
+}
+
+// decodeClaims decodes the payload of a JWT into v without verifying it.
+func decodeClaims(jwt string, v interface{}) error {
+	payload, err := decodePayload(jwt)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		return fmt.Errorf("id_token payload decode: %w", err)
+	}
+	return nil
+}
+
+// decodePayload returns the decoded payload segment of a JWT.
+func decodePayload(jwt string) ([]byte, error) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("JWT has %d segments, expected 3", len(parts))
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("id_token payload decode: %w", err)
+	}
+	return payload, nil
+}
+
+// randString returns a random URL safe string for the state and nonce, which
+// providers may not round-trip intact if they contain +, / or =.
+func randString() string {
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// authTimeLeeway allows for clock skew when checking the auth_time claim
+// against Config.MaxAge.
+const authTimeLeeway = time.Minute
+
+// authenticationParams returns the OpenID Connect auth params that control
+// how the user is authenticated.
+func authenticationParams(conf Config) ([]oauth2.AuthCodeOption, error) {
+	if conf.MaxAge != "" {
+		if seconds, err := strconv.Atoi(conf.MaxAge); err != nil || seconds < 0 {
+			return nil, fmt.Errorf("invalid max_age %q, expected a number of seconds", conf.MaxAge)
+		}
+	}
+	var opts []oauth2.AuthCodeOption
+	for _, p := range []struct{ name, value string }{
+		{"prompt", conf.Prompt},
+		{"max_age", conf.MaxAge},
+		{"login_hint", conf.LoginHint},
+		{"acr_values", conf.ACRValues},
+		{"ui_locales", conf.UILocales},
+	} {
+		if p.value != "" {
+			opts = append(opts, oauth2.SetAuthURLParam(p.name, p.value))
+		}
+	}
+	return opts, nil
+}
+
+// checkAuthentication validates the auth_time and acr claims of the id_token
+// against the max_age and acr_values that were asked for, if any.
+func checkAuthentication(idToken, maxAge, acrValues string, now time.Time) error {
+	if maxAge == "" && acrValues == "" {
+		return nil
+	}
+	if idToken == "" {
+		return fmt.Errorf("missing OIDC id_token to check auth_time and acr against")
+	}
+	var claims struct {
+		AuthTime int64  `json:"auth_time"`
+		ACR      string `json:"acr"`
+	}
+	if err := decodeClaims(idToken, &claims); err != nil {
+		return err
+	}
+	if maxAge != "" {
+		seconds, err := strconv.Atoi(maxAge)
+		if err != nil {
+			return fmt.Errorf("invalid max_age %q", maxAge)
+		}
+		if claims.AuthTime == 0 {
+			return fmt.Errorf("no auth_time claim, which max_age requires")
+		}
+		authTime := time.Unix(claims.AuthTime, 0)
+		if now.Sub(authTime) > time.Duration(seconds)*time.Second+authTimeLeeway {
+			return fmt.Errorf("auth_time %s is more than max_age %ss ago", authTime.UTC().Format(time.RFC3339), maxAge)
+		}
+	}
+	if acrValues != "" && !contains(strings.Fields(acrValues), claims.ACR) {
+		return fmt.Errorf("acr %q is not one of the requested %q", claims.ACR, acrValues)
+	}
+	return nil
+}
+
+// claimRequirement is a claim that Config.RequireClaims asserts the value of.
+type claimRequirement struct {
+	name, value string
+}
+
+// parseRequiredClaims parses the name=value pairs of Config.RequireClaims.
+func parseRequiredClaims(list StringList) ([]claimRequirement, error) {
+	var required []claimRequirement
+	for _, c := range list {
+		kv := strings.SplitN(c, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid required claim %q, expected name=value", c)
+		}
+		required = append(required, claimRequirement{kv[0], kv[1]})
+	}
+	return required, nil
+}
+
+// checkRequiredClaims errors with each of the required claims that the
+// id_token doesn't have the value of. A claim name with dots is looked up
+// in nested objects if there's no claim of that name, and an array claim
+// matches if it contains the value.
+func checkRequiredClaims(idToken string, list StringList) error {
+	required, err := parseRequiredClaims(list)
+	if err != nil || len(required) == 0 {
+		return err
+	}
+	if idToken == "" {
+		return fmt.Errorf("missing OIDC id_token to check the required claims against")
+	}
+	var claims map[string]interface{}
+	if err := decodeClaims(idToken, &claims); err != nil {
+		return err
+	}
+	var mismatches []string
+	for _, r := range required {
+		value, ok := lookupClaim(claims, r.name)
+		switch {
+		case !ok:
+			mismatches = append(mismatches, fmt.Sprintf("%s: missing, want %q", r.name, r.value))
+		case !claimMatches(value, r.value):
+			got, _ := json.Marshal(value)
+			mismatches = append(mismatches, fmt.Sprintf("%s: got %s, want %q", r.name, got, r.value))
+		}
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("id_token claims don't match:\n  %s", strings.Join(mismatches, "\n  "))
+	}
+	return nil
+}
+
+func lookupClaim(claims map[string]interface{}, name string) (interface{}, bool) {
+	if value, ok := claims[name]; ok {
+		return value, true
+	}
+	var value interface{} = claims
+	for _, part := range strings.Split(name, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[part]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// claimMatches compares a claim to the value given on the command line: as
+// a string, as JSON for numbers and booleans, or any element of an array.
+func claimMatches(claim interface{}, want string) bool {
+	switch c := claim.(type) {
+	case string:
+		return c == want
+	case []interface{}:
+		for _, element := range c {
+			if claimMatches(element, want) {
+				return true
+			}
+		}
+		return false
+	}
+	b, err := json.Marshal(claim)
+	return err == nil && string(b) == want
+}
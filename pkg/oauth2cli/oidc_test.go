@@ -0,0 +1,106 @@
+package oauth2cli
+
+import (
+	"bytes"
+	"encoding/base64"
+	"log"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("checkNonce", func() {
+	var (
+		logs bytes.Buffer
+		flow Flow
+	)
+
+	jwt := func(payload string) string {
+		return "e30." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".sig"
+	}
+
+	BeforeEach(func() {
+		logs.Reset()
+		flow = Flow{Logger: log.New(&logs, "", 0)}
+	})
+
+	It("should accept a matching nonce without logging the payload", func() {
+		Expect(flow.checkNonce("n0nce", jwt(`{"nonce":"n0nce","sub":"someone"}`))).To(Succeed())
+		Expect(logs.String()).To(BeEmpty())
+	})
+
+	It("should error on a mismatched nonce", func() {
+		Expect(flow.checkNonce("n0nce", jwt(`{"nonce":"other"}`))).To(MatchError(`"other" != "n0nce"`))
+	})
+
+	It("should error on a malformed id_token", func() {
+		Expect(flow.checkNonce("n0nce", "not-a-jwt")).To(MatchError("JWT has 1 segments, expected 3"))
+	})
+
+	It("should log the redacted payload in verbose mode", func() {
+		flow.Config.Verbose = true
+		Expect(flow.checkNonce("n0nce", jwt(`{"nonce":"n0nce","sub":"someone"}`))).To(Succeed())
+		Expect(logs.String()).To(ContainSubstring(`"sub":"someone"`))
+		Expect(logs.String()).ToNot(ContainSubstring("n0nce"))
+	})
+})
+
+var _ = Describe("checkAuthentication", func() {
+	now := time.Unix(1700000000, 0)
+
+	jwt := func(payload string) string {
+		return "e30." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".sig"
+	}
+
+	It("should check nothing when neither max_age nor acr_values was asked for", func() {
+		Expect(checkAuthentication("", "", "", now)).To(Succeed())
+	})
+
+	It("should accept an auth_time within max_age", func() {
+		Expect(checkAuthentication(jwt(`{"auth_time":1699999700}`), "300", "", now)).To(Succeed())
+	})
+
+	It("should error on an auth_time older than max_age", func() {
+		Expect(checkAuthentication(jwt(`{"auth_time":1699999000}`), "300", "", now)).To(MatchError(ContainSubstring("is more than max_age 300s ago")))
+	})
+
+	It("should error without an auth_time when max_age was asked for", func() {
+		Expect(checkAuthentication(jwt(`{}`), "0", "", now)).To(MatchError("no auth_time claim, which max_age requires"))
+	})
+
+	It("should accept an acr that was asked for", func() {
+		Expect(checkAuthentication(jwt(`{"acr":"mfa"}`), "", "pwd mfa", now)).To(Succeed())
+	})
+
+	It("should error on another acr", func() {
+		Expect(checkAuthentication(jwt(`{"acr":"pwd"}`), "", "mfa", now)).To(MatchError(`acr "pwd" is not one of the requested "mfa"`))
+	})
+})
+
+var _ = Describe("checkRequiredClaims", func() {
+	jwt := func(payload string) string {
+		return "e30." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".sig"
+	}
+	idToken := jwt(`{"email":"someone@example.com","email_verified":true,"groups":["users","admins"],"address":{"country":"FR"}}`)
+
+	It("should accept matching strings, booleans, array elements and nested claims", func() {
+		Expect(checkRequiredClaims(idToken, StringList{
+			"email=someone@example.com",
+			"email_verified=true",
+			"groups=admins",
+			"address.country=FR",
+		})).To(Succeed())
+	})
+
+	It("should list each mismatched or missing claim", func() {
+		err := checkRequiredClaims(idToken, StringList{"email=other@example.com", "tenant=acme"})
+		Expect(err).To(MatchError("id_token claims don't match:\n" +
+			`  email: got "someone@example.com", want "other@example.com"` + "\n" +
+			`  tenant: missing, want "acme"`))
+	})
+
+	It("should error on a requirement that isn't name=value", func() {
+		Expect(checkRequiredClaims(idToken, StringList{"email"})).To(MatchError(`invalid required claim "email", expected name=value`))
+	})
+})
@@ -0,0 +1,44 @@
+package oauth2cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// parResponse is a pushed authorization response (RFC 9126 section 2.2).
+type parResponse struct {
+	RequestURI string `json:"request_uri"`
+	ExpiresIn  int    `json:"expires_in"`
+}
+
+// pushAuthorization posts the params of authURL to Config.PARURL and returns
+// the auth URL with just the client_id and the request_uri the provider
+// answered with, as described by RFC 9126.
+func (f *Flow) pushAuthorization(ctx context.Context, client *http.Client, authURL string) (string, error) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return "", err
+	}
+	body, err := f.postClientForm(ctx, client, f.Config.PARURL, u.Query())
+	if err != nil {
+		return "", fmt.Errorf("pushed authorization request: %w", err)
+	}
+	var response parResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", fmt.Errorf("pushed authorization request: invalid response: %w", err)
+	}
+	if response.RequestURI == "" {
+		return "", fmt.Errorf("pushed authorization request: no request_uri in the response")
+	}
+	if f.Config.Verbose {
+		f.logf("Pushed the authorization request, its request_uri expires in %ds\n", response.ExpiresIn)
+	}
+	u.RawQuery = url.Values{
+		"client_id":   {f.Config.ClientID},
+		"request_uri": {response.RequestURI},
+	}.Encode()
+	return u.String(), nil
+}
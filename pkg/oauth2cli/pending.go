@@ -0,0 +1,96 @@
+package oauth2cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// pendingAuthorization is what Config.PendingFile keeps of an attempt until
+// its callback arrives, for Config.Resume to complete it.
+type pendingAuthorization struct {
+	State       string    `json:"state"`
+	Nonce       string    `json:"nonce,omitempty"`
+	Verifier    string    `json:"code_verifier,omitempty"`
+	RedirectURL string    `json:"redirect_uri"`
+	Created     time.Time `json:"created"`
+}
+
+// attempt returns the attempt that p was saved from, sending exchangeOpts
+// and the PKCE verifier with the exchange.
+func (p *pendingAuthorization) attempt(exchangeOpts []oauth2.AuthCodeOption) *attempt {
+	a := &attempt{
+		state:        p.State,
+		nonce:        p.Nonce,
+		verifier:     p.Verifier,
+		exchangeOpts: append([]oauth2.AuthCodeOption{}, exchangeOpts...),
+	}
+	if p.Verifier != "" {
+		a.exchangeOpts = append(a.exchangeOpts, oauth2.SetAuthURLParam("code_verifier", p.Verifier))
+	}
+	return a
+}
+
+// savePending writes attempt a, redirecting to redirectURL, to
+// Config.PendingFile, readable only by the user.
+func (f *Flow) savePending(a *attempt, redirectURL string) error {
+	if f.Config.PendingFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(pendingAuthorization{
+		State:       a.state,
+		Nonce:       a.nonce,
+		Verifier:    a.verifier,
+		RedirectURL: redirectURL,
+		Created:     time.Now(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(f.Config.PendingFile, data, 0600); err != nil {
+		return fmt.Errorf("failed to write the pending authorization: %w", err)
+	}
+	return nil
+}
+
+// clearPending removes Config.PendingFile once the state of the attempt in
+// it is used up.
+func (f *Flow) clearPending() {
+	if f.Config.PendingFile == "" {
+		return
+	}
+	if err := os.Remove(f.Config.PendingFile); err != nil && !os.IsNotExist(err) {
+		f.logf("warning: failed to remove %s: %s\n", f.Config.PendingFile, err)
+	}
+}
+
+// readPending reads the authorization pending in path.
+func readPending(path string) (*pendingAuthorization, error) {
+	if path == "" {
+		return nil, errors.New("resuming needs a pending authorization file")
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no authorization is pending in %s", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p pendingAuthorization
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("invalid pending authorization in %s: %w", path, err)
+	}
+	if p.State == "" || p.RedirectURL == "" {
+		return nil, fmt.Errorf("invalid pending authorization in %s: no state or redirect_uri", path)
+	}
+	return &p, nil
+}
+
+func (f *Flow) logResume(p *pendingAuthorization) {
+	f.logf("Resuming the authorization started at %s, redirecting to %s\n", p.Created.Format(time.RFC3339), p.RedirectURL)
+}
@@ -0,0 +1,33 @@
+package oauth2cli
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+// PKCE (RFC 7636) code challenge methods.
+const (
+	PKCES256  = "S256"
+	PKCEPlain = "plain"
+)
+
+// newCodeVerifier returns a random code_verifier of 43 unreserved characters.
+func newCodeVerifier() string {
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// codeChallenge derives the code_challenge for verifier.
+func codeChallenge(verifier, method string) (string, error) {
+	switch method {
+	case PKCES256:
+		sum := sha256.Sum256([]byte(verifier))
+		return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+	case PKCEPlain:
+		return verifier, nil
+	}
+	return "", fmt.Errorf("unknown PKCE method %q, expected S256 or plain", method)
+}
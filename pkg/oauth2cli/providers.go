@@ -0,0 +1,127 @@
+package oauth2cli
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Provider is a preset of a common provider's endpoints and quirks.
+type Provider struct {
+	AuthURL       string
+	TokenURL      string
+	DeviceAuthURL string
+	RevokeURL     string
+	// Issuer is set for providers whose id_tokens can be verified.
+	Issuer string
+	// AuthStyle is how the provider takes the client credentials, saving the
+	// failed request of auto detection.
+	AuthStyle string
+	// AuthParams are needed by the provider for a useful token, such as
+	// Dropbox's token_access_type=offline for a refresh token.
+	AuthParams StringList
+	// TokenResponseMap finds the token in responses that don't have it at
+	// the top, as for Config.TokenResponseMap.
+	TokenResponseMap string
+}
+
+// Providers are the presets by name.
+var Providers = map[string]Provider{
+	"dropbox": {
+		AuthURL:    "https://www.dropbox.com/oauth2/authorize",
+		TokenURL:   "https://api.dropboxapi.com/oauth2/token",
+		AuthStyle:  "header",
+		AuthParams: StringList{"token_access_type=offline"},
+	},
+	"github": {
+		// GitHub answers with a form encoded token unless asked for JSON,
+		// which golang.org/x/oauth2 parses all the same.
+		AuthURL:       "https://github.com/login/oauth/authorize",
+		TokenURL:      "https://github.com/login/oauth/access_token",
+		DeviceAuthURL: "https://github.com/login/device/code",
+		AuthStyle:     "params",
+	},
+	"gitlab": {
+		AuthURL:       "https://gitlab.com/oauth/authorize",
+		TokenURL:      "https://gitlab.com/oauth/token",
+		DeviceAuthURL: "https://gitlab.com/oauth/authorize_device",
+		RevokeURL:     "https://gitlab.com/oauth/revoke",
+		Issuer:        "https://gitlab.com",
+		AuthStyle:     "params",
+	},
+	"google": {
+		AuthURL:       "https://accounts.google.com/o/oauth2/v2/auth",
+		TokenURL:      "https://oauth2.googleapis.com/token",
+		DeviceAuthURL: "https://oauth2.googleapis.com/device/code",
+		RevokeURL:     "https://oauth2.googleapis.com/revoke",
+		Issuer:        "https://accounts.google.com",
+		AuthStyle:     "params",
+	},
+	"microsoft": {
+		// The common tenant takes both work and personal accounts, so the
+		// id_token issuer varies and isn't preset.
+		AuthURL:       "https://login.microsoftonline.com/common/oauth2/v2.0/authorize",
+		TokenURL:      "https://login.microsoftonline.com/common/oauth2/v2.0/token",
+		DeviceAuthURL: "https://login.microsoftonline.com/common/oauth2/v2.0/devicecode",
+		AuthStyle:     "params",
+	},
+	"slack": {
+		// The user token asked for with user_scope is under authed_user,
+		// while a bot token is at the top.
+		AuthURL:          "https://slack.com/oauth/v2/authorize",
+		TokenURL:         "https://slack.com/api/oauth.v2.access",
+		AuthStyle:        "params",
+		TokenResponseMap: `{"access_token": "authed_user.access_token", "token_type": "authed_user.token_type", "scope": "authed_user.scope", "refresh_token": "authed_user.refresh_token", "expires_in": "authed_user.expires_in"}`,
+	},
+	"spotify": {
+		AuthURL:   "https://accounts.spotify.com/authorize",
+		TokenURL:  "https://accounts.spotify.com/api/token",
+		AuthStyle: "header",
+	},
+}
+
+// ProviderNames returns the names of the presets, sorted.
+func ProviderNames() []string {
+	names := make([]string, 0, len(Providers))
+	for name := range Providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ApplyProvider sets what isn't already set in conf from the named preset.
+func ApplyProvider(name string, conf *Config) error {
+	p, ok := Providers[name]
+	if !ok {
+		return fmt.Errorf("unknown provider %q, expected one of %v", name, ProviderNames())
+	}
+	for _, e := range []struct {
+		configured *string
+		preset     string
+	}{
+		{&conf.AuthURL, p.AuthURL},
+		{&conf.TokenURL, p.TokenURL},
+		{&conf.DeviceAuthURL, p.DeviceAuthURL},
+		{&conf.RevokeURL, p.RevokeURL},
+		{&conf.Issuer, p.Issuer},
+		{&conf.TokenResponseMap, p.TokenResponseMap},
+	} {
+		if *e.configured == "" {
+			*e.configured = e.preset
+		}
+	}
+	if p.AuthStyle != "" && (conf.AuthStyle == "" || conf.AuthStyle == "auto") {
+		conf.AuthStyle = p.AuthStyle
+	}
+	given := map[string]bool{}
+	for _, param := range conf.AuthParams {
+		given[strings.SplitN(param, "=", 2)[0]] = true
+	}
+	for _, param := range p.AuthParams {
+		if !given[strings.SplitN(param, "=", 2)[0]] {
+			conf.AuthParams = append(conf.AuthParams, param)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,508 @@
+package oauth2cli
+
+import (
+	"errors"
+	"strings"
+)
+
+// A minimal QR code encoder (ISO/IEC 18004) for showing URLs in the terminal
+// with Config.QR: byte mode at error correction level L, which fits the
+// longest auth URLs in the smallest code.
+
+// qrBlocks is, for each version at level L, the error correction codewords
+// per block and the number of blocks and data codewords of its two groups.
+var qrBlocks = [41]struct{ ec, blocks1, data1, blocks2, data2 int }{
+	{},
+	{7, 1, 19, 0, 0}, {10, 1, 34, 0, 0}, {15, 1, 55, 0, 0}, {20, 1, 80, 0, 0},
+	{26, 1, 108, 0, 0}, {18, 2, 68, 0, 0}, {20, 2, 78, 0, 0}, {24, 2, 97, 0, 0},
+	{30, 2, 116, 0, 0}, {18, 2, 68, 2, 69}, {20, 4, 81, 0, 0}, {24, 2, 92, 2, 93},
+	{26, 4, 107, 0, 0}, {30, 3, 115, 1, 116}, {22, 5, 87, 1, 88}, {24, 5, 98, 1, 99},
+	{28, 1, 107, 5, 108}, {30, 5, 120, 1, 121}, {28, 3, 113, 4, 114}, {28, 3, 107, 5, 108},
+	{28, 4, 116, 4, 117}, {28, 2, 111, 7, 112}, {30, 4, 121, 5, 122}, {30, 6, 117, 4, 118},
+	{26, 8, 106, 4, 107}, {28, 10, 114, 2, 115}, {30, 8, 122, 4, 123}, {30, 3, 117, 10, 118},
+	{30, 7, 116, 7, 117}, {30, 5, 115, 10, 116}, {30, 13, 115, 3, 116}, {30, 17, 115, 0, 0},
+	{30, 17, 115, 1, 116}, {30, 13, 115, 6, 116}, {30, 12, 121, 7, 122}, {30, 6, 121, 14, 122},
+	{30, 17, 122, 4, 123}, {30, 4, 122, 18, 123}, {30, 20, 117, 4, 118}, {30, 19, 118, 6, 119},
+}
+
+// errQRTooLong is returned for data that doesn't fit in a version 40 code.
+var errQRTooLong = errors.New("too long for a QR code")
+
+// qrCode is a QR code's modules, true for dark, indexed by row then column.
+type qrCode struct {
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+// encodeQR returns the QR code of data.
+func encodeQR(data []byte) (*qrCode, error) {
+	version := 0
+	for v := 1; v <= 40; v++ {
+		if 4+qrCountBits(v)+8*len(data) <= 8*qrDataCodewords(v) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errQRTooLong
+	}
+
+	// Byte mode, the count, the data, then the terminator and padding.
+	var bits qrBits
+	bits.append(4, 4)
+	bits.append(len(data), qrCountBits(version))
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	capacity := 8 * qrDataCodewords(version)
+	terminator := capacity - len(bits)
+	if terminator > 4 {
+		terminator = 4
+	}
+	bits.append(0, terminator)
+	bits.append(0, (8-len(bits)%8)%8)
+	codewords := bits.bytes()
+	for pad := 0xEC; len(codewords) < qrDataCodewords(version); pad ^= 0xEC ^ 0x11 {
+		codewords = append(codewords, byte(pad))
+	}
+
+	q := newQRCode(version)
+	q.drawCodewords(qrInterleave(version, codewords))
+
+	// The mask with the lowest penalty, as the standard asks.
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormat(mask)
+		if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		q.applyMask(mask)
+	}
+	q.applyMask(best)
+	q.drawFormat(best)
+	return q, nil
+}
+
+// qrCountBits is the length of the byte mode character count.
+func qrCountBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+func qrDataCodewords(version int) int {
+	b := qrBlocks[version]
+	return b.blocks1*b.data1 + b.blocks2*b.data2
+}
+
+// qrRawModules is the number of modules of a version that hold codewords
+// and remainder bits, rather than patterns and format information.
+func qrRawModules(version int) int {
+	n := (16*version+128)*version + 64
+	if version >= 2 {
+		align := version/7 + 2
+		n -= (25*align-10)*align - 55
+		if version >= 7 {
+			n -= 36
+		}
+	}
+	return n
+}
+
+// qrInterleave splits the data codewords into blocks, adds their error
+// correction and interleaves them.
+func qrInterleave(version int, data []byte) []byte {
+	b := qrBlocks[version]
+	divisor := rsDivisor(b.ec)
+	var blocks, ecBlocks [][]byte
+	for i := 0; i < b.blocks1+b.blocks2; i++ {
+		n := b.data1
+		if i >= b.blocks1 {
+			n = b.data2
+		}
+		blocks = append(blocks, data[:n])
+		ecBlocks = append(ecBlocks, rsRemainder(data[:n], divisor))
+		data = data[n:]
+	}
+	var result []byte
+	for i := 0; i < b.data1 || i < b.data2; i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < b.ec; i++ {
+		for _, block := range ecBlocks {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// rsMultiply multiplies in GF(2^8) with the QR code polynomial 0x11D.
+func rsMultiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int(y>>uint(i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// rsDivisor is the Reed-Solomon generator polynomial of the given degree,
+// without its leading coefficient.
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = rsMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = rsMultiply(root, 2)
+	}
+	return result
+}
+
+// rsRemainder is the error correction of data.
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= rsMultiply(d, factor)
+		}
+	}
+	return result
+}
+
+// qrBits is a bit string, one bit per entry.
+type qrBits []bool
+
+func (b *qrBits) append(value, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, value>>uint(i)&1 == 1)
+	}
+}
+
+func (b qrBits) bytes() []byte {
+	result := make([]byte, len(b)/8)
+	for i, bit := range b {
+		if bit {
+			result[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return result
+}
+
+// newQRCode returns a code of the version with its function patterns drawn.
+func newQRCode(version int) *qrCode {
+	size := 4*version + 17
+	q := &qrCode{size: size}
+	q.modules = make([][]bool, size)
+	q.function = make([][]bool, size)
+	for i := range q.modules {
+		q.modules[i] = make([]bool, size)
+		q.function[i] = make([]bool, size)
+	}
+
+	for i := 0; i < size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	for _, c := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x >= 0 && x < size && y >= 0 && y < size {
+					d := max(abs(dx), abs(dy))
+					q.set(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+	align := qrAlignment(version)
+	for i, ax := range align {
+		for j, ay := range align {
+			last := len(align) - 1
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(ax+dx, ay+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+	// Reserved until the mask is chosen.
+	q.drawFormat(0)
+
+	if version >= 7 {
+		bits := qrVersionBits(version)
+		for i := 0; i < 18; i++ {
+			dark := bits>>uint(i)&1 == 1
+			a, b := size-11+i%3, i/3
+			q.set(a, b, dark)
+			q.set(b, a, dark)
+		}
+	}
+	return q
+}
+
+// qrAlignment is the row and column positions of the alignment patterns.
+func qrAlignment(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	n := version/7 + 2
+	step := (version*4 + n*2 + 1) / (n*2 - 2) * 2
+	if version == 32 {
+		step = 26
+	}
+	result := make([]int, n)
+	result[0] = 6
+	for i, pos := n-1, version*4+10; i >= 1; i, pos = i-1, pos-step {
+		result[i] = pos
+	}
+	return result
+}
+
+// qrVersionBits is the version information, with its BCH code.
+func qrVersionBits(version int) int {
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	return version<<12 | rem
+}
+
+// qrFormatBits is the format information of level L with the mask, with its
+// BCH code and masked.
+func qrFormatBits(mask int) int {
+	data := 1<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+// set draws a function module at column x and row y.
+func (q *qrCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+// drawFormat draws both copies of the format information for level L.
+func (q *qrCode) drawFormat(mask int) {
+	bits := qrFormatBits(mask)
+	bit := func(i int) bool { return bits>>uint(i)&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true)
+}
+
+// drawCodewords places the codewords in the zigzag order, upwards and
+// downwards in columns of two from the bottom right.
+func (q *qrCode) drawCodewords(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if !q.function[y][x] && i < len(data)*8 {
+					q.modules[y][x] = data[i>>3]>>uint(7-i&7)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask XORs the mask with the data modules, so applying it twice
+// undoes it.
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the code by the four rules of the standard: runs of the
+// same color, 2x2 blocks, finder-like patterns and the dark proportion.
+func (q *qrCode) penalty() int {
+	score := 0
+	at := func(x, y int, row bool) bool {
+		if row {
+			return q.modules[y][x]
+		}
+		return q.modules[x][y]
+	}
+	finder := []bool{true, false, true, true, true, false, true}
+	for _, row := range []bool{true, false} {
+		for y := 0; y < q.size; y++ {
+			run := 0
+			for x := 0; x < q.size; x++ {
+				if x > 0 && at(x, y, row) == at(x-1, y, row) {
+					run++
+				} else {
+					run = 1
+				}
+				if run == 5 {
+					score += 3
+				} else if run > 5 {
+					score++
+				}
+				if x+7 <= q.size {
+					match := true
+					for i, dark := range finder {
+						if at(x+i, y, row) != dark {
+							match = false
+							break
+						}
+					}
+					if match && (q.light(x-4, x, y, row, at) || q.light(x+7, x+11, y, row, at)) {
+						score += 40
+					}
+				}
+			}
+		}
+	}
+	dark := 0
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < q.size && y+1 < q.size {
+				c := q.modules[y][x]
+				if c == q.modules[y][x+1] && c == q.modules[y+1][x] && c == q.modules[y+1][x+1] {
+					score += 3
+				}
+			}
+		}
+	}
+	// 10 for each 5% the dark proportion is from 50%, which it can't be
+	// exactly as the size is odd.
+	total := q.size * q.size
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	return score + k*10
+}
+
+// light reports whether the modules from..to (exclusive) of a row or column
+// are light, counting those outside the code as the light quiet zone.
+func (q *qrCode) light(from, to, y int, row bool, at func(x, y int, row bool) bool) bool {
+	for x := from; x < to; x++ {
+		if x >= 0 && x < q.size && at(x, y, row) {
+			return false
+		}
+	}
+	return true
+}
+
+// terminal renders the code with half block characters, two rows to a
+// line, in black on white with a quiet zone of two modules.
+func (q *qrCode) terminal() string {
+	const quiet = 2
+	dark := func(x, y int) bool {
+		x, y = x-quiet, y-quiet
+		return x >= 0 && x < q.size && y >= 0 && y < q.size && q.modules[y][x]
+	}
+	var b strings.Builder
+	width := q.size + 2*quiet
+	for y := 0; y < width; y += 2 {
+		b.WriteString("\x1b[30;47m")
+		for x := 0; x < width; x++ {
+			top, bottom := dark(x, y), dark(x, y+1) && y+1 < width
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString("\x1b[0m\n")
+	}
+	return b.String()
+}
+
+// showQR logs the QR code of a URL for Config.QR.
+func (f *Flow) showQR(url string) {
+	q, err := encodeQR([]byte(url))
+	if err != nil {
+		f.logf("warning: can't show a QR code: the URL is %s\n", err)
+		return
+	}
+	f.logf("Or scan this QR code:\n%s\n", q.terminal())
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
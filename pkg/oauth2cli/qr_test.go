@@ -0,0 +1,171 @@
+package oauth2cli
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("QR codes", func() {
+	// decode reads the data back from a code, reversing each step of the
+	// encoding: the format, the mask, the placement and the interleaving.
+	decode := func(q *qrCode) string {
+		format := 0
+		for i := 14; i >= 9; i-- {
+			format = format<<1 | boolBit(q.modules[8][14-i])
+		}
+		format = format<<1 | boolBit(q.modules[8][7])
+		format = format<<1 | boolBit(q.modules[8][8])
+		format = format<<1 | boolBit(q.modules[7][8])
+		for i := 5; i >= 0; i-- {
+			format = format<<1 | boolBit(q.modules[i][8])
+		}
+		mask := -1
+		for m := 0; m < 8; m++ {
+			if qrFormatBits(m) == format {
+				mask = m
+			}
+		}
+		Expect(mask).ToNot(Equal(-1), "format bits %015b", format)
+		q.applyMask(mask)
+		defer q.applyMask(mask)
+
+		var bits qrBits
+		for right := q.size - 1; right >= 1; right -= 2 {
+			if right == 6 {
+				right = 5
+			}
+			for vert := 0; vert < q.size; vert++ {
+				for j := 0; j < 2; j++ {
+					x, y := right-j, vert
+					if (right+1)&2 == 0 {
+						y = q.size - 1 - vert
+					}
+					if !q.function[y][x] {
+						bits = append(bits, q.modules[y][x])
+					}
+				}
+			}
+		}
+		codewords := bits.bytes()
+
+		version := (q.size - 17) / 4
+		b := qrBlocks[version]
+		n := b.blocks1 + b.blocks2
+		blocks := make([][]byte, n)
+		i := 0
+		for k := 0; k < b.data1 || k < b.data2; k++ {
+			for j := range blocks {
+				if j < b.blocks1 && k >= b.data1 || j >= b.blocks1 && k >= b.data2 {
+					continue
+				}
+				blocks[j] = append(blocks[j], codewords[i])
+				i++
+			}
+		}
+		var data qrBits
+		for j, block := range blocks {
+			ec := make([]byte, b.ec)
+			for k := range ec {
+				ec[k] = codewords[i+k*n+j]
+			}
+			Expect(rsRemainder(block, rsDivisor(b.ec))).To(Equal(ec))
+			for _, c := range block {
+				data.append(int(c), 8)
+			}
+		}
+
+		read := func(n int) int {
+			v := 0
+			for _, bit := range data[:n] {
+				v = v<<1 | boolBit(bit)
+			}
+			data = data[n:]
+			return v
+		}
+		Expect(read(4)).To(Equal(4))
+		length := read(qrCountBits(version))
+		var s []byte
+		for k := 0; k < length; k++ {
+			s = append(s, byte(read(8)))
+		}
+		return string(s)
+	}
+
+	It("should have as many codewords as each version has room for", func() {
+		for v := 1; v <= 40; v++ {
+			b := qrBlocks[v]
+			Expect(qrDataCodewords(v)+b.ec*(b.blocks1+b.blocks2)).To(Equal(qrRawModules(v)/8), "version %d", v)
+		}
+	})
+
+	It("should leave the raw modules for the codewords", func() {
+		for v := 1; v <= 40; v++ {
+			q := newQRCode(v)
+			free := 0
+			for _, row := range q.function {
+				for _, f := range row {
+					if !f {
+						free++
+					}
+				}
+			}
+			Expect(free).To(Equal(qrRawModules(v)), "version %d", v)
+		}
+	})
+
+	It("should compute the Reed-Solomon error correction", func() {
+		// The HELLO WORLD 1-M example of the standard.
+		data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+		Expect(rsRemainder(data, rsDivisor(10))).To(Equal([]byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}))
+	})
+
+	It("should compute the format and version information", func() {
+		Expect(qrFormatBits(0)).To(Equal(0x77C4))
+		Expect(qrFormatBits(4)).To(Equal(0x662F))
+		Expect(qrVersionBits(7)).To(Equal(0x07C94))
+		Expect(qrVersionBits(40)).To(Equal(0x28C69))
+	})
+
+	It("should encode data that reads back the same", func() {
+		for _, s := range []string{
+			"https://example.com",
+			"https://accounts.example.com/authorize?client_id=123&redirect_uri=http%3A%2F%2F127.0.0.1%3A8081%2Foauth%2Fcallback&response_type=code&scope=openid+profile&state=" + strings.Repeat("x", 43),
+			strings.Repeat("a", 1000),
+		} {
+			q, err := encodeQR([]byte(s))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decode(q)).To(Equal(s))
+		}
+	})
+
+	It("should use the smallest version the data fits in", func() {
+		q, err := encodeQR([]byte(strings.Repeat("a", 17)))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(q.size).To(Equal(21))
+		q, err = encodeQR([]byte(strings.Repeat("a", 18)))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(q.size).To(Equal(25))
+	})
+
+	It("should fail for data too long for any version", func() {
+		_, err := encodeQR([]byte(strings.Repeat("a", 2954)))
+		Expect(err).To(Equal(errQRTooLong))
+	})
+
+	It("should render two rows to a line", func() {
+		q, err := encodeQR([]byte("https://example.com"))
+		Expect(err).ToNot(HaveOccurred())
+		lines := strings.Split(strings.TrimSuffix(q.terminal(), "\n"), "\n")
+		Expect(lines).To(HaveLen((q.size + 4 + 1) / 2))
+		Expect(lines[1]).To(HavePrefix("\x1b[30;47m  █▀▀▀▀▀█"))
+	})
+})
+
+func boolBit(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
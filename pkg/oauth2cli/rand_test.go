@@ -0,0 +1,27 @@
+package oauth2cli
+
+import (
+	"net/url"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("randString", func() {
+	It("should be URL safe", func() {
+		for i := 0; i < 100; i++ {
+			Expect(randString()).To(MatchRegexp(`^[A-Za-z0-9_-]{43}$`))
+		}
+	})
+
+	It("should round-trip through a query string", func() {
+		for i := 0; i < 100; i++ {
+			state := randString()
+			query, err := url.ParseQuery(url.Values{"state": {state}}.Encode())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(query.Get("state")).To(Equal(state))
+			// Nothing for a provider to mangle, such as + into a space.
+			Expect(url.QueryEscape(state)).To(Equal(state))
+		}
+	})
+})
@@ -0,0 +1,80 @@
+package oauth2cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+// sensitiveFields are the form fields and JSON keys redacted from verbose
+// logs of requests to, and responses from, the provider.
+var sensitiveFields = map[string]bool{
+	"access_token":     true,
+	"actor_token":      true,
+	"assertion":        true,
+	"client_assertion": true,
+	"client_secret":    true,
+	"code":             true,
+	"code_verifier":    true,
+	"device_code":      true,
+	"id_token":         true,
+	"nonce":            true,
+	"password":         true,
+	"refresh_token":    true,
+	"subject_token":    true,
+	"token":            true,
+}
+
+// redactHeader masks the value of a sensitive request header, keeping the
+// scheme of an Authorization.
+func redactHeader(name, value string) string {
+	switch name {
+	case "Authorization":
+		return redactAuthorization(value)
+	case "Cookie":
+		return redacted
+	}
+	return value
+}
+
+// redactBody replaces the values of sensitive fields in a JSON object or
+// form encoded body, leaving anything else as is.
+func redactBody(body []byte) []byte {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(trimmed, &fields); err != nil {
+			return body
+		}
+		for k := range fields {
+			if sensitiveFields[k] {
+				fields[k] = json.RawMessage(`"` + redacted + `"`)
+			}
+		}
+		redactedBody, err := json.Marshal(fields)
+		if err != nil {
+			return body
+		}
+		return redactedBody
+	}
+
+	// Form bodies are rewritten pair by pair to keep their order.
+	pairs := strings.Split(string(body), "&")
+	for i, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if key, err := url.QueryUnescape(kv[0]); err == nil && len(kv) == 2 && sensitiveFields[key] {
+			pairs[i] = kv[0] + "=" + redacted
+		}
+	}
+	return []byte(strings.Join(pairs, "&"))
+}
+
+// redactAuthorization masks the credentials of an Authorization header,
+// keeping the scheme.
+func redactAuthorization(value string) string {
+	if i := strings.IndexByte(value, ' '); i > 0 {
+		return value[:i+1] + redacted
+	}
+	return redacted
+}
@@ -0,0 +1,59 @@
+package oauth2cli
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// withResources adds a resource param to rawURL for each of resources, as
+// RFC 8707 has them repeated rather than space separated.
+func withResources(rawURL string, resources []string) (string, error) {
+	if len(resources) == 0 {
+		return rawURL, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Del("resource")
+	for _, resource := range resources {
+		query.Add("resource", resource)
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// resourceTransport adds the resource params to the form posts to the token
+// endpoint that don't have any, which golang.org/x/oauth2 can only set once
+// and not at all when refreshing.
+type resourceTransport struct {
+	TokenURL  string
+	Resources []string
+	Transport http.RoundTripper
+}
+
+func (t resourceTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	endpoint := *r.URL
+	endpoint.RawQuery = ""
+	if r.Method != "POST" || r.Body == nil || endpoint.String() != t.TokenURL || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return t.Transport.RoundTrip(r)
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	form, err := url.ParseQuery(string(body))
+	if err == nil && len(form["resource"]) == 0 {
+		form["resource"] = t.Resources
+		body = []byte(form.Encode())
+	}
+	r = r.Clone(r.Context())
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return t.Transport.RoundTrip(r)
+}
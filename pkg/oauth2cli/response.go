@@ -0,0 +1,139 @@
+package oauth2cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// parseTokenResponseMap parses Config.TokenResponseMap.
+func parseTokenResponseMap(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var m map[string]string
+	if err := json.Unmarshal([]byte(s), &m); err != nil {
+		return nil, fmt.Errorf("invalid token response map: %w", err)
+	}
+	for field, path := range m {
+		if field == "" || path == "" {
+			return nil, fmt.Errorf("invalid token response map: empty field or path in %q: %q", field, path)
+		}
+	}
+	return m, nil
+}
+
+// tokenResponseTransport adapts the token endpoint's successful responses
+// to what the flows parse: form encoded ones, such as GitHub's, become JSON,
+// Map moves fields such as Slack's nested user token to the top, and an
+// error answered with a 2xx, as GitHub's and Slack's are, becomes a 400.
+type tokenResponseTransport struct {
+	TokenURL  string
+	Map       map[string]string
+	Transport http.RoundTripper
+}
+
+func (t tokenResponseTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	res, err := t.Transport.RoundTrip(r)
+	endpoint := *r.URL
+	endpoint.RawQuery = ""
+	if err != nil || r.Method != "POST" || endpoint.String() != t.TokenURL || res.StatusCode < 200 || res.StatusCode > 299 {
+		return res, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	fields, convert := tokenResponseFields(res.Header.Get("Content-Type"), body)
+	if fields == nil {
+		// Left for the flow to fail on as it would have.
+		return res, nil
+	}
+	mapped := false
+	for field, path := range t.Map {
+		if v, ok := lookupPath(fields, path); ok {
+			fields[field] = v
+			mapped = true
+		}
+	}
+	failed := false
+	if token, _ := fields["access_token"].(string); token == "" && fields["error"] != nil {
+		res.StatusCode = http.StatusBadRequest
+		res.Status = fmt.Sprintf("%d %s", res.StatusCode, http.StatusText(res.StatusCode))
+		failed = true
+	} else if p, ok := r.Context().Value(tokenFieldsKey{}).(*map[string]interface{}); ok {
+		*p = fields
+	}
+	if !mapped && !convert && !failed {
+		return res, nil
+	}
+
+	if body, err = json.Marshal(fields); err != nil {
+		return nil, err
+	}
+	res.Header = res.Header.Clone()
+	res.Header.Set("Content-Type", "application/json")
+	res.Header.Del("Content-Length")
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	return res, nil
+}
+
+// tokenFieldsKey is the context key of a *map[string]interface{} that
+// tokenResponseTransport sets to the fields of the token response, which
+// golang.org/x/oauth2 keeps unexported.
+type tokenFieldsKey struct{}
+
+// tokenResponseFields parses a JSON object, or a form encoded body as
+// golang.org/x/oauth2 does for those content types, reporting whether it
+// needs encoding as JSON for the flows to parse it. The fields are nil if
+// it's neither.
+func tokenResponseFields(contentType string, body []byte) (map[string]interface{}, bool) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err == nil {
+		return fields, mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")
+	}
+	if mediaType != "application/x-www-form-urlencoded" && mediaType != "text/plain" {
+		return nil, false
+	}
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, false
+	}
+	fields = map[string]interface{}{}
+	for k := range values {
+		v := values.Get(k)
+		// expires_in and the like are numbers in JSON.
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && strings.HasSuffix(k, "expires_in") {
+			fields[k] = n
+		} else {
+			fields[k] = v
+		}
+	}
+	return fields, true
+}
+
+// lookupPath returns the value at a dotted path into nested objects.
+func lookupPath(fields map[string]interface{}, path string) (interface{}, bool) {
+	var v interface{} = fields
+	for _, name := range strings.Split(path, ".") {
+		object, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = object[name]; !ok || v == nil {
+			return nil, false
+		}
+	}
+	return v, true
+}
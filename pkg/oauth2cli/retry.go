@@ -0,0 +1,116 @@
+package oauth2cli
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// retryDelay is the default wait before the first retry of a token request,
+// doubled for each retry after that.
+const retryDelay = 500 * time.Millisecond
+
+// clockAfter and clockNow are time.After and time.Now, for tests to see how
+// long the retries wait.
+var (
+	clockAfter = time.After
+	clockNow   = time.Now
+)
+
+// retryToken runs fetch until it succeeds, fails with an error that isn't
+// transient, or Config.Retries retries have been made.
+func (f *Flow) retryToken(ctx context.Context, fetch func() (*oauth2.Token, error)) (*oauth2.Token, error) {
+	delay := retryDelay
+	if f.Config.RetryBackoff > 0 {
+		delay = time.Duration(f.Config.RetryBackoff)
+	}
+	for retry := 1; ; retry++ {
+		token, err := fetch()
+		if err == nil || retry > f.Config.Retries || !transient(ctx, err) {
+			return token, unreachable(ctx, err)
+		}
+		wait := delay
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) {
+			if d, ok := retryAfter(retrieveErr.Response); ok {
+				wait = d
+			}
+		}
+		if f.Config.Verbose {
+			f.logf("token request failed, retry %d of %d in %s: %s\n", retry, f.Config.Retries, wait, err)
+		}
+		select {
+		case <-clockAfter(wait):
+		case <-ctx.Done():
+			return nil, err
+		}
+		delay *= 2
+	}
+}
+
+// retryAfter returns how long the Retry-After header of a 429 or 503
+// response asks to wait before trying again, given in seconds or as an HTTP
+// date (RFC 9110 section 10.2.3).
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+		return 0, false
+	}
+	value := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if wait := date.Sub(clockNow()); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
+
+// unreachable classifies a token request error without a response as
+// ErrUnreachable. golang.org/x/oauth2 doesn't wrap them, so as for transient
+// that's any error other than a response's.
+func unreachable(ctx context.Context, err error) error {
+	var retrieveErr *oauth2.RetrieveError
+	if err == nil || ctx.Err() != nil || errors.As(err, &retrieveErr) {
+		return err
+	}
+	return classify(ErrUnreachable, err)
+}
+
+// transient reports whether a token request error is worth retrying: a 5xx
+// or 429 response, or a network error other than a failed certificate
+// check.
+func transient(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var (
+		retrieveErr *oauth2.RetrieveError
+		unknownCA   x509.UnknownAuthorityError
+		hostnameErr x509.HostnameError
+		invalidCert x509.CertificateInvalidError
+	)
+	switch {
+	case errors.As(err, &retrieveErr):
+		status := retrieveErr.Response.StatusCode
+		return status >= 500 || status == http.StatusTooManyRequests
+	case errors.As(err, &unknownCA), errors.As(err, &hostnameErr), errors.As(err, &invalidCert), errors.Is(err, errPinMismatch):
+		return false
+	}
+	return true
+}
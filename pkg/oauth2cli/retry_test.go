@@ -0,0 +1,96 @@
+package oauth2cli
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/oauth2"
+)
+
+// recordWaits replaces clockAfter with one that records how long it's asked
+// to wait, without waiting, until restore is called.
+func recordWaits() (waits *[]time.Duration, restore func()) {
+	waits = &[]time.Duration{}
+	after := clockAfter
+	clockAfter = func(d time.Duration) <-chan time.Time {
+		*waits = append(*waits, d)
+		c := make(chan time.Time, 1)
+		c <- time.Time{}
+		return c
+	}
+	return waits, func() { clockAfter = after }
+}
+
+var _ = Describe("retryAfter", func() {
+	response := func(status int, value string) *http.Response {
+		return &http.Response{StatusCode: status, Header: http.Header{"Retry-After": {value}}}
+	}
+	wait := func(resp *http.Response) time.Duration {
+		d, ok := retryAfter(resp)
+		Expect(ok).To(BeTrue())
+		return d
+	}
+
+	It("should take a delay in seconds", func() {
+		Expect(wait(response(http.StatusTooManyRequests, "2"))).To(Equal(2 * time.Second))
+	})
+
+	It("should take an HTTP date", func() {
+		now := clockNow
+		defer func() { clockNow = now }()
+		fixed := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+		clockNow = func() time.Time { return fixed }
+
+		Expect(wait(response(http.StatusServiceUnavailable, fixed.Add(3*time.Second).Format(http.TimeFormat)))).To(Equal(3 * time.Second))
+		Expect(wait(response(http.StatusServiceUnavailable, fixed.Add(-time.Minute).Format(http.TimeFormat)))).To(Equal(time.Duration(0)))
+	})
+
+	It("should ignore other responses and values", func() {
+		_, ok := retryAfter(response(http.StatusBadRequest, "2"))
+		Expect(ok).To(BeFalse())
+		_, ok = retryAfter(response(http.StatusTooManyRequests, "soon"))
+		Expect(ok).To(BeFalse())
+		_, ok = retryAfter(response(http.StatusTooManyRequests, "-1"))
+		Expect(ok).To(BeFalse())
+	})
+})
+
+var _ = Describe("retryToken", func() {
+	It("should wait for as long as a 429's Retry-After asks", func() {
+		waits, restore := recordWaits()
+		defer restore()
+		f := &Flow{Config: Config{Retries: 3}}
+		calls := 0
+		token, err := f.retryToken(context.Background(), func() (*oauth2.Token, error) {
+			calls++
+			if calls == 1 {
+				resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"2"}}}
+				return nil, &oauth2.RetrieveError{Response: resp}
+			}
+			if calls == 2 {
+				return nil, &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusBadGateway}}
+			}
+			return &oauth2.Token{AccessToken: "mytoken"}, nil
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(token.AccessToken).To(Equal("mytoken"))
+		// The backoff carries on as before for a response without one.
+		Expect(*waits).To(Equal([]time.Duration{2 * time.Second, 2 * retryDelay}))
+	})
+
+	It("should not retry a 4xx other than 429", func() {
+		waits, restore := recordWaits()
+		defer restore()
+		f := &Flow{Config: Config{Retries: 3}}
+		_, err := f.retryToken(context.Background(), func() (*oauth2.Token, error) {
+			return nil, &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusBadRequest}}
+		})
+		var retrieveErr *oauth2.RetrieveError
+		Expect(errors.As(err, &retrieveErr)).To(BeTrue())
+		Expect(*waits).To(BeEmpty())
+	})
+})
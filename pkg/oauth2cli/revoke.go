@@ -0,0 +1,30 @@
+package oauth2cli
+
+import (
+	"context"
+	"net/url"
+)
+
+// Token type hints for Revoke.
+const (
+	HintAccessToken  = "access_token"
+	HintRefreshToken = "refresh_token"
+)
+
+// Revoke revokes token at Config.RevokeURL, as described by RFC 7009. hint is
+// the token_type_hint, and may be empty.
+func (f *Flow) Revoke(ctx context.Context, token, hint string) error {
+	client, err := newHTTPClient(f.Config, f.logger(), nil)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, f.Config.Timeout)
+	defer cancel()
+
+	form := url.Values{"token": {token}}
+	if hint != "" {
+		form.Set("token_type_hint", hint)
+	}
+	_, err = f.postClientForm(ctx, client, f.Config.RevokeURL, form)
+	return err
+}
@@ -0,0 +1,63 @@
+package oauth2cli
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+
+	"golang.org/x/oauth2"
+)
+
+const redacted = "***"
+
+// requestSpec describes the requests the flow makes so that they can be
+// shared with a provider's support team.
+type requestSpec struct {
+	Authorization specRequest `json:"authorization_request"`
+	Token         specRequest `json:"token_request"`
+}
+
+type specRequest struct {
+	Method string            `json:"method"`
+	URL    string            `json:"url"`
+	Params map[string]string `json:"params"`
+}
+
+// writeRequestSpec writes the request spec for visitURL as JSON to path, with
+// the client secret and authorization code redacted.
+func writeRequestSpec(path string, config *oauth2.Config, visitURL string) error {
+	u, err := url.Parse(visitURL)
+	if err != nil {
+		return err
+	}
+	authParams := map[string]string{}
+	for k := range u.Query() {
+		authParams[k] = u.Query().Get(k)
+	}
+	u.RawQuery = ""
+
+	spec := requestSpec{
+		Authorization: specRequest{
+			Method: "GET",
+			URL:    u.String(),
+			Params: authParams,
+		},
+		Token: specRequest{
+			Method: "POST",
+			URL:    config.Endpoint.TokenURL,
+			Params: map[string]string{
+				"grant_type":    "authorization_code",
+				"code":          redacted,
+				"redirect_uri":  config.RedirectURL,
+				"client_id":     config.ClientID,
+				"client_secret": redacted,
+			},
+		},
+	}
+
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
@@ -0,0 +1,121 @@
+package oauth2cli
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"time"
+)
+
+// SuccessPage is the data a success template is rendered with. It has no
+// tokens, so that they aren't shown on screen.
+type SuccessPage struct {
+	TokenType       string
+	Expiry          time.Time
+	Scopes          []string
+	HasRefreshToken bool
+	// Claims are those of the id_token, if there is one. They are only
+	// verified with Config.VerifyIDToken.
+	Claims map[string]interface{}
+}
+
+// ResultPage is the data a result template, for both pages, is rendered
+// with. Error is the provider's error when it redirects back with one, and
+// the SuccessPage is set otherwise.
+type ResultPage struct {
+	SuccessPage
+	Error *AuthorizationError
+}
+
+// defaultSuccessTemplate is the page shown in the browser when no
+// Config.SuccessTemplate is given.
+var defaultSuccessTemplate = template.Must(template.New("success").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Authentication complete</title>
+<style>body { font-family: sans-serif; margin: 4em auto; max-width: 40em; }</style>
+</head>
+<body>
+<h1>Authentication complete</h1>
+<p>You can close this tab.</p>
+{{if .Scopes}}<p>Granted scopes: {{range $i, $s := .Scopes}}{{if $i}}, {{end}}<code>{{$s}}</code>{{end}}</p>{{end}}
+{{if not .Expiry.IsZero}}<p>The token expires at {{.Expiry.Format "15:04:05 MST, 2 Jan 2006"}}.</p>{{end}}
+</body>
+</html>
+`))
+
+// defaultErrorTemplate is the page shown in the browser when the provider
+// redirects back with an error and no Config.ErrorTemplate is given. It is
+// rendered with the AuthorizationError.
+var defaultErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Authentication failed</title>
+<style>body { font-family: sans-serif; margin: 4em auto; max-width: 40em; }</style>
+</head>
+<body>
+<h1>Authentication failed</h1>
+<p>The provider answered with <code>{{.Code}}</code>{{if .Description}}: {{.Description}}{{end}}</p>
+{{if .URI}}<p>See <a href="{{.URI}}">{{.URI}}</a> for more.</p>{{end}}
+<p>You can close this tab and try again from the command line.</p>
+</body>
+</html>
+`))
+
+// pageTemplate returns the parsed template file at path, or result if it
+// isn't nil, or the built-in page.
+func pageTemplate(path string, result browserPage, builtin *template.Template) (browserPage, error) {
+	switch {
+	case path != "":
+		return template.ParseFiles(path)
+	case result != nil:
+		return result, nil
+	}
+	return builtin, nil
+}
+
+// browserPage renders a page shown in the browser, with a SuccessPage or an
+// AuthorizationError.
+type browserPage interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// resultTemplate renders both pages with a ResultPage.
+type resultTemplate struct {
+	*template.Template
+}
+
+func (t resultTemplate) Execute(w io.Writer, data interface{}) error {
+	var result ResultPage
+	switch data := data.(type) {
+	case SuccessPage:
+		result.SuccessPage = data
+	case *AuthorizationError:
+		result.Error = data
+	}
+	return t.Template.Execute(w, result)
+}
+
+// pages returns the success and error pages: those of conf, or else its
+// result template, or else the built-in ones.
+func pages(conf Config) (browserPage, browserPage, error) {
+	var result browserPage
+	if conf.ResultTemplate != "" {
+		t, err := template.ParseFiles(conf.ResultTemplate)
+		if err != nil {
+			return nil, nil, fmt.Errorf("result template: %w", err)
+		}
+		result = resultTemplate{t}
+	}
+	success, err := pageTemplate(conf.SuccessTemplate, result, defaultSuccessTemplate)
+	if err != nil {
+		return nil, nil, fmt.Errorf("success template: %w", err)
+	}
+	errorPage, err := pageTemplate(conf.ErrorTemplate, result, defaultErrorTemplate)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error template: %w", err)
+	}
+	return success, errorPage, nil
+}
@@ -0,0 +1,77 @@
+package oauth2cli
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// logSummary logs what was issued, for Config.Summary. The scopes are those
+// of the introspection response if there is one, then those of the token
+// response, falling back to the requested ones.
+func (f *Flow) logSummary(token *oauth2.Token, requested []string, introspection map[string]interface{}) {
+	if !f.Config.Summary {
+		return
+	}
+	f.logf("%s", tokenSummary(token, requested, introspection, time.Now()))
+}
+
+func tokenSummary(token *oauth2.Token, requested []string, introspection map[string]interface{}, now time.Time) string {
+	var b strings.Builder
+	line := func(name, format string, v ...interface{}) {
+		fmt.Fprintf(&b, "  %-15s"+format+"\n", append([]interface{}{name + ":"}, v...)...)
+	}
+	b.WriteString("Token summary:\n")
+	line("type", "%s", token.Type())
+
+	scopes, from := grantedScopes(token, nil), "granted"
+	if scope, ok := introspection["scope"].(string); ok {
+		scopes, from = strings.Fields(scope), "introspected"
+	} else if len(scopes) == 0 {
+		scopes, from = requested, "requested, none were in the response"
+	}
+	if len(scopes) == 0 {
+		line("scopes", "none (%s)", from)
+	} else {
+		line("scopes", "%s (%s)", strings.Join(scopes, " "), from)
+	}
+
+	switch {
+	case token.Expiry.IsZero():
+		line("expires", "not given")
+	case token.Expiry.After(now):
+		line("expires", "%s, in %s", token.Expiry.Format(time.RFC3339), humanDuration(token.Expiry.Sub(now)))
+	default:
+		line("expires", "%s, %s ago", token.Expiry.Format(time.RFC3339), humanDuration(now.Sub(token.Expiry)))
+	}
+	line("refresh token", "%s", yesNo(token.RefreshToken != ""))
+	idToken, _ := token.Extra("id_token").(string)
+	line("id_token", "%s", yesNo(idToken != ""))
+	return b.String()
+}
+
+// humanDuration formats d to the minute, such as 59m or 1h30m, or to the
+// second under a minute.
+func humanDuration(d time.Duration) string {
+	if d < time.Minute {
+		return d.Round(time.Second).String()
+	}
+	d = d.Round(time.Minute)
+	h, m := int64(d/time.Hour), int64(d%time.Hour/time.Minute)
+	switch {
+	case h == 0:
+		return fmt.Sprintf("%dm", m)
+	case m == 0:
+		return fmt.Sprintf("%dh", h)
+	}
+	return fmt.Sprintf("%dh%dm", h, m)
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,48 @@
+package oauth2cli
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/oauth2"
+)
+
+var _ = Describe("Token summary", func() {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	It("should describe the token", func() {
+		token := (&oauth2.Token{
+			AccessToken:  "mytoken",
+			TokenType:    "Bearer",
+			RefreshToken: "myrefresh",
+			Expiry:       now.Add(59*time.Minute + 10*time.Second),
+		}).WithExtra(map[string]interface{}{"scope": "read write"})
+
+		Expect(tokenSummary(token, []string{"read"}, nil, now)).To(Equal(`Token summary:
+  type:          Bearer
+  scopes:        read write (granted)
+  expires:       2026-01-02T04:03:15Z, in 59m
+  refresh token: yes
+  id_token:      no
+`))
+	})
+
+	It("should prefer the introspected scopes, then fall back to the requested ones", func() {
+		token := &oauth2.Token{AccessToken: "mytoken"}
+		Expect(tokenSummary(token, []string{"read"}, map[string]interface{}{"scope": "read admin"}, now)).To(ContainSubstring("scopes:        read admin (introspected)\n"))
+		Expect(tokenSummary(token, []string{"read"}, nil, now)).To(ContainSubstring("scopes:        read (requested, none were in the response)\n"))
+		Expect(tokenSummary(token, nil, nil, now)).To(ContainSubstring("expires:       not given\n"))
+	})
+
+	It("should say how long ago an expired token expired", func() {
+		token := &oauth2.Token{AccessToken: "mytoken", Expiry: now.Add(-90 * time.Minute)}
+		Expect(tokenSummary(token, nil, nil, now)).To(ContainSubstring("expires:       2026-01-02T01:34:05Z, 1h30m ago\n"))
+	})
+
+	It("should round durations to the minute", func() {
+		Expect(humanDuration(42 * time.Second)).To(Equal("42s"))
+		Expect(humanDuration(59*time.Minute + 40*time.Second)).To(Equal("1h"))
+		Expect(humanDuration(25*time.Hour + 5*time.Minute)).To(Equal("25h5m"))
+	})
+})
@@ -0,0 +1,136 @@
+package oauth2cli
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// tunnelPreset is a command that opens a public HTTPS tunnel to {addr},
+// printing the public URL in a line that pattern finds it in.
+type tunnelPreset struct {
+	command string
+	pattern *regexp.Regexp
+}
+
+// tunnelPresets are the Config.Tunnel names of common tunnel clients. The
+// patterns skip the other URLs they print, such as cloudflared's terms.
+var tunnelPresets = map[string]tunnelPreset{
+	"ngrok": {
+		command: "ngrok http {addr} --log stdout --log-format json",
+		pattern: regexp.MustCompile(`"url":"(https://[^"]+)"`),
+	},
+	"cloudflared": {
+		command: "cloudflared tunnel --no-autoupdate --url http://{addr}",
+		pattern: regexp.MustCompile(`(https://[a-z0-9-]+\.trycloudflare\.com)`),
+	},
+}
+
+// tunnelURLPattern finds the public URL in the output of other commands.
+var tunnelURLPattern = regexp.MustCompile(`(https://[^\s"'<>]+)`)
+
+// tunnelTimeout is how long to wait for the tunnel's public URL.
+const tunnelTimeout = 30 * time.Second
+
+// tunnel is a running tunnel client.
+type tunnel struct {
+	URL *url.URL
+	cmd *exec.Cmd
+}
+
+// openTunnel runs the Config.Tunnel preset or command, with {addr} replaced
+// by addr, until it prints the public URL that forwards to addr.
+func (f *Flow) openTunnel(ctx context.Context, addr string) (*tunnel, error) {
+	preset, ok := tunnelPresets[f.Config.Tunnel]
+	if !ok {
+		preset = tunnelPreset{command: f.Config.Tunnel, pattern: tunnelURLPattern}
+	}
+	args := strings.Fields(strings.ReplaceAll(preset.command, "{addr}", addr))
+	if len(args) == 0 {
+		return nil, errors.New("tunnel: no command")
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	r, w := io.Pipe()
+	cmd.Stdout, cmd.Stderr = w, w
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("tunnel: %w", err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+		w.Close()
+	}()
+
+	// The output is kept being read once the URL is found, so that the
+	// client doesn't block on writing it.
+	found := make(chan string, 1)
+	lastLine := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(r)
+		last := ""
+		for scanner.Scan() {
+			line := scanner.Text()
+			if f.Config.Verbose {
+				f.logf("tunnel: %s\n", line)
+			}
+			if m := preset.pattern.FindStringSubmatch(line); m != nil {
+				select {
+				case found <- m[1]:
+				default:
+				}
+			}
+			last = line
+		}
+		lastLine <- last
+	}()
+
+	t := &tunnel{cmd: cmd}
+	timer := time.NewTimer(tunnelTimeout)
+	defer timer.Stop()
+	select {
+	case raw := <-found:
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Close()
+			return nil, fmt.Errorf("tunnel: invalid URL %q: %w", raw, err)
+		}
+		t.URL = u
+		return t, nil
+	case err := <-exited:
+		if err == nil {
+			err = errors.New("exited")
+		}
+		return nil, fmt.Errorf("tunnel: %s %s before printing its URL: %s", args[0], err, <-lastLine)
+	case <-timer.C:
+		t.Close()
+		return nil, fmt.Errorf("tunnel: %s printed no URL within %s", args[0], tunnelTimeout)
+	case <-ctx.Done():
+		t.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// Close stops the tunnel client.
+func (t *tunnel) Close() {
+	if t.cmd.Process != nil {
+		_ = t.cmd.Process.Kill()
+	}
+}
+
+// tunnelAddr is the address that the tunnel forwards to, the callback
+// server's, on loopback when it listens on all interfaces.
+func tunnelAddr(iface string, port int) string {
+	if ip := net.ParseIP(iface); iface == "" || (ip != nil && ip.IsUnspecified()) {
+		iface = "127.0.0.1"
+	}
+	return net.JoinHostPort(iface, fmt.Sprint(port))
+}
@@ -0,0 +1,55 @@
+package oauth2cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// userinfo logs the claims the OpenID Connect userinfo endpoint returns for
+// the access token, which shows what the granted scopes give access to.
+func (f *Flow) userinfo(ctx context.Context, client *http.Client, token *oauth2.Token) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", f.Config.UserinfoURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	token.SetAuthHeader(req)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %d %s\nResponse: %s", f.Config.UserinfoURL, resp.StatusCode, http.StatusText(resp.StatusCode), body)
+	}
+
+	var claims map[string]interface{}
+	// Providers may sign the response, as OpenID Connect Core 5.3.2 allows.
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/jwt") {
+		decoded, err := DecodeJWT(strings.TrimSpace(string(body)))
+		if err != nil {
+			return fmt.Errorf("invalid response: %w", err)
+		}
+		claims = decoded.Claims
+	} else if err := json.Unmarshal(body, &claims); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	pretty, err := json.MarshalIndent(claims, "", "  ")
+	if err != nil {
+		return err
+	}
+	f.logf("userinfo:\n%s\n", pretty)
+	return nil
+}
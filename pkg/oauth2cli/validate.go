@@ -0,0 +1,155 @@
+package oauth2cli
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// checkRedirectURL errors when the redirect URL would send the code over an
+// unencrypted connection to anything other than this machine.
+func checkRedirectURL(u *url.URL) error {
+	if u.Scheme != "http" || isLoopback(u.Hostname()) {
+		return nil
+	}
+	return fmt.Errorf("insecure redirect URL %s, use https or a loopback address", u)
+}
+
+// checkCallbackURL errors when the callback URL can't reach the callback
+// server listening on iface and port, or is on the root path, where it's easy
+// to mistake for a misconfigured redirect.
+func checkCallbackURL(u *url.URL, iface string, port int) error {
+	urlPort := u.Port()
+	if urlPort == "" {
+		urlPort = "80"
+		if u.Scheme == "https" {
+			urlPort = "443"
+		}
+	}
+	sameHost := u.Hostname() == iface || (isLoopback(u.Hostname()) && isLoopback(iface)) || iface == "" || iface == "0.0.0.0" || iface == "::"
+	if !sameHost || urlPort != strconv.Itoa(port) {
+		return fmt.Errorf("callback URL %s doesn't point at the callback server on %s, the provider's redirect must reach this server", u, net.JoinHostPort(iface, strconv.Itoa(port)))
+	}
+	if u.Path == "" || u.Path == "/" {
+		return fmt.Errorf("callback URL %s is on the root path, every request to the callback server will be taken as the redirect", u)
+	}
+	return nil
+}
+
+// checkEndpointHosts errors when the auth and token URLs are on different
+// hosts, a sign of endpoints being mixed up between providers, unless the
+// token URL host is allowed.
+func checkEndpointHosts(authURL, tokenURL string, allowed []string) error {
+	auth, err := url.Parse(authURL)
+	if err != nil {
+		return err
+	}
+	token, err := url.Parse(tokenURL)
+	if err != nil {
+		return err
+	}
+	if auth.Hostname() == token.Hostname() {
+		return nil
+	}
+	for _, host := range allowed {
+		if strings.TrimSpace(host) == token.Hostname() {
+			return nil
+		}
+	}
+	return fmt.Errorf("auth URL host %q differs from token URL host %q", auth.Hostname(), token.Hostname())
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// warn logs a validation problem, returning it instead in strict mode.
+func (f *Flow) warn(err error) error {
+	if f.Config.Strict {
+		return err
+	}
+	f.logf("warning: %s\n", err)
+	return nil
+}
+
+// grantedScopes returns the scopes from the token response, falling back to
+// the scp claim of a JWT access token and then to the requested scopes, as
+// RFC 6749 allows the scope to be omitted when it matches the request.
+func grantedScopes(token *oauth2.Token, requested []string) []string {
+	if scope, ok := token.Extra("scope").(string); ok {
+		return strings.Fields(scope)
+	}
+
+	var claims struct {
+		Scp interface{} `json:"scp"`
+	}
+	if err := decodeClaims(token.AccessToken, &claims); err == nil {
+		switch scp := claims.Scp.(type) {
+		case string:
+			return strings.Fields(scp)
+		case []interface{}:
+			var scopes []string
+			for _, s := range scp {
+				if s, ok := s.(string); ok {
+					scopes = append(scopes, s)
+				}
+			}
+			return scopes
+		}
+	}
+
+	return requested
+}
+
+// missingScopes returns the required scopes that were not granted.
+func missingScopes(required, granted []string) []string {
+	have := map[string]bool{}
+	for _, s := range granted {
+		have[s] = true
+	}
+
+	var missing []string
+	for _, s := range required {
+		if !have[s] {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
+
+// checkIssuerParam checks the iss param of an authorization response, if
+// there is one, against the issuer, if configured, against mix-up attacks
+// (RFC 9207).
+func checkIssuerParam(query url.Values, issuer string) error {
+	iss, ok := query["iss"]
+	if !ok || issuer == "" || iss[0] == issuer {
+		return nil
+	}
+	return classify(ErrValidation, fmt.Errorf("Invalid issuer: %s, expected %s", iss[0], issuer))
+}
+
+// unexpectedParams returns the sorted names of callback params that aren't
+// part of an authorization response, or one of extra.
+func unexpectedParams(query url.Values, codeParam, stateParam string, extra ...string) []string {
+	var unexpected []string
+	for k := range query {
+		switch k {
+		case stateParam, codeParam, "error", "error_description", "error_uri", "iss":
+		default:
+			if !contains(extra, k) {
+				unexpected = append(unexpected, k)
+			}
+		}
+	}
+	sort.Strings(unexpected)
+	return unexpected
+}
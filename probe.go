@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/geckoboard/oauth2-cli/pkg/oauth2cli"
+	"golang.org/x/oauth2"
+)
+
+// probe requests -probe with the token and logs the response, telling
+// whether the token works against the API it's for. A response other than
+// 2xx is an error. With a DPoP key, the request carries a proof for the
+// token.
+func probe(ctx context.Context, conf config, token *oauth2.Token, dpopKey *oauth2cli.DPoPKey) error {
+	method := conf.ProbeMethod
+	if method == "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequestWithContext(ctx, strings.ToUpper(method), conf.Probe, strings.NewReader(conf.ProbeBody))
+	if err != nil {
+		return err
+	}
+	if conf.ProbeBody != "" {
+		if json.Valid([]byte(conf.ProbeBody)) {
+			req.Header.Set("Content-Type", "application/json")
+		} else {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	token.SetAuthHeader(req)
+	if dpopKey != nil {
+		if err := dpopKey.SetProof(req); err != nil {
+			return err
+		}
+	}
+
+	client := &http.Client{Timeout: time.Duration(conf.HTTPTimeout)}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	log.Printf("probe: %s %s: %s\n%s\n", req.Method, conf.Probe, resp.Status, body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s: %s", req.Method, conf.Probe, resp.Status)
+	}
+	return nil
+}
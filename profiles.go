@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/geckoboard/oauth2-cli/pkg/oauth2cli"
+	"golang.org/x/oauth2"
+)
+
+// authorizeProfiles authorizes each profile of a repeated -profile at once,
+// the code flows sharing one callback server on the port of the first, and
+// outputs their tokens as one JSON object keyed by profile. A cached token
+// that's valid, or can be refreshed, is used as it is for one profile.
+func authorizeProfiles(confs []config, args []string) int {
+	if len(args) > 0 && args[0] != "auth" {
+		log.Fatalf("-profile can only be repeated to authorize, not with %s\n", args[0])
+	}
+	for _, conf := range confs {
+		switch {
+		case conf.Check:
+			log.Fatalln("-profile can only be repeated to authorize, not with -check")
+		case !grant(conf.Flow):
+			log.Fatalf("-profile can only be repeated to authorize, not with -flow %s\n", conf.Flow)
+		case conf.Format != formatJSON:
+			log.Fatalf("a repeated -profile outputs JSON, not -format %s\n", conf.Format)
+		case conf.Manual || conf.Resume || conf.Loop != 0:
+			log.Fatalln("a repeated -profile can't be used with -manual, -resume or -loop")
+		case conf.Exec != "" || len(conf.ExecArgs) > 0 || conf.Probe != "" || conf.RevokeAfter:
+			log.Fatalln("a repeated -profile can't be used with -exec, -probe or -revoke-after")
+		}
+	}
+
+	// The profiles can share a -cache file, so it's read before the flows
+	// start and written by one at a time.
+	var cacheMu sync.Mutex
+	flows := make([]oauth2cli.Flow, len(confs))
+	tokens := make([]*oauth2.Token, len(confs))
+	var pending []int
+	for i, conf := range confs {
+		flows[i] = profileFlow(conf, &cacheMu)
+		if conf.Cache != "" && !conf.Force {
+			if token, ok := cachedToken(conf, flows[i]); ok {
+				tokens[i] = token
+				continue
+			}
+		}
+		pending = append(pending, i)
+	}
+
+	if paths := callbackPaths(confs, pending); len(paths) > 0 {
+		// The callbacks are told apart by their path, so clashing ones get
+		// the profile appended.
+		for i, path := range paths {
+			if clashes(paths, path) {
+				flows[i].Config.Callback = profileCallback(confs[i].Callback, confs[i].Profile)
+			}
+		}
+		for i := range paths {
+			if err := checkSharedCallback(confs[0], confs[i]); err != nil {
+				log.Fatalf("error: %s\n", err)
+			}
+		}
+		server, err := oauth2cli.ListenCallbacks(confs[0].Interface, confs[0].Port)
+		if err != nil {
+			return reportError(confs[0], err)
+		}
+		defer server.Close()
+		for i := range paths {
+			flows[i].CallbackServer = server
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errs := make([]error, len(confs))
+	var wg sync.WaitGroup
+	for _, i := range pending {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tokens[i], errs[i] = flows[i].Authorize(ctx)
+		}(i)
+	}
+	wg.Wait()
+
+	code := 0
+	output := map[string]jsonToken{}
+	for i, conf := range confs {
+		switch {
+		case errs[i] != nil && ctx.Err() != nil:
+			code = reportError(conf, fmt.Errorf("-profile %s: %w", conf.Profile, errInterrupted))
+		case errs[i] != nil:
+			if c := reportError(conf, fmt.Errorf("-profile %s: %w", conf.Profile, errs[i])); code == 0 {
+				code = c
+			}
+		default:
+			output[conf.Profile] = jsonToken{tokens[i], callbackParams(tokens[i])}
+		}
+	}
+	// The tokens that were issued are output even when another failed.
+	if len(output) > 0 {
+		if err := emitTokens(confs[0], output); err != nil {
+			log.Printf("error: failed to write tokens: %s\n", err)
+			return 1
+		}
+	}
+	return code
+}
+
+// profileFlow returns the flow of conf, which logs with the profile as a
+// prefix and writes its token to -cache while holding cacheMu.
+func profileFlow(conf config, cacheMu *sync.Mutex) oauth2cli.Flow {
+	flow := oauth2cli.Flow{
+		Config: conf.Config,
+		Logger: log.New(log.Writer(), log.Prefix()+conf.Profile+": ", log.Flags()),
+		OnToken: func(token *oauth2.Token) error {
+			if conf.Cache == "" {
+				return nil
+			}
+			cacheMu.Lock()
+			defer cacheMu.Unlock()
+			if err := writeCache(conf, token); err != nil {
+				return fmt.Errorf("failed to write token cache: %w", err)
+			}
+			return nil
+		},
+	}
+	if conf.Quiet {
+		flow.Logger.SetOutput(ioutil.Discard)
+	}
+	return flow
+}
+
+// callbackPaths returns the callback paths of the code flows among the
+// pending confs, by their index.
+func callbackPaths(confs []config, pending []int) map[int]string {
+	paths := map[int]string{}
+	for _, i := range pending {
+		if confs[i].Flow != oauth2cli.FlowCode {
+			continue
+		}
+		if u, err := url.Parse(confs[i].Callback); err == nil {
+			paths[i] = u.Path
+		}
+	}
+	return paths
+}
+
+// checkSharedCallback checks that the redirect URL of conf is served by the
+// callback server shared on the interface and port of first, which its flow
+// would otherwise wait on until -timeout.
+func checkSharedCallback(first, conf config) error {
+	u, err := url.Parse(conf.Callback)
+	if err != nil {
+		// The flow reports it.
+		return nil
+	}
+	shared := net.JoinHostPort(first.Interface, strconv.Itoa(first.Port))
+	if u.Host == "" {
+		if conf.Interface != first.Interface || conf.Port != first.Port {
+			return fmt.Errorf("profile %q listens on %s, but the callbacks are served on %s of profile %q: give it the same -interface and -port",
+				conf.Profile, net.JoinHostPort(conf.Interface, strconv.Itoa(conf.Port)), shared, first.Profile)
+		}
+		return nil
+	}
+	port := u.Port()
+	if port == "" && u.Scheme == "http" {
+		port = "80"
+	}
+	if port != strconv.Itoa(first.Port) || !sameHost(u.Hostname(), first.Interface) {
+		return fmt.Errorf("profile %q has the callback %s, but the callbacks are served on %s of profile %q: give it just a callback path, or that host and port",
+			conf.Profile, conf.Callback, shared, first.Profile)
+	}
+	return nil
+}
+
+// sameHost reports whether a redirect URL for host reaches a server listening
+// on iface.
+func sameHost(host, iface string) bool {
+	if host == iface || iface == "" || net.ParseIP(iface).IsUnspecified() {
+		return true
+	}
+	loopback := func(h string) bool {
+		ip := net.ParseIP(h)
+		return h == "localhost" || ip != nil && ip.IsLoopback()
+	}
+	return loopback(host) && loopback(iface)
+}
+
+// clashes reports whether more than one callback has path.
+func clashes(paths map[int]string, path string) bool {
+	n := 0
+	for _, p := range paths {
+		if p == path {
+			n++
+		}
+	}
+	return n > 1
+}
+
+// profileCallback appends the profile to the path of the callback URL.
+func profileCallback(callback, profile string) string {
+	u, err := url.Parse(callback)
+	if err != nil {
+		return callback
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + url.PathEscape(profile)
+	return u.String()
+}
+
+// emitTokens writes the tokens keyed by profile as emitToken does one.
+func emitTokens(conf config, tokens map[string]jsonToken) error {
+	tokensJSON, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	switch {
+	case conf.Out != "":
+		return writeOutput(conf.Out, append(tokensJSON, '\n'))
+	case conf.SummaryOnly:
+		// Already summarized by the flows.
+	case !conf.Quiet:
+		log.Printf("result:\n%s\n", tokensJSON)
+	case conf.NoStdout:
+	default:
+		_, err = os.Stdout.Write(append(tokensJSON, '\n'))
+	}
+	return err
+}
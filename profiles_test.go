@@ -0,0 +1,147 @@
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Repeated -profile", func() {
+	var (
+		issuer       string
+		dir          string
+		callbackPort int
+		args         []string
+	)
+
+	start := func(args ...string) *gexec.Session {
+		session, err := gexec.Start(exec.Command(cmdPath, args...), GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+		return session
+	}
+
+	BeforeEach(func() {
+		port, err := EphemeralPort()
+		Expect(err).ToNot(HaveOccurred())
+		issuer = fmt.Sprintf("http://127.0.0.1:%d", port)
+		session := start("mock-server", "-serve-addr", fmt.Sprintf("127.0.0.1:%d", port))
+		Eventually(session.Err).Should(gbytes.Say("Serving a mock provider"))
+
+		dir, err = ioutil.TempDir("", "oauth2-cli-profiles")
+		Expect(err).ToNot(HaveOccurred())
+		config := fmt.Sprintf(`{
+			"issuer": %q,
+			"pkce": true,
+			"profiles": {
+				"a": {"client_id": "client-a", "scope": "openid"},
+				"b": {"client_id": "client-b", "scope": "openid email"}
+			}
+		}`, issuer)
+		Expect(ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600)).To(Succeed())
+
+		callbackPort, err = EphemeralPort()
+		Expect(err).ToNot(HaveOccurred())
+		args = []string{"-config", filepath.Join(dir, "config.json"), "-profile", "a", "-profile", "b",
+			"-port", fmt.Sprint(callbackPort), "-cache", filepath.Join(dir, "tokens.json"), "-out", "-"}
+	})
+
+	AfterEach(func() {
+		gexec.TerminateAndWait()
+		os.RemoveAll(dir)
+	})
+
+	It("should authorize each profile through one callback server", func() {
+		session := start(args...)
+		re := regexp.MustCompile(regexp.QuoteMeta(issuer+"/authorize") + `\S+`)
+		Eventually(func() [][]byte { return re.FindAll(session.Err.Contents(), -1) }).Should(HaveLen(2))
+		Expect(session.Err).To(gbytes.Say(`[ab]: `))
+
+		for _, authURL := range re.FindAll(session.Err.Contents(), -1) {
+			res, err := http.Get(string(authURL))
+			Expect(err).ToNot(HaveOccurred())
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+		}
+		Eventually(session).Should(gexec.Exit(0))
+		Expect(string(session.Err.Contents())).To(ContainSubstring("/oauth/callback/a"))
+		Expect(string(session.Err.Contents())).To(ContainSubstring("/oauth/callback/b"))
+
+		var tokens map[string]map[string]interface{}
+		Expect(json.Unmarshal(session.Out.Contents(), &tokens)).To(Succeed())
+		Expect(tokens).To(HaveLen(2))
+		Expect(tokens["a"]["access_token"]).To(HavePrefix("eyJ"))
+		Expect(tokens["b"]["access_token"]).To(HavePrefix("eyJ"))
+		Expect(tokens["a"]["access_token"]).ToNot(Equal(tokens["b"]["access_token"]))
+
+		By("reusing the cached tokens on the next run")
+		session = start(args...)
+		Eventually(session).Should(gexec.Exit(0))
+		Expect(json.Unmarshal(session.Out.Contents(), &tokens)).To(Succeed())
+		Expect(tokens).To(HaveKey("a"))
+		Expect(tokens).To(HaveKey("b"))
+	})
+
+	It("should not take the value of another flag for a profile", func() {
+		session := start(append([]string{"-scope", "profile"}, args...)...)
+		re := regexp.MustCompile(regexp.QuoteMeta(issuer+"/authorize") + `\S+`)
+		Eventually(func() [][]byte { return re.FindAll(session.Err.Contents(), -1) }).Should(HaveLen(2))
+
+		for _, authURL := range re.FindAll(session.Err.Contents(), -1) {
+			Expect(string(authURL)).To(ContainSubstring("scope=profile"))
+			res, err := http.Get(string(authURL))
+			Expect(err).ToNot(HaveOccurred())
+			res.Body.Close()
+		}
+		Eventually(session).Should(gexec.Exit(0))
+		var tokens map[string]map[string]interface{}
+		Expect(json.Unmarshal(session.Out.Contents(), &tokens)).To(Succeed())
+		Expect(tokens).To(HaveLen(2))
+		Expect(tokens).To(HaveKey("a"))
+		Expect(tokens).To(HaveKey("b"))
+	})
+
+	It("should pick the file's profile past the value of another flag", func() {
+		config := fmt.Sprintf(`{"issuer": %q, "pkce": true, "profile": "b", "profiles": {"b": {"client_id": "client-b"}}}`, issuer)
+		Expect(ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600)).To(Succeed())
+		session := start("-scope", "profile", "-config", filepath.Join(dir, "config.json"), "-port", fmt.Sprint(callbackPort))
+		Eventually(session.Err).Should(gbytes.Say(regexp.QuoteMeta(issuer+"/authorize") + `\S+client_id=client-b`))
+	})
+
+	It("should reject a callback that the shared server doesn't serve", func() {
+		config := fmt.Sprintf(`{
+			"issuer": %q,
+			"pkce": true,
+			"profiles": {
+				"a": {"client_id": "client-a"},
+				"b": {"client_id": "client-b", "callback": "http://localhost:9000/cb"}
+			}
+		}`, issuer)
+		Expect(ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600)).To(Succeed())
+		session := start(args...)
+		Eventually(session).Should(gexec.Exit(1))
+		Expect(session.Err).To(gbytes.Say(fmt.Sprintf(`profile "b" has the callback http://localhost:9000/cb, but the callbacks are served on 127.0.0.1:%d of profile "a"`, callbackPort)))
+		Expect(session.Err).ToNot(gbytes.Say("authorize"))
+	})
+
+	It("should only output JSON", func() {
+		session := start(append(args, "-format", "token")...)
+		Eventually(session).Should(gexec.Exit(1))
+		Expect(session.Err).To(gbytes.Say("a repeated -profile outputs JSON, not -format token"))
+	})
+
+	It("should reject a profile given twice", func() {
+		session := start(append(args, "-profile", "a")...)
+		Eventually(session).Should(gexec.Exit(1))
+		Expect(session.Err).To(gbytes.Say("-profile a is given twice"))
+	})
+})
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/geckoboard/oauth2-cli/pkg/oauth2cli"
+)
+
+// proxyCommand is the proxy command, which forwards the requests it gets on
+// -serve-addr to -upstream with the token, refreshing it like serve.
+func proxyCommand(conf config, flow oauth2cli.Flow) int {
+	upstream, err := url.Parse(conf.Upstream)
+	if err != nil || upstream.Scheme == "" || upstream.Host == "" {
+		log.Println("usage: oauth2-cli proxy [flags] upstream-url, such as https://api.example.com")
+		return 1
+	}
+	format := fmt.Sprintf("Proxying http://%%s to %s\n", strings.ReplaceAll(upstream.Redacted(), "%", "%%"))
+	return serveToken(conf, flow, format, func(s *tokenServer) http.Handler {
+		// Any page could make requests with the token, so none are allowed.
+		return s.guard(s.proxy(upstream), nil)
+	})
+}
+
+// proxy returns a reverse proxy to upstream that authorizes each request
+// with the current token, replacing any Authorization header it had.
+func (s *tokenServer) proxy(upstream *url.URL) http.Handler {
+	rp := httputil.NewSingleHostReverseProxy(upstream)
+	director := rp.Director
+	rp.Director = func(r *http.Request) {
+		director(r)
+		// APIs behind virtual hosts route by the Host header.
+		r.Host = upstream.Host
+		token, _ := s.current()
+		token.SetAuthHeader(r)
+		if s.flow.DPoPKey != nil {
+			if err := s.flow.DPoPKey.SetProof(r); err != nil {
+				log.Printf("warning: %s\n", err)
+			}
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := s.current(); !ok {
+			http.Error(w, errExpired, http.StatusServiceUnavailable)
+			return
+		}
+		rp.ServeHTTP(w, r)
+	})
+}
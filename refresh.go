@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/geckoboard/oauth2-cli/pkg/oauth2cli"
+	"golang.org/x/oauth2"
+)
+
+// refreshEvery keeps refreshing the token for -refresh-interval, at least
+// that often and before it expires, until ctx is done. Each refreshed token
+// is output and cached by the flow's OnToken, as the first was, and -exec is
+// run with it. The refresh token of each refresh is used for the next, so
+// rotated ones are followed, and each id_token is checked to have the sub of
+// the last. It returns the exit code.
+func refreshEvery(ctx context.Context, conf config, flow oauth2cli.Flow, token *oauth2.Token) int {
+	if code := runExec(conf, token); code != 0 {
+		return code
+	}
+	issued := time.Now()
+	idToken, _ := token.Extra("id_token").(string)
+	for {
+		if token.RefreshToken == "" {
+			log.Println("error: there's no refresh token to refresh with")
+			return 1
+		}
+		select {
+		case <-ctx.Done():
+			return 0
+		case <-time.After(nextRefresh(time.Duration(conf.RefreshInterval), issued, token.Expiry, time.Now())):
+		}
+
+		refreshing := flow
+		refreshing.Config.Flow = oauth2cli.FlowRefresh
+		refreshing.Config.RefreshToken = token.RefreshToken
+		refreshing.Config.PriorIDToken = idToken
+		refreshed, err := refreshing.Authorize(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0
+			}
+			var retrieveErr *oauth2.RetrieveError
+			if errors.As(err, &retrieveErr) && retrieveErr.Response.StatusCode < 500 || errors.Is(err, oauth2cli.ErrValidation) {
+				// A rejected refresh token won't be accepted later either,
+				// nor a token that fails its checks trusted.
+				return reportError(conf, err)
+			}
+			log.Printf("warning: failed to refresh the token, retrying in %s: %s\n", refreshRetryDelay, err)
+			select {
+			case <-ctx.Done():
+				return 0
+			case <-time.After(refreshRetryDelay):
+			}
+			continue
+		}
+		if !conf.Quiet {
+			log.Printf("Refreshed the token, which expires at %s\n", refreshed.Expiry.Format(time.RFC3339))
+		}
+		token, issued = refreshed, time.Now()
+		// A refresh needn't issue another id_token.
+		if refreshedIDToken, _ := token.Extra("id_token").(string); refreshedIDToken != "" {
+			idToken = refreshedIDToken
+		}
+		if code := runExec(conf, token); code != 0 {
+			return code
+		}
+	}
+}
+
+// nextRefresh is how long after now to refresh the token for
+// -refresh-interval: after interval, or before it expires if that's sooner.
+func nextRefresh(interval time.Duration, issued, expiry, now time.Time) time.Duration {
+	wait := interval - now.Sub(issued)
+	if !expiry.IsZero() {
+		if d := refreshDelay(issued, expiry, now); d < wait {
+			wait = d
+		}
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// runExec runs the -exec command with the token, if there is one, returning
+// its exit code.
+func runExec(conf config, token *oauth2.Token) int {
+	if conf.Exec == "" {
+		return 0
+	}
+	code, err := runWithToken(conf.Exec, token)
+	if err != nil {
+		log.Printf("failed to run %q: %s\n", conf.Exec, err)
+		return 1
+	}
+	return code
+}
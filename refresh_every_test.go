@@ -0,0 +1,31 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("nextRefresh", func() {
+	issued := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	It("should wait for the interval when the token lasts longer", func() {
+		Expect(nextRefresh(15*time.Minute, issued, issued.Add(time.Hour), issued)).To(Equal(15 * time.Minute))
+		Expect(nextRefresh(15*time.Minute, issued, issued.Add(time.Hour), issued.Add(5*time.Minute))).To(Equal(10 * time.Minute))
+	})
+
+	It("should refresh before the token expires", func() {
+		// As serve does, 80% of the way through.
+		Expect(nextRefresh(time.Hour, issued, issued.Add(10*time.Minute), issued)).To(Equal(8 * time.Minute))
+		Expect(nextRefresh(time.Hour, issued, issued.Add(time.Minute), issued)).To(Equal(48 * time.Second))
+	})
+
+	It("should wait for the interval for a token without an expiry", func() {
+		Expect(nextRefresh(time.Minute, issued, time.Time{}, issued)).To(Equal(time.Minute))
+	})
+
+	It("should refresh straight away once overdue", func() {
+		Expect(nextRefresh(time.Minute, issued, issued.Add(time.Hour), issued.Add(2*time.Minute))).To(Equal(time.Duration(0)))
+	})
+})
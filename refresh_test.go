@@ -0,0 +1,235 @@
+package main_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+	"github.com/onsi/gomega/ghttp"
+	"golang.org/x/oauth2"
+)
+
+var _ = Describe("Refresh flow", func() {
+	var (
+		args    []string
+		session *gexec.Session
+		server  *ghttp.Server
+	)
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		args = []string{
+			"-flow", "refresh",
+			"-token", server.URL() + "/oauth/token",
+			"-id", "123",
+			"-secret", "abc",
+			"-refresh-token", "oldrefresh",
+		}
+
+		server.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyRequest("POST", "/oauth/token"),
+			ghttp.VerifyBasicAuth("123", "abc"),
+			ghttp.VerifyFormKV("grant_type", "refresh_token"),
+			ghttp.VerifyFormKV("refresh_token", "oldrefresh"),
+			ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+				AccessToken:  "mytoken",
+				TokenType:    "Bearer",
+				RefreshToken: "newrefresh",
+			}),
+		))
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		session, err = gexec.Start(exec.Command(cmdPath, args...), GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		gexec.TerminateAndWait()
+		server.Close()
+	})
+
+	It("should output the refreshed token with the rotated refresh token", func() {
+		Eventually(session).Should(gexec.Exit(0))
+		Expect(session.Err).ToNot(gbytes.Say("Visit this URL"))
+		Expect(session.Err).To(gbytes.Say(`"access_token": "mytoken"`))
+		Expect(session.Err).To(gbytes.Say(`"refresh_token": "newrefresh"`))
+	})
+
+	Context("with -client-auth private_key_jwt", func() {
+		var dir string
+
+		BeforeEach(func() {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+			dir, err = ioutil.TempDir("", "client-key")
+			Expect(err).ToNot(HaveOccurred())
+			keyFile := filepath.Join(dir, "key.pem")
+			keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+			Expect(ioutil.WriteFile(keyFile, keyPEM, 0600)).To(Succeed())
+
+			args = append(args, "-client-auth", "private_key_jwt", "-client-key", keyFile)
+			server.SetHandler(0, ghttp.CombineHandlers(
+				ghttp.VerifyFormKV("client_id", "123"),
+				ghttp.VerifyFormKV("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"),
+				func(w http.ResponseWriter, r *http.Request) {
+					Expect(r.Header.Get("Authorization")).To(BeEmpty())
+					Expect(r.PostForm).ToNot(HaveKey("client_secret"))
+					parts := strings.Split(r.PostForm.Get("client_assertion"), ".")
+					Expect(parts).To(HaveLen(3))
+					claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+					Expect(err).ToNot(HaveOccurred())
+					Expect(string(claims)).To(ContainSubstring(`"aud":"` + server.URL() + `/oauth/token"`))
+					Expect(string(claims)).To(ContainSubstring(`"iss":"123"`))
+				},
+				ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "mytoken",
+					TokenType:   "Bearer",
+				}),
+			))
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should authenticate with a signed client_assertion", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "mytoken"`))
+		})
+	})
+
+	Context("with -prior-id-token and a refreshed id_token for someone else", func() {
+		BeforeEach(func() {
+			args = append(args, "-prior-id-token", FakeJWT(map[string]interface{}{"sub": "alice"}))
+			server.SetHandler(0, ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token": "mytoken",
+				"token_type":   "Bearer",
+				"id_token":     FakeJWT(map[string]interface{}{"sub": "mallory"}),
+			}))
+		})
+
+		It("should warn that the sub changed", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`warning: OIDC sub: the refreshed id_token has sub "mallory", but the prior one "alice"`))
+		})
+
+		Context("with -strict", func() {
+			BeforeEach(func() {
+				args = append(args, "-strict")
+			})
+
+			It("should fail", func() {
+				Eventually(session).Should(gexec.Exit(9))
+				Expect(session.Err).To(gbytes.Say(`OIDC sub error: the refreshed id_token has sub "mallory"`))
+				Expect(session.Err).ToNot(gbytes.Say("mytoken"))
+			})
+		})
+	})
+
+	Context("with -refresh-interval", func() {
+		BeforeEach(func() {
+			args = append(args, "-refresh-interval", "1h", "-format", "token")
+			// Expiring in 2s, the token is refreshed well before the hour.
+			server.SetHandler(0, ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token":  "mytoken",
+				"token_type":    "Bearer",
+				"refresh_token": "newrefresh",
+				"expires_in":    2,
+			}))
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyFormKV("refresh_token", "newrefresh"),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+					"access_token": "secondtoken",
+					"token_type":   "Bearer",
+					"expires_in":   3600,
+				}),
+			))
+		})
+
+		It("should refresh with the rotated refresh token before expiry and output each token", func() {
+			Eventually(session.Out).Should(gbytes.Say("mytoken\n"))
+			Eventually(session.Out, 2).Should(gbytes.Say("secondtoken\n"))
+			Expect(session.Err).To(gbytes.Say("Refreshed the token"))
+			Consistently(session).ShouldNot(gexec.Exit())
+
+			session.Interrupt()
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(server.ReceivedRequests()).To(HaveLen(2))
+		})
+	})
+
+	Context("with -refresh-interval and a refresh for someone else", func() {
+		BeforeEach(func() {
+			args = append(args, "-refresh-interval", "100ms", "-strict")
+			server.SetHandler(0, ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token":  "mytoken",
+				"token_type":    "Bearer",
+				"refresh_token": "newrefresh",
+				"id_token":      FakeJWT(map[string]interface{}{"sub": "alice"}),
+			}))
+			server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token": "secondtoken",
+				"token_type":   "Bearer",
+				"id_token":     FakeJWT(map[string]interface{}{"sub": "mallory"}),
+			}))
+		})
+
+		It("should compare the sub with that of the last id_token, and stop", func() {
+			Eventually(session, 3).Should(gexec.Exit(9))
+			Expect(session.Err).To(gbytes.Say(`OIDC sub error: the refreshed id_token has sub "mallory", but the prior one "alice"`))
+			Expect(session.Err).ToNot(gbytes.Say("secondtoken"))
+		})
+	})
+
+	Context("with -grant refresh_token", func() {
+		BeforeEach(func() {
+			args[0], args[1] = "-grant", "refresh_token"
+		})
+
+		It("should run the refresh flow", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "mytoken"`))
+		})
+	})
+
+	Context("with -verify-id-token and an id_token signed by another key", func() {
+		BeforeEach(func() {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+			other, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+
+			args = append(args, "-verify-id-token", "-jwks-url", server.URL()+"/jwks")
+			server.RouteToHandler("GET", "/jwks", ghttp.RespondWithJSONEncoded(http.StatusOK, JWKS(&key.PublicKey, "key-1")))
+			server.SetHandler(0, ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token": "mytoken",
+				"token_type":   "Bearer",
+				"id_token": SignedJWT(other, "key-1", map[string]interface{}{
+					"aud": "123",
+					"exp": time.Now().Add(time.Hour).Unix(),
+				}),
+			}))
+		})
+
+		It("should fail the verification", func() {
+			Eventually(session, 5).Should(gexec.Exit(9))
+			Expect(session.Err).To(gbytes.Say("OIDC id_token verification error: no key matches the RS256 signature"))
+			Expect(session.Err).ToNot(gbytes.Say("mytoken"))
+		})
+	})
+})
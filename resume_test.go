@@ -0,0 +1,146 @@
+package main_test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+	"github.com/onsi/gomega/ghttp"
+	"golang.org/x/oauth2"
+)
+
+var _ = Describe("Resuming an authorization", func() {
+	var (
+		server   *ghttp.Server
+		dir      string
+		pending  string
+		verifier string
+		port     int
+		flags    []string
+		authURL  *url.URL
+	)
+
+	// start runs the subcommand with the flags, and args after them.
+	start := func(subcommand string, args ...string) *gexec.Session {
+		command := exec.Command(cmdPath, append(append([]string{subcommand}, flags...), args...)...)
+		session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+		return session
+	}
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		server.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyRequest("POST", "/oauth/token"),
+			ghttp.VerifyFormKV("code", "mycode"),
+			func(w http.ResponseWriter, r *http.Request) {
+				Expect(r.ParseForm()).To(Succeed())
+				verifier = r.PostForm.Get("code_verifier")
+			},
+			ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+				AccessToken: "mytoken",
+				TokenType:   "Bearer",
+			}),
+		))
+
+		var err error
+		dir, err = ioutil.TempDir("", "resume")
+		Expect(err).ToNot(HaveOccurred())
+		pending = filepath.Join(dir, "pending.json")
+		port, err = EphemeralPort()
+		Expect(err).ToNot(HaveOccurred())
+		verifier = ""
+		flags = []string{
+			"-pending-file", pending,
+			"-pkce",
+			"-port", fmt.Sprint(port),
+			"-auth", server.URL() + "/oauth/authorize",
+			"-token", server.URL() + "/oauth/token",
+			"-id", "123",
+		}
+	})
+
+	JustBeforeEach(func() {
+		// The first run is killed while the user is in the browser.
+		session := start("auth")
+		Eventually(session.Err).Should(gbytes.Say("Visit this URL in your browser"))
+		re := regexp.MustCompile(regexp.QuoteMeta(server.URL()+"/oauth/authorize") + `\S+`)
+		Eventually(func() []byte { return re.Find(session.Err.Contents()) }).ShouldNot(BeNil())
+		var err error
+		authURL, err = url.Parse(string(re.Find(session.Err.Contents())))
+		Expect(err).ToNot(HaveOccurred())
+		session.Kill().Wait()
+		Expect(pending).To(BeAnExistingFile())
+	})
+
+	AfterEach(func() {
+		gexec.TerminateAndWait()
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	expectVerifier := func() {
+		sum := sha256.Sum256([]byte(verifier))
+		Expect(authURL.Query().Get("code_challenge")).To(Equal(base64.RawURLEncoding.EncodeToString(sum[:])))
+	}
+
+	It("should only let the pending file be read by the user", func() {
+		info, err := os.Stat(pending)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+	})
+
+	It("should complete it with the redirect URL given to resume", func() {
+		redirect := fmt.Sprintf("%s?code=mycode&state=%s", authURL.Query().Get("redirect_uri"), authURL.Query().Get("state"))
+		session := start("resume", redirect)
+
+		Eventually(session).Should(gexec.Exit(0))
+		Expect(session.Err).To(gbytes.Say("Resuming the authorization started at"))
+		Expect(session.Err).To(gbytes.Say(`"access_token": "mytoken"`))
+		expectVerifier()
+		Expect(pending).ToNot(BeAnExistingFile())
+	})
+
+	It("should reject a redirect URL with the wrong state", func() {
+		session := start("resume", "http://localhost/?code=mycode&state=forged")
+
+		Eventually(session).Should(gexec.Exit(6))
+		Expect(session.Err).To(gbytes.Say("Invalid state: forged"))
+		Expect(server.ReceivedRequests()).To(BeEmpty())
+		Expect(pending).To(BeAnExistingFile())
+	})
+
+	It("should serve the callback on the pending redirect URL", func() {
+		session := start("resume")
+		Eventually(session.Err).Should(gbytes.Say("Resuming the authorization"))
+		Expect(session.Err.Contents()).ToNot(ContainSubstring("Visit this URL"))
+
+		res, err := http.Get(fmt.Sprintf("%s?code=mycode&state=%s", authURL.Query().Get("redirect_uri"), url.QueryEscape(authURL.Query().Get("state"))))
+		Expect(err).ToNot(HaveOccurred())
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+		Eventually(session).Should(gexec.Exit(0))
+		Expect(session.Err).To(gbytes.Say(`"access_token": "mytoken"`))
+		expectVerifier()
+	})
+
+	It("should fail when nothing is pending", func() {
+		Expect(os.Remove(pending)).To(Succeed())
+		session := start("resume", "mycode")
+
+		Eventually(session).Should(gexec.Exit(1))
+		Expect(session.Err).To(gbytes.Say("no authorization is pending in " + regexp.QuoteMeta(pending)))
+	})
+})
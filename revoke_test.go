@@ -0,0 +1,145 @@
+package main_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+	"github.com/onsi/gomega/ghttp"
+	"golang.org/x/oauth2"
+)
+
+var _ = Describe("Revocation", func() {
+	var (
+		args    []string
+		session *gexec.Session
+		server  *ghttp.Server
+	)
+
+	revoked := func(token, hint string) http.HandlerFunc {
+		return ghttp.CombineHandlers(
+			ghttp.VerifyRequest("POST", "/oauth/revoke"),
+			ghttp.VerifyBasicAuth("123", "abc"),
+			ghttp.VerifyFormKV("token", token),
+			ghttp.VerifyFormKV("token_type_hint", hint),
+			ghttp.RespondWith(http.StatusOK, ""),
+		)
+	}
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		args = []string{
+			"-id", "123",
+			"-secret", "abc",
+			"-revoke-url", server.URL() + "/oauth/revoke",
+		}
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		session, err = gexec.Start(exec.Command(cmdPath, args...), GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		gexec.TerminateAndWait()
+		server.Close()
+	})
+
+	Context("with -flow revoke", func() {
+		BeforeEach(func() {
+			args = append(args, "-flow", "revoke", "-revoke-token", "oldrefresh", "-revoke-token-type", "refresh_token")
+		})
+
+		It("should revoke the token", func() {
+			server.AppendHandlers(revoked("oldrefresh", "refresh_token"))
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say("Revoked refresh_token"))
+		})
+
+		It("should report the error body", func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusBadRequest, `{"error":"unsupported_token_type"}`))
+
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say("revocation failed: .*400 Bad Request"))
+			Expect(session.Err).To(gbytes.Say("unsupported_token_type"))
+		})
+	})
+
+	Context("with the revoke command", func() {
+		Context("with a token", func() {
+			BeforeEach(func() {
+				args = append(args, "revoke", "oldtoken")
+				server.AppendHandlers(revoked("oldtoken", "access_token"))
+			})
+
+			It("should revoke it", func() {
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(session.Err).To(gbytes.Say("Revoked access_token"))
+			})
+		})
+
+		Context("with a cached token", func() {
+			var dir, cache string
+
+			BeforeEach(func() {
+				var err error
+				dir, err = ioutil.TempDir("", "revoke")
+				Expect(err).ToNot(HaveOccurred())
+				cache = filepath.Join(dir, "token.json")
+				Expect(ioutil.WriteFile(cache, []byte(`{"access_token":"cachedtoken","refresh_token":"cachedrefresh"}`), 0600)).To(Succeed())
+
+				args = append(args, "-cache", cache, "revoke")
+				server.AppendHandlers(
+					revoked("cachedtoken", "access_token"),
+					revoked("cachedrefresh", "refresh_token"),
+				)
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(dir)
+			})
+
+			It("should revoke the cached tokens and remove them", func() {
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(session.Err).To(gbytes.Say("Revoked access_token"))
+				Expect(session.Err).To(gbytes.Say("Revoked refresh_token"))
+				Expect(cache).ToNot(BeAnExistingFile())
+			})
+		})
+	})
+
+	Context("with -revoke-after", func() {
+		BeforeEach(func() {
+			args = append(args,
+				"-flow", "client_credentials",
+				"-token", server.URL()+"/oauth/token",
+				"-revoke-after",
+			)
+			server.AppendHandlers(
+				ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken:  "mytoken",
+					TokenType:    "Bearer",
+					RefreshToken: "myrefresh",
+				}),
+				revoked("mytoken", "access_token"),
+				revoked("myrefresh", "refresh_token"),
+			)
+		})
+
+		It("should revoke the issued tokens after output", func() {
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "mytoken"`))
+			Expect(session.Err).To(gbytes.Say("Revoked access_token"))
+			Expect(session.Err).To(gbytes.Say("Revoked refresh_token"))
+			Expect(server.ReceivedRequests()).To(HaveLen(3))
+		})
+	})
+})
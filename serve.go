@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/geckoboard/oauth2-cli/pkg/oauth2cli"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// refreshBefore is the most time before the token expires that serve
+	// refreshes it. Short-lived tokens are refreshed once 80% of their
+	// lifetime has passed instead.
+	refreshBefore = time.Minute
+	// refreshRetryDelay is the wait to try again after a failed refresh.
+	refreshRetryDelay = 10 * time.Second
+)
+
+// serve runs the flow once, with the cached token if there is one, then
+// serves GET /token on -serve-addr with a valid access token, refreshing it
+// in the background, until interrupted.
+func serve(conf config, flow oauth2cli.Flow) int {
+	return serveToken(conf, flow, "Serving the token on http://%s/token\n", func(s *tokenServer) http.Handler {
+		return s.guard(s, conf.AllowOrigins)
+	})
+}
+
+// serveToken is serve with the handler returned by handler, for the proxy
+// command too. addrFormat is logged with the address once it's listening.
+func serveToken(conf config, flow oauth2cli.Flow, addrFormat string, handler func(*tokenServer) http.Handler) int {
+	// The token is served rather than printed, and cached on each refresh.
+	flow.OnToken = func(token *oauth2.Token) error {
+		if conf.Cache == "" {
+			return nil
+		}
+		if err := writeCache(conf, token); err != nil {
+			return fmt.Errorf("failed to write token cache: %w", err)
+		}
+		return nil
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var token *oauth2.Token
+	if conf.Cache != "" && !conf.Force {
+		token, _ = cachedToken(conf, flow)
+	}
+	if token == nil {
+		var err error
+		if token, err = flow.Authorize(ctx); err != nil {
+			if ctx.Err() != nil {
+				return reportError(conf, errInterrupted)
+			}
+			return reportError(conf, err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", conf.ServeAddr)
+	if err != nil {
+		log.Printf("error: %s\n", err)
+		return 1
+	}
+	s := &tokenServer{conf: conf, flow: flow, addr: listener.Addr().(*net.TCPAddr), token: token}
+	server := http.Server{Handler: handler(s)}
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			log.Printf("error: %s\n", err)
+			stop()
+		}
+	}()
+	log.Printf(addrFormat, listener.Addr())
+
+	s.refresh(ctx)
+	_ = server.Shutdown(context.Background())
+	return 0
+}
+
+// tokenServer serves the token of serve, which refresh keeps valid.
+type tokenServer struct {
+	conf config
+	flow oauth2cli.Flow
+	addr *net.TCPAddr
+
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+func (s *tokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/token" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token, ok := s.current()
+	if !ok {
+		http.Error(w, errExpired, http.StatusServiceUnavailable)
+		return
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Vary", "Origin")
+	}
+
+	// The body is what -format would print.
+	var buf bytes.Buffer
+	contentType := "application/json"
+	var err error
+	if s.conf.Format == formatJSON {
+		err = json.NewEncoder(&buf).Encode(token)
+	} else {
+		contentType = "text/plain; charset=utf-8"
+		err = writeToken(&buf, s.conf, token)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// guard rejects the requests to h that a web page could make without being
+// allowed: those with an Origin that origins doesn't have, and those with a
+// Host other than the listening address, which a page that rebinds its own
+// DNS name to the loopback address sends.
+func (s *tokenServer) guard(h http.Handler, origins []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.allowedHost(r.Host) {
+			http.Error(w, fmt.Sprintf("Host %q is not %s", r.Host, s.addr), http.StatusMisdirectedRequest)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" && !contains(origins, origin) {
+			http.Error(w, fmt.Sprintf("Origin %q is not allowed", origin), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// allowedHost reports whether host, the Host of a request, names the
+// listening address: its IP, or localhost for a loopback one, and its port.
+// Any IP will do when listening on all of them, but names other than
+// localhost and that of -serve-addr are rejected, as they can be rebound.
+func (s *tokenServer) allowedHost(host string) bool {
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		name, port = host, "80"
+	}
+	if port != strconv.Itoa(s.addr.Port) {
+		return false
+	}
+	if serveName, _, err := net.SplitHostPort(s.conf.ServeAddr); err == nil && serveName != "" && strings.EqualFold(name, serveName) {
+		return true
+	}
+	if strings.EqualFold(name, "localhost") {
+		return s.addr.IP.IsLoopback() || s.addr.IP.IsUnspecified()
+	}
+	ip := net.ParseIP(name)
+	return ip != nil && (s.addr.IP.IsUnspecified() || ip.Equal(s.addr.IP))
+}
+
+// errExpired is the response once the token has expired.
+const errExpired = "The token expired and couldn't be refreshed, see the oauth2-cli logs"
+
+// current returns the token, and whether it is still valid. Unlike
+// token.Valid there is no margin, as refresh makes sure the token isn't about
+// to expire.
+func (s *tokenServer) current() (*oauth2.Token, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.token, s.token.Expiry.IsZero() || time.Now().Before(s.token.Expiry)
+}
+
+// refresh refreshes the token before it expires until ctx is done. A token
+// without an expiry is served as it is, one without a refresh token until
+// it expires.
+func (s *tokenServer) refresh(ctx context.Context) {
+	issued := time.Now()
+	for {
+		s.mu.Lock()
+		token := s.token
+		s.mu.Unlock()
+
+		var wait <-chan time.Time
+		switch {
+		case token.Expiry.IsZero():
+		case token.RefreshToken == "":
+			if time.Now().Before(token.Expiry) {
+				log.Printf("warning: no refresh token, the token will no longer be served after %s\n", token.Expiry.Format(time.RFC3339))
+			}
+		default:
+			wait = time.After(refreshDelay(issued, token.Expiry, time.Now()))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-wait:
+		}
+
+		flow := s.flow
+		flow.Config.Flow = oauth2cli.FlowRefresh
+		flow.Config.RefreshToken = token.RefreshToken
+		refreshed, err := flow.Authorize(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			var retrieveErr *oauth2.RetrieveError
+			if errors.As(err, &retrieveErr) && retrieveErr.Response.StatusCode < 500 {
+				// A rejected refresh token won't be accepted later either,
+				// so the token is served until it expires.
+				log.Printf("error: the refresh token was rejected, restart serve to authorize again: %s\n", err)
+				<-ctx.Done()
+				return
+			}
+			log.Printf("warning: failed to refresh the token, retrying in %s: %s\n", refreshRetryDelay, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(refreshRetryDelay):
+			}
+			continue
+		}
+		log.Printf("Refreshed the token, which expires at %s\n", refreshed.Expiry.Format(time.RFC3339))
+		issued = time.Now()
+		s.mu.Lock()
+		s.token = refreshed
+		s.mu.Unlock()
+	}
+}
+
+// refreshDelay is how long after now to refresh a token issued at issued
+// that expires at expiry.
+func refreshDelay(issued, expiry, now time.Time) time.Duration {
+	at := issued.Add(expiry.Sub(issued) * 4 / 5)
+	if latest := expiry.Add(-refreshBefore); latest.After(issued) && latest.Before(at) {
+		at = latest
+	}
+	if d := at.Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// isTerminal reports whether f is connected to a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// errNoTerminal is returned by readHidden when stdin isn't a terminal, even
+// if it's a character device such as /dev/null.
+var errNoTerminal = errors.New("stdin isn't a terminal")
+
+// readHidden prompts on stderr and reads a line from the terminal on stdin
+// without echoing it, with stty, so not on Windows.
+func readHidden(prompt string) (string, error) {
+	if err := stty("-echo"); err != nil {
+		return "", errNoTerminal
+	}
+	defer stty("echo")
+
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	// The newline typed wasn't echoed either.
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// stty sets the mode of the terminal on stdin.
+func stty(mode string) error {
+	cmd := exec.Command("stty", mode)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
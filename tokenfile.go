@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// tokenFileIterations is the PBKDF2-HMAC-SHA256 iteration count that
+// -token-file keys are derived from the passphrase with.
+const tokenFileIterations = 600000
+
+// tokenFile is an encrypted -token-file: the tokens' JSON sealed with
+// AES-256-GCM, keyed by the passphrase through PBKDF2. Only the standard
+// library is needed to read one.
+type tokenFile struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func encryptTokenFile(data []byte, passphrase string) ([]byte, error) {
+	f := tokenFile{
+		Version:    1,
+		KDF:        "pbkdf2-sha256",
+		Iterations: tokenFileIterations,
+		Salt:       make([]byte, 16),
+	}
+	if _, err := rand.Read(f.Salt); err != nil {
+		return nil, err
+	}
+	aead, err := tokenFileCipher(passphrase, f.Salt, f.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	f.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(f.Nonce); err != nil {
+		return nil, err
+	}
+	f.Ciphertext = aead.Seal(nil, f.Nonce, data, nil)
+	return json.Marshal(f)
+}
+
+func decryptTokenFile(data []byte, passphrase string) ([]byte, error) {
+	var f tokenFile
+	if err := json.Unmarshal(data, &f); err != nil || f.Version == 0 {
+		return nil, errors.New("not an encrypted token file")
+	}
+	if f.Version != 1 || f.KDF != "pbkdf2-sha256" || f.Iterations < 1 {
+		return nil, fmt.Errorf("unsupported token file version %d, kdf %q", f.Version, f.KDF)
+	}
+	aead, err := tokenFileCipher(passphrase, f.Salt, f.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.Nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid token file nonce")
+	}
+	plain, err := aead.Open(nil, f.Nonce, f.Ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("wrong passphrase, or the token file is corrupt")
+	}
+	return plain, nil
+}
+
+func tokenFileCipher(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2SHA256([]byte(passphrase), salt, iterations))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// pbkdf2SHA256 derives a 32 byte key as in RFC 8018, which is the one block
+// of PBKDF2-HMAC-SHA256.
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var index [4]byte
+	binary.BigEndian.PutUint32(index[:], 1)
+	prf.Write(salt)
+	prf.Write(index[:])
+	u := prf.Sum(nil)
+	key := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/hex"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("pbkdf2SHA256", func() {
+	It("should derive the RFC 7914 test vectors", func() {
+		Expect(hex.EncodeToString(pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1))).
+			To(Equal("55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"))
+		Expect(hex.EncodeToString(pbkdf2SHA256([]byte("Password"), []byte("NaCl"), 80000))).
+			To(Equal("4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56"))
+	})
+})
+
+var _ = Describe("encryptTokenFile", func() {
+	It("should round trip with the passphrase", func() {
+		data, err := encryptTokenFile([]byte(`{"refresh_token":"secret"}`), "hunter2")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).ToNot(ContainSubstring("secret"))
+
+		plain, err := decryptTokenFile(data, "hunter2")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(plain)).To(Equal(`{"refresh_token":"secret"}`))
+	})
+
+	It("should fail with another passphrase", func() {
+		data, err := encryptTokenFile([]byte(`{}`), "hunter2")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = decryptTokenFile(data, "hunter3")
+		Expect(err).To(MatchError("wrong passphrase, or the token file is corrupt"))
+	})
+
+	It("should fail on a plaintext cache", func() {
+		_, err := decryptTokenFile([]byte(`{"access_token":"mytoken"}`), "hunter2")
+		Expect(err).To(MatchError("not an encrypted token file"))
+	})
+})
@@ -0,0 +1,117 @@
+package main_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+	"github.com/onsi/gomega/ghttp"
+	"golang.org/x/oauth2"
+)
+
+var _ = Describe("Tunnel", func() {
+	var (
+		dir     string
+		port    int
+		args    []string
+		server  *ghttp.Server
+		session *gexec.Session
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "tunnel")
+		Expect(err).ToNot(HaveOccurred())
+		// The fake ngrok logs the tunnel as ngrok does, recording the
+		// address it was asked to forward to.
+		script := fmt.Sprintf(`#!/bin/sh
+echo "$2" > %s/addr
+echo '{"lvl":"info","msg":"started tunnel","url":"https://abc123.ngrok.example"}'
+exec sleep 60
+`, dir)
+		Expect(ioutil.WriteFile(filepath.Join(dir, "ngrok"), []byte(script), 0755)).To(Succeed())
+
+		server = ghttp.NewServer()
+		port, err = EphemeralPort()
+		Expect(err).ToNot(HaveOccurred())
+		args = []string{
+			"-auth", server.URL() + "/oauth/authorize",
+			"-token", server.URL() + "/oauth/token",
+			"-id", "123",
+			"-secret", "abc",
+			"-port", fmt.Sprint(port),
+		}
+	})
+
+	JustBeforeEach(func() {
+		command := exec.Command(cmdPath, args...)
+		command.Env = append(os.Environ(), "PATH="+dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+		var err error
+		session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		gexec.TerminateAndWait()
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	Context("with -tunnel ngrok", func() {
+		BeforeEach(func() {
+			args = append(args, "-tunnel", "ngrok")
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyFormKV("code", "mycode"),
+				ghttp.VerifyFormKV("redirect_uri", "https://abc123.ngrok.example/oauth/callback"),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, oauth2.Token{
+					AccessToken: "mytoken",
+					TokenType:   "Bearer",
+				}),
+			))
+		})
+
+		It("should send the public URL as the redirect URL", func() {
+			Eventually(session.Err).Should(gbytes.Say(`register this redirect URL with the provider:\s+https://abc123.ngrok.example/oauth/callback`))
+			re := regexp.MustCompile(regexp.QuoteMeta(server.URL()+"/oauth/authorize") + `\S+`)
+			Eventually(func() []byte { return re.Find(session.Err.Contents()) }).ShouldNot(BeNil())
+			authURL, err := url.Parse(string(re.Find(session.Err.Contents())))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(authURL.Query().Get("redirect_uri")).To(Equal("https://abc123.ngrok.example/oauth/callback"))
+
+			addr, err := ioutil.ReadFile(filepath.Join(dir, "addr"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(addr)).To(Equal(fmt.Sprintf("127.0.0.1:%d\n", port)))
+
+			// What the tunnel forwards arrives at the local callback server.
+			callback := url.Values{"code": {"mycode"}, "state": {authURL.Query().Get("state")}}
+			res, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/oauth/callback?%s", port, callback.Encode()))
+			Expect(err).ToNot(HaveOccurred())
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Err).To(gbytes.Say(`"access_token": "mytoken"`))
+		})
+	})
+
+	Context("when the tunnel command fails", func() {
+		BeforeEach(func() {
+			args = append(args, "-tunnel", "sh -c exit")
+		})
+
+		It("should fail before showing the auth URL", func() {
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say(`tunnel: sh exited before printing its URL`))
+			Expect(session.Err.Contents()).ToNot(ContainSubstring("/oauth/authorize"))
+		})
+	})
+})